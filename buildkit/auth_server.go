@@ -116,14 +116,8 @@ func (ap *authProvider) FetchToken(ctx context.Context, req *auth.FetchTokenRequ
 func (ap *authProvider) credentials(host string) (*auth.CredentialsResponse, error) {
 	ap.mu.Lock()
 	defer ap.mu.Unlock()
-	if host == "https://index.docker.io/v1/" {
-		host = "https://docker.io"
-	}
-	if host == "registry-1.docker.io" {
-		host = "https://docker.io"
-	}
 	res := &auth.CredentialsResponse{}
-	ac, ok := ap.auth[host]
+	ac, ok := ap.auth[normalizeRegistry(host)]
 	if ok {
 		res.Username = ac.username
 		res.Secret = ac.password
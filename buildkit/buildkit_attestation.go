@@ -0,0 +1,272 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	attestationSubjectAnnotation = "vnd.docker.reference.digest"
+	predicateTypeAnnotation      = "in-toto.io/predicate-type"
+)
+
+// findAttestations maps the digest of every image manifest within an index to
+// the attestation manifest that buildkit attached to it (if any).
+func findAttestations(index *v1.IndexManifest) map[string]v1.Descriptor {
+	result := map[string]v1.Descriptor{}
+	for _, x := range index.Manifests {
+		if subject, ok := x.Annotations[attestationSubjectAnnotation]; ok && isAttestationManifest(x) {
+			result[subject] = x
+		}
+	}
+	return result
+}
+
+// getAttestationLayers fetches an attestation manifest and returns its layers,
+// each of which holds a single in-toto statement.
+func getAttestationLayers(ctx context.Context, auth RegistryAuth, reference name.Reference, attestation v1.Descriptor) ([]v1.Descriptor, error) {
+
+	attestationReference := reference.Context().Digest(attestation.Digest.String())
+
+	descriptor, err := remote.Get(attestationReference, makeOptions(craneOptions(ctx, auth)...).Remote...)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.Layers, nil
+}
+
+func getPredicateTypes(layers []v1.Descriptor) []string {
+	result := make([]string, 0)
+	for _, x := range layers {
+		if predicate, ok := x.Annotations[predicateTypeAnnotation]; ok {
+			result = append(result, predicate)
+		}
+	}
+	return result
+}
+
+func isProvenancePredicate(predicateType string) bool {
+	return strings.HasPrefix(predicateType, "https://slsa.dev/provenance/")
+}
+
+func isSbomPredicate(predicateType string) bool {
+	return strings.HasPrefix(predicateType, "https://spdx.dev/Document") ||
+		strings.HasPrefix(predicateType, "https://cyclonedx.org/bom")
+}
+
+// getAttestationStatement finds the in-toto statement attached to the image
+// of the given platform whose predicate type is accepted by matches.
+func getAttestationStatement(ctx context.Context, auth RegistryAuth, reference name.Reference, platform string, matches func(string) bool) (*InTotoStatement, error) {
+
+	descriptor, err := remote.Get(reference, makeOptions(craneOptions(ctx, auth)...).Remote...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isV2IndexManifest(descriptor.MediaType) {
+		return nil, fmt.Errorf("'%s' is not an image index so it has no attestations", reference.Name())
+	}
+
+	index, err := v1.ParseIndexManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	attestations := findAttestations(index)
+
+	for _, x := range index.Manifests {
+		if isAttestationManifest(x) || !isSupportedPlatform([]string{platform}, x.Platform) {
+			continue
+		}
+
+		attestation, ok := attestations[x.Digest.String()]
+		if !ok {
+			continue
+		}
+
+		layers, err := getAttestationLayers(ctx, auth, reference, attestation)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, layer := range layers {
+			if !matches(layer.Annotations[predicateTypeAnnotation]) {
+				continue
+			}
+
+			blob, err := remote.Layer(reference.Context().Digest(layer.Digest.String()), makeOptions(craneOptions(ctx, auth)...).Remote...)
+			if err != nil {
+				return nil, err
+			}
+
+			reader, err := blob.Compressed()
+			if err != nil {
+				return nil, err
+			}
+
+			bites, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			statement := InTotoStatement{}
+			err = json.Unmarshal(bites, &statement)
+			if err != nil {
+				return nil, err
+			}
+
+			return &statement, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no matching attestation was found for platform '%s' of '%s'", platform, reference.Name())
+}
+
+func readImageSbomDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	platform := data.Get("platform").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	reference, err := imageTag(registry_url, repository_name, tag)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	statement, err := getAttestationStatement(context, auth, reference, platform, isSbomPredicate)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	packages := make([]interface{}, 0)
+	document := SpdxDocument{}
+	if json.Unmarshal(statement.Predicate, &document) == nil {
+		for _, x := range document.Packages {
+			packages = append(packages, map[string]interface{}{
+				"name":    x.Name,
+				"version": x.VersionInfo,
+			})
+		}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("predicate_type", statement.PredicateType)
+	data.Set("sbom", string(statement.Predicate))
+	data.Set("packages", packages)
+
+	return diag.Diagnostics{}
+}
+
+func readImageProvenanceDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	platform := data.Get("platform").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	reference, err := imageTag(registry_url, repository_name, tag)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	statement, err := getAttestationStatement(context, auth, reference, platform, isProvenancePredicate)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	provenance := SlsaProvenance{}
+	err = json.Unmarshal(statement.Predicate, &provenance)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not parse the provenance attestation.",
+			Detail:   err.Error(),
+		}}
+	}
+
+	source_repository := provenance.Metadata.Buildkit.VCS["source"]
+	if source_repository == "" {
+		source_repository = provenance.Invocation.ConfigSource.URI
+	}
+
+	source_revision := provenance.Metadata.Buildkit.VCS["revision"]
+	if source_revision == "" {
+		source_revision = provenance.Invocation.ConfigSource.Digest["sha1"]
+	}
+
+	materials := make([]interface{}, 0)
+	for _, x := range provenance.Materials {
+		digest := map[string]interface{}{}
+		for k, v := range x.Digest {
+			digest[k] = v
+		}
+		materials = append(materials, map[string]interface{}{
+			"uri":    x.URI,
+			"digest": digest,
+		})
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("predicate_type", statement.PredicateType)
+	data.Set("builder_id", provenance.Builder.ID)
+	data.Set("build_type", provenance.BuildType)
+	data.Set("source_repository", source_repository)
+	data.Set("source_revision", source_revision)
+	data.Set("materials", materials)
+	data.Set("provenance", string(statement.Predicate))
+
+	return diag.Diagnostics{}
+}
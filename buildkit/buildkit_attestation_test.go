@@ -0,0 +1,190 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"reflect"
+	"testing"
+)
+
+// testPushAttestedIndex pushes an index with a linux/amd64 image and the
+// attestation manifest buildkit attaches to it, which holds the statements.
+func testPushAttestedIndex(t *testing.T, reference string, statements ...InTotoStatement) {
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attestation := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	for _, x := range statements {
+		x.Type = "https://in-toto.io/Statement/v0.1"
+		bites, err := json.Marshal(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attestation, err = mutate.Append(attestation, mutate.Addendum{
+			Layer:       static.NewLayer(bites, "application/vnd.in-toto+json"),
+			Annotations: map[string]string{predicateTypeAnnotation: x.PredicateType},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{
+			Add:        image,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+		mutate.IndexAddendum{
+			Add: attestation,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"},
+				Annotations: map[string]string{
+					"vnd.docker.reference.type":  "attestation-manifest",
+					attestationSubjectAnnotation: digest.String(),
+				},
+			},
+		})
+
+	parsed, err := name.ParseReference(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(parsed, index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindAttestations(t *testing.T) {
+	host := testRegistry(t)
+	testPushAttestedIndex(t, host+"/app:1.0.0", InTotoStatement{PredicateType: "https://slsa.dev/provenance/v0.2", Predicate: json.RawMessage("{}")})
+
+	raw, err := crane.Manifest(host + "/app:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attestations := findAttestations(index)
+	if attestation, ok := attestations[index.Manifests[0].Digest.String()]; !ok || attestation.Digest != index.Manifests[1].Digest {
+		t.Fatalf("expected the attestation manifest to be found for the image but got %v", attestations)
+	}
+}
+
+func TestReadImageSbomDataSource(t *testing.T) {
+	host := testRegistry(t)
+	testPushAttestedIndex(t, host+"/app:1.0.0",
+		InTotoStatement{PredicateType: "https://slsa.dev/provenance/v0.2", Predicate: json.RawMessage("{}")},
+		InTotoStatement{PredicateType: "https://spdx.dev/Document", Predicate: json.RawMessage(`{"spdxVersion":"SPDX-2.3","packages":[{"name":"musl","versionInfo":"1.2.3"}]}`)})
+	testPushImage(t, host+"/app:1.1.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageSbomDataSource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"tag":             "1.0.0",
+		"platform":        "linux/amd64",
+	})
+
+	if diags := readImageSbomDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("predicate_type").(string) != "https://spdx.dev/Document" {
+		t.Fatalf("expected the spdx attestation but got %s", data.Get("predicate_type"))
+	}
+	expected := []interface{}{map[string]interface{}{"name": "musl", "version": "1.2.3"}}
+	if packages := data.Get("packages").([]interface{}); !reflect.DeepEqual(packages, expected) {
+		t.Fatalf("expected %v but got %v", expected, packages)
+	}
+
+	// an image without attestations and a platform that wasn't built
+	for _, x := range [][]string{{"1.1.0", "linux/amd64"}, {"1.0.0", "linux/arm64"}} {
+		data := schema.TestResourceDataRaw(t, buildkitImageSbomDataSource().Schema, map[string]interface{}{
+			"registry_url":    host,
+			"repository_name": "app",
+			"tag":             x[0],
+			"platform":        x[1],
+		})
+		if diags := readImageSbomDataSource(context.Background(), data, meta); !diags.HasError() {
+			t.Fatalf("expected no sbom to be found for %v", x)
+		}
+	}
+}
+
+func TestReadImageProvenanceDataSource(t *testing.T) {
+	host := testRegistry(t)
+	testPushAttestedIndex(t, host+"/app:1.0.0", InTotoStatement{
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Predicate: json.RawMessage(`{
+			"builder": {"id": "https://github.com/org/app/actions/runs/1"},
+			"buildType": "https://mobyproject.org/buildkit@v1",
+			"invocation": {"configSource": {"uri": "https://github.com/org/app.git#main", "digest": {"sha1": "abc"}}},
+			"materials": [{"uri": "pkg:docker/alpine@3.15", "digest": {"sha256": "def"}}],
+			"metadata": {"https://mobyproject.org/buildkit@v1#metadata": {"vcs": {"source": "https://github.com/org/app", "revision": "123"}}}
+		}`),
+	})
+	testPushAttestedIndex(t, host+"/app:1.1.0", InTotoStatement{
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Predicate:     json.RawMessage(`{"invocation": {"configSource": {"uri": "https://github.com/org/app.git#main", "digest": {"sha1": "abc"}}}}`),
+	})
+	testPushAttestedIndex(t, host+"/app:1.2.0", InTotoStatement{PredicateType: "https://spdx.dev/Document", Predicate: json.RawMessage("{}")})
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	read := func(tag string) (*schema.ResourceData, diag.Diagnostics) {
+		data := schema.TestResourceDataRaw(t, buildkitImageProvenanceDataSource().Schema, map[string]interface{}{
+			"registry_url":    host,
+			"repository_name": "app",
+			"tag":             tag,
+			"platform":        "linux/amd64",
+		})
+		return data, readImageProvenanceDataSource(context.Background(), data, meta)
+	}
+
+	data, diags := read("1.0.0")
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	actual := []interface{}{data.Get("builder_id"), data.Get("build_type"), data.Get("source_repository"), data.Get("source_revision")}
+	expected := []interface{}{"https://github.com/org/app/actions/runs/1", "https://mobyproject.org/buildkit@v1", "https://github.com/org/app", "123"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v but got %v", expected, actual)
+	}
+	materials := []interface{}{map[string]interface{}{"uri": "pkg:docker/alpine@3.15", "digest": map[string]interface{}{"sha256": "def"}}}
+	if !reflect.DeepEqual(data.Get("materials"), materials) {
+		t.Fatalf("expected %v but got %v", materials, data.Get("materials"))
+	}
+
+	// the source falls back to the config source without vcs metadata
+	data, diags = read("1.1.0")
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if data.Get("source_repository") != "https://github.com/org/app.git#main" || data.Get("source_revision") != "abc" {
+		t.Fatalf("expected the config source but got %s %s", data.Get("source_repository"), data.Get("source_revision"))
+	}
+
+	if _, diags := read("1.2.0"); !diags.HasError() {
+		t.Fatal("expected an image without provenance to be an error")
+	}
+}
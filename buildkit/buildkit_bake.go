@@ -0,0 +1,758 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/moby/buildkit/client"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bakeFunctions are the functions available to expressions in a bake file.
+var bakeFunctions = map[string]function.Function{
+	"and":           stdlib.AndFunc,
+	"coalesce":      stdlib.CoalesceFunc,
+	"concat":        stdlib.ConcatFunc,
+	"contains":      stdlib.ContainsFunc,
+	"distinct":      stdlib.DistinctFunc,
+	"equal":         stdlib.EqualFunc,
+	"format":        stdlib.FormatFunc,
+	"formatdate":    stdlib.FormatDateFunc,
+	"join":          stdlib.JoinFunc,
+	"lower":         stdlib.LowerFunc,
+	"not":           stdlib.NotFunc,
+	"notequal":      stdlib.NotEqualFunc,
+	"or":            stdlib.OrFunc,
+	"regex_replace": stdlib.RegexReplaceFunc,
+	"replace":       stdlib.ReplaceFunc,
+	"split":         stdlib.SplitFunc,
+	"substr":        stdlib.SubstrFunc,
+	"trimprefix":    stdlib.TrimPrefixFunc,
+	"trimspace":     stdlib.TrimSpaceFunc,
+	"trimsuffix":    stdlib.TrimSuffixFunc,
+	"upper":         stdlib.UpperFunc,
+}
+
+func buildkitBakeResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createBake,
+		ReadContext:   readBake,
+		UpdateContext: updateBake,
+		DeleteContext: deleteBake,
+		CustomizeDiff: diffBake,
+		Description:   "Builds the targets of a docker bake definition (HCL or JSON) with buildkit.",
+		Schema: map[string]*schema.Schema{
+			"file": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"file", "definition"},
+				Description:  "Path to a bake file (e.g. `docker-bake.hcl` or `docker-bake.json`). Relative contexts are resolved against its directory.",
+			},
+			"definition": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"file", "definition"},
+				Description:  "An inline bake definition in HCL or JSON (e.g. from `jsonencode`). Relative contexts are resolved against the working directory.",
+			},
+			"targets": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The targets or groups to build. Defaults to the `default` group, or every target when there is none.",
+			},
+			"variables": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Values for the variables of the bake file, overriding their defaults.",
+			},
+			"push": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to push the images of targets to their `tags`.",
+			},
+			"secrets": {
+				Type:        schema.TypeMap,
+				Default:     map[string]string{},
+				Optional:    true,
+				Sensitive:   true,
+				Description: "A map of secrets in key => value form that will be made accessible to every target.",
+			},
+			"secrets_base64": {
+				Type:        schema.TypeMap,
+				Default:     map[string]string{},
+				Optional:    true,
+				Sensitive:   true,
+				Description: "A map of secrets in key => base64_encoded_value form that will be made accessible to every target.",
+			},
+			"forward_ssh_agent_socket": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should the host running Terraform make their ssh agent socket available to the targets?",
+			},
+			"max_concurrency": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      4,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "The maximum number of targets to build in parallel.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the targets to be built again when any of the values change.",
+			},
+			"digests": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The image digest of every target that was built, by target name.",
+			},
+		},
+	}
+}
+
+// parseBakeFile parses a bake file in either of its formats. Variables are
+// evaluated first so that targets and groups can refer to them.
+func parseBakeFile(filename string, content []byte, overrides map[string]string) (*BakeFile, error) {
+
+	parser := hclparse.NewParser()
+
+	var file *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(filename, ".json") {
+		file, diags = parser.ParseJSON(content, filename)
+	} else {
+		file, diags = parser.ParseHCL(content, filename)
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	evalContext, diags := bakeEvalContext(file.Body, overrides)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	result := &BakeFile{}
+	if diags := gohcl.DecodeBody(file.Body, evalContext, result); diags.HasErrors() {
+		return nil, diags
+	}
+
+	return result, nil
+}
+
+func bakeEvalContext(body hcl.Body, overrides map[string]string) (*hcl.EvalContext, hcl.Diagnostics) {
+
+	evalContext := &hcl.EvalContext{
+		Variables: map[string]cty.Value{},
+		Functions: bakeFunctions,
+	}
+
+	content, _, diags := body.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+	})
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	for _, block := range content.Blocks {
+		name := block.Labels[0]
+
+		attributes, _, diags := block.Body.PartialContent(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "default"}},
+		})
+
+		if diags.HasErrors() {
+			return nil, diags
+		}
+
+		value := cty.StringVal("")
+		if x, ok := attributes.Attributes["default"]; ok {
+			if value, diags = x.Expr.Value(evalContext); diags.HasErrors() {
+				return nil, diags
+			}
+		}
+
+		// overrides are strings so they take on the type of the default where possible
+		if override, ok := overrides[name]; ok {
+			if converted, err := convert.Convert(cty.StringVal(override), value.Type()); err == nil {
+				value = converted
+			} else {
+				value = cty.StringVal(override)
+			}
+		}
+
+		evalContext.Variables[name] = value
+	}
+
+	return evalContext, nil
+}
+
+// expandBakeTargets resolves group names into the names of their targets,
+// keeping the order they were listed in.
+func expandBakeTargets(file *BakeFile, names []string) ([]string, error) {
+
+	groups := map[string]BakeGroupBlock{}
+	for _, x := range file.Groups {
+		groups[x.Name] = x
+	}
+
+	targets := map[string]bool{}
+	for _, x := range file.Targets {
+		targets[x.Name] = true
+	}
+
+	if len(names) == 0 {
+		if _, ok := groups["default"]; ok || targets["default"] {
+			names = []string{"default"}
+		} else {
+			for _, x := range file.Targets {
+				names = append(names, x.Name)
+			}
+		}
+	}
+
+	result := make([]string, 0)
+	seen := map[string]bool{}
+
+	var expand func(name string, visiting map[string]bool) error
+	expand = func(name string, visiting map[string]bool) error {
+		if group, ok := groups[name]; ok {
+			if visiting[name] {
+				return fmt.Errorf("group '%s' contains itself", name)
+			}
+			visiting[name] = true
+			for _, x := range group.Targets {
+				if err := expand(x, visiting); err != nil {
+					return err
+				}
+			}
+			delete(visiting, name)
+			return nil
+		}
+		if !targets[name] {
+			return fmt.Errorf("no target or group named '%s'", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+		return nil
+	}
+
+	for _, x := range names {
+		if err := expand(x, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// inheritBakeTarget merges the targets a target inherits from into it. Later
+// parents win over earlier ones and the target itself wins over all of them.
+func inheritBakeTarget(blocks map[string]BakeTargetBlock, name string, visiting map[string]bool) (BakeTargetBlock, error) {
+
+	block, ok := blocks[name]
+	if !ok {
+		return BakeTargetBlock{}, fmt.Errorf("no target named '%s'", name)
+	}
+
+	if visiting[name] {
+		return BakeTargetBlock{}, fmt.Errorf("target '%s' inherits from itself", name)
+	}
+
+	if err := unsupportedBakeAttributes(block); err != nil {
+		return BakeTargetBlock{}, err
+	}
+
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	result := BakeTargetBlock{Name: name}
+
+	for _, x := range append(block.Inherits, "") {
+		current := block
+		if x != "" {
+			parent, err := inheritBakeTarget(blocks, x, visiting)
+			if err != nil {
+				return BakeTargetBlock{}, err
+			}
+			current = parent
+		}
+
+		if current.Context != nil {
+			result.Context = current.Context
+		}
+		if current.Dockerfile != nil {
+			result.Dockerfile = current.Dockerfile
+		}
+		if current.Target != nil {
+			result.Target = current.Target
+		}
+		if current.Args != nil {
+			result.Args = merge(result.Args, current.Args)
+		}
+		if current.Contexts != nil {
+			result.Contexts = merge(result.Contexts, current.Contexts)
+		}
+		if current.Labels != nil {
+			result.Labels = merge(result.Labels, current.Labels)
+		}
+		if current.Tags != nil {
+			result.Tags = current.Tags
+		}
+		if current.Platforms != nil {
+			result.Platforms = current.Platforms
+		}
+		if current.CacheFrom != nil {
+			result.CacheFrom = current.CacheFrom
+		}
+		if current.CacheTo != nil {
+			result.CacheTo = current.CacheTo
+		}
+	}
+
+	return result, nil
+}
+
+// unsupportedBakeAttributes fails for the attributes of a target that the
+// provider doesn't build with, e.g. `secret` or `output`, rather than
+// building the target without them.
+func unsupportedBakeAttributes(block BakeTargetBlock) error {
+	if block.Remain == nil {
+		return nil
+	}
+
+	attributes, diags := block.Remain.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(attributes))
+	for k := range attributes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("target '%s' sets %s, which aren't supported", block.Name, strings.Join(names, ", "))
+}
+
+// bakeDependencies are the names of the targets that the target uses as one
+// of its contexts, e.g. `base = "target:base"`.
+func bakeDependencies(target BakeTarget) []string {
+	result := make([]string, 0)
+	for _, x := range target.Contexts {
+		if name, ok := strings.CutPrefix(x, "target:"); ok {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// resolveBakeTargets returns the fully inherited targets selected by names,
+// along with the targets they use as contexts. Those are ordered before the
+// targets that use them.
+func resolveBakeTargets(file *BakeFile, names []string) ([]BakeTarget, error) {
+
+	expanded, err := expandBakeTargets(file, names)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := map[string]BakeTargetBlock{}
+	for _, x := range file.Targets {
+		blocks[x.Name] = x
+	}
+
+	result := make([]BakeTarget, 0, len(expanded))
+	resolved := map[string]bool{}
+
+	var resolve func(name string, visiting map[string]bool) error
+	resolve = func(name string, visiting map[string]bool) error {
+		if resolved[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("target '%s' uses itself as a context", name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		block, err := inheritBakeTarget(blocks, name, map[string]bool{})
+		if err != nil {
+			return err
+		}
+
+		target := BakeTarget{
+			Name:       name,
+			Context:    ".",
+			Dockerfile: "Dockerfile",
+			Args:       merge(block.Args),
+			Contexts:   merge(block.Contexts),
+			Labels:     merge(block.Labels),
+			Tags:       append([]string{}, block.Tags...),
+			Platforms:  append([]string{}, block.Platforms...),
+			CacheFrom:  append([]string{}, block.CacheFrom...),
+			CacheTo:    append([]string{}, block.CacheTo...),
+		}
+
+		if block.Context != nil {
+			target.Context = *block.Context
+		}
+		if block.Dockerfile != nil {
+			target.Dockerfile = *block.Dockerfile
+		}
+		if block.Target != nil {
+			target.Target = *block.Target
+		}
+
+		for _, x := range bakeDependencies(target) {
+			if err := resolve(x, visiting); err != nil {
+				return err
+			}
+		}
+
+		resolved[name] = true
+		result = append(result, target)
+		return nil
+	}
+
+	for _, name := range expanded {
+		if err := resolve(name, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// parseCacheOption parses the csv form of cache-from and cache-to entries
+// (e.g. `type=registry,ref=example.com/app:cache`). A plain reference is
+// short for a registry cache.
+func parseCacheOption(value string) client.CacheOptionsEntry {
+	if !strings.Contains(value, "=") {
+		return client.CacheOptionsEntry{
+			Type:  "registry",
+			Attrs: map[string]string{"ref": value},
+		}
+	}
+
+	result := client.CacheOptionsEntry{Attrs: map[string]string{}}
+	for _, x := range strings.Split(value, ",") {
+		key, val, _ := strings.Cut(x, "=")
+		key = strings.TrimSpace(key)
+		if key == "type" {
+			result.Type = val
+		} else {
+			result.Attrs[key] = val
+		}
+	}
+
+	return result
+}
+
+func readBakeDefinition(data *schema.ResourceData) (string, *BakeFile, error) {
+
+	file := data.Get("file").(string)
+	definition := data.Get("definition").(string)
+	overrides := getStringMap(data, "variables")
+
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", nil, err
+		}
+		parsed, err := parseBakeFile(file, content, overrides)
+		return filepath.Dir(file), parsed, err
+	}
+
+	filename := "docker-bake.hcl"
+	if strings.HasPrefix(strings.TrimSpace(definition), "{") {
+		filename = "docker-bake.json"
+	}
+
+	parsed, err := parseBakeFile(filename, []byte(definition), overrides)
+	return ".", parsed, err
+}
+
+// resolveBakePaths returns the context of the target relative to the bake
+// file and its Dockerfile relative to the context.
+func resolveBakePaths(directory string, target BakeTarget) (string, string) {
+	buildContext := target.Context
+	if !filepath.IsAbs(buildContext) {
+		buildContext = filepath.Join(directory, buildContext)
+	}
+
+	dockerfile := target.Dockerfile
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(buildContext, dockerfile)
+	}
+
+	return buildContext, dockerfile
+}
+
+// bakeImageRefs are the references the targets that are pushed can be pulled
+// from by the targets that use them as a context, by target name.
+func bakeImageRefs(targets []BakeTarget, push bool, digests map[string]string) map[string]string {
+	result := map[string]string{}
+	if !push {
+		return result
+	}
+	for _, x := range targets {
+		if len(x.Tags) == 0 {
+			continue
+		}
+		result[x.Name] = x.Tags[0]
+		if digest, ok := digests[x.Name]; ok {
+			result[x.Name] += "@" + digest
+		}
+	}
+	return result
+}
+
+// getBakeSolveOpt is the solve of the target. The targets it uses as contexts
+// are pulled from refs, since they are built by solves of their own.
+func getBakeSolveOpt(directory string, target BakeTarget, push bool, refs map[string]string) (client.SolveOpt, error) {
+
+	if strings.Contains(target.Context, "://") {
+		return client.SolveOpt{}, fmt.Errorf("target '%s' has a remote context, only local contexts are supported", target.Name)
+	}
+
+	buildContext, dockerfile := resolveBakePaths(directory, target)
+
+	localDirs := map[string]string{
+		"context":    buildContext,
+		"dockerfile": filepath.Dir(dockerfile),
+	}
+
+	frontendAttrs := map[string]string{"filename": filepath.Base(dockerfile)}
+	for k, v := range target.Args {
+		frontendAttrs["build-arg:"+k] = v
+	}
+	for k, v := range target.Labels {
+		frontendAttrs["label:"+k] = v
+	}
+	if len(target.Platforms) > 0 {
+		frontendAttrs["platform"] = strings.Join(target.Platforms, ",")
+	}
+	if target.Target != "" {
+		frontendAttrs["target"] = target.Target
+	}
+	for k, v := range target.Contexts {
+		if name, ok := strings.CutPrefix(v, "target:"); ok {
+			ref, ok := refs[name]
+			if !ok {
+				return client.SolveOpt{}, fmt.Errorf("target '%s' uses target '%s' as its context '%s', which has to be pushed to a tag", target.Name, name, k)
+			}
+			frontendAttrs["context:"+k] = "docker-image://" + ref
+		} else if strings.Contains(v, "://") {
+			frontendAttrs["context:"+k] = v
+		} else {
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(directory, v)
+			}
+			localDirs["context:"+k] = v
+			frontendAttrs["context:"+k] = "local:context:" + k
+		}
+	}
+
+	exportAttrs := map[string]string{}
+	if len(target.Tags) > 0 {
+		exportAttrs["name"] = strings.Join(target.Tags, ",")
+		exportAttrs["push"] = strconv.FormatBool(push)
+	}
+
+	cacheExports := make([]client.CacheOptionsEntry, 0, len(target.CacheTo))
+	for _, x := range target.CacheTo {
+		cacheExports = append(cacheExports, parseCacheOption(x))
+	}
+
+	cacheImports := make([]client.CacheOptionsEntry, 0, len(target.CacheFrom))
+	for _, x := range target.CacheFrom {
+		cacheImports = append(cacheImports, parseCacheOption(x))
+	}
+
+	return client.SolveOpt{
+		Exports: []client.ExportEntry{{
+			Type:  "image",
+			Attrs: exportAttrs,
+		}},
+		CacheExports:  cacheExports,
+		CacheImports:  cacheImports,
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		LocalDirs:     localDirs,
+	}, nil
+}
+
+func createBake(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	push := data.Get("push").(bool)
+	max_concurrency := data.Get("max_concurrency").(int)
+	provider := meta.(TerraformProviderBuildkit)
+
+	directory, file, err := readBakeDefinition(data)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not read the bake definition.",
+			Detail:   err.Error(),
+		}}
+	}
+
+	targets, err := resolveBakeTargets(file, getStringList(data, "targets"))
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	// the digests of the targets used as contexts are only known once they are built
+	for _, x := range targets {
+		if _, err = getBakeSolveOpt(directory, x, push, bakeImageRefs(targets, push, nil)); err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+	}
+
+	sessionProviders, diags := getSessionProviders(data, provider)
+
+	if len(diags) > 0 {
+		return diags
+	}
+
+	sharedKey, err := provider.sharedKey("")
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	cli := provider.buildkit_client
+
+	digests := map[string]string{}
+	lock := sync.Mutex{}
+
+	// targets are built once the targets they use as contexts are, which the
+	// order of the targets always allows for
+	for remaining := targets; len(remaining) > 0; {
+		ready, waiting := []BakeTarget{}, []BakeTarget{}
+		for _, x := range remaining {
+			built := true
+			for _, dependency := range bakeDependencies(x) {
+				_, ok := digests[dependency]
+				built = built && ok
+			}
+			if built {
+				ready = append(ready, x)
+			} else {
+				waiting = append(waiting, x)
+			}
+		}
+		refs := bakeImageRefs(targets, push, digests)
+
+		// every target shares the same key and session so they also share the local context uploads
+		err = forEach(ctx, max_concurrency, len(ready), func(ctx context.Context, i int) error {
+			opt, err := getBakeSolveOpt(directory, ready[i], push, refs)
+			if err != nil {
+				return err
+			}
+			opt.Session = sessionProviders
+			opt.SharedKey = sharedKey
+
+			resp, err := cli.Solve(ctx, nil, opt, nil)
+			if err != nil {
+				return fmt.Errorf("target '%s' failed: %w", ready[i].Name, err)
+			}
+
+			lock.Lock()
+			digests[ready[i].Name] = resp.ExporterResponse["containerimage.digest"]
+			lock.Unlock()
+			return nil
+		})
+
+		if err != nil {
+			return diag.Diagnostics{buildkitFailure(provider, "bake", err)}
+		}
+
+		remaining = waiting
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("digests", digests)
+
+	return diag.Diagnostics{}
+}
+
+// diffBake plans the digests as unknown whenever the targets are built again,
+// so that nothing depending on them is planned with those of the last build.
+func diffBake(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if diff.Id() == "" {
+		return nil
+	}
+	for key, definition := range buildkitBakeResource().Schema {
+		if !definition.Computed && diff.HasChange(key) {
+			return diff.SetNewComputed("digests")
+		}
+	}
+	return nil
+}
+
+func readBake(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// builds only happen on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateBake(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createBake(ctx, data, meta)
+}
+
+func deleteBake(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
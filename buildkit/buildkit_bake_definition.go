@@ -0,0 +1,174 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func buildkitBakeDefinitionDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readBakeDefinitionDataSource,
+		Schema: map[string]*schema.Schema{
+			"file": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"file", "definition"},
+				Description:  "Path to the bake file (e.g. `docker-bake.hcl` or `docker-bake.json`) that should be parsed. Relative contexts are resolved against its directory.",
+			},
+			"definition": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"file", "definition"},
+				Description:  "An inline bake definition in HCL or JSON. Relative contexts are resolved against the working directory.",
+			},
+			"targets": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The targets or groups to resolve. Defaults to the `default` group, or every target when there is none.",
+			},
+			"variables": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Values for the variables of the bake file, overriding their defaults.",
+			},
+			"resolved_targets": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the target.",
+						},
+						"context": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Path to the build context of the target.",
+						},
+						"dockerfile": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Path to the Dockerfile of the target.",
+						},
+						"target": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The stage of the Dockerfile the target builds. Empty for the last stage.",
+						},
+						"args": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The build arguments of the target.",
+						},
+						"contexts": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The named contexts of the target, as written in the bake file, e.g. `target:base` for another target.",
+						},
+						"labels": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The labels of the target.",
+						},
+						"tags": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The image references the target is tagged with.",
+						},
+						"platforms": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The platforms the target is built for.",
+						},
+						"cache_from": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The caches the target imports, in `cache-from` form.",
+						},
+						"cache_to": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Description: "The caches the target exports, in `cache-to` form.",
+						},
+					},
+				},
+				Description: "The selected targets with their inherited values and variables applied, in the order they are built.",
+			},
+		},
+	}
+}
+
+func readBakeDefinitionDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	directory, file, err := readBakeDefinition(data)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not read the bake definition.",
+			Detail:   err.Error(),
+		}}
+	}
+
+	targets, err := resolveBakeTargets(file, getStringList(data, "targets"))
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	resolved_targets := make([]interface{}, 0, len(targets))
+	for _, x := range targets {
+		buildContext, dockerfile := resolveBakePaths(directory, x)
+		resolved_targets = append(resolved_targets, map[string]interface{}{
+			"name":       x.Name,
+			"context":    buildContext,
+			"dockerfile": dockerfile,
+			"target":     x.Target,
+			"args":       x.Args,
+			"contexts":   x.Contexts,
+			"labels":     x.Labels,
+			"tags":       x.Tags,
+			"platforms":  x.Platforms,
+			"cache_from": x.CacheFrom,
+			"cache_to":   x.CacheTo,
+		})
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("resolved_targets", resolved_targets)
+
+	return diag.Diagnostics{}
+}
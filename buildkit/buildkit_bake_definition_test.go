@@ -0,0 +1,48 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadBakeDefinitionDataSource(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"docker-bake.hcl": testBakeHcl,
+	})
+
+	data := schema.TestResourceDataRaw(t, buildkitBakeDefinitionDataSource().Schema, map[string]interface{}{
+		"file":      filepath.Join(directory, "docker-bake.hcl"),
+		"targets":   []interface{}{"worker"},
+		"variables": map[string]interface{}{"TAG": "v2"},
+	})
+
+	if diags := readBakeDefinitionDataSource(context.Background(), data, nil); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("resolved_targets.#").(int) != 1 {
+		t.Fatalf("expected one target but got %v", data.Get("resolved_targets"))
+	}
+	if data.Get("resolved_targets.0.context").(string) != filepath.Join(directory, "services") {
+		t.Fatalf("expected the context to be relative to the bake file: %v", data.Get("resolved_targets"))
+	}
+	if data.Get("resolved_targets.0.dockerfile").(string) != filepath.Join(directory, "services", "app", "Dockerfile") {
+		t.Fatalf("expected the dockerfile to be relative to the context: %v", data.Get("resolved_targets"))
+	}
+	if data.Get("resolved_targets.0.tags.0").(string) != "example.com/worker:V2" || data.Get("resolved_targets.0.args.SERVICE").(string) != "app" {
+		t.Fatalf("unexpected target: %v", data.Get("resolved_targets"))
+	}
+}
+
+func TestReadBakeDefinitionDataSourceInvalid(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, buildkitBakeDefinitionDataSource().Schema, map[string]interface{}{
+		"definition": `target "app" {`,
+	})
+
+	if diags := readBakeDefinitionDataSource(context.Background(), data, nil); len(diags) == 0 {
+		t.Fatal("expected an invalid definition to fail")
+	}
+}
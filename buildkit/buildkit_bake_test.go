@@ -0,0 +1,338 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBakeHcl = `
+variable "TAG" {
+  default = "latest"
+}
+
+variable "PUSH_CACHE" {
+  default = false
+}
+
+group "default" {
+  targets = ["app", "worker"]
+}
+
+group "all" {
+  targets = ["default", "docs"]
+}
+
+target "_common" {
+  context   = "services"
+  platforms = ["linux/amd64"]
+  args = {
+    GO_VERSION = "1.18"
+  }
+}
+
+target "app" {
+  inherits   = ["_common"]
+  dockerfile = "app/Dockerfile"
+  tags       = ["example.com/app:${TAG}"]
+  args = {
+    SERVICE = "app"
+  }
+  cache-from = ["example.com/app:cache"]
+  cache-to   = [PUSH_CACHE ? "type=registry,ref=example.com/app:cache,mode=max" : "type=inline"]
+}
+
+target "worker" {
+  inherits = ["app"]
+  tags     = ["example.com/worker:${upper(TAG)}"]
+  target   = "worker"
+}
+
+target "docs" {
+  context = "docs"
+}
+`
+
+func TestResolveBakeTargets(t *testing.T) {
+	file, err := parseBakeFile("docker-bake.hcl", []byte(testBakeHcl), map[string]string{"TAG": "v1", "PUSH_CACHE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := resolveBakeTargets(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []BakeTarget{
+		{
+			Name:       "app",
+			Context:    "services",
+			Dockerfile: "app/Dockerfile",
+			Args:       map[string]string{"GO_VERSION": "1.18", "SERVICE": "app"},
+			Contexts:   map[string]string{},
+			Labels:     map[string]string{},
+			Tags:       []string{"example.com/app:v1"},
+			Platforms:  []string{"linux/amd64"},
+			CacheFrom:  []string{"example.com/app:cache"},
+			CacheTo:    []string{"type=registry,ref=example.com/app:cache,mode=max"},
+		},
+		{
+			Name:       "worker",
+			Context:    "services",
+			Dockerfile: "app/Dockerfile",
+			Target:     "worker",
+			Args:       map[string]string{"GO_VERSION": "1.18", "SERVICE": "app"},
+			Contexts:   map[string]string{},
+			Labels:     map[string]string{},
+			Tags:       []string{"example.com/worker:V1"},
+			Platforms:  []string{"linux/amd64"},
+			CacheFrom:  []string{"example.com/app:cache"},
+			CacheTo:    []string{"type=registry,ref=example.com/app:cache,mode=max"},
+		},
+	}
+
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, targets)
+	}
+}
+
+func TestExpandBakeTargets(t *testing.T) {
+	file, err := parseBakeFile("docker-bake.hcl", []byte(testBakeHcl), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := expandBakeTargets(file, []string{"all", "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(names, []string{"app", "worker", "docs"}) {
+		t.Fatalf("unexpected targets %v", names)
+	}
+
+	if _, err := expandBakeTargets(file, []string{"missing"}); err == nil {
+		t.Fatal("expected an unknown target to fail")
+	}
+}
+
+func TestResolveBakeTargetsJson(t *testing.T) {
+	definition := `{
+		"variable": {"TAG": {"default": "dev"}},
+		"target": {
+			"api": {"tags": ["example.com/api:${TAG}"]},
+			"web": {"context": "web", "inherits": ["api"]}
+		}
+	}`
+
+	file, err := parseBakeFile("docker-bake.json", []byte(definition), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a default group every target is built
+	targets, err := resolveBakeTargets(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 2 || targets[1].Name != "web" || targets[1].Context != "web" || targets[1].Dockerfile != "Dockerfile" ||
+		!reflect.DeepEqual(targets[1].Tags, []string{"example.com/api:dev"}) {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+}
+
+func TestInheritBakeTargetCycle(t *testing.T) {
+	file, err := parseBakeFile("docker-bake.hcl", []byte(`
+		target "a" { inherits = ["b"] }
+		target "b" { inherits = ["a"] }
+	`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolveBakeTargets(file, []string{"a"}); err == nil {
+		t.Fatal("expected an inheritance cycle to fail")
+	}
+}
+
+func TestParseCacheOption(t *testing.T) {
+	registry := parseCacheOption("example.com/app:cache")
+	if registry.Type != "registry" || registry.Attrs["ref"] != "example.com/app:cache" {
+		t.Fatalf("unexpected cache option %+v", registry)
+	}
+
+	local := parseCacheOption("type=local,dest=/tmp/cache,mode=max")
+	if local.Type != "local" || !reflect.DeepEqual(local.Attrs, map[string]string{"dest": "/tmp/cache", "mode": "max"}) {
+		t.Fatalf("unexpected cache option %+v", local)
+	}
+}
+
+func TestGetBakeSolveOpt(t *testing.T) {
+	opt, err := getBakeSolveOpt("/work", BakeTarget{
+		Name:       "app",
+		Context:    "services",
+		Dockerfile: "app/Dockerfile.prod",
+		Target:     "release",
+		Args:       map[string]string{"A": "1"},
+		Tags:       []string{"example.com/app:1", "example.com/app:latest"},
+		Platforms:  []string{"linux/amd64", "linux/arm64"},
+	}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opt.LocalDirs["context"] != "/work/services" || opt.LocalDirs["dockerfile"] != "/work/services/app" {
+		t.Fatalf("unexpected local dirs %v", opt.LocalDirs)
+	}
+
+	expected := map[string]string{
+		"filename":    "Dockerfile.prod",
+		"build-arg:A": "1",
+		"platform":    "linux/amd64,linux/arm64",
+		"target":      "release",
+	}
+
+	if !reflect.DeepEqual(opt.FrontendAttrs, expected) {
+		t.Fatalf("unexpected frontend attrs %v", opt.FrontendAttrs)
+	}
+
+	if opt.Exports[0].Attrs["name"] != "example.com/app:1,example.com/app:latest" || opt.Exports[0].Attrs["push"] != "true" {
+		t.Fatalf("unexpected export %v", opt.Exports[0].Attrs)
+	}
+
+	if _, err := getBakeSolveOpt("/work", BakeTarget{Name: "remote", Context: "https://github.com/example/app.git"}, false, nil); err == nil {
+		t.Fatal("expected a remote context to fail")
+	}
+}
+
+func TestResolveBakeTargetContexts(t *testing.T) {
+	file, err := parseBakeFile("docker-bake.hcl", []byte(`
+		target "base" {
+			context = "base"
+			tags    = ["example.com/base:1"]
+		}
+		target "app" {
+			contexts = {
+				base   = "target:base"
+				assets = "assets"
+				alpine = "docker-image://alpine:3.15"
+			}
+		}
+		target "loop" {
+			contexts = { self = "target:loop" }
+		}
+	`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the target used as a context is built first even when it isn't selected
+	targets, err := resolveBakeTargets(file, []string{"app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].Name != "base" || targets[1].Name != "app" || !reflect.DeepEqual(bakeDependencies(targets[1]), []string{"base"}) {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+
+	if _, err := getBakeSolveOpt("/work", targets[1], false, bakeImageRefs(targets, false, nil)); err == nil {
+		t.Fatal("expected a context of a target that isn't pushed to fail")
+	}
+
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	opt, err := getBakeSolveOpt("/work", targets[1], true, bakeImageRefs(targets, true, map[string]string{"base": digest}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"context:base":   "docker-image://example.com/base:1@" + digest,
+		"context:assets": "local:context:assets",
+		"context:alpine": "docker-image://alpine:3.15",
+	}
+	for k, v := range expected {
+		if opt.FrontendAttrs[k] != v {
+			t.Fatalf("expected %s to be %s but got %v", k, v, opt.FrontendAttrs)
+		}
+	}
+	if opt.LocalDirs["context:assets"] != "/work/assets" {
+		t.Fatalf("unexpected local dirs %v", opt.LocalDirs)
+	}
+
+	if _, err := resolveBakeTargets(file, []string{"loop"}); err == nil {
+		t.Fatal("expected a target that uses itself as a context to fail")
+	}
+}
+
+func TestResolveBakeTargetsUnsupported(t *testing.T) {
+	for filename, definition := range map[string]string{
+		"docker-bake.hcl": `
+			target "_common" {
+				no-cache = true
+			}
+			target "app" {
+				inherits = ["_common"]
+				secret   = ["id=token,src=token.txt"]
+			}
+			target "docs" {}
+		`,
+		"docker-bake.json": `{"target": {"_common": {"no-cache": true}, "app": {"inherits": ["_common"], "secret": ["id=token,src=token.txt"]}, "docs": {}}}`,
+	} {
+		file, err := parseBakeFile(filename, []byte(definition), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := resolveBakeTargets(file, []string{"docs"}); err != nil {
+			t.Fatalf("expected a target without unsupported attributes to resolve: %v", err)
+		}
+
+		_, err = resolveBakeTargets(file, []string{"app"})
+		if err == nil || !strings.Contains(err.Error(), "secret") {
+			t.Fatalf("expected the unsupported attribute of the target to fail for %s: %v", filename, err)
+		}
+
+		// without it the target fails on the attribute it inherits
+		for i := range file.Targets {
+			if file.Targets[i].Name == "app" {
+				file.Targets[i].Remain = nil
+			}
+		}
+		_, err = resolveBakeTargets(file, []string{"app"})
+		if err == nil || !strings.Contains(err.Error(), "no-cache") {
+			t.Fatalf("expected the unsupported attribute of the parent to fail for %s: %v", filename, err)
+		}
+	}
+}
+
+func TestDiffBake(t *testing.T) {
+	resource := buildkitBakeResource()
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{"definition": testBakeHcl})
+	data.SetId("previous")
+	data.Set("digests", map[string]interface{}{"app": "sha256:1111"})
+	state := data.State()
+
+	unchanged, err := resource.SimpleDiff(context.Background(), state, terraform.NewResourceConfigRaw(map[string]interface{}{"definition": testBakeHcl}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil && len(unchanged.Attributes) > 0 {
+		t.Fatalf("expected no changes when nothing changed: %v", unchanged.Attributes)
+	}
+
+	changed, err := resource.SimpleDiff(context.Background(), state, terraform.NewResourceConfigRaw(map[string]interface{}{
+		"definition": testBakeHcl,
+		"variables":  map[string]interface{}{"TAG": "1.0.0"},
+	}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attribute, ok := changed.Attributes["digests.%"]; !ok || !attribute.NewComputed {
+		t.Fatalf("expected the digests to be unknown until the targets are built again: %v", changed.Attributes)
+	}
+}
@@ -0,0 +1,58 @@
+package buildkit
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"strings"
+)
+
+// getBaseImageArgs are the build arguments that pass each base_image to the
+// Dockerfile, pinned by its digest, e.g. `BASE_IMAGE=ghcr.io/org/base@sha256:...`
+// for `FROM ${BASE_IMAGE}`. The digest changes whenever the base image is
+// rebuilt, which rebuilds the image with it.
+func getBaseImageArgs(data interface{ Get(string) interface{} }) (map[string]string, error) {
+	result := map[string]string{}
+
+	for _, x := range data.Get("base_image").([]interface{}) {
+		casted := x.(map[string]interface{})
+		build_arg := casted["build_arg"].(string)
+		reference, err := baseImageReference(casted["resource_digest"].(string), casted["repository"].(string))
+		if err != nil {
+			return nil, fmt.Errorf("the base_image of the build arg '%s' is invalid: %w", build_arg, err)
+		}
+		if _, ok := result["build-arg:"+build_arg]; ok {
+			return nil, fmt.Errorf("the build arg '%s' is set by more than one base_image", build_arg)
+		}
+		result["build-arg:"+build_arg] = reference
+	}
+
+	return result, nil
+}
+
+// baseImageReference is the digest url of a base image, given either its
+// digest url or its digest and the repository it is pulled from.
+func baseImageReference(resource_digest string, repository string) (string, error) {
+	if strings.Contains(resource_digest, "@") {
+		parsed, err := name.NewDigest(resource_digest)
+		if err != nil {
+			return "", err
+		}
+		return parsed.Name(), nil
+	}
+
+	if _, err := v1.NewHash(resource_digest); err != nil {
+		return "", fmt.Errorf("'%s' is neither a digest nor a digest url: %w", resource_digest, err)
+	}
+
+	if repository == "" {
+		return "", fmt.Errorf("the repository of the digest '%s' is required to pull it", resource_digest)
+	}
+
+	parsed, err := name.NewDigest(strings.TrimSuffix(repository, "/") + "@" + resource_digest)
+	if err != nil {
+		return "", err
+	}
+
+	return parsed.Name(), nil
+}
@@ -0,0 +1,50 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetBaseImageArgs(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"args": map[string]interface{}{"BASE_IMAGE": "alpine:3", "VERSION": "1.0.0"},
+		"base_image": []interface{}{
+			map[string]interface{}{"resource_digest": digest, "repository": "ghcr.io/org/base", "build_arg": "BASE_IMAGE"},
+			map[string]interface{}{"resource_digest": "ghcr.io/org/tools@" + digest, "build_arg": "TOOLS_IMAGE"},
+		},
+	}))
+
+	args, err := getBaseImageArgs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"build-arg:BASE_IMAGE":  "ghcr.io/org/base@" + digest,
+		"build-arg:TOOLS_IMAGE": "ghcr.io/org/tools@" + digest,
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected the base images to be pinned by their digest: %v", args)
+	}
+
+	if merged := merge(getBuildArgs(data), args); merged["build-arg:BASE_IMAGE"] != expected["build-arg:BASE_IMAGE"] || merged["build-arg:VERSION"] != "1.0.0" {
+		t.Fatalf("expected the base images to take precedence over the args: %v", merged)
+	}
+
+	for _, x := range []map[string]interface{}{
+		{"resource_digest": digest, "build_arg": "BASE_IMAGE"},
+		{"resource_digest": "latest", "repository": "ghcr.io/org/base", "build_arg": "BASE_IMAGE"},
+		{"resource_digest": "ghcr.io/org/base:latest", "build_arg": "BASE_IMAGE"},
+	} {
+		invalid := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+			"base_image": []interface{}{x},
+		}))
+		if _, err := getBaseImageArgs(invalid); err == nil {
+			t.Fatalf("expected %v to be invalid", x)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+func buildkitBinfmtResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createBinfmt,
+		ReadContext:   readBinfmt,
+		UpdateContext: updateBinfmt,
+		DeleteContext: deleteBinfmt,
+		Description:   "Installs the QEMU binfmt_misc handlers of the tonistiigi/binfmt image on a Docker host, so that the buildkit daemons on that host can build platforms they don't run natively.",
+		Schema: map[string]*schema.Schema{
+			"docker_host": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The address of the Docker daemon to run the installer on, e.g. `unix:///var/run/docker.sock` or `tcp://build-host:2376`. When empty, the `DOCKER_HOST` environment variable or the local daemon is used. TLS is configured by the `DOCKER_TLS_VERIFY` and `DOCKER_CERT_PATH` environment variables.",
+			},
+			"image": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "tonistiigi/binfmt:latest",
+				Description: "The installer image. Pin it to a tag or digest to control which version of QEMU is installed.",
+			},
+			"platforms": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The platforms or architectures to install emulators for, e.g. `linux/arm64` or `riscv64`. Every emulator of the image is installed when empty.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the emulators to be installed again when any of the values change, e.g. after the host was replaced.",
+			},
+			"supported_platforms": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The platforms the host can run after the installation, natively or emulated.",
+			},
+			"emulators": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The binfmt_misc handlers registered on the host after the installation, e.g. `qemu-aarch64`.",
+			},
+		},
+	}
+}
+
+// BinfmtStatus is what the installer prints once it is done.
+type BinfmtStatus struct {
+	Supported []string `json:"supported"`
+	Emulators []string `json:"emulators"`
+}
+
+// binfmtInstallArgs are the arguments of the installer for the platforms.
+func binfmtInstallArgs(platforms []string) []string {
+	if len(platforms) == 0 {
+		return []string{"--install", "all"}
+	}
+	return []string{"--install", strings.Join(platforms, ",")}
+}
+
+// parseBinfmtStatus reads the status from the stdout of the installer, which
+// reports the progress of each emulator on stderr.
+func parseBinfmtStatus(stdout []byte) (BinfmtStatus, error) {
+	status := BinfmtStatus{}
+	if err := json.Unmarshal(bytes.TrimSpace(stdout), &status); err != nil {
+		return status, fmt.Errorf("the installer printed no status: %w", err)
+	}
+	return status, nil
+}
+
+// encodeDockerAuth encodes the credentials of the registry the way the Docker
+// daemon expects them when it pulls an image.
+func encodeDockerAuth(auth RegistryAuth) (string, error) {
+	if auth.username == "" {
+		return "", nil
+	}
+	encoded, err := json.Marshal(types.AuthConfig{Username: auth.username, Password: auth.password, ServerAddress: auth.registry_url})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// runBinfmt pulls the installer and runs it in a privileged container, which
+// it needs to register handlers with the kernel of the host, and returns
+// the stdout and stderr of the container once it exits.
+func runBinfmt(ctx context.Context, host string, image string, auth RegistryAuth, args []string) ([]byte, []byte, error) {
+	options := []docker.Opt{docker.FromEnv, docker.WithAPIVersionNegotiation()}
+	if host != "" {
+		options = append(options, docker.WithHost(host))
+	}
+
+	cli, err := docker.NewClientWithOpts(options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cli.Close()
+
+	registryAuth, err := encodeDockerAuth(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pull, err := cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: registryAuth})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the pull is only done once its progress has been read to the end
+	_, err = io.Copy(ioutil.Discard, pull)
+	pull.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, err := cli.ContainerCreate(ctx, &container.Config{Image: image, Cmd: args}, &container.HostConfig{Privileged: true}, nil, nil, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, nil, err
+	}
+
+	var exitCode int64
+	waited, failed := cli.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case result := <-waited:
+		exitCode = result.StatusCode
+	case err := <-failed:
+		return nil, nil, err
+	}
+
+	logs, err := cli.ContainerLogs(ctx, created.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer logs.Close()
+
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, logs); err != nil {
+		return nil, nil, err
+	}
+
+	if exitCode != 0 {
+		return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("the installer exited with status %d", exitCode)
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+func createBinfmt(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	host := data.Get("docker_host").(string)
+	image := data.Get("image").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	reference, err := name.ParseReference(image)
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not parse the image '%s'.", image),
+			Detail:   err.Error(),
+		}}
+	}
+
+	stdout, stderr, err := runBinfmt(ctx, host, image, provider.registryAuth(reference.Context().RegistryStr()), binfmtInstallArgs(getStringList(data, "platforms")))
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not install the emulators of %s: %s", image, err.Error()),
+			Detail:   string(stderr),
+		}}
+	}
+
+	status, err := parseBinfmtStatus(stdout)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not read what %s installed.", image),
+			Detail:   err.Error(),
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("supported_platforms", status.Supported)
+	data.Set("emulators", status.Emulators)
+
+	return diag.Diagnostics{}
+}
+
+func readBinfmt(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// handlers are only installed on apply, use triggers to install them again
+	return diagnostics
+}
+
+func updateBinfmt(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createBinfmt(ctx, data, meta)
+}
+
+func deleteBinfmt(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// the handlers may be used by builds outside of terraform so they stay
+	// registered, they are gone once the host restarts
+	return diagnostics
+}
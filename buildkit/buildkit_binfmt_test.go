@@ -0,0 +1,64 @@
+package buildkit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"reflect"
+	"testing"
+)
+
+func TestBinfmtInstallArgs(t *testing.T) {
+	if args := binfmtInstallArgs(nil); !reflect.DeepEqual(args, []string{"--install", "all"}) {
+		t.Fatalf("expected every emulator to be installed but got %v", args)
+	}
+
+	if args := binfmtInstallArgs([]string{"linux/arm64", "riscv64"}); !reflect.DeepEqual(args, []string{"--install", "linux/arm64,riscv64"}) {
+		t.Fatalf("expected the emulators of the platforms to be installed but got %v", args)
+	}
+}
+
+func TestParseBinfmtStatus(t *testing.T) {
+	status, err := parseBinfmtStatus([]byte(`{
+  "supported": ["linux/amd64", "linux/arm64"],
+  "emulators": ["qemu-aarch64"]
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := BinfmtStatus{Supported: []string{"linux/amd64", "linux/arm64"}, Emulators: []string{"qemu-aarch64"}}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, status)
+	}
+
+	if _, err := parseBinfmtStatus([]byte("installing: arm64 OK")); err == nil {
+		t.Fatal("expected an error for output that isn't a status")
+	}
+}
+
+func TestEncodeDockerAuth(t *testing.T) {
+	if encoded, _ := encodeDockerAuth(RegistryAuth{}); encoded != "" {
+		t.Fatalf("expected no credentials but got %s", encoded)
+	}
+
+	encoded, err := encodeDockerAuth(RegistryAuth{registry_url: "docker.io", username: "user", password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := types.AuthConfig{}
+	if err := json.Unmarshal(decoded, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Username != "user" || config.Password != "secret" || config.ServerAddress != "docker.io" {
+		t.Fatalf("expected the credentials of the registry but got %+v", config)
+	}
+}
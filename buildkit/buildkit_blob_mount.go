@@ -0,0 +1,73 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// getCopiedTargets are the publish targets that buildkit doesn't push, keyed
+// by their index, with the index of the target they are copied from once it
+// is pushed. Those are the targets that publish only some of the platforms,
+// and the targets in the same registry as another target. Copying within a
+// registry mounts the blobs from the other repository instead of uploading
+// them again, so publishing to several repositories of a registry uploads the
+// layers once. Targets in the same repository as one that is pushed are
+// pushed along with it, which only uploads the manifest again.
+func getCopiedTargets(data *schema.ResourceData) map[int]int {
+	result := map[int]int{}
+	mount_blobs := data.Get("mount_blobs").(bool)
+	publish_targets := data.Get("publish_target").([]interface{})
+
+	// the first target pushed to each registry and each repository
+	registries := map[string]int{}
+	repositories := map[string]bool{}
+
+	for i, x := range publish_targets {
+		casted := x.(map[string]interface{})
+		if len(getTargetPlatforms(casted)) > 0 {
+			continue
+		}
+
+		registry := casted["registry_url"].(string)
+		repository := fullImage(registry, casted["name"].(string))
+
+		source, ok := registries[normalizeRegistry(registry)]
+
+		if ok && mount_blobs && !repositories[repository] {
+			result[i] = source
+			continue
+		}
+
+		if !ok {
+			registries[normalizeRegistry(registry)] = i
+		}
+
+		repositories[repository] = true
+	}
+
+	first := getFullTarget(publish_targets)
+
+	for i, x := range publish_targets {
+		casted := x.(map[string]interface{})
+		if len(getTargetPlatforms(casted)) == 0 || first < 0 {
+			continue
+		}
+		result[i] = first
+		if source, ok := registries[normalizeRegistry(casted["registry_url"].(string))]; ok && mount_blobs {
+			result[i] = source
+		}
+	}
+
+	return result
+}
+
+// copyTarget copies the image that was pushed to the source target to the
+// target, by its digest, keeping only the platforms of the target if it has
+// any.
+func copyTarget(ctx context.Context, provider TerraformProviderBuildkit, source map[string]interface{}, target map[string]interface{}, digest string) error {
+	registry := target["registry_url"].(string)
+	from := fullImage(source["registry_url"].(string), source["name"].(string)+"@"+digest)
+	to := fullImage(registry, target["name"].(string)+":"+target["tag"].(string))
+	_, err := copyPlatforms(ctx, from, provider.registryAuth(source["registry_url"].(string)), to, provider.registryAuth(registry), getTargetPlatforms(target))
+	return err
+}
@@ -0,0 +1,56 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"reflect"
+	"testing"
+)
+
+func TestGetCopiedTargets(t *testing.T) {
+	targets := []interface{}{
+		map[string]interface{}{"registry_url": "123456789012.dkr.ecr.us-east-1.amazonaws.com", "name": "app", "tag": "1.0.0"},
+		map[string]interface{}{"registry_url": "123456789012.dkr.ecr.us-east-1.amazonaws.com", "name": "app", "tag": "latest"},
+		map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1.0.0"},
+		map[string]interface{}{"registry_url": "123456789012.dkr.ecr.us-east-1.amazonaws.com", "name": "worker", "tag": "1.0.0"},
+		map[string]interface{}{"registry_url": "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", "name": "cron", "tag": "1.0.0"},
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{"publish_target": targets}))
+
+	if mounted := getCopiedTargets(data); !reflect.DeepEqual(mounted, map[int]int{3: 0, 4: 0}) {
+		t.Fatalf("expected the other repositories of the registry to be mounted from the first: %v", mounted)
+	}
+
+	names := getCompiledOutputs(data)[0].Attrs["name"]
+	if names != "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.0.0,123456789012.dkr.ecr.us-east-1.amazonaws.com/app:latest,ghcr.io/org/app:1.0.0" {
+		t.Fatalf("expected the mounted targets to not be pushed by buildkit: %s", names)
+	}
+
+	disabled := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{"publish_target": targets, "mount_blobs": false}))
+
+	if mounted := getCopiedTargets(disabled); len(mounted) > 0 {
+		t.Fatalf("expected every target to be pushed: %v", mounted)
+	}
+}
+
+func TestCopyTarget(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	source := map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"}
+	target := map[string]interface{}{"registry_url": host, "name": "worker", "tag": "1.0.0"}
+
+	if err := copyTarget(context.Background(), provider, source, target, digest); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := getRemoteImageHash(context.Background(), host+"/worker:1.0.0", provider.registryAuth(host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != digest {
+		t.Fatalf("expected the target to point at %s but got %s", digest, hash)
+	}
+}
@@ -0,0 +1,199 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client/llb"
+	"go.opentelemetry.io/otel/attribute"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sshGitContextPattern matches contexts that the buildkit daemon clones over
+// ssh rather than being sent from the host running terraform, e.g.
+// `git@github.com:org/repo.git#main` or `ssh://git@github.com/org/repo.git`.
+var sshGitContextPattern = regexp.MustCompile(`^(ssh://|[\w.-]+@[\w.-]+:)`)
+
+func isSSHGitContext(buildContext string) bool {
+	return sshGitContextPattern.MatchString(buildContext)
+}
+
+// validateContext makes sure a git context has an ssh agent to be cloned with
+// and isn't snapshotted or overlaid, since it isn't on the host.
+func validateContext(buildContext string, forward_ssh_agent_socket bool, snapshot_context bool, context_files bool) error {
+	if !isSSHGitContext(buildContext) {
+		return nil
+	}
+	if !forward_ssh_agent_socket {
+		return fmt.Errorf("the git context '%s' is cloned with the ssh agent of the host running terraform, set forward_ssh_agent_socket to forward it", buildContext)
+	}
+	if snapshot_context {
+		return fmt.Errorf("the git context '%s' is cloned by the buildkit daemon and can't be snapshotted", buildContext)
+	}
+	if context_files {
+		return fmt.Errorf("the git context '%s' is cloned by the buildkit daemon and can't have context_files written on top", buildContext)
+	}
+	return nil
+}
+
+// getContextInputs are the frontend inputs that make the daemon clone a git
+// context itself.
+func getContextInputs(buildContext string) map[string]llb.State {
+	if !isSSHGitContext(buildContext) {
+		return nil
+	}
+	remote, ref, _ := strings.Cut(buildContext, "#")
+	return map[string]llb.State{"context": llb.Git(remote, ref)}
+}
+
+// getLocalDirs are the directories sent to the daemon along with the build.
+func getLocalDirs(buildContext string, dockerfile string) map[string]string {
+	dirs := map[string]string{"dockerfile": filepath.Dir(dockerfile)}
+	if !isSSHGitContext(buildContext) {
+		dirs["context"] = buildContext
+	}
+	return dirs
+}
+
+// preparedContext is the directory a build context is sent to the daemon
+// from, along with what the build is keyed by and the digest of its contents.
+type preparedContext struct {
+	directory string
+	key       string
+	digest    string
+}
+
+// prepareContext unpacks, overlays and snapshots the context as configured.
+// The temporary directories it needs are removed by the cleanup.
+func prepareContext(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, buildContext string, context_files map[string]string) (preparedContext, func(), diag.Diagnostics) {
+
+	directories := make([]string, 0)
+	cleanup := func() {
+		for _, x := range directories {
+			os.RemoveAll(x)
+		}
+	}
+
+	var diags diag.Diagnostics
+
+	context_tarball_digest := ""
+
+	if tarball := data.Get("context_tarball").(string); tarball != "" {
+		unpacked, err := ioutil.TempDir("", "terraform-provider-buildkit-")
+
+		if err != nil {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+
+		directories = append(directories, unpacked)
+
+		_, span := startSpan(ctx, provider.tracer(), "unpack context", attribute.String("buildkit.context_tarball", tarball))
+		context_tarball_digest, err = extractTarball(tarball, unpacked)
+		span.SetAttributes(attribute.String("buildkit.context_tarball_digest", context_tarball_digest))
+		span.end(err)
+
+		if err != nil {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not unpack the context tarball '%s'.", tarball),
+				Detail:   err.Error(),
+			}}
+		}
+
+		buildContext = unpacked
+	}
+
+	data.Set("context_tarball_digest", context_tarball_digest)
+
+	// the files are part of the key rather than the temporary context they are written to
+	keyContext := buildContext
+
+	if len(context_files) > 0 {
+		overlay, err := ioutil.TempDir("", "terraform-provider-buildkit-")
+
+		if err != nil {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+
+		directories = append(directories, overlay)
+
+		if buildContext != "" {
+			if _, diags = snapshotDirectory(HashQuery{Directory: buildContext}, overlay); len(diags) > 0 {
+				return preparedContext{}, cleanup, diags
+			}
+		}
+
+		if err := writeContextFiles(overlay, context_files); err != nil {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "Could not write the context_files.",
+				Detail:   err.Error(),
+			}}
+		}
+
+		buildContext = overlay
+	}
+
+	context_digest := ""
+
+	if data.Get("snapshot_context").(bool) {
+		snapshot, err := ioutil.TempDir("", "terraform-provider-buildkit-")
+
+		if err != nil {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+
+		directories = append(directories, snapshot)
+
+		_, span := startSpan(ctx, provider.tracer(), "snapshot context", attribute.String("buildkit.context", buildContext))
+		context_digest, diags = snapshotDirectory(HashQuery{Directory: buildContext}, snapshot)
+		span.SetAttributes(attribute.String("buildkit.context_digest", context_digest))
+		span.endDiagnostics(diags)
+
+		if len(diags) > 0 {
+			return preparedContext{}, cleanup, diags
+		}
+
+		if expected := data.Get("expected_context_digest").(string); expected != "" && expected != context_digest {
+			return preparedContext{}, cleanup, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("The context '%s' changed since it was hashed.", buildContext),
+				Detail:   fmt.Sprintf("Expected the context to have hash %s but it has %s.", expected, context_digest),
+			}}
+		}
+
+		buildContext = snapshot
+	}
+
+	built_digest := context_digest
+
+	// without a snapshot the context is hashed before it is sent
+	if built_digest == "" && buildContext != "" && !isSSHGitContext(buildContext) {
+		_, span := startSpan(ctx, provider.tracer(), "hash context", attribute.String("buildkit.context", buildContext))
+		built_digest, _, diags = getDirectoryHash(HashQuery{Directory: buildContext, CacheDirectory: provider.hash_cache_directory})
+		span.SetAttributes(attribute.String("buildkit.context_digest", built_digest))
+		span.endDiagnostics(diags)
+
+		if diags.HasError() {
+			return preparedContext{}, cleanup, diags
+		}
+	}
+
+	data.Set("context_digest", built_digest)
+
+	return preparedContext{directory: buildContext, key: keyContext, digest: context_digest}, cleanup, diag.Diagnostics{}
+}
@@ -0,0 +1,59 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/moby/buildkit/solver/pb"
+	"testing"
+)
+
+func TestValidateContext(t *testing.T) {
+	for _, x := range []string{"git@github.com:org/repo.git#main", "ssh://git@github.com/org/repo.git", "deploy@git.example.com:repo.git"} {
+		if !isSSHGitContext(x) {
+			t.Fatalf("expected %s to be a git context", x)
+		}
+		if err := validateContext(x, true, false, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateContext(x, false, false, false); err == nil {
+			t.Fatalf("expected %s to need the ssh agent", x)
+		}
+		if err := validateContext(x, true, true, false); err == nil {
+			t.Fatalf("expected %s to not be snapshotted", x)
+		}
+		if err := validateContext(x, true, false, true); err == nil {
+			t.Fatalf("expected %s to not have files written on top", x)
+		}
+	}
+	for _, x := range []string{"./images/app", "/home/me/app", "C:\\images\\app"} {
+		if isSSHGitContext(x) {
+			t.Fatalf("expected %s to be a local context", x)
+		}
+		if err := validateContext(x, false, true, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGitContextIsClonedByTheDaemon(t *testing.T) {
+	// the host keys are scanned while marshalling, which fails fast on localhost
+	inputs := getContextInputs("git@localhost:org/repo.git#main")
+	definition, err := inputs["context"].Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var op pb.Op
+	if err := op.Unmarshal(definition.Def[0]); err != nil {
+		t.Fatal(err)
+	}
+	source := op.GetSource()
+	if source == nil || source.Identifier != "git://localhost/org/repo.git#main" || source.Attrs[pb.AttrMountSSHSock] != "default" {
+		t.Fatalf("expected the daemon to clone the context with the forwarded agent: %v", source)
+	}
+	dirs := getLocalDirs("git@github.com:org/repo.git#main", "/work/app/Dockerfile")
+	if _, ok := dirs["context"]; ok || dirs["dockerfile"] != "/work/app" {
+		t.Fatalf("expected only the dockerfile to be sent: %v", dirs)
+	}
+	if inputs := getContextInputs("/work/app"); len(inputs) != 0 {
+		t.Fatalf("expected a local context to be sent: %v", inputs)
+	}
+}
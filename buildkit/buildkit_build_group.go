@@ -0,0 +1,243 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// buildGroup makes sure that images with the same inputs are built only once
+// for the lifetime of the provider, which terraform starts anew for every
+// apply. This happens when a module that builds an image is instantiated
+// several times. The first resource runs the build and the others wait for
+// it and copy what it published to their own publish targets. A nil group
+// runs every build.
+type buildGroup struct {
+	mutex  sync.Mutex
+	builds map[string]*sharedBuild
+}
+
+// sharedBuild is the result of a build that other resources can reuse.
+type sharedBuild struct {
+	done            chan struct{}
+	image_digest    string
+	trace_id        string
+	source          string
+	source_registry string
+	report          BuildReport
+	diagnostics     diag.Diagnostics
+}
+
+func newBuildGroup() *buildGroup {
+	return &buildGroup{builds: map[string]*sharedBuild{}}
+}
+
+// join returns the build for the key and whether the caller is the one that
+// has to run it, in which case it must call finish.
+func (group *buildGroup) join(key string) (*sharedBuild, bool) {
+	if group == nil {
+		return &sharedBuild{done: make(chan struct{})}, true
+	}
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if build, ok := group.builds[key]; ok {
+		return build, false
+	}
+
+	build := &sharedBuild{done: make(chan struct{})}
+	group.builds[key] = build
+	return build, true
+}
+
+// finish records the outcome of the build for the resources waiting on it.
+// The first publish target is where they copy the image from.
+func (build *sharedBuild) finish(data *schema.ResourceData, diagnostics diag.Diagnostics, report BuildReport) {
+	build.diagnostics = diagnostics
+	build.report = report
+	if !diagnostics.HasError() {
+		build.image_digest = data.Get("image_digest").(string)
+		build.trace_id = data.Get("trace_id").(string)
+		// the other resources are copied from a target with every platform
+		publish_targets := data.Get("publish_target").([]interface{})
+		if first := getFullTarget(publish_targets); first >= 0 {
+			casted := publish_targets[first].(map[string]interface{})
+			build.source = casted["digest_url"].(string)
+			build.source_registry = casted["registry_url"].(string)
+		}
+	}
+	close(build.done)
+}
+
+// getBuildKey hashes everything that goes into a build, other than where it is
+// published to. The context is identified by its hash when it was snapshotted
+// or unpacked from a tarball and by its location otherwise.
+func getBuildKey(data *schema.ResourceData, buildContext string, context_digest string, frontendAttrs map[string]string) (string, diag.Diagnostics) {
+	secrets, diags := getSecrets(data)
+
+	if len(diags) > 0 {
+		return "", diags
+	}
+
+	_, secret_mounts, _ := getSecretBlocks(data)
+
+	dockerfile := resolvePath(data.Get("dockerfile").(string))
+	dockerfile_content, err := ioutil.ReadFile(dockerfile)
+
+	if err != nil {
+		return "", diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	context_tarball_digest := data.Get("context_tarball_digest").(string)
+
+	// a snapshot or unpacked tarball lives in a directory of its own so only its
+	// contents matter, and a git context is the same wherever terraform runs
+	if context_digest != "" || context_tarball_digest != "" {
+		buildContext = ""
+	} else if !isSSHGitContext(buildContext) {
+		buildContext = resolvePath(buildContext)
+	}
+
+	key, err := json.Marshal(map[string]interface{}{
+		"context":                buildContext,
+		"context_digest":         context_digest,
+		"context_files":          data.Get("context_files"),
+		"context_tarball_digest": context_tarball_digest,
+		"dockerfile":             dockerfile,
+		"dockerfile_content":     dockerfile_content,
+		"frontend_attrs":         frontendAttrs,
+		"secrets":                secrets,
+		"secret_mounts":          secret_mounts,
+		"ssh":                    getSSHAgents(data),
+		"squash":                 data.Get("squash").(bool),
+		"squash_from":            data.Get("squash_from").(string),
+		"triggers":               data.Get("triggers"),
+	})
+
+	if err != nil {
+		return "", diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:]), diag.Diagnostics{}
+}
+
+// resolvePath makes different paths to the same file equal, as far as possible.
+func resolvePath(path string) string {
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+// reuseBuild waits for the build and copies the image it published to the
+// publish targets of the resource. It returns false when the build wasn't
+// published anywhere, so the resource has to be built after all.
+func reuseBuild(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, build *sharedBuild) (diag.Diagnostics, bool) {
+
+	select {
+	case <-build.done:
+	case <-ctx.Done():
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  ctx.Err().Error(),
+		}}, true
+	}
+
+	if build.diagnostics.HasError() {
+		return build.diagnostics, true
+	}
+
+	publish_targets := data.Get("publish_target").([]interface{})
+
+	if len(publish_targets) > 0 && build.source == "" {
+		return nil, false
+	}
+
+	lock, diags := getPublishLock(data)
+
+	if len(diags) > 0 {
+		return diags, true
+	}
+
+	unlock, diags := lockTargets(ctx, lock, provider, publish_targets)
+
+	if len(diags) > 0 {
+		return diags, true
+	}
+
+	defer unlock()
+
+	_ = data.Set("image_digest", build.image_digest)
+	_ = data.Set("trace_id", build.trace_id)
+	_ = data.Set("exporter_metadata", build.report.ExporterResponse)
+	new_targets := []interface{}{}
+
+	diags = diag.Diagnostics{}
+	for _, x := range publish_targets {
+		casted := x.(map[string]interface{})
+		registry := casted["registry_url"].(string)
+		completeRef := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
+		targetCtx, span := startSpan(ctx, provider.tracer(), "publish target", attribute.String("buildkit.tag_url", completeRef), attribute.String("buildkit.source", build.source))
+		hash, err := copyPlatforms(targetCtx, build.source, provider.registryAuth(build.source_registry), completeRef, provider.registryAuth(registry), getTargetPlatforms(casted))
+		if err == nil {
+			err = publishLatestTag(targetCtx, casted, hash, provider.registryAuth(registry))
+		}
+		platform_tag_urls := map[string]interface{}{}
+		if err == nil {
+			platform_tag_urls, err = publishPlatformTags(targetCtx, casted, hash, provider.registryAuth(registry))
+		}
+		published := merge(publishedTarget(casted, hash), map[string]interface{}{"platform_tag_urls": platform_tag_urls})
+		if err == nil {
+			published, err = withPlatformDigests(targetCtx, data, published, provider.registryAuth(registry))
+		}
+		span.SetAttributes(attribute.String("buildkit.digest", hash))
+		span.end(err)
+		if err != nil {
+			diags = append(diags, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			})
+		}
+
+		new_targets = append(new_targets, published)
+	}
+
+	if len(diags) > 0 {
+		return diags, true
+	}
+
+	if data.Get("verify_consistency").(bool) {
+		if diags := verifyConsistency(ctx, provider, new_targets); len(diags) > 0 {
+			return diags, true
+		}
+	}
+
+	if data.Get("verify_pull").(bool) {
+		if diags := verifyPull(ctx, provider, new_targets); len(diags) > 0 {
+			return diags, true
+		}
+	}
+
+	data.Set("publish_target", new_targets)
+	setImageRefs(data)
+
+	return diag.Diagnostics{}, true
+}
@@ -0,0 +1,115 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildGroupJoin(t *testing.T) {
+	group := newBuildGroup()
+
+	first, leader := group.join("key")
+	if !leader {
+		t.Fatal("expected the first resource to run the build")
+	}
+
+	second, leader := group.join("key")
+	if leader || second != first {
+		t.Fatal("expected the second resource to wait for the first build")
+	}
+
+	if _, leader := group.join("other"); !leader {
+		t.Fatal("expected a different build to run on its own")
+	}
+
+	var none *buildGroup
+	if _, leader := none.join("key"); !leader {
+		t.Fatal("expected every build to run without a group")
+	}
+}
+
+func TestGetBuildKey(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{"Dockerfile": "FROM scratch"})
+
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(directory, link); err != nil {
+		t.Fatal(err)
+	}
+
+	keyOf := func(context string, args map[string]interface{}) string {
+		data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+			"context":    context,
+			"dockerfile": filepath.Join(context, "Dockerfile"),
+			"args":       args,
+		})
+		key, diags := getBuildKey(data, context, "", getBuildArgs(data))
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+		return key
+	}
+
+	if keyOf(directory, nil) != keyOf(link, nil) {
+		t.Fatal("expected the same context to have the same key regardless of how it is reached")
+	}
+
+	if keyOf(directory, nil) == keyOf(directory, map[string]interface{}{"VERSION": "1"}) {
+		t.Fatal("expected different args to have different keys")
+	}
+}
+
+func TestReuseBuild(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:build")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	build := &sharedBuild{
+		done:            make(chan struct{}),
+		image_digest:    digest,
+		source:          host + "/app@" + digest,
+		source_registry: host,
+		report:          BuildReport{ExporterResponse: map[string]string{"containerimage.digest": digest}},
+		diagnostics:     diag.Diagnostics{},
+	}
+	close(build.done)
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"context":    "/context",
+		"dockerfile": "/context/Dockerfile",
+		"publish_target": []interface{}{map[string]interface{}{
+			"registry_url": host,
+			"name":         "other",
+			"tag":          "1.0.0",
+		}},
+	})
+
+	diags, ok := reuseBuild(context.Background(), data, meta, build)
+	if !ok || len(diags) > 0 {
+		t.Fatalf("expected the build to be reused: %v", diags)
+	}
+
+	if data.Get("image_digest").(string) != digest {
+		t.Fatalf("expected image digest %s but got %s", digest, data.Get("image_digest"))
+	}
+
+	if actual := data.Get("exporter_metadata").(map[string]interface{})["containerimage.digest"]; actual != digest {
+		t.Fatalf("expected the exporter response of the build but got %v", actual)
+	}
+
+	for _, x := range data.Get("publish_target").([]interface{}) {
+		if actual := x.(map[string]interface{})["digest_url"].(string); actual != host+"/other@"+digest {
+			t.Fatalf("expected the image to be copied but got %s", actual)
+		}
+	}
+
+	// without a published image there's nothing to copy from
+	build.source = ""
+	if _, ok := reuseBuild(context.Background(), data, meta, build); ok {
+		t.Fatal("expected the resource to be built when the build wasn't published")
+	}
+}
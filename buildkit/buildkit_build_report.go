@@ -0,0 +1,185 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"io/ioutil"
+	"strings"
+)
+
+// solveReporter collects the steps and warnings the daemon reports while
+// solving, for the metadata_file of an image.
+type solveReporter struct {
+	order    []digest.Digest
+	steps    map[digest.Digest]*BuildReportStep
+	warnings []BuildReportWarning
+}
+
+func newSolveReporter() *solveReporter {
+	return &solveReporter{steps: map[digest.Digest]*BuildReportStep{}}
+}
+
+func (r *solveReporter) observe(status *client.SolveStatus) {
+	for _, vertex := range status.Vertexes {
+		step, ok := r.steps[vertex.Digest]
+		if !ok {
+			step = &BuildReportStep{}
+			r.steps[vertex.Digest] = step
+			r.order = append(r.order, vertex.Digest)
+		}
+		step.Name = vertex.Name
+		step.Cached = vertex.Cached
+		step.Started = vertex.Started
+		step.Completed = vertex.Completed
+		step.Error = vertex.Error
+		if vertex.Started != nil && vertex.Completed != nil {
+			step.DurationMs = vertex.Completed.Sub(*vertex.Started).Milliseconds()
+		}
+	}
+
+	for _, warning := range status.Warnings {
+		details := []string{}
+		for _, x := range warning.Detail {
+			details = append(details, string(x))
+		}
+		step := ""
+		if x, ok := r.steps[warning.Vertex]; ok {
+			step = x.Name
+		}
+		r.warnings = append(r.warnings, BuildReportWarning{
+			Step:   step,
+			Short:  string(warning.Short),
+			Detail: strings.Join(details, "\n"),
+			Url:    warning.URL,
+		})
+	}
+}
+
+// fill adds the steps, cache statistics and warnings to the report.
+func (r *solveReporter) fill(report *BuildReport) {
+	report.Steps = []BuildReportStep{}
+	report.Cache = BuildReportCache{}
+	for _, x := range r.order {
+		step := r.steps[x]
+		report.Steps = append(report.Steps, *step)
+		report.Cache.Steps++
+		if step.Cached {
+			report.Cache.Cached++
+		}
+	}
+	report.Warnings = append([]BuildReportWarning{}, r.warnings...)
+}
+
+// writeBuildReport writes what the image was built into to its metadata_file,
+// along with the digest of every platform of the image, if it has one.
+func writeBuildReport(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, report BuildReport) diag.Diagnostics {
+	metadata_file := data.Get("metadata_file").(string)
+
+	if metadata_file == "" {
+		return diag.Diagnostics{}
+	}
+
+	report.ImageDigest = data.Get("image_digest").(string)
+	report.TraceId = data.Get("trace_id").(string)
+	report.PublishTargets = []BuildReportTarget{}
+	report.Platforms = map[string]string{}
+
+	for _, x := range data.Get("publish_target").([]interface{}) {
+		casted := x.(map[string]interface{})
+		report.PublishTargets = append(report.PublishTargets, BuildReportTarget{
+			TagUrl:    casted["tag_url"].(string),
+			DigestUrl: casted["digest_url"].(string),
+			Digest:    casted["digest"].(string),
+		})
+	}
+
+	// every target is the same image so the platforms of the first one will do
+	if len(report.PublishTargets) > 0 {
+		target := data.Get("publish_target").([]interface{})[0].(map[string]interface{})
+		platforms, err := getPlatformDigests(ctx, report.PublishTargets[0].DigestUrl, provider.registryAuth(target["registry_url"].(string)))
+
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not read the platforms of '%s' for the metadata_file.", report.PublishTargets[0].DigestUrl),
+				Detail:   err.Error(),
+			}}
+		}
+
+		report.Platforms = platforms
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+
+	if err == nil {
+		err = ioutil.WriteFile(metadata_file, content, 0644)
+	}
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not write the metadata_file '%s'.", metadata_file),
+			Detail:   err.Error(),
+		}}
+	}
+
+	return diag.Diagnostics{}
+}
+
+// getPlatformDigests returns the digest of the manifest of each platform of
+// the image, e.g. `linux/arm64/v8`, leaving out attestations.
+func getPlatformDigests(ctx context.Context, reference string, auth RegistryAuth) (map[string]string, error) {
+	parsed, err := name.ParseReference(reference)
+
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor, err := remote.Get(parsed, makeOptions(craneOptions(ctx, auth)...).Remote...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+
+	if !isV2IndexManifest(descriptor.MediaType) {
+		image, err := processManifest(ctx, parsed, descriptor.Manifest, auth)
+		if err != nil {
+			return nil, err
+		}
+		result[platformName(image.Platform, image.Variant)] = descriptor.Digest.String()
+		return result, nil
+	}
+
+	index, err := v1.ParseIndexManifest(bytes.NewReader(descriptor.Manifest))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, x := range index.Manifests {
+		if isAttestationManifest(x) {
+			continue
+		}
+		result[platformName(x.Platform.OS+"/"+x.Platform.Architecture, x.Platform.Variant)] = x.Digest.String()
+	}
+
+	return result, nil
+}
+
+func platformName(platform string, variant string) string {
+	if variant == "" {
+		return platform
+	}
+	return platform + "/" + variant
+}
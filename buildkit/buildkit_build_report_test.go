@@ -0,0 +1,152 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSolveReporter(t *testing.T) {
+	started := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	completed := started.Add(1500 * time.Millisecond)
+	base := digest.FromString("base")
+	run := digest.FromString("run")
+
+	reporter := newSolveReporter()
+	reporter.observe(&client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: base, Name: "[1/2] FROM alpine", Started: &started, Completed: &started, Cached: true},
+		{Digest: run, Name: "[2/2] RUN make", Started: &started},
+	}})
+	reporter.observe(&client.SolveStatus{
+		Vertexes: []*client.Vertex{{Digest: run, Name: "[2/2] RUN make", Started: &started, Completed: &completed}},
+		Warnings: []*client.VertexWarning{{Vertex: run, Short: []byte("deprecated"), Detail: [][]byte{[]byte("use"), []byte("something else")}}},
+	})
+
+	report := BuildReport{}
+	reporter.fill(&report)
+
+	if report.Cache.Steps != 2 || report.Cache.Cached != 1 {
+		t.Fatalf("expected 1 of 2 steps to be cached but got %+v", report.Cache)
+	}
+
+	if len(report.Steps) != 2 || report.Steps[1].Name != "[2/2] RUN make" || report.Steps[1].DurationMs != 1500 {
+		t.Fatalf("expected the steps in the order they started with their durations but got %+v", report.Steps)
+	}
+
+	expected := BuildReportWarning{Step: "[2/2] RUN make", Short: "deprecated", Detail: "use\nsomething else"}
+	if len(report.Warnings) != 1 || report.Warnings[0] != expected {
+		t.Fatalf("expected the warning %+v but got %+v", expected, report.Warnings)
+	}
+}
+
+// testPushIndex pushes an index with a random image for each platform.
+func testPushIndex(t *testing.T, reference string, platforms ...v1.Platform) v1.ImageIndex {
+	var index v1.ImageIndex = empty.Index
+	for i := range platforms {
+		image, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := image.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config = config.DeepCopy()
+		config.OS, config.Architecture = platforms[i].OS, platforms[i].Architecture
+		image, err = mutate.ConfigFile(image, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        image,
+			Descriptor: v1.Descriptor{Platform: &platforms[i]},
+		})
+	}
+	parsed, err := name.ParseReference(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(parsed, index); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestWriteBuildReport(t *testing.T) {
+	host := testRegistry(t)
+	index := testPushIndex(t, host+"/app:1.0.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata_file := filepath.Join(t.TempDir(), "metadata.json")
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"metadata_file": metadata_file,
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"},
+		},
+	}))
+	_ = data.Set("image_digest", "sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	_ = data.Set("publish_target", []interface{}{
+		publishedTarget(data.Get("publish_target").([]interface{})[0].(map[string]interface{}), indexDigest.String()),
+	})
+
+	diags := writeBuildReport(context.Background(), data, TerraformProviderBuildkit{}, BuildReport{DurationMs: 42})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	content, err := ioutil.ReadFile(metadata_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := BuildReport{}
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.DurationMs != 42 || report.ImageDigest != data.Get("image_digest").(string) {
+		t.Fatalf("expected the report of the build but got %+v", report)
+	}
+
+	if len(report.PublishTargets) != 1 || report.PublishTargets[0].Digest != indexDigest.String() {
+		t.Fatalf("expected the publish target with digest %s but got %+v", indexDigest, report.PublishTargets)
+	}
+
+	expected := map[string]string{
+		"linux/amd64":    manifest.Manifests[0].Digest.String(),
+		"linux/arm64/v8": manifest.Manifests[1].Digest.String(),
+	}
+	for platform, digest := range expected {
+		if report.Platforms[platform] != digest {
+			t.Fatalf("expected platform %s to have digest %s but got %v", platform, digest, report.Platforms)
+		}
+	}
+}
+
+func TestWriteBuildReportWithoutFile(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(nil))
+
+	// the publish target was never pushed, so reading it would fail
+	if diags := writeBuildReport(context.Background(), data, TerraformProviderBuildkit{}, BuildReport{}); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+}
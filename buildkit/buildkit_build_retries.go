@@ -0,0 +1,81 @@
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/go-hclog"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"time"
+)
+
+// how long to wait before the first retry of a build, which doubles with
+// every retry up to the maximum
+var (
+	buildRetryBackoff    = 5 * time.Second
+	buildRetryMaxBackoff = time.Minute
+)
+
+// transientSolveErrors are parts of the messages of errors a build fails with
+// when the connection to the daemon was lost or its worker restarted, rather
+// than because of the build itself.
+var transientSolveErrors = []string{
+	"connection reset by peer",
+	"broken pipe",
+	"transport is closing",
+	"error reading from server: EOF",
+	"no worker found",
+	"no active session",
+}
+
+// isTransientSolveError is whether a build that failed with the error could
+// succeed when it is run again as it is.
+func isTransientSolveError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	switch grpcerrors.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+
+	message := err.Error()
+	for _, x := range transientSolveErrors {
+		if strings.Contains(message, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retrySolve runs the build and runs it again, up to the given number of
+// retries, for as long as it fails with transient errors. Builds are cached by
+// the daemon, so a retry continues more or less where the build was stopped.
+// Returns the number of retries it took.
+func retrySolve[T any](ctx context.Context, retries int, logger hclog.Logger, redactor *redactor, solve func(context.Context) (T, error)) (T, int, error) {
+	backoff := buildRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		result, err := solve(ctx)
+
+		if attempt >= retries || ctx.Err() != nil || !isTransientSolveError(err) {
+			return result, attempt, err
+		}
+
+		logger.Warn("retrying build", "attempt", attempt+1, "retries", retries, "backoff", backoff.String(), "error", redactor.redact(err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return result, attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > buildRetryMaxBackoff {
+			backoff = buildRetryMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsTransientSolveError(t *testing.T) {
+	transient := []error{
+		grpcerrors.WrapCode(status.Error(codes.Unavailable, "connection refused"), codes.Unavailable),
+		errors.New("failed to solve: rpc error: code = Unknown desc = read tcp 10.0.0.1:1234: connection reset by peer"),
+		fmt.Errorf("failed to solve: %w", errors.New("error reading from server: EOF")),
+	}
+
+	for _, x := range transient {
+		if !isTransientSolveError(x) {
+			t.Errorf("expected '%s' to be transient", x)
+		}
+	}
+
+	permanent := []error{
+		errors.New(`process "/bin/sh -c make" did not complete successfully: exit code: 2`),
+		status.Error(codes.InvalidArgument, "failed to parse dockerfile"),
+		fmt.Errorf("failed to solve: %w", context.Canceled),
+		nil,
+	}
+
+	for _, x := range permanent {
+		if isTransientSolveError(x) {
+			t.Errorf("expected '%v' to not be transient", x)
+		}
+	}
+}
+
+func TestRetrySolve(t *testing.T) {
+	backoff := buildRetryBackoff
+	buildRetryBackoff = time.Millisecond
+	t.Cleanup(func() {
+		buildRetryBackoff = backoff
+	})
+
+	output := &bytes.Buffer{}
+	logger := newProgressLogger(output)
+	redactor := newRedactor([]string{"hunter2"})
+
+	attempts := 0
+	result, retries, err := retrySolve(context.Background(), 3, logger, redactor, func(ctx context.Context) (string, error) {
+		attempts++
+		if attempts < 3 {
+			return "", errors.New("hunter2: connection reset by peer")
+		}
+		return "sha256:abc", nil
+	})
+
+	if err != nil || result != "sha256:abc" || retries != 2 {
+		t.Fatalf("expected the build to succeed after 2 retries: %v %v %v", result, retries, err)
+	}
+	if strings.Count(output.String(), "retrying build") != 2 || strings.Contains(output.String(), "hunter2") {
+		t.Fatalf("expected each retry to be logged without secrets: %s", output.String())
+	}
+
+	attempts = 0
+	_, retries, err = retrySolve(context.Background(), 1, logger, redactor, func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("broken pipe")
+	})
+
+	if err == nil || attempts != 2 || retries != 1 {
+		t.Fatalf("expected the build to give up after 1 retry: %d %v", attempts, err)
+	}
+
+	attempts = 0
+	_, _, err = retrySolve(context.Background(), 3, logger, redactor, func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("exit code: 2")
+	})
+
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected the build to not be retried: %d %v", attempts, err)
+	}
+}
@@ -0,0 +1,377 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd/platforms"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the name of the node at the buildkit_url of the provider
+const defaultNodeName = "default"
+
+// builderNode is one of the buildkit daemons of a multi-node builder, like
+// the nodes of a buildx builder. The daemon at the buildkit_url is the first.
+type builderNode struct {
+	name      string
+	url       string
+	client    *client.Client
+	platforms []string
+	mutex     sync.Mutex
+	listed    bool
+	native    []string
+	emulated  []string
+}
+
+// nodeRoute is the part of a build that runs on a node.
+type nodeRoute struct {
+	node      *builderNode
+	platforms []string
+}
+
+// architectures that the cpus of another architecture run without emulation
+var nativeArchitectures = map[string][]string{
+	"amd64": {"386"},
+	"arm64": {"arm"},
+}
+
+// supportedPlatforms returns the platforms the node builds natively and the
+// ones it can only build by emulating them. The platforms configured for a
+// node are all native. Otherwise the workers of the daemon are asked, the
+// first platform of a worker being the one of the machine it runs on.
+func (node *builderNode) supportedPlatforms(ctx context.Context) ([]string, []string, error) {
+	if len(node.platforms) > 0 {
+		return node.platforms, nil, nil
+	}
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.listed {
+		return node.native, node.emulated, nil
+	}
+
+	workers, err := node.client.ListWorkers(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list the workers of node '%s': %w", node.name, err)
+	}
+
+	node.native, node.emulated = classifyWorkerPlatforms(workers)
+	node.listed = true
+
+	return node.native, node.emulated, nil
+}
+
+func classifyWorkerPlatforms(workers []*client.WorkerInfo) ([]string, []string) {
+	native := []string{}
+	emulated := []string{}
+	for _, worker := range workers {
+		if len(worker.Platforms) == 0 {
+			continue
+		}
+		host := platforms.Normalize(worker.Platforms[0])
+		for _, x := range worker.Platforms {
+			x = platforms.Normalize(x)
+			if x.OS == host.OS && (x.Architecture == host.Architecture || contains(nativeArchitectures[host.Architecture], x.Architecture)) {
+				native = append(native, platforms.Format(x))
+			} else {
+				emulated = append(emulated, platforms.Format(x))
+			}
+		}
+	}
+	return native, emulated
+}
+
+func contains(values []string, value string) bool {
+	for _, x := range values {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// platformMatches is true when one of the supported platforms can build the
+// platform, e.g. `linux/arm64` and `linux/arm64/v8` are the same.
+func platformMatches(supported []string, platform string) bool {
+	parsed := parsePlatform(platform)
+	wanted := ocispecs.Platform{OS: parsed.OperatingSystem, Architecture: parsed.Architecture, Variant: parsed.Variant}
+	for _, x := range supported {
+		parsed := parsePlatform(x)
+		matcher := platforms.NewMatcher(ocispecs.Platform{OS: parsed.OperatingSystem, Architecture: parsed.Architecture, Variant: parsed.Variant})
+		if matcher.Match(wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// routePlatforms assigns each platform to the first node that builds it
+// natively, or else to the first node that can emulate it. Platforms that no
+// node supports are left to the first node, which fails them the same way a
+// single daemon does. A single node builds every platform without asking.
+func routePlatforms(ctx context.Context, nodes []*builderNode, requested []string) ([]nodeRoute, error) {
+	if len(nodes) == 1 || len(requested) == 0 {
+		return []nodeRoute{{node: nodes[0], platforms: requested}}, nil
+	}
+
+	routes := []nodeRoute{}
+	index := map[*builderNode]int{}
+
+	for _, platform := range requested {
+		var native, emulated *builderNode
+		for _, node := range nodes {
+			nativePlatforms, emulatedPlatforms, err := node.supportedPlatforms(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if native == nil && platformMatches(nativePlatforms, platform) {
+				native = node
+			}
+			if emulated == nil && platformMatches(emulatedPlatforms, platform) {
+				emulated = node
+			}
+		}
+
+		node := nodes[0]
+		if native != nil {
+			node = native
+		} else if emulated != nil {
+			node = emulated
+		}
+
+		if i, ok := index[node]; ok {
+			routes[i].platforms = append(routes[i].platforms, platform)
+		} else {
+			index[node] = len(routes)
+			routes = append(routes, nodeRoute{node: node, platforms: []string{platform}})
+		}
+	}
+
+	return routes, nil
+}
+
+// emulatedPlatforms returns the node each platform of the routes is built on
+// when the node can only build it by emulating it, e.g. with QEMU registered
+// through binfmt_misc. Platforms that no worker of the node lists at all are
+// left out, the daemon fails them with an error of its own.
+func emulatedPlatforms(ctx context.Context, routes []nodeRoute) (map[string]string, error) {
+	result := map[string]string{}
+	for _, route := range routes {
+		if len(route.platforms) == 0 {
+			continue
+		}
+		native, emulated, err := route.node.supportedPlatforms(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, platform := range route.platforms {
+			if !platformMatches(native, platform) && platformMatches(emulated, platform) {
+				result[platform] = route.node.name
+			}
+		}
+	}
+	return result, nil
+}
+
+// emulationDiagnostics warns about every emulated platform, so that it is
+// clear why its build is so much slower or fails, or errors when native
+// builds are required.
+func emulationDiagnostics(emulated map[string]string, require_native bool) diag.Diagnostics {
+	platforms := []string{}
+	for platform := range emulated {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	diagnostics := diag.Diagnostics{}
+	for _, platform := range platforms {
+		if require_native {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Platform %s would be emulated on node '%s' but require_native is set.", platform, emulated[platform]),
+				Detail:   fmt.Sprintf("No node of the builder runs %s natively. Add a node that does, or unset require_native to build it through emulation.", platform),
+			})
+		} else {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Warning,
+				Summary:  fmt.Sprintf("Platform %s is emulated on node '%s'.", platform, emulated[platform]),
+				Detail:   fmt.Sprintf("No node of the builder runs %s natively, so it is built through QEMU registered with binfmt_misc. Emulated builds are often ten times slower and can fail on instructions QEMU doesn't support. Add a node that runs %s natively, or set require_native to fail instead.", platform, platform),
+			})
+		}
+	}
+	return diagnostics
+}
+
+// routedPlatforms is which node built each platform.
+func routedPlatforms(routes []nodeRoute) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, route := range routes {
+		for _, platform := range route.platforms {
+			result[platform] = route.node.name
+		}
+	}
+	return result
+}
+
+// getNodeOutputs pushes what a node built to the repository of every publish
+// target by its digest only, so that the results of all nodes can be merged
+// into the tags of the targets afterwards.
+func getNodeOutputs(outputs []client.ExportEntry, repositories []string) []client.ExportEntry {
+	result := []client.ExportEntry{}
+	for _, x := range outputs {
+		attrs := merge(x.Attrs, map[string]string{
+			"name":           strings.Join(repositories, ","),
+			"push-by-digest": "true",
+		})
+		result = append(result, client.ExportEntry{Type: x.Type, Attrs: attrs})
+	}
+	return result
+}
+
+// mergeNodeImages pushes an index of the platforms every node built to the
+// reference and returns its digest. The nodes pushed their images to its
+// repository by their digests.
+func mergeNodeImages(ctx context.Context, reference string, auth RegistryAuth, digests []string) (string, error) {
+	tag, err := name.ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+	manifests := []v1.Descriptor{}
+
+	for _, x := range digests {
+		descriptor, err := remote.Get(tag.Context().Digest(x), options...)
+		if err != nil {
+			return "", err
+		}
+
+		if isV2IndexManifest(descriptor.MediaType) {
+			index, err := v1.ParseIndexManifest(bytes.NewReader(descriptor.Manifest))
+			if err != nil {
+				return "", err
+			}
+			manifests = append(manifests, index.Manifests...)
+			continue
+		}
+
+		image, err := descriptor.Image()
+		if err != nil {
+			return "", err
+		}
+		raw, err := image.RawConfigFile()
+		if err != nil {
+			return "", err
+		}
+		config := ImageConfigManifest{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return "", err
+		}
+		manifests = append(manifests, v1.Descriptor{
+			MediaType: descriptor.MediaType,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+			Platform: &v1.Platform{
+				OS:           config.Os,
+				OSVersion:    config.OSVersion,
+				Architecture: config.Architecture,
+				Variant:      config.Variant,
+			},
+		})
+	}
+
+	mediaType := types.DockerManifestList
+	for _, x := range manifests {
+		if x.MediaType == types.OCIManifestSchema1 {
+			mediaType = types.OCIImageIndex
+		}
+	}
+
+	raw, err := json.Marshal(v1.IndexManifest{SchemaVersion: 2, MediaType: mediaType, Manifests: manifests})
+	if err != nil {
+		return "", err
+	}
+
+	hash, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	err = remote.Put(tag, &remote.Descriptor{
+		Descriptor: v1.Descriptor{
+			MediaType: mediaType,
+			Digest:    hash,
+			Size:      size,
+		},
+		Manifest: raw,
+	}, options...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+// solveOnNodes builds the platforms routed to each node at the same time and
+// merges what the nodes pushed into the tag of every publish target. The
+// response has the digest of the merged image.
+func solveOnNodes(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, routes []nodeRoute, outputs []client.ExportEntry, solve func(context.Context, nodeRoute, []client.ExportEntry) (*client.SolveResponse, error)) (*client.SolveResponse, error) {
+	publish_targets := data.Get("publish_target").([]interface{})
+	copied := getCopiedTargets(data)
+
+	// the targets that are copied from another are copied from the merged image later
+	repositories := []string{}
+	for i, x := range publish_targets {
+		if _, ok := copied[i]; ok {
+			continue
+		}
+		casted := x.(map[string]interface{})
+		repositories = append(repositories, fullImage(casted["registry_url"].(string), casted["name"].(string)))
+	}
+
+	nodeOutputs := getNodeOutputs(outputs, repositories)
+	digests := make([]string, len(routes))
+
+	err := forEach(ctx, len(routes), len(routes), func(ctx context.Context, i int) error {
+		resp, err := solve(ctx, routes[i], nodeOutputs)
+		if err != nil {
+			return fmt.Errorf("node '%s': %w", routes[i].node.name, err)
+		}
+		digests[i] = resp.ExporterResponse["containerimage.digest"]
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	image_digest := ""
+	for i, x := range publish_targets {
+		if _, ok := copied[i]; ok {
+			continue
+		}
+		casted := x.(map[string]interface{})
+		registry := casted["registry_url"].(string)
+		completeRef := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
+		image_digest, err = mergeNodeImages(ctx, completeRef, provider.registryAuth(registry), digests)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &client.SolveResponse{ExporterResponse: map[string]string{"containerimage.digest": image_digest}}, nil
+}
@@ -0,0 +1,144 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/moby/buildkit/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyWorkerPlatforms(t *testing.T) {
+	native, emulated := classifyWorkerPlatforms([]*client.WorkerInfo{{
+		Platforms: []ocispecs.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "386"},
+			{OS: "linux", Architecture: "arm64"},
+			{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+	}})
+
+	if !reflect.DeepEqual(native, []string{"linux/amd64", "linux/386"}) {
+		t.Fatalf("expected the platforms of the host to be native but got %v", native)
+	}
+
+	if !reflect.DeepEqual(emulated, []string{"linux/arm64", "linux/arm/v7"}) {
+		t.Fatalf("expected the other platforms to be emulated but got %v", emulated)
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	if !platformMatches([]string{"linux/arm64"}, "linux/arm64/v8") {
+		t.Fatal("expected linux/arm64 to build linux/arm64/v8")
+	}
+
+	if platformMatches([]string{"linux/amd64"}, "linux/arm64") {
+		t.Fatal("expected linux/amd64 not to build linux/arm64")
+	}
+}
+
+func TestRoutePlatforms(t *testing.T) {
+	amd64 := &builderNode{name: defaultNodeName, platforms: []string{"linux/amd64"}}
+	arm64 := &builderNode{name: "arm", platforms: []string{"linux/arm64", "linux/arm/v7"}}
+
+	routes, err := routePlatforms(context.Background(), []*builderNode{amd64, arm64}, []string{"linux/arm64", "linux/amd64", "linux/arm/v7", "linux/s390x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"linux/arm64":  "arm",
+		"linux/arm/v7": "arm",
+		"linux/amd64":  defaultNodeName,
+		"linux/s390x":  defaultNodeName,
+	}
+
+	if len(routes) != 2 || !reflect.DeepEqual(routedPlatforms(routes), expected) {
+		t.Fatalf("expected the platforms to be routed as %v but got %v", expected, routedPlatforms(routes))
+	}
+}
+
+func TestRoutePlatformsOnSingleNode(t *testing.T) {
+	node := &builderNode{name: defaultNodeName}
+
+	// a single node isn't asked which platforms it supports, it has no client
+	routes, err := routePlatforms(context.Background(), []*builderNode{node}, []string{"linux/arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 || routes[0].node != node {
+		t.Fatalf("expected every platform on the only node but got %v", routes)
+	}
+}
+
+func TestMergeNodeImages(t *testing.T) {
+	host := testRegistry(t)
+
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err = mutate.ConfigFile(image, &v1.ConfigFile{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(image, host+"/app:amd64"); err != nil {
+		t.Fatal(err)
+	}
+
+	index := testPushIndex(t, host+"/app:arm", v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := mergeNodeImages(context.Background(), host+"/app:1.0.0", RegistryAuth{}, []string{testDigestOf(t, image), indexDigest.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platforms, err := getPlatformDigests(context.Background(), host+"/app:1.0.0", RegistryAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(platforms) != 3 || platforms["linux/amd64"] != testDigestOf(t, image) {
+		t.Fatalf("expected the platforms of every node in the merged image but got %v", platforms)
+	}
+
+	tagged, err := crane.Digest(host + "/app:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tagged != merged {
+		t.Fatalf("expected the tag to point at %s but got %s", merged, tagged)
+	}
+}
+
+func TestEmulatedPlatforms(t *testing.T) {
+	node := &builderNode{name: defaultNodeName, listed: true, native: []string{"linux/amd64"}, emulated: []string{"linux/arm64", "linux/riscv64"}}
+
+	emulated, err := emulatedPlatforms(context.Background(), []nodeRoute{{node: node, platforms: []string{"linux/amd64", "linux/arm64", "linux/s390x"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(emulated, map[string]string{"linux/arm64": defaultNodeName}) {
+		t.Fatalf("expected only linux/arm64 to be emulated but got %v", emulated)
+	}
+
+	warnings := emulationDiagnostics(emulated, false)
+	if len(warnings) != 1 || warnings.HasError() {
+		t.Fatalf("expected a warning for the emulated platform but got %v", warnings)
+	}
+
+	if errors := emulationDiagnostics(emulated, true); !errors.HasError() {
+		t.Fatalf("expected an error when native builds are required but got %v", errors)
+	}
+}
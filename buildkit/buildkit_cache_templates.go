@@ -0,0 +1,57 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"strings"
+)
+
+// getImageCaches are the caches an image imports from and exports to. Those
+// of the image take precedence over the templates of the provider, which are
+// filled in with the registry and name of its first publish target.
+func getImageCaches(data *schema.ResourceData, provider TerraformProviderBuildkit) ([]client.CacheOptionsEntry, []client.CacheOptionsEntry) {
+	cache_from := getStringList(data, "cache_from")
+	cache_to := getStringList(data, "cache_to")
+
+	if len(cache_from) == 0 {
+		cache_from = expandCacheTemplates(provider.cache_from, data.Get("publish_target").([]interface{}))
+	}
+
+	if len(cache_to) == 0 {
+		cache_to = expandCacheTemplates(provider.cache_to, data.Get("publish_target").([]interface{}))
+	}
+
+	return parseCacheOptions(cache_from), parseCacheOptions(cache_to)
+}
+
+// expandCacheTemplates replaces `${registry}` and `${name}` in the templates
+// with the registry and name of the first publish target. Templates that use
+// them are left out for images that aren't published.
+func expandCacheTemplates(templates []string, publish_targets []interface{}) []string {
+	result := []string{}
+
+	for _, x := range templates {
+		if len(publish_targets) == 0 {
+			if !strings.Contains(x, "${registry}") && !strings.Contains(x, "${name}") {
+				result = append(result, x)
+			}
+			continue
+		}
+
+		target := publish_targets[0].(map[string]interface{})
+		result = append(result, strings.NewReplacer(
+			"${registry}", registryHost(target["registry_url"].(string)),
+			"${name}", strings.TrimPrefix(target["name"].(string), "/"),
+		).Replace(x))
+	}
+
+	return result
+}
+
+func parseCacheOptions(values []string) []client.CacheOptionsEntry {
+	result := make([]client.CacheOptionsEntry, 0, len(values))
+	for _, x := range values {
+		result = append(result, parseCacheOption(x))
+	}
+	return result
+}
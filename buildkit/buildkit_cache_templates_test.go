@@ -0,0 +1,49 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"testing"
+)
+
+func TestGetImageCaches(t *testing.T) {
+	provider := TerraformProviderBuildkit{
+		cache_from: []string{"type=registry,ref=${registry}/${name}:buildcache", "type=local,src=/tmp/cache"},
+		cache_to:   []string{"type=registry,ref=${registry}/${name}:buildcache,mode=max"},
+	}
+
+	published := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": "https://ghcr.io/", "name": "org/app", "tag": "1.0.0"},
+		},
+	}))
+
+	imports, exports := getImageCaches(published, provider)
+
+	if len(imports) != 2 || imports[0].Type != "registry" || imports[0].Attrs["ref"] != "ghcr.io/org/app:buildcache" || imports[1].Type != "local" {
+		t.Fatalf("expected the templates to be filled in: %+v", imports)
+	}
+	if len(exports) != 1 || exports[0].Attrs["ref"] != "ghcr.io/org/app:buildcache" || exports[0].Attrs["mode"] != "max" {
+		t.Fatalf("expected the templates to be filled in: %+v", exports)
+	}
+
+	unpublished := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"build_only":     true,
+		"publish_target": []interface{}{},
+	}))
+
+	imports, exports = getImageCaches(unpublished, provider)
+
+	if len(imports) != 1 || imports[0].Type != "local" || len(exports) != 0 {
+		t.Fatalf("expected the templates needing a publish target to be left out: %+v %+v", imports, exports)
+	}
+
+	overridden := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"cache_from": []interface{}{"ghcr.io/org/base:buildcache"},
+	}))
+
+	imports, exports = getImageCaches(overridden, provider)
+
+	if len(imports) != 1 || imports[0].Type != "registry" || imports[0].Attrs["ref"] != "ghcr.io/org/base:buildcache" || len(exports) != 1 {
+		t.Fatalf("expected the caches of the image to take precedence: %+v %+v", imports, exports)
+	}
+}
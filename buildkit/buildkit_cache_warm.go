@@ -0,0 +1,209 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var CacheEntryResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"type": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The type of cache (e.g. `registry`, `local` or `inline`).",
+		},
+		"attrs": {
+			Type:        schema.TypeMap,
+			Optional:    true,
+			Default:     map[string]string{},
+			Description: "The attributes of the cache, like `ref` and `mode` for a registry cache.",
+		},
+	},
+}
+
+func buildkitCacheWarmResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createCacheWarm,
+		ReadContext:   readCacheWarm,
+		UpdateContext: updateCacheWarm,
+		DeleteContext: deleteCacheWarm,
+		Description:   "Builds a Dockerfile without exporting an image so that the build cache of the daemon (and any exported caches) stay warm.",
+		Schema: map[string]*schema.Schema{
+			"context": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Path to the directory that should be used as the docker context.",
+			},
+			"dockerfile": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Path to the Dockerfile. For now this is expected to live somewhere within the context dir already.",
+			},
+			"platforms": {
+				Type:     schema.TypeSet,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Target platforms / architectures to warm the cache for.",
+			},
+			"target": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The stage of the Dockerfile to build. Defaults to the last stage.",
+			},
+			"args": {
+				Type:        schema.TypeMap,
+				Default:     map[string]string{},
+				Optional:    true,
+				Description: "Arguments that should be made available to the build. Used to set values for ARG commands in the Dockerfile.",
+			},
+			"secrets": {
+				Type:        schema.TypeMap,
+				Default:     map[string]string{},
+				Optional:    true,
+				Sensitive:   true,
+				Description: "A map of secrets in key => value form that will be made accessible to the build.",
+			},
+			"secrets_base64": {
+				Type:        schema.TypeMap,
+				Default:     map[string]string{},
+				Optional:    true,
+				Sensitive:   true,
+				Description: "A map of secrets in key => base64_encoded_value form that will be made accessible to the build.",
+			},
+			"forward_ssh_agent_socket": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should the host running Terraform make their ssh agent socket available to the build?",
+			},
+			"cache_export": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        CacheEntryResource,
+				Description: "Caches the build should be exported to, e.g. a registry cache shared by CI builders.",
+			},
+			"cache_import": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        CacheEntryResource,
+				Description: "Caches the build may import layers from.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the cache to be warmed again when any of the values change.",
+			},
+			"last_warmed": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The time (RFC 3339) the cache was last warmed at.",
+			},
+		},
+	}
+}
+
+func getCacheEntries(data *schema.ResourceData, key string) []client.CacheOptionsEntry {
+	entries := data.Get(key).([]interface{})
+	result := make([]client.CacheOptionsEntry, 0, len(entries))
+	for _, x := range entries {
+		casted := x.(map[string]interface{})
+		attrs := map[string]string{}
+		for k, v := range casted["attrs"].(map[string]interface{}) {
+			attrs[k] = v.(string)
+		}
+		result = append(result, client.CacheOptionsEntry{
+			Type:  casted["type"].(string),
+			Attrs: attrs,
+		})
+	}
+	return result
+}
+
+func createCacheWarm(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	buildContext := data.Get("context").(string)
+	dockerfile := data.Get("dockerfile").(string)
+	target := data.Get("target").(string)
+	provider := meta.(TerraformProviderBuildkit)
+	platforms := getPlatforms(data)
+	args := getBuildArgs(data)
+	sessionProviders, diags := getSessionProviders(data, provider)
+
+	if len(diags) > 0 {
+		return diags
+	}
+
+	cli := provider.buildkit_client
+
+	sharedKey, err := provider.sharedKey("")
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	frontendAttrs := merge(args, map[string]string{
+		"platform": strings.Join(platforms, ","),
+	})
+
+	if target != "" {
+		frontendAttrs["target"] = target
+	}
+
+	// there are no exports so only the build cache is populated
+	_, err = cli.Solve(ctx, nil, client.SolveOpt{
+		CacheExports:  getCacheEntries(data, "cache_export"),
+		CacheImports:  getCacheEntries(data, "cache_import"),
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		LocalDirs: map[string]string{
+			"context":    buildContext,
+			"dockerfile": filepath.Dir(dockerfile),
+		},
+		Session:   sessionProviders,
+		SharedKey: sharedKey,
+	}, nil)
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "warm the cache", err)}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("last_warmed", time.Now().UTC().Format(time.RFC3339))
+
+	return diag.Diagnostics{}
+}
+
+func readCacheWarm(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// warming only happens on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateCacheWarm(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createCacheWarm(ctx, data, meta)
+}
+
+func deleteCacheWarm(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
@@ -0,0 +1,46 @@
+package buildkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeContextFiles writes the files into the directory, replacing files with
+// the same path. Every path must stay within the directory, including through
+// the links of a context that was copied into it, since they could point
+// anywhere on the host running terraform.
+func writeContextFiles(directory string, files map[string]string) error {
+	for name, content := range files {
+		target := filepath.Join(directory, filepath.FromSlash(name))
+
+		if path.IsAbs(name) || filepath.IsAbs(name) || !strings.HasPrefix(target, directory+string(filepath.Separator)) {
+			return fmt.Errorf("the context file '%s' must be a relative path within the context", name)
+		}
+
+		for parent := filepath.Dir(target); parent != directory; parent = filepath.Dir(parent) {
+			if info, err := os.Lstat(parent); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("the context file '%s' is within a link of the context", name)
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// a link is replaced rather than written through
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		if err := ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package buildkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteContextFiles(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{"nginx.conf": "old", "html/index.html": "old"})
+
+	err := writeContextFiles(directory, map[string]string{
+		"nginx.conf":          "server {}",
+		"html/about/foo.html": "<p>foo</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"nginx.conf": "server {}", "html/about/foo.html": "<p>foo</p>", "html/index.html": "old"} {
+		content, err := ioutil.ReadFile(filepath.Join(directory, filepath.FromSlash(name)))
+		if err != nil || string(content) != expected {
+			t.Fatalf("expected %s to be %q but got %q %v", name, expected, content, err)
+		}
+	}
+}
+
+func TestWriteContextFilesStaysWithinTheContext(t *testing.T) {
+	outside := t.TempDir()
+	directory := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(directory, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(directory, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../escape.txt", "/etc/escape.txt", "linked/escape.txt"} {
+		if err := writeContextFiles(directory, map[string]string{name: "escaped"}); err == nil {
+			t.Fatalf("expected %s to be rejected", name)
+		}
+	}
+
+	if err := writeContextFiles(directory, map[string]string{"file.txt": "replaced"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "target.txt")); err == nil {
+		t.Fatal("expected the link to be replaced rather than written through")
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("expected nothing to be written outside of the context: %v", entries)
+	}
+}
@@ -0,0 +1,123 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractTarball unpacks the tarball, gzip compressed or not, into destination
+// and returns the digest of the tarball as it was read. The digest describes
+// exactly what was extracted, even when the file is replaced in the meantime.
+func extractTarball(tarball string, destination string) (string, error) {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(file, content))
+
+	var stream io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+		defer unzipped.Close()
+		stream = unzipped
+	}
+
+	archive := tar.NewReader(stream)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		target := filepath.Join(destination, filepath.FromSlash(header.Name))
+		if target != destination && !strings.HasPrefix(target, destination+string(filepath.Separator)) {
+			return "", fmt.Errorf("'%s' is outside of the tarball", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700)
+		case tar.TypeReg:
+			err = writeTarballFile(archive, target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		case tar.TypeLink:
+			source := filepath.Join(destination, filepath.FromSlash(header.Linkname))
+			if !strings.HasPrefix(source, destination+string(filepath.Separator)) {
+				return "", fmt.Errorf("'%s' links to '%s' outside of the tarball", header.Name, header.Linkname)
+			}
+			err = os.Link(source, target)
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// whatever follows the end of the archive is part of the file all the same
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(content.Sum(nil)), nil
+}
+
+func writeTarballFile(archive io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, archive); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// diffContextTarball plans the digest of the context tarball as unknown when
+// its contents changed, which rebuilds the image. The digest is only known
+// once the tarball is unpacked, since it can change between plan and apply.
+func diffContextTarball(diff *schema.ResourceDiff) error {
+	if !diff.NewValueKnown("context_tarball") {
+		return diff.SetNewComputed("context_tarball_digest")
+	}
+
+	digest := ""
+	if tarball := diff.Get("context_tarball").(string); tarball != "" {
+		var err error
+		// a tarball that doesn't exist yet is produced during the apply
+		if digest, err = fileDigest(tarball); err != nil {
+			return diff.SetNewComputed("context_tarball_digest")
+		}
+	}
+
+	if digest != diff.Get("context_tarball_digest").(string) {
+		return diff.SetNewComputed("context_tarball_digest")
+	}
+
+	return nil
+}
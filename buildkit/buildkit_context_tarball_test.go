@@ -0,0 +1,98 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTarball(t *testing.T, path string, compress bool, entries ...*tar.Header) {
+	content := bytes.Buffer{}
+	archive := tar.NewWriter(&content)
+	for _, x := range entries {
+		// regular files contain their own name
+		body := ""
+		if x.Typeflag == tar.TypeReg {
+			body = x.Name
+			x.Size = int64(len(body))
+		}
+		if err := archive.WriteHeader(x); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := content.Bytes()
+	if compress {
+		zipped := bytes.Buffer{}
+		writer := gzip.NewWriter(&zipped)
+		writer.Write(data)
+		writer.Close()
+		data = zipped.Bytes()
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTarball(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		tarball := filepath.Join(t.TempDir(), "context.tar.gz")
+		writeTarball(t, tarball, compress,
+			&tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "src/main.go", Typeflag: tar.TypeReg, Mode: 0644},
+			&tar.Header{Name: "run.sh", Typeflag: tar.TypeReg, Mode: 0755},
+			&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "run.sh"},
+		)
+
+		destination := t.TempDir()
+		digest, err := extractTarball(tarball, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, _ := fileDigest(tarball)
+		if digest != expected {
+			t.Fatalf("expected the digest of the whole tarball %s but got %s", expected, digest)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(destination, "src", "main.go"))
+		if err != nil || string(content) != "src/main.go" {
+			t.Fatalf("expected the file to be unpacked: %q %v", content, err)
+		}
+		if info, err := os.Stat(filepath.Join(destination, "run.sh")); err != nil || info.Mode().Perm()&0100 == 0 {
+			t.Fatalf("expected the file to stay executable: %v", err)
+		}
+		if link, err := os.Readlink(filepath.Join(destination, "link")); err != nil || link != "run.sh" {
+			t.Fatalf("expected the link to be unpacked: %s %v", link, err)
+		}
+	}
+}
+
+func TestExtractTarballOutsideOfDestination(t *testing.T) {
+	tarball := filepath.Join(t.TempDir(), "context.tar")
+	writeTarball(t, tarball, false, &tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644})
+
+	parent := t.TempDir()
+	destination := filepath.Join(parent, "context")
+	if err := os.Mkdir(destination, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := extractTarball(tarball, destination); err == nil {
+		t.Fatal("expected a file outside of the destination to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape.txt")); err == nil {
+		t.Fatal("expected nothing to be written outside of the destination")
+	}
+}
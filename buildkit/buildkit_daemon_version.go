@@ -0,0 +1,139 @@
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net/url"
+)
+
+// the version daemons that don't report their version are taken to have,
+// since the Info call was added to buildkit in v0.11
+const unreportedBuildkitVersion = "0.10.0"
+
+var errVersionUnreported = errors.New("the daemon doesn't report its version")
+
+// rawCodec sends and receives messages that are already encoded, for calls to
+// the daemon that the buildkit client this provider is built with doesn't
+// know about yet.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte{}, data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// daemonVersion asks the daemon at the address for its version, e.g.
+// `v0.12.5`, over a connection of its own.
+func daemonVersion(ctx context.Context, address string) (string, error) {
+	dialer, err := sessionContextDialer(address)
+	if err != nil {
+		return "", err
+	}
+
+	uri, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority(uri.Host),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	request := []byte{}
+	response := []byte{}
+	err = conn.Invoke(ctx, "/moby.buildkit.v1.Control/Info", &request, &response, grpc.ForceCodec(rawCodec{}))
+	if status.Code(err) == codes.Unimplemented {
+		return "", errVersionUnreported
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return parseInfoVersion(response)
+}
+
+// parseInfoVersion is the version of the buildkitVersion (1) of an
+// InfoResponse, which is the version (2) of a BuildkitVersion.
+func parseInfoVersion(response []byte) (string, error) {
+	buildkitVersion, err := protoField(response, 1)
+	if err != nil {
+		return "", err
+	}
+	result, err := protoField(buildkitVersion, 2)
+	if err != nil {
+		return "", err
+	}
+	if len(result) == 0 {
+		return "", errVersionUnreported
+	}
+	return string(result), nil
+}
+
+// protoField is the last value of the length delimited field of the message.
+func protoField(message []byte, field protowire.Number) ([]byte, error) {
+	var result []byte
+	for len(message) > 0 {
+		number, kind, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+		if number == field && kind == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(message)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			result = value
+			message = message[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(number, kind, message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+	}
+	return result, nil
+}
+
+// checkBuildkitVersion fails when the version of a daemon doesn't satisfy
+// the constraint. Release candidates and development builds are compared by
+// the release they lead up to.
+func checkBuildkitVersion(constraint string, daemon string) error {
+	constraints, err := version.NewConstraint(constraint)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := version.NewVersion(daemon)
+	if err != nil {
+		return fmt.Errorf("could not parse the version '%s' of the daemon: %w", daemon, err)
+	}
+
+	if !constraints.Check(parsed.Core()) {
+		return fmt.Errorf("the daemon is version %s, which doesn't satisfy the required_buildkit_version '%s'", daemon, constraint)
+	}
+
+	return nil
+}
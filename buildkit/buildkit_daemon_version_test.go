@@ -0,0 +1,86 @@
+package buildkit
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net"
+	"testing"
+)
+
+// testInfoResponse is an InfoResponse of a daemon with the version.
+func testInfoResponse(version string) []byte {
+	buildkitVersion := protowire.AppendTag(nil, 1, protowire.BytesType)
+	buildkitVersion = protowire.AppendString(buildkitVersion, "github.com/moby/buildkit")
+	buildkitVersion = protowire.AppendTag(buildkitVersion, 2, protowire.BytesType)
+	buildkitVersion = protowire.AppendString(buildkitVersion, version)
+	buildkitVersion = protowire.AppendTag(buildkitVersion, 3, protowire.BytesType)
+	buildkitVersion = protowire.AppendString(buildkitVersion, "0123456789abcdef")
+
+	response := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(response, buildkitVersion)
+}
+
+// testDaemon serves the Info call of the control api with the response, or
+// nothing at all when it is nil, and returns its address.
+func testDaemon(t *testing.T, response []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if response == nil || method != "/moby.buildkit.v1.Control/Info" {
+			return status.Error(codes.Unimplemented, method)
+		}
+		request := []byte{}
+		if err := stream.RecvMsg(&request); err != nil {
+			return err
+		}
+		return stream.SendMsg(&response)
+	}))
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestDaemonVersion(t *testing.T) {
+	daemon, err := daemonVersion(context.Background(), testDaemon(t, testInfoResponse("v0.12.5")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if daemon != "v0.12.5" {
+		t.Fatalf("expected v0.12.5 but got %s", daemon)
+	}
+
+	if _, err := daemonVersion(context.Background(), testDaemon(t, nil)); err != errVersionUnreported {
+		t.Fatalf("expected a daemon without the Info call to not report its version: %v", err)
+	}
+}
+
+func TestCheckBuildkitVersion(t *testing.T) {
+	for _, x := range []struct {
+		constraint string
+		daemon     string
+		ok         bool
+	}{
+		{">= 0.12", "v0.12.5", true},
+		{">= 0.12", "v0.13.0-rc1", true},
+		{">= 0.12", "v0.11.6", false},
+		{">= 0.12", unreportedBuildkitVersion, false},
+		{">= 0.9, < 0.13", "v0.12.0", true},
+	} {
+		if err := checkBuildkitVersion(x.constraint, x.daemon); (err == nil) != x.ok {
+			t.Fatalf("expected %s to satisfy %s: %v, got %v", x.daemon, x.constraint, x.ok, err)
+		}
+	}
+
+	if err := checkBuildkitVersion(">= 0.12", "v0.0.0+unknown"); err == nil {
+		t.Fatal("expected a development build to not satisfy the constraint")
+	}
+}
@@ -0,0 +1,98 @@
+package buildkit
+
+import (
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/sync/singleflight"
+	"sync"
+)
+
+// digestCache remembers what references resolved to for the lifetime of the
+// provider, which terraform starts anew for every plan and apply. Queries
+// resolve the same tag once per platform manifest and again for every
+// resource that reads it, so this saves most of those round trips. Lookups
+// of the same reference that happen at the same time are made only once.
+// Anything the provider writes to a reference must be forgotten. A nil cache
+// always asks the registry.
+type digestCache struct {
+	group   singleflight.Group
+	mutex   sync.Mutex
+	digests map[string]string
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{digests: map[string]string{}}
+}
+
+// digestKey normalizes the reference so that e.g. `alpine:3` and
+// `index.docker.io/library/alpine:3` share an entry.
+func digestKey(reference string) string {
+	parsed, err := name.ParseReference(canonicalImage(reference))
+	if err != nil {
+		return reference
+	}
+	return parsed.Name()
+}
+
+func (cache *digestCache) digest(reference string, options ...crane.Option) (string, error) {
+	if cache == nil {
+		return crane.Digest(reference, options...)
+	}
+
+	key := digestKey(reference)
+
+	cache.mutex.Lock()
+	digest, ok := cache.digests[key]
+	cache.mutex.Unlock()
+
+	if ok {
+		return digest, nil
+	}
+
+	result, err, _ := cache.group.Do(key, func() (interface{}, error) {
+		digest, err := crane.Digest(reference, options...)
+		if err != nil {
+			return "", err
+		}
+		cache.remember(reference, digest)
+		return digest, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+// remember records a digest that was learned some other way, e.g. from the
+// descriptor of a manifest that had to be fetched anyway.
+func (cache *digestCache) remember(reference string, digest string) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.digests[digestKey(reference)] = digest
+}
+
+// cached is the digest remembered for the reference, without asking the
+// registry when there is none.
+func (cache *digestCache) cached(reference string) (string, bool) {
+	if cache == nil {
+		return "", false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	digest, ok := cache.digests[digestKey(reference)]
+	return digest, ok
+}
+
+func (cache *digestCache) forget(reference string) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.digests, digestKey(reference))
+}
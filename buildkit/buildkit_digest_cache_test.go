@@ -0,0 +1,73 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDigestCache(t *testing.T) {
+	var manifests int32
+	inner := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodHead {
+			atomic.AddInt32(&manifests, 1)
+		}
+		inner.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	digest := testPushImage(t, host+"/app:1.0.0")
+	auth := RegistryAuth{digests: newDigestCache()}
+	ctx := context.Background()
+
+	var group sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			if actual, err := getRemoteImageHash(ctx, host+"/app:1.0.0", auth); err != nil || actual != digest {
+				t.Errorf("expected %s but got %s (%v)", digest, actual, err)
+			}
+		}()
+	}
+	group.Wait()
+
+	if actual := atomic.LoadInt32(&manifests); actual != 1 {
+		t.Fatalf("expected the digest to be looked up once but it was looked up %d times", actual)
+	}
+
+	// the tag is pushed to again, which the provider always forgets
+	moved := testPushImage(t, host+"/app:1.0.0")
+	auth.digests.forget(host + "/app:1.0.0")
+
+	if actual, err := getRemoteImageHash(ctx, host+"/app:1.0.0", auth); err != nil || actual != moved {
+		t.Fatalf("expected %s after the push but got %s (%v)", moved, actual, err)
+	}
+
+	if actual := atomic.LoadInt32(&manifests); actual != 2 {
+		t.Fatalf("expected the digest to be looked up again but it was looked up %d times", actual)
+	}
+}
+
+func TestDigestKey(t *testing.T) {
+	if digestKey("alpine:3") != digestKey("index.docker.io/library/alpine:3") {
+		t.Fatalf("expected short and qualified references to share a key")
+	}
+}
+
+func TestDigestKeyDockerHub(t *testing.T) {
+	for _, x := range []string{"nginx:1", "library/nginx:1", "docker.io/nginx:1", "registry-1.docker.io/library/nginx:1"} {
+		if digestKey(x) != digestKey("index.docker.io/library/nginx:1") {
+			t.Fatalf("expected %s to share the entry of index.docker.io/library/nginx:1", x)
+		}
+	}
+}
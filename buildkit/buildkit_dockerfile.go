@@ -0,0 +1,201 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"os"
+	"strings"
+)
+
+func buildkitDockerfileDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readDockerfileDataSource,
+		Schema: map[string]*schema.Schema{
+			"dockerfile": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Path to the Dockerfile that should be parsed.",
+			},
+			"stages": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the stage (as given by `FROM ... AS name`).",
+						},
+						"base_image": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The image (or earlier stage) the stage is built from.",
+						},
+						"platform": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The value of the `--platform` flag of the stage.",
+						},
+					},
+				},
+				Description: "The build stages in the order they are declared.",
+			},
+			"args": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the argument.",
+						},
+						"default": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The default value of the argument.",
+						},
+						"has_default": {
+							Type:        schema.TypeBool,
+							Computed:    true,
+							Description: "Whether the argument declares a default value. Arguments without one must be supplied by the build.",
+						},
+						"stage": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the stage that declares the argument. Empty for unnamed stages and for arguments declared before the first `FROM`, which `stage_index` tells apart.",
+						},
+						"stage_index": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The index within `stages` of the stage that declares the argument, or `-1` for arguments declared before the first `FROM`.",
+						},
+					},
+				},
+				Description: "The `ARG` instructions in the order they are declared.",
+			},
+			"exposed_ports": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The ports from the `EXPOSE` instructions of the last stage. Ports exposed by earlier stages, or by the images the last stage is built from, aren't included.",
+			},
+		},
+	}
+}
+
+func parseDockerfile(dockerfile string) (*Dockerfile, error) {
+	file, err := os.Open(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parsed, err := parser.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Dockerfile{Warnings: parsed.Warnings}
+
+	for _, node := range parsed.AST.Children {
+		switch strings.ToLower(node.Value) {
+		case "from":
+			stage := DockerfileStage{Line: node.StartLine}
+			if node.Next != nil {
+				stage.BaseImage = node.Next.Value
+				if as := node.Next.Next; as != nil && strings.EqualFold(as.Value, "as") && as.Next != nil {
+					stage.Name = as.Next.Value
+				}
+			}
+			for _, flag := range node.Flags {
+				if strings.HasPrefix(flag, "--platform=") {
+					stage.Platform = strings.TrimPrefix(flag, "--platform=")
+				}
+			}
+			result.Stages = append(result.Stages, stage)
+		case "arg":
+			stage, index := "", len(result.Stages)-1
+			if index >= 0 {
+				stage = result.Stages[index].Name
+			}
+			for x := node.Next; x != nil; x = x.Next {
+				name, value, found := strings.Cut(x.Value, "=")
+				result.Args = append(result.Args, DockerfileArg{
+					Name:       name,
+					Default:    strings.Trim(value, "\"'"),
+					HasDefault: found,
+					Stage:      stage,
+					StageIndex: index,
+				})
+			}
+		}
+		if len(result.Stages) > 0 && !strings.EqualFold(node.Value, "from") {
+			current := &result.Stages[len(result.Stages)-1]
+			current.Commands = append(current.Commands, node)
+		}
+	}
+
+	return result, nil
+}
+
+func readDockerfileDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	dockerfile := data.Get("dockerfile").(string)
+
+	parsed, err := parseDockerfile(dockerfile)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not parse the Dockerfile '%s'.", dockerfile),
+			Detail:   err.Error(),
+		}}
+	}
+
+	args := make([]interface{}, 0)
+	for _, x := range parsed.Args {
+		args = append(args, map[string]interface{}{
+			"name":        x.Name,
+			"default":     x.Default,
+			"has_default": x.HasDefault,
+			"stage":       x.Stage,
+			"stage_index": x.StageIndex,
+		})
+	}
+
+	stages := make([]interface{}, 0)
+	for _, x := range parsed.Stages {
+		stages = append(stages, map[string]interface{}{
+			"name":       x.Name,
+			"base_image": x.BaseImage,
+			"platform":   x.Platform,
+		})
+	}
+
+	exposedPorts := make([]interface{}, 0)
+	if len(parsed.Stages) > 0 {
+		for _, command := range parsed.Stages[len(parsed.Stages)-1].Commands {
+			if strings.EqualFold(command.Value, "expose") {
+				for x := command.Next; x != nil; x = x.Next {
+					exposedPorts = append(exposedPorts, x.Value)
+				}
+			}
+		}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("stages", stages)
+	data.Set("args", args)
+	data.Set("exposed_ports", exposedPorts)
+
+	return diag.Diagnostics{}
+}
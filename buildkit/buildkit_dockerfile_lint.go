@@ -0,0 +1,237 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"sort"
+	"strings"
+)
+
+const (
+	lintSeverityWarning = "warning"
+	lintSeverityError   = "error"
+)
+
+func buildkitDockerfileLintDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readDockerfileLintDataSource,
+		Schema: map[string]*schema.Schema{
+			"dockerfile": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Path to the Dockerfile that should be checked.",
+			},
+			"ignore_rules": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Names of rules that should not be reported.",
+			},
+			"warn": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether findings should also be reported as warning diagnostics during plan. Findings with severity `error` always fail the plan unless their rule is ignored.",
+			},
+			"findings": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"rule": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the rule that produced the finding.",
+						},
+						"message": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "A description of the problem.",
+						},
+						"line": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The line of the Dockerfile the finding refers to.",
+						},
+						"severity": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Either `warning` or `error`. Errors fail the plan.",
+						},
+					},
+				},
+				Description: "The problems found in the Dockerfile, ordered by line.",
+			},
+		},
+	}
+}
+
+func lintDockerfile(dockerfile *Dockerfile) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, w := range dockerfile.Warnings {
+		line := 0
+		if w.Location != nil {
+			line = w.Location.Start.Line
+		}
+		findings = append(findings, LintFinding{
+			Rule:     "ParserWarning",
+			Message:  w.Short,
+			Line:     line,
+			Severity: lintSeverityWarning,
+		})
+	}
+
+	stages := map[string]bool{}
+
+	for _, stage := range dockerfile.Stages {
+		if stage.Name != strings.ToLower(stage.Name) {
+			findings = append(findings, LintFinding{
+				Rule:     "StageNameCasing",
+				Message:  fmt.Sprintf("Stage name '%s' should be lowercase.", stage.Name),
+				Line:     stage.Line,
+				Severity: lintSeverityWarning,
+			})
+		}
+
+		if stage.Name != "" && stages[strings.ToLower(stage.Name)] {
+			findings = append(findings, LintFinding{
+				Rule:     "DuplicateStageName",
+				Message:  fmt.Sprintf("Stage name '%s' is already used by an earlier stage.", stage.Name),
+				Line:     stage.Line,
+				Severity: lintSeverityError,
+			})
+		}
+
+		if isUnpinnedBaseImage(stage.BaseImage, stages) {
+			findings = append(findings, LintFinding{
+				Rule:     "UnpinnedBaseImage",
+				Message:  fmt.Sprintf("Base image '%s' should be pinned to a specific tag or digest.", stage.BaseImage),
+				Line:     stage.Line,
+				Severity: lintSeverityWarning,
+			})
+		}
+
+		if stage.Name != "" {
+			stages[strings.ToLower(stage.Name)] = true
+		}
+
+		seen := map[string]bool{}
+
+		for _, command := range stage.Commands {
+			instruction := strings.ToLower(command.Value)
+
+			switch instruction {
+			case "maintainer":
+				findings = append(findings, LintFinding{
+					Rule:     "MaintainerDeprecated",
+					Message:  "The MAINTAINER instruction is deprecated, use a LABEL instead.",
+					Line:     command.StartLine,
+					Severity: lintSeverityWarning,
+				})
+			case "cmd", "entrypoint", "healthcheck":
+				if seen[instruction] {
+					findings = append(findings, LintFinding{
+						Rule:     "MultipleInstructionsDisallowed",
+						Message:  fmt.Sprintf("Multiple %s instructions in the same stage, only the last one will take effect.", strings.ToUpper(instruction)),
+						Line:     command.StartLine,
+						Severity: lintSeverityWarning,
+					})
+				}
+				seen[instruction] = true
+				if instruction != "healthcheck" && !command.Attributes["json"] {
+					findings = append(findings, LintFinding{
+						Rule:     "JSONArgsRecommended",
+						Message:  fmt.Sprintf("The %s instruction should use the JSON form so signals reach the process.", strings.ToUpper(instruction)),
+						Line:     command.StartLine,
+						Severity: lintSeverityWarning,
+					})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+
+	return findings
+}
+
+func isUnpinnedBaseImage(image string, stages map[string]bool) bool {
+	if image == "" || strings.EqualFold(image, "scratch") || stages[strings.ToLower(image)] {
+		return false
+	}
+	// images built from arguments can't be judged until the build
+	if strings.Contains(image, "$") || strings.Contains(image, "@") {
+		return false
+	}
+	tag, err := name.NewTag(image)
+	if err != nil {
+		return false
+	}
+	return tag.TagStr() == "latest"
+}
+
+func readDockerfileLintDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	dockerfile := data.Get("dockerfile").(string)
+	ignore_rules := getStringList(data, "ignore_rules")
+	warn := data.Get("warn").(bool)
+
+	parsed, err := parseDockerfile(dockerfile)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not parse the Dockerfile '%s'.", dockerfile),
+			Detail:   err.Error(),
+		}}
+	}
+
+	ignored := map[string]bool{}
+	for _, rule := range ignore_rules {
+		ignored[rule] = true
+	}
+
+	diagnostics := diag.Diagnostics{}
+	findings := make([]interface{}, 0)
+
+	for _, x := range lintDockerfile(parsed) {
+		if ignored[x.Rule] {
+			continue
+		}
+		findings = append(findings, map[string]interface{}{
+			"rule":     x.Rule,
+			"message":  x.Message,
+			"line":     x.Line,
+			"severity": x.Severity,
+		})
+		if x.Severity == lintSeverityError {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("%s:%d: %s", dockerfile, x.Line, x.Message),
+				Detail:   fmt.Sprintf("Reported by the %s rule, which can be added to ignore_rules.", x.Rule),
+			})
+		} else if warn {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Warning,
+				Summary:  fmt.Sprintf("%s:%d: %s", dockerfile, x.Line, x.Message),
+				Detail:   fmt.Sprintf("Reported by the %s rule.", x.Rule),
+			})
+		}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("findings", findings)
+
+	return diagnostics
+}
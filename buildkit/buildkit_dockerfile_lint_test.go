@@ -0,0 +1,116 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestLintDockerfile(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"Dockerfile": `
+FROM golang:1.18 AS Build
+MAINTAINER someone@example.com
+FROM alpine AS build
+COPY --from=Build /go/bin/app /app
+CMD /app
+CMD ["/app"]
+`,
+	})
+
+	parsed, err := parseDockerfile(filepath.Join(directory, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := make([]string, 0)
+	for _, x := range lintDockerfile(parsed) {
+		rules = append(rules, x.Rule)
+	}
+
+	expected := []string{
+		"StageNameCasing",
+		"MaintainerDeprecated",
+		"DuplicateStageName",
+		"UnpinnedBaseImage",
+		"JSONArgsRecommended",
+		"MultipleInstructionsDisallowed",
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Fatalf("expected %v but got %v", expected, rules)
+		}
+	}
+}
+
+func TestLintDockerfileAllowsPinnedImagesAndStages(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"Dockerfile": `
+ARG BASE=alpine
+FROM ${BASE} AS base
+FROM base AS final
+FROM scratch
+COPY --from=final / /
+ENTRYPOINT ["/app"]
+`,
+	})
+
+	parsed, err := parseDockerfile(filepath.Join(directory, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if findings := lintDockerfile(parsed); len(findings) > 0 {
+		t.Fatalf("expected no findings but got %v", findings)
+	}
+}
+
+func TestReadDockerfileLintFailsOnErrors(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"Dockerfile": `
+FROM alpine:3.15 AS build
+FROM alpine:3.15 AS build
+CMD /app
+`,
+	})
+	dockerfile := filepath.Join(directory, "Dockerfile")
+
+	for _, x := range []struct {
+		ignore   []interface{}
+		warn     bool
+		errors   int
+		warnings int
+	}{
+		{nil, false, 1, 0},
+		{nil, true, 1, 1},
+		{[]interface{}{"DuplicateStageName"}, true, 0, 1},
+	} {
+		data := schema.TestResourceDataRaw(t, buildkitDockerfileLintDataSource().Schema, map[string]interface{}{
+			"dockerfile":   dockerfile,
+			"ignore_rules": x.ignore,
+			"warn":         x.warn,
+		})
+
+		errors, warnings := 0, 0
+		for _, d := range readDockerfileLintDataSource(context.Background(), data, nil) {
+			if d.Severity == diag.Error {
+				errors++
+			} else {
+				warnings++
+			}
+		}
+
+		if errors != x.errors || warnings != x.warnings {
+			t.Fatalf("expected %d errors and %d warnings when ignoring %v but got %d and %d", x.errors, x.warnings, x.ignore, errors, warnings)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDockerfileDataSource(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"Dockerfile": `
+ARG VERSION=3.15
+FROM alpine:${VERSION} AS base
+ARG TARGET
+FROM --platform=linux/amd64 base
+ARG UNNAMED
+EXPOSE 80 443/tcp
+`,
+	})
+
+	data := schema.TestResourceDataRaw(t, buildkitDockerfileDataSource().Schema, map[string]interface{}{
+		"dockerfile": filepath.Join(directory, "Dockerfile"),
+	})
+
+	if diags := readDockerfileDataSource(context.Background(), data, nil); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("stages.#").(int) != 2 {
+		t.Fatalf("expected two stages but got %v", data.Get("stages"))
+	}
+	if data.Get("stages.0.name").(string) != "base" || data.Get("stages.1.platform").(string) != "linux/amd64" {
+		t.Fatalf("unexpected stages: %v", data.Get("stages"))
+	}
+	if data.Get("args.0.default").(string) != "3.15" || data.Get("args.1.has_default").(bool) {
+		t.Fatalf("unexpected args: %v", data.Get("args"))
+	}
+	if data.Get("args.1.stage").(string) != "base" || data.Get("args.1.stage_index").(int) != 0 {
+		t.Fatalf("expected TARGET to belong to the base stage: %v", data.Get("args"))
+	}
+	// a global arg and one of an unnamed stage are told apart by the index
+	if data.Get("args.0.stage_index").(int) != -1 || data.Get("args.2.stage").(string) != "" || data.Get("args.2.stage_index").(int) != 1 {
+		t.Fatalf("expected VERSION to be global and UNNAMED to belong to the second stage: %v", data.Get("args"))
+	}
+	if data.Get("exposed_ports.#").(int) != 2 {
+		t.Fatalf("unexpected exposed ports: %v", data.Get("exposed_ports"))
+	}
+}
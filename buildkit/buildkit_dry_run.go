@@ -0,0 +1,124 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// dryRunAttributes are the attributes of buildkit_image that a dry run needs
+// to know during the plan.
+var dryRunAttributes = []string{
+	"context",
+	"context_files",
+	"context_tarball",
+	"dockerfile",
+	"args",
+	"base_image",
+	"labels",
+	"platforms",
+	"forward_ssh_agent_socket",
+}
+
+// dryRunImage returns a build that only runs the dockerfile frontend, which
+// parses the Dockerfile, resolves its base images and checks its stages and
+// args, without running any of its steps or exporting anything.
+func dryRunImage(frontendAttrs map[string]string, frontendInputs map[string]llb.State) gateway.BuildFunc {
+	return func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		inputs, err := marshalFrontendInputs(ctx, frontendInputs)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := c.Solve(ctx, gateway.SolveRequest{
+			Frontend:       "dockerfile.v0",
+			FrontendOpt:    frontendAttrs,
+			FrontendInputs: inputs,
+		}); err != nil {
+			return nil, err
+		}
+
+		return gateway.NewResult(), nil
+	}
+}
+
+// diffDryRun validates the build of an image that will be built against the
+// daemon during the plan, when validate_on_plan is set, so that mistakes in
+// the Dockerfile fail the plan instead of an apply that already changed other
+// infrastructure. Images whose inputs are only known after apply, or whose
+// Dockerfile doesn't exist yet, are left to the apply.
+func diffDryRun(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if !diff.Get("validate_on_plan").(bool) {
+		return nil
+	}
+
+	if diff.Id() != "" && !hasImageInputChanges(diff) {
+		return nil
+	}
+
+	for _, x := range dryRunAttributes {
+		if !diff.NewValueKnown(x) {
+			return nil
+		}
+	}
+
+	dockerfile := diff.Get("dockerfile").(string)
+
+	if _, err := os.Stat(dockerfile); err != nil {
+		return nil
+	}
+
+	provider := meta.(TerraformProviderBuildkit)
+
+	// only the .dockerignore of the context is read, which a tarball or files
+	// written during the apply can't be checked for
+	buildContext := diff.Get("context").(string)
+
+	if buildContext == "" || diff.Get("context_tarball").(string) != "" {
+		empty, err := ioutil.TempDir("", "terraform-provider-buildkit-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(empty)
+		buildContext = empty
+	}
+
+	sshProvider, diags := getSSHProvider(getSSHAgents(diff))
+
+	if len(diags) > 0 {
+		return fmt.Errorf("%s", diags[0].Summary)
+	}
+
+	base_images, err := getBaseImageArgs(diff)
+
+	if err != nil {
+		return err
+	}
+
+	frontendAttrs := merge(getLabels(diff), getBuildArgs(diff), base_images, map[string]string{
+		"platform": strings.Join(getPlatforms(diff), ","),
+	})
+
+	solveOpt := client.SolveOpt{
+		LocalDirs: getLocalDirs(buildContext, dockerfile),
+		Session:   []session.Attachable{NewDockerAuthProvider(provider.registry_auth), sshProvider},
+	}
+
+	dryRunCtx, span := startSpan(ctx, provider.tracer(), "dry run")
+	_, err = provider.buildkit_client.Build(dryRunCtx, solveOpt, "terraform-provider-buildkit", dryRunImage(frontendAttrs, getContextInputs(buildContext)), nil)
+	span.end(err)
+
+	if err != nil {
+		failure := buildkitFailure(provider, "validate the build of the image", err)
+		return fmt.Errorf("%s\n\n%s", failure.Summary, failure.Detail)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"testing"
+)
+
+// testGatewayClient records the requests made to the frontend instead of
+// running them.
+type testGatewayClient struct {
+	gateway.Client
+	requests []gateway.SolveRequest
+}
+
+func (c *testGatewayClient) Solve(ctx context.Context, request gateway.SolveRequest) (*gateway.Result, error) {
+	c.requests = append(c.requests, request)
+	return gateway.NewResult(), nil
+}
+
+func TestDryRunImageOnlyRunsTheFrontend(t *testing.T) {
+	c := &testGatewayClient{}
+	attrs := map[string]string{"platform": "linux/amd64", "build-arg:VERSION": "1.0.0"}
+
+	result, err := dryRunImage(attrs, getContextInputs("git@localhost:org/repo.git#main"))(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.requests) != 1 || c.requests[0].Frontend != "dockerfile.v0" || c.requests[0].FrontendOpt["build-arg:VERSION"] != "1.0.0" {
+		t.Fatalf("expected a single request to the dockerfile frontend: %v", c.requests)
+	}
+	if c.requests[0].FrontendInputs["context"] == nil {
+		t.Fatal("expected the git context to be passed to the frontend")
+	}
+	if result.Ref != nil || len(result.Refs) > 0 {
+		t.Fatal("expected nothing to be built")
+	}
+}
+
+func TestDryRunSkipsUnknownInputs(t *testing.T) {
+	resource := buildkitImageResource()
+
+	// the daemon isn't contacted, which would fail without a provider
+	for _, x := range []map[string]interface{}{
+		{"validate_on_plan": false},
+		{"validate_on_plan": true, "context": testUnknown},
+		{"validate_on_plan": true, "dockerfile": testUnknown},
+		{"validate_on_plan": true, "dockerfile": "../examples/basic/Dockerfile.generated"},
+	} {
+		if _, err := resource.Diff(context.Background(), nil, terraform.NewResourceConfigRaw(testImageConfig(x)), nil); err != nil {
+			t.Fatalf("unexpected error for %v: %v", x, err)
+		}
+	}
+}
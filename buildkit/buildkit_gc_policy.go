@@ -0,0 +1,250 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/moby/buildkit/client"
+	"strconv"
+	"strings"
+)
+
+var GcPolicyResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"keep_storage_bytes": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			Description: "Stop pruning once the cache is no larger than this many bytes.",
+		},
+		"keep_duration": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "",
+			Description: "Only prune cache records that have not been used for this long (e.g. `48h`).",
+		},
+		"filters": {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+			Description: "Buildkit filters selecting the cache records the rule applies to (e.g. `type==exec.cachemount`).",
+		},
+		"all": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Whether the rule also applies to internal and frontend cache records.",
+		},
+	},
+}
+
+func buildkitGcPolicyResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createGcPolicy,
+		ReadContext:   readGcPolicy,
+		UpdateContext: updateGcPolicy,
+		DeleteContext: deleteGcPolicy,
+		CustomizeDiff: diffGcPolicy,
+		Description:   "A garbage collection policy for the build cache of the buildkit daemon, enforced on every apply.",
+		Schema: map[string]*schema.Schema{
+			"policy": {
+				Type:        schema.TypeList,
+				Required:    true,
+				MinItems:    1,
+				Elem:        GcPolicyResource,
+				Description: "The rules of the policy. They are applied in order, like the gc policy of buildkitd.",
+			},
+			"worker_type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "oci",
+				ValidateFunc: validation.StringInSlice([]string{"oci", "containerd"}, false),
+				Description:  "The worker (`oci` or `containerd`) the rendered `buildkitd_config` is for.",
+			},
+			"buildkitd_config": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The policy as `buildkitd.toml` configuration, so it can also be enforced by the daemon itself.",
+			},
+			"daemon_policy": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        GcPolicyResource,
+				Description: "The gc policy the buildkit daemon is configured with, as reported by its first worker.",
+			},
+			"reclaimed_bytes": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of bytes freed by the last apply.",
+			},
+			"pruned_records": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of cache records removed by the last apply.",
+			},
+		},
+	}
+}
+
+func getGcPolicies(data *schema.ResourceData) ([]client.PruneInfo, error) {
+	policies := data.Get("policy").([]interface{})
+	result := make([]client.PruneInfo, 0, len(policies))
+
+	for _, x := range policies {
+		casted := x.(map[string]interface{})
+
+		duration, err := parseKeepDuration(casted["keep_duration"].(string))
+		if err != nil {
+			return nil, err
+		}
+
+		filters := make([]string, 0)
+		for _, f := range casted["filters"].([]interface{}) {
+			filters = append(filters, f.(string))
+		}
+
+		result = append(result, client.PruneInfo{
+			Filter:       filters,
+			All:          casted["all"].(bool),
+			KeepDuration: duration,
+			KeepBytes:    int64(casted["keep_storage_bytes"].(int)),
+		})
+	}
+
+	return result, nil
+}
+
+func gcPoliciesToMaps(policies []client.PruneInfo) []interface{} {
+	result := make([]interface{}, 0, len(policies))
+	for _, x := range policies {
+		keep_duration := ""
+		if x.KeepDuration > 0 {
+			keep_duration = x.KeepDuration.String()
+		}
+		result = append(result, map[string]interface{}{
+			"keep_storage_bytes": int(x.KeepBytes),
+			"keep_duration":      keep_duration,
+			"filters":            x.Filter,
+			"all":                x.All,
+		})
+	}
+	return result
+}
+
+// renderGcPolicyConfig renders the policies the way buildkitd.toml expects
+// them, where durations are given in seconds.
+func renderGcPolicyConfig(workerType string, policies []client.PruneInfo) string {
+	builder := strings.Builder{}
+	for i, x := range policies {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(fmt.Sprintf("[[worker.%s.gcpolicy]]\n", workerType))
+		if x.All {
+			builder.WriteString("  all = true\n")
+		}
+		if x.KeepBytes > 0 {
+			builder.WriteString(fmt.Sprintf("  keepBytes = %d\n", x.KeepBytes))
+		}
+		if x.KeepDuration > 0 {
+			builder.WriteString(fmt.Sprintf("  keepDuration = %d\n", int64(x.KeepDuration.Seconds())))
+		}
+		if len(x.Filter) > 0 {
+			quoted := make([]string, len(x.Filter))
+			for j, f := range x.Filter {
+				quoted[j] = strconv.Quote(f)
+			}
+			builder.WriteString(fmt.Sprintf("  filters = [%s]\n", strings.Join(quoted, ", ")))
+		}
+	}
+	return builder.String()
+}
+
+func createGcPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	provider := meta.(TerraformProviderBuildkit)
+	worker_type := data.Get("worker_type").(string)
+	policies, err := getGcPolicies(data)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	cli := provider.buildkit_client
+
+	reclaimed := int64(0)
+	pruned := 0
+
+	for _, x := range policies {
+		bytes, records, err := pruneCache(ctx, cli, pruneInfoOptions(x))
+		if err != nil {
+			return diag.Diagnostics{buildkitFailure(provider, "prune the build cache", err)}
+		}
+
+		reclaimed += bytes
+		pruned += records
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("buildkitd_config", renderGcPolicyConfig(worker_type, policies))
+	data.Set("reclaimed_bytes", int(reclaimed))
+	data.Set("pruned_records", pruned)
+
+	return readGcPolicy(ctx, data, meta)
+}
+
+func readGcPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	provider := meta.(TerraformProviderBuildkit)
+
+	cli := provider.buildkit_client
+
+	workers, err := cli.ListWorkers(ctx)
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "list the workers", err)}
+	}
+
+	daemon_policy := make([]interface{}, 0)
+	if len(workers) > 0 {
+		daemon_policy = gcPoliciesToMaps(workers[0].GCPolicy)
+	}
+
+	data.Set("daemon_policy", daemon_policy)
+
+	return diag.Diagnostics{}
+}
+
+// diffGcPolicy always plans an update so that the policy is enforced on
+// every apply rather than only when its rules change.
+func diffGcPolicy(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if diff.Id() == "" {
+		return nil
+	}
+	if err := diff.SetNewComputed("reclaimed_bytes"); err != nil {
+		return err
+	}
+	return diff.SetNewComputed("pruned_records")
+}
+
+func updateGcPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createGcPolicy(ctx, data, meta)
+}
+
+func deleteGcPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
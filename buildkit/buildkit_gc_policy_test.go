@@ -0,0 +1,38 @@
+package buildkit
+
+import (
+	"github.com/moby/buildkit/client"
+	"testing"
+	"time"
+)
+
+func TestRenderGcPolicyConfig(t *testing.T) {
+	config := renderGcPolicyConfig("oci", []client.PruneInfo{
+		{Filter: []string{"type==source.local", "type==exec.cachemount"}, KeepDuration: 48 * time.Hour, KeepBytes: 512000000},
+		{All: true, KeepBytes: 1024000000},
+	})
+
+	expected := `[[worker.oci.gcpolicy]]
+  keepBytes = 512000000
+  keepDuration = 172800
+  filters = ["type==source.local", "type==exec.cachemount"]
+
+[[worker.oci.gcpolicy]]
+  all = true
+  keepBytes = 1024000000
+`
+
+	if config != expected {
+		t.Fatalf("expected\n%s\nbut got\n%s", expected, config)
+	}
+}
+
+func TestGcPolicyWorkerType(t *testing.T) {
+	validate := buildkitGcPolicyResource().Schema["worker_type"].ValidateFunc
+	if _, errs := validate("containerd", "worker_type"); len(errs) > 0 {
+		t.Fatalf("expected containerd to be valid: %v", errs)
+	}
+	if _, errs := validate("runc", "worker_type"); len(errs) == 0 {
+		t.Fatal("expected an unknown worker to be rejected when planning")
+	}
+}
@@ -0,0 +1,397 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+)
+
+// getDirectoryHash hashes the relative path, file type, executable bit and
+// contents of every file in the directory that isn't excluded by .dockerignore.
+// Timestamps, ownership and other metadata are deliberately left out so the
+// same content produces the same hash on any machine and in any fresh clone.
+// The directory may also be a single file, in which case it is hashed alone.
+func getDirectoryHash(query HashQuery) (string, map[string]string, diag.Diagnostics) {
+	directory, entries, diags := listHashEntries(query)
+	if len(diags) > 0 {
+		return "", nil, diags
+	}
+	cache := loadFileHashCache(query, directory)
+	if err := digestFiles(entries, runtime.NumCPU(), cache); err != nil {
+		return "", nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			},
+		}
+	}
+	// the cache is only an optimization so failing to write it doesn't fail the hash
+	_ = cache.save()
+	return combineHashEntries(entries)
+}
+
+// listHashEntries walks the directory and returns the absolute path of the
+// directory along with every file that takes part in its hash, in the order
+// they are hashed.
+func listHashEntries(query HashQuery) (string, []hashEntry, diag.Diagnostics) {
+	directory, _ := filepath.Abs(query.Directory)
+	stat, err := os.Stat(directory)
+	if err != nil {
+		return "", nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not open '%s'.", directory),
+				Detail:   err.Error(),
+			},
+		}
+	}
+	excludePatterns := []string{}
+	if stat.IsDir() {
+		excludePatterns, err = build.ReadDockerignore(directory)
+		if err != nil {
+			return "", nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Could not open .dockerignore file in directory '%s'.", directory),
+					Detail:   err.Error(),
+				},
+			}
+		}
+	}
+	matcher, err := fileutils.NewPatternMatcher(append(excludePatterns, query.Excludes...))
+	if err != nil {
+		return "", nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not parse the exclude patterns for directory '%s'.", directory),
+				Detail:   err.Error(),
+			},
+		}
+	}
+	includes, err := fileutils.NewPatternMatcher(query.Includes)
+	if err != nil {
+		return "", nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not parse the include patterns for directory '%s'.", directory),
+				Detail:   err.Error(),
+			},
+		}
+	}
+	entries := make([]hashEntry, 0)
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		if relative == "." {
+			if info.IsDir() {
+				return nil
+			}
+			relative = ""
+		} else {
+			excluded, err := matcher.MatchesOrParentMatches(relative)
+			if err != nil {
+				return err
+			}
+			if excluded {
+				if info.IsDir() && !matcher.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if len(query.Includes) > 0 {
+				included, err := includes.MatchesOrParentMatches(relative)
+				if err != nil || !included {
+					return err
+				}
+			}
+		}
+		entries = append(entries, hashEntry{path: path, relative: filepath.ToSlash(relative), info: info})
+		return nil
+	})
+	if err != nil {
+		return "", nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			},
+		}
+	}
+	return directory, entries, diag.Diagnostics{}
+}
+
+// combineHashEntries combines the entries in the order they were walked, so
+// the hash doesn't depend on which file finished first. Regular files must
+// already have the digest of their contents.
+func combineHashEntries(entries []hashEntry) (string, map[string]string, diag.Diagnostics) {
+	hash := sha256.New()
+	files := map[string]string{}
+	for _, entry := range entries {
+		if err := hashFile(hash, entry); err != nil {
+			return "", nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  err.Error(),
+				},
+			}
+		}
+		if entry.digest != "" {
+			files[entry.relative] = entry.digest
+		}
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), files, diag.Diagnostics{}
+}
+
+// getPathsHash hashes each path on its own and combines the results into one
+// hash. Paths and per-file hashes are keyed relative to the base, so the hash
+// doesn't depend on where the checkout is.
+func getPathsHash(base string, queries []HashQuery) (string, map[string]string, diag.Diagnostics) {
+	hash := sha256.New()
+	files := map[string]string{}
+	for _, query := range queries {
+		pathHash, pathFiles, diags := getDirectoryHash(query)
+		if len(diags) > 0 {
+			return "", nil, diags
+		}
+		location := portablePath(base, query.Directory)
+		fmt.Fprintf(hash, "%s\x00%s\x00", location, pathHash)
+		for k, v := range pathFiles {
+			files[path.Join(location, k)] = v
+		}
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), files, diag.Diagnostics{}
+}
+
+// portablePath is the target relative to the base with forward slashes. It
+// is only absolute when it can't be made relative, e.g. on another drive.
+func portablePath(base string, target string) string {
+	if relative, err := relativePath(base, target); err == nil {
+		return filepath.ToSlash(relative)
+	}
+	return filepath.ToSlash(target)
+}
+
+// addDockerfileHash folds the dockerfile's location and contents into an
+// existing hash so that switching or editing the dockerfile changes it even
+// when the dockerfile lives outside of the context. The location is relative
+// to the context, or to the working directory when there is none.
+func addDockerfileHash(hash string, files map[string]string, context string, dockerfile string) (string, diag.Diagnostics) {
+	_, dockerfileFiles, diags := getDirectoryHash(HashQuery{Directory: dockerfile})
+	if len(diags) > 0 {
+		return "", diags
+	}
+	if context == "" {
+		context = "."
+	}
+	location := portablePath(context, dockerfile)
+	combined := sha256.New()
+	fmt.Fprintf(combined, "%s\x00%s\x00%s\x00", hash, location, dockerfileFiles[""])
+	files[location] = dockerfileFiles[""]
+	return "sha256:" + hex.EncodeToString(combined.Sum(nil)), diag.Diagnostics{}
+}
+
+// relativePath is the path of target relative to base. Both are made absolute
+// first, since either can be relative to the working directory, and on windows
+// a path relative to a drive like `C:\src` can't be made relative to one that
+// isn't.
+func relativePath(base string, target string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(base, target)
+}
+
+// hashEntry is a file found while walking a directory. The digest of its
+// contents is filled in by digestFiles.
+type hashEntry struct {
+	path     string
+	relative string
+	info     os.FileInfo
+	digest   string
+}
+
+// hashKind describes the type of the file along with its executable bit.
+func hashKind(info os.FileInfo) string {
+	if info.IsDir() {
+		return "d"
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		return "l"
+	} else if info.Mode()&0111 != 0 {
+		return "x"
+	}
+	return "f"
+}
+
+// digestFiles reads and hashes the contents of every regular file using a
+// pool of workers, since that dominates the time it takes to hash large
+// directories. Files found in the cache aren't read at all.
+func digestFiles(entries []hashEntry, concurrency int, cache *fileHashCache) error {
+	return forEach(context.Background(), concurrency, len(entries), func(ctx context.Context, i int) error {
+		switch hashKind(entries[i].info) {
+		case "f", "x":
+			digest, err := cache.digest(entries[i])
+			if err != nil {
+				return err
+			}
+			entries[i].digest = digest
+		}
+		return nil
+	})
+}
+
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	content := sha256.New()
+	if _, err = io.Copy(content, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(content.Sum(nil)), nil
+}
+
+// hashFile writes an entry for the file into hash. Regular files must
+// already have the digest of their contents.
+func hashFile(hash io.Writer, entry hashEntry) error {
+	kind := hashKind(entry.info)
+
+	fmt.Fprintf(hash, "%s\x00%s\x00", entry.relative, kind)
+
+	switch kind {
+	case "l":
+		target, err := os.Readlink(entry.path)
+		if err != nil {
+			return err
+		}
+		// windows reports targets with backslashes, which would change the hash
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(target))
+	case "f", "x":
+		fmt.Fprintf(hash, "%s\x00", entry.digest)
+	}
+
+	return nil
+}
+
+// snapshotDirectory copies every file that takes part in the hash of the
+// directory into destination and returns the hash of what was copied. Digests
+// are computed from the bytes as they are copied, so the hash describes the
+// snapshot even when the directory changes in the meantime, and matches the
+// hash of the directory for as long as it doesn't.
+func snapshotDirectory(query HashQuery, destination string) (string, diag.Diagnostics) {
+	directory, entries, diags := listHashEntries(query)
+	if len(diags) > 0 {
+		return "", diags
+	}
+
+	// directories and links are created up front so that files can be copied in any order
+	err := func() error {
+		for i, entry := range entries {
+			if entry.relative == "" {
+				return fmt.Errorf("'%s' is not a directory", directory)
+			}
+			target := filepath.Join(destination, filepath.FromSlash(entry.relative))
+			switch hashKind(entry.info) {
+			case "d":
+				if err := os.MkdirAll(target, entry.info.Mode().Perm()|0700); err != nil {
+					return err
+				}
+			case "l":
+				link, err := os.Readlink(entry.path)
+				if err != nil {
+					return err
+				}
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+					return err
+				}
+				if err := os.Symlink(link, target); err != nil {
+					return err
+				}
+			}
+			entries[i].path = target
+		}
+		return nil
+	}()
+
+	if err == nil {
+		err = forEach(context.Background(), runtime.NumCPU(), len(entries), func(ctx context.Context, i int) error {
+			switch hashKind(entries[i].info) {
+			case "f", "x":
+				source := filepath.Join(directory, filepath.FromSlash(entries[i].relative))
+				digest, err := copyFile(source, entries[i].path, entries[i].info.Mode().Perm())
+				if err != nil {
+					return err
+				}
+				entries[i].digest = digest
+			}
+			return nil
+		})
+	}
+
+	if err != nil {
+		return "", diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not snapshot '%s'.", directory),
+				Detail:   err.Error(),
+			},
+		}
+	}
+
+	hash, _, diags := combineHashEntries(entries)
+	return hash, diags
+}
+
+// copyFile copies the file and returns the digest of the bytes that were copied.
+func copyFile(source string, destination string, mode os.FileMode) (string, error) {
+	input, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return "", err
+	}
+
+	output, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return "", err
+	}
+
+	content := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(output, content), input); err != nil {
+		output.Close()
+		return "", err
+	}
+
+	if err := output.Close(); err != nil {
+		return "", err
+	}
+
+	// the mode given to OpenFile is subject to the umask
+	if err := os.Chmod(destination, mode); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(content.Sum(nil)), nil
+}
@@ -0,0 +1,131 @@
+package buildkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileHashCache remembers the digests of the files of a directory between
+// runs so that files whose size and modification time haven't changed don't
+// have to be read again. A nil cache always reads the files.
+type fileHashCache struct {
+	path     string
+	started  time.Time
+	mutex    sync.Mutex
+	previous map[string]FileHashCacheEntry
+	current  map[string]FileHashCacheEntry
+}
+
+// loadFileHashCache reads the cache of the query from the cache directory. Each
+// combination of directory and patterns gets its own file so that queries
+// over the same directory don't evict each other's entries.
+func loadFileHashCache(query HashQuery, directory string) *fileHashCache {
+	if query.CacheDirectory == "" {
+		return nil
+	}
+
+	key := sha256.New()
+	fmt.Fprintf(key, "%s\x00%s\x00%s\x00", directory, strings.Join(query.Excludes, "\x00"), strings.Join(query.Includes, "\x00"))
+
+	cache := &fileHashCache{
+		path:     filepath.Join(query.CacheDirectory, hex.EncodeToString(key.Sum(nil))+".json"),
+		started:  time.Now(),
+		previous: map[string]FileHashCacheEntry{},
+		current:  map[string]FileHashCacheEntry{},
+	}
+
+	// a missing or corrupt cache just means every file is read again
+	if content, err := ioutil.ReadFile(cache.path); err == nil {
+		if err := json.Unmarshal(content, &cache.previous); err != nil {
+			cache.previous = map[string]FileHashCacheEntry{}
+		}
+	}
+
+	return cache
+}
+
+// digest returns the digest of the contents of the entry, reading the file
+// only when the cache has no entry for its current size and modification time.
+func (cache *fileHashCache) digest(entry hashEntry) (string, error) {
+	if cache == nil {
+		return fileDigest(entry.path)
+	}
+
+	expected := FileHashCacheEntry{
+		Size:    entry.info.Size(),
+		ModTime: entry.info.ModTime().UnixNano(),
+	}
+
+	cache.mutex.Lock()
+	cached, ok := cache.previous[entry.relative]
+	cache.mutex.Unlock()
+
+	if ok && cached.Size == expected.Size && cached.ModTime == expected.ModTime {
+		cache.remember(entry.relative, cached)
+		return cached.Digest, nil
+	}
+
+	digest, err := fileDigest(entry.path)
+	if err != nil {
+		return "", err
+	}
+
+	// a file modified right before it was read could be modified again without
+	// its modification time changing, so it isn't trusted until a later run
+	if entry.info.ModTime().Before(cache.started.Add(-time.Second)) {
+		expected.Digest = digest
+		cache.remember(entry.relative, expected)
+	}
+
+	return digest, nil
+}
+
+func (cache *fileHashCache) remember(relative string, entry FileHashCacheEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.current[relative] = entry
+}
+
+// save writes the entries of the files seen during this run, which drops the
+// entries of files that no longer exist. The file is replaced atomically so
+// concurrent runs never see a partially written cache.
+func (cache *fileHashCache) save() error {
+	if cache == nil {
+		return nil
+	}
+
+	content, err := json.Marshal(cache.current)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cache.path), 0755); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(cache.path), ".hashes-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), cache.path)
+}
@@ -0,0 +1,64 @@
+package buildkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHashCache(t *testing.T) {
+	directory, cacheDirectory := t.TempDir(), t.TempDir()
+	writeFiles(t, directory, map[string]string{"main.go": "package main", "README.md": "hello"})
+
+	file := filepath.Join(directory, "main.go")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	query := HashQuery{Directory: directory, CacheDirectory: cacheDirectory}
+
+	uncached, _, _ := getDirectoryHash(HashQuery{Directory: directory})
+	first, _, diags := getDirectoryHash(query)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if first != uncached {
+		t.Fatalf("expected the cache not to change the hash")
+	}
+
+	written, err := ioutil.ReadDir(cacheDirectory)
+	if err != nil || len(written) != 1 {
+		t.Fatalf("expected a single cache file but got %v (%v)", written, err)
+	}
+
+	// same size and modification time, so the cached digest is used without reading the file
+	writeFiles(t, directory, map[string]string{"main.go": "package test"})
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	second, files, _ := getDirectoryHash(query)
+	if second != first {
+		t.Fatalf("expected the cached digest of main.go to be used")
+	}
+
+	// README.md was modified too recently to be trusted so it is read every time
+	writeFiles(t, directory, map[string]string{"README.md": "HELLO"})
+	third, changed, _ := getDirectoryHash(query)
+	if third == second || changed["README.md"] == files["README.md"] {
+		t.Fatalf("expected a recently modified file to be read again")
+	}
+
+	// a new modification time invalidates the entry
+	if err := os.Chtimes(file, old.Add(time.Minute), old.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	fourth, _, _ := getDirectoryHash(query)
+	fresh, _, _ := getDirectoryHash(HashQuery{Directory: directory})
+	if fourth != fresh {
+		t.Fatalf("expected a changed modification time to invalidate the cache")
+	}
+}
@@ -2,8 +2,42 @@ package buildkit
 
 import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
+const (
+	deleteStrategyNone           = "none"
+	deleteStrategyUntag          = "untag"
+	deleteStrategyDeleteManifest = "delete_manifest"
+)
+
+// imageNonBuildAttributes are the attributes of buildkit_image that don't
+// change what is built or where it is published, so changing them only
+// updates the state.
+var imageNonBuildAttributes = map[string]bool{
+	"build_retries":            true,
+	"cache_from":               true,
+	"cache_to":                 true,
+	"delete_strategy":          true,
+	"detect_label_drift":       true,
+	"metadata_file":            true,
+	"mount_blobs":              true,
+	"publish_lock":             true,
+	"require_native":           true,
+	"resolve_platform_digests": true,
+	"shared_key":               true,
+	"validate_on_plan":         true,
+	"verify_consistency":       true,
+	"verify_pull":              true,
+}
+
+// imageInputDigests are the computed attributes of buildkit_image that track
+// the contents of its inputs, so that a change of the contents rebuilds the
+// image even though the configuration stays the same.
+var imageInputDigests = map[string]bool{
+	"context_tarball_digest": true,
+}
+
 var PublishTargetResource = &schema.Resource{
 	Schema: map[string]*schema.Schema{
 		"registry_url": {
@@ -21,17 +55,170 @@ var PublishTargetResource = &schema.Resource{
 			Required:    true,
 			Description: "The tag you want to publish this particular build as.",
 		},
+		"platforms": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Description: "The platforms of the image to publish to this target, e.g. only `linux/amd64` to a registry that doesn't accept multi-platform images. Every platform is published when empty. A single platform is published as the image of that platform rather than an index. Targets limited to some of the platforms are copied from a target that publishes every platform once it is pushed, of which there has to be at least one.",
+		},
 		"tag_url": {
 			Type:        schema.TypeString,
 			Computed:    true,
-			ForceNew:    true,
-			Description: "The tag you want to publish this particular build as.",
+			Description: "The tag-based url the image was published as.",
 		},
 		"digest_url": {
 			Type:        schema.TypeString,
 			Computed:    true,
-			ForceNew:    true,
-			Description: "The tag you want to publish this particular build as.",
+			Description: "The hash-based url of the published image. You should prefer this when you need to point to the exact image.",
+		},
+		"digest": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "The digest the tag points at, without the registry and repository of `digest_url`.",
+		},
+		"platform_digests": {
+			Type:        schema.TypeMap,
+			Computed:    true,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Description: "The digest of the image of each platform the tag points at, e.g. `platform_digests[\"linux/arm64\"]`, which is what a runtime on that platform pulls. Only set when the image has `resolve_platform_digests` enabled.",
+		},
+		"also_tag_latest": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Should `latest_tag` be moved to the image as well whenever it is published? The alias is moved by putting the manifest under it, so it never points at a partially published image. It is published again when it is gone from the registry, but it is left alone when something else moved it since.",
+		},
+		"latest_tag": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "latest",
+			Description: "The alias that `also_tag_latest` moves to the image, e.g. `stable`.",
+		},
+		"latest_tag_url": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "The url of the alias the image was published as, when `also_tag_latest` is set.",
+		},
+		"platform_tags": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Should the image of each platform also be published under the tag suffixed with the platform, e.g. `1.2.3-amd64` and `1.2.3-arm64` for `1.2.3`, for deployment tools and older orchestrators that can't pull from a multi-platform index? The suffix is the architecture and its variant, e.g. `armv7` for `linux/arm/v7`, prefixed with the os for other operating systems than linux, e.g. `windows-amd64`. The tags are published again when any of them is gone from the registry.",
+		},
+		"platform_tag_urls": {
+			Type:        schema.TypeMap,
+			Computed:    true,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Description: "The url of the tag the image of each platform was published as, e.g. `platform_tag_urls[\"linux/arm64\"]`, when `platform_tags` is set.",
+		},
+	},
+}
+
+var SecretResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"id": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The id the secret is mounted by, as in `RUN --mount=type=secret,id=...`.",
+		},
+		"value": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Default:     "",
+			Description: "The value of the secret.",
+		},
+		"value_base64": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Default:     "",
+			Description: "The base64 encoded value of the secret, for binary secrets.",
+		},
+		"mode": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "",
+			Description: "The octal file mode the secret is mounted with, e.g. `0400`, unless the mount sets one itself. Buildkit mounts secrets with `0400` by default.",
+		},
+		"uid": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			Description: "The id of the user that owns the mounted secret, unless the mount sets one itself.",
+		},
+		"gid": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+			Description: "The id of the group that owns the mounted secret, unless the mount sets one itself.",
+		},
+	},
+}
+
+var PublishLockResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"url": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "",
+			Description: "The url of a lock service to lock the publish targets with instead of a sentinel tag, e.g. one that also locks the state of Terraform's http backend. Each tag is locked with a `LOCK` request to the url with the tag as its `tag` query parameter, which succeeds with `200` or reports that the tag is locked by someone else with `409` or `423`, and unlocked with an `UNLOCK` request.",
+		},
+		"timeout": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "10m",
+			Description: "How long to wait for a publish target that is locked by someone else before giving up, e.g. `30m`.",
+		},
+		"ttl": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "1h",
+			Description: "How long a sentinel tag locks its publish target without being extended, after which it is taken over, e.g. when the run that held it was killed. It is extended every third of the ttl while the image is built and published.",
+		},
+	},
+}
+
+var BaseImageResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"resource_digest": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The digest of the base image, e.g. `buildkit_image.base.image_digest` along with `repository`, or its digest url, e.g. `buildkit_image.base.image_ref`.",
+		},
+		"repository": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "",
+			Description: "The repository the base image is pulled from, e.g. `ghcr.io/org/base`. Required unless `resource_digest` is a digest url.",
+		},
+		"build_arg": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "The build argument the Dockerfile takes the base image from, e.g. `BASE_IMAGE` for `ARG BASE_IMAGE` and `FROM ${BASE_IMAGE}`. Takes precedence over a build argument of the same name in `args`.",
+		},
+	},
+}
+
+var SbomResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"generator": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "",
+			Description: "The image of the SBOM generator, e.g. a pinned `docker/buildkit-syft-scanner:1.0.0@sha256:...`, so that every image has its SBOM generated by the exact same tool. Uses the `sbom_generator` of the provider when empty, or else the default scanner of the buildkit daemon.",
+		},
+		"scan_context": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Should the build context be scanned as well as the image, e.g. to include the dependencies of source files that aren't part of the image?",
+		},
+		"scan_stages": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Should every stage of the Dockerfile be scanned as well as the final one, e.g. to include what was used to compile the image?",
 		},
 	},
 }
@@ -69,6 +256,37 @@ var ImageResource = &schema.Resource{
 			Computed:    true,
 			Description: "Platform that is supported by this image.",
 		},
+		"variant": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "The variant of the cpu architecture of the image, e.g. `v8` for `linux/arm64`, if any.",
+		},
+		"os_version": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "The version of the operating system the image requires, e.g. `10.0.17763.2114` for windows images, if any.",
+		},
+		"created": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "The RFC3339 timestamp of when the image was built.",
+		},
+		"attestations": {
+			Type:        schema.TypeList,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Computed:    true,
+			Description: "The in-toto predicate types of the attestations attached to the image.",
+		},
+		"has_provenance": {
+			Type:        schema.TypeBool,
+			Computed:    true,
+			Description: "Whether a SLSA provenance attestation is attached to the image.",
+		},
+		"has_sbom": {
+			Type:        schema.TypeBool,
+			Computed:    true,
+			Description: "Whether an SBOM attestation is attached to the image.",
+		},
 	},
 }
 
@@ -77,15 +295,51 @@ func buildkitDirectoryHashDataSource() *schema.Resource {
 		ReadContext: readDirectoryHashDataSource,
 		Schema: map[string]*schema.Schema{
 			"context": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				AtLeastOneOf: []string{"context", "paths"},
+				Description:  "Path to the directory that should be used as the docker context.",
+			},
+			"paths": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Additional files or directories that should be hashed along with the context. Each directory honors its own .dockerignore file.",
+			},
+			"dockerfile": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Path to the directory that should be used as the docker context.",
+				Optional:    true,
+				Description: "Path to the Dockerfile used for the build. Its location and contents are included in the hash even when it lives outside of the context.",
+			},
+			"excludes": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Additional patterns (using .dockerignore syntax) of files that should be left out of the hash.",
+			},
+			"includes": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Patterns (using .dockerignore syntax) of files that should be hashed. When set, all other files are left out of the hash.",
 			},
 			"hash": {
 				Type:        schema.TypeString,
 				Computed:    true,
 				Description: "The hash of the directory, excluding any .dockerignore files.",
 			},
+			"files": {
+				Type:        schema.TypeMap,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Computed:    true,
+				Description: "The sha256 hash of every file that contributed to `hash`, keyed by their path relative to `context` (or to the root module, when there is none). Useful for finding out which file changed.",
+			},
 		},
 	}
 }
@@ -98,7 +352,28 @@ func buildkitImagesDataSource() *schema.Resource {
 				Type:        schema.TypeBool,
 				Default:     true,
 				Optional:    true,
-				Description: "Should all images be returned that match the criteria or only the most recent which matches?",
+				Description: "Should all images be returned that match the criteria or only the most recent which matches? Images built at the same time are ordered by the version of their tags and then by their platform, so the same image is selected between plans.",
+			},
+			"most_recent_n": {
+				Type:          schema.TypeInt,
+				Default:       0,
+				Optional:      true,
+				ConflictsWith: []string{"most_recent_only"},
+				Description:   "Return only the N most recent images which match the criteria, instead of only the most recent. Conflicts with `most_recent_only`.",
+			},
+			"sort_by": {
+				Type:         schema.TypeString,
+				Default:      "",
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"", "created", "tag_semver", "tag_lexical"}, false),
+				Description:  "What the images are ordered by, which decides what the most recent images are. Either `created` for when they were built, `tag_semver` for the version of their tag or `tag_lexical` for their tag as a string. Tags that aren't versions are lower than any version. Images with the same tag, e.g. the platforms of an index, are ordered by when they were built. Defaults to `tag_semver` when `version_constraint` is set and `created` otherwise.",
+			},
+			"order": {
+				Type:         schema.TypeString,
+				Default:      "desc",
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"asc", "desc"}, false),
+				Description:  "Either `desc` to return the highest images by `sort_by` first, or `asc` to return the lowest first. The most recent images are the first ones in this order.",
 			},
 			"images": {
 				Type:        schema.TypeList,
@@ -106,6 +381,18 @@ func buildkitImagesDataSource() *schema.Resource {
 				Elem:        ImageResource,
 				Description: "The image results of your query.",
 			},
+			"images_by_tag": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The digest url (e.g. `docker.io/org/app@sha256:...`) each tag of the results points at, keyed by tag. For an index this is the digest of the index, which covers every platform.",
+			},
+			"digests_by_platform": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The digest of the manifest of each platform (e.g. `linux/amd64` or `linux/arm64/v8`), keyed by platform. When the results have more than one tag, the digest of each platform is that of the first result in their order, i.e. the most recent one.",
+			},
 			"registry_url": {
 				Type:        schema.TypeString,
 				Required:    true,
@@ -117,10 +404,18 @@ func buildkitImagesDataSource() *schema.Resource {
 				Description: "The repository name you want to search.",
 			},
 			"tag_pattern": {
-				Type:        schema.TypeString,
-				Default:     "/.*/",
-				Optional:    true,
-				Description: "A regex pattern you want to filter tags by.",
+				Type:         schema.TypeString,
+				Default:      "/.*/",
+				Optional:     true,
+				ValidateFunc: validateTagPattern,
+				Description:  "A regex pattern you want to filter tags by.",
+			},
+			"version_constraint": {
+				Type:         schema.TypeString,
+				Default:      "",
+				Optional:     true,
+				ValidateFunc: validateVersionConstraint,
+				Description:  "A version constraint (e.g. `~> 1.4`) you want to filter tags by. Tags that aren't valid semantic versions are excluded and results are ordered from the highest version to the lowest, unless `sort_by` says otherwise.",
 			},
 			"labels": {
 				Type:        schema.TypeMap,
@@ -128,6 +423,43 @@ func buildkitImagesDataSource() *schema.Resource {
 				Optional:    true,
 				Description: "Required label keys / values to filter the returned images by.",
 			},
+			"created_after": {
+				Type:        schema.TypeString,
+				Default:     "",
+				Optional:    true,
+				Description: "An RFC3339 timestamp. Only images built after this time are returned.",
+			},
+			"created_before": {
+				Type:        schema.TypeString,
+				Default:     "",
+				Optional:    true,
+				Description: "An RFC3339 timestamp. Only images built before this time are returned.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Default:     "",
+				Optional:    true,
+				Description: "Only return images whose tag currently points at this digest (e.g. `sha256:...`), or whose platform manifest or config has it. Useful for finding every tag of a particular image.",
+			},
+			"max_concurrency": {
+				Type:         schema.TypeInt,
+				Default:      8,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "The maximum number of concurrent requests made to the registry while inspecting tags.",
+			},
+			"page_size": {
+				Type:        schema.TypeInt,
+				Default:     0,
+				Optional:    true,
+				Description: "The number of tags to request per page when listing the repository. Uses the registry default when zero. When tags are inspected in the order the registry lists them, no more pages are requested once `max_tags` matching tags were listed.",
+			},
+			"max_tags": {
+				Type:        schema.TypeInt,
+				Default:     0,
+				Optional:    true,
+				Description: "The maximum number of matching tags to inspect. When `version_constraint` is set the highest versions are inspected first, when the images are sorted by their tags the first tags in that order are, otherwise tags are inspected in the order the registry lists them. Unlimited when zero.",
+			},
 			"supported_platforms": {
 				Type:     schema.TypeSet,
 				Required: true,
@@ -135,7 +467,360 @@ func buildkitImagesDataSource() *schema.Resource {
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
-				Description: "Required platforms that must be supported by the returned images.",
+				Description: "Required platforms that must be supported by the returned images, e.g. `linux/amd64`, `linux/arm/v7` or `windows(10.0.17763)/amd64`. A variant or os version that is left out matches any.",
+			},
+		},
+	}
+}
+
+func buildkitRepositoryTagsDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readRepositoryTagsDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url you want to search.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name you want to list tags for.",
+			},
+			"page_size": {
+				Type:        schema.TypeInt,
+				Default:     0,
+				Optional:    true,
+				Description: "The number of tags to request per page when listing the repository. Uses the registry default when zero.",
+			},
+			"tag_pattern": {
+				Type:         schema.TypeString,
+				Default:      "/.*/",
+				Optional:     true,
+				ValidateFunc: validateTagPattern,
+				Description:  "A regex pattern you want to filter tags by.",
+			},
+			"tags": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The tags within the repository that match `tag_pattern`. No manifests are fetched to produce this list.",
+			},
+		},
+	}
+}
+
+func buildkitRegistryCatalogDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readRegistryCatalogDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url you want to list repositories for. The registry must support the `/v2/_catalog` API, or be ECR, GCR or Artifact Registry. When the url has a path, e.g. `europe-docker.pkg.dev/project`, only the repositories under it are listed and they are named relative to it.",
+			},
+			"prefix": {
+				Type:        schema.TypeString,
+				Default:     "",
+				Optional:    true,
+				Description: "Only return repositories whose name starts with this prefix.",
+			},
+			"repositories": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The names of the repositories within the registry that start with `prefix`.",
+			},
+		},
+	}
+}
+
+func buildkitTagExistsDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readTagExistsDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url you want to search.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name you want to search.",
+			},
+			"tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The tag you want to check for.",
+			},
+			"exists": {
+				Type:        schema.TypeBool,
+				Computed:    true,
+				Description: "Whether the tag exists within the repository.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest the tag currently points at. Empty when the tag does not exist.",
+			},
+			"digest_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hash-based url for the image. Empty when the tag does not exist.",
+			},
+		},
+	}
+}
+
+func buildkitImageSbomDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readImageSbomDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name of the image.",
+			},
+			"tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The tag of the image.",
+			},
+			"platform": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The platform of the image whose SBOM should be returned (e.g. `linux/amd64`).",
+			},
+			"predicate_type": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The in-toto predicate type of the SBOM attestation.",
+			},
+			"sbom": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The raw SBOM document as JSON.",
+			},
+			"packages": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the package.",
+						},
+						"version": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The version of the package.",
+						},
+					},
+				},
+				Description: "The packages listed in the SBOM. Only populated for SPDX documents.",
+			},
+		},
+	}
+}
+
+func buildkitImageProvenanceDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readImageProvenanceDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name of the image.",
+			},
+			"tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The tag of the image.",
+			},
+			"platform": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The platform of the image whose provenance should be returned (e.g. `linux/amd64`).",
+			},
+			"predicate_type": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The in-toto predicate type of the provenance attestation.",
+			},
+			"builder_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The id of the builder that produced the image.",
+			},
+			"build_type": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The type of build that produced the image.",
+			},
+			"source_repository": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The source repository the image was built from, when recorded by the builder.",
+			},
+			"source_revision": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The revision of the source repository the image was built from, when recorded by the builder.",
+			},
+			"materials": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"uri": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The uri of the material.",
+						},
+						"digest": {
+							Type:        schema.TypeMap,
+							Elem:        schema.TypeString,
+							Computed:    true,
+							Description: "The digests of the material keyed by algorithm.",
+						},
+					},
+				},
+				Description: "The materials (base images, sources, etc.) that went into the build.",
+			},
+			"provenance": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The raw provenance predicate as JSON.",
+			},
+		},
+	}
+}
+
+func buildkitImageSignatureDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readImageSignatureDataSource,
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name of the image.",
+			},
+			"tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The tag of the image.",
+			},
+			"public_key": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"public_key", "certificate_roots"},
+				Description:  "A PEM encoded public key the image must be signed with (as created by `cosign generate-key-pair`).",
+			},
+			"certificate_roots": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"public_key", "certificate_roots"},
+				RequiredWith: []string{"rekor_public_key"},
+				Description:  "PEM encoded root certificates for keyless signatures (e.g. the Fulcio root). The signing certificate must chain up to one of them.",
+			},
+			"rekor_public_key": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"public_key"},
+				RequiredWith:  []string{"certificate_roots"},
+				Description:   "The PEM encoded public key of the transparency log keyless signatures were entered into (e.g. the Rekor public key). The time a signature was logged at is only trusted when the log signed it.",
+			},
+			"certificate_identity": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"public_key"},
+				Description:   "The email or URI the signing certificate must have been issued to.",
+			},
+			"certificate_oidc_issuer": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"public_key"},
+				Description:   "The OIDC issuer that must have authenticated the signer (e.g. `https://token.actions.githubusercontent.com`).",
+			},
+			"verified": {
+				Type:        schema.TypeBool,
+				Computed:    true,
+				Description: "Whether a signature of the image could be verified.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest the tag points at, which is what the signature covers.",
+			},
+			"signer_identity": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The email or URI of the signing certificate. Empty for key based signatures.",
+			},
+			"signer_oidc_issuer": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The OIDC issuer recorded in the signing certificate. Empty for key based signatures.",
+			},
+		},
+	}
+}
+
+func buildkitDockerHubRateLimitDataSource() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: readDockerHubRateLimitDataSource,
+		Schema: map[string]*schema.Schema{
+			"min_remaining": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "Fail when fewer pulls than this remain within the current window.",
+			},
+			"limited": {
+				Type:        schema.TypeBool,
+				Computed:    true,
+				Description: "Whether pulls are rate limited at all. Paid accounts are not.",
+			},
+			"limit": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of pulls allowed within a window.",
+			},
+			"remaining": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of pulls left within the current window.",
+			},
+			"window_seconds": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The length of the window in seconds.",
+			},
+			"source": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "What the limit is applied to, either the account id or the ip address of the caller.",
 			},
 		},
 	}
@@ -147,7 +832,8 @@ func buildkitImageResource() *schema.Resource {
 		ReadContext:   readImage,
 		UpdateContext: updateImage,
 		DeleteContext: deleteImage,
-		Description:   "A docker image built with buildkit and published to target registries.",
+		CustomizeDiff: diffImage,
+		Description:   "A docker image built with buildkit and published to target registries. Images with the same inputs are only built once per apply, the others are copied from the first publish target of that build.",
 		Schema: map[string]*schema.Schema{
 			"id": {
 				Type:        schema.TypeString,
@@ -162,15 +848,37 @@ func buildkitImageResource() *schema.Resource {
 				Description: "A map of strings that will cause a change to the counter when any of the values change.",
 			},
 			"publish_target": {
-				Type:        schema.TypeSet,
+				Type:        schema.TypeList,
 				Optional:    true,
+				Computed:    true,
 				Elem:        PublishTargetResource,
-				Description: "Describes a coordinate where you want to publish the image after building.",
+				Description: "Describes a coordinate where you want to publish the image after building. Targets are kept in the order they are configured, and the first is where images with the same inputs are copied from.",
 			},
 			"context": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				AtLeastOneOf:  []string{"context", "context_tarball", "context_files"},
+				ConflictsWith: []string{"context_tarball"},
+				Description:   "Path to the directory that should be used as the docker context, or a git repository the buildkit daemon clones over ssh, e.g. `git@github.com:org/repo.git#main` or `ssh://git@github.com/org/repo.git#v1.0.0:subdir`. Git contexts are cloned with the ssh agent forwarded by `forward_ssh_agent_socket`, so private repositories work without tokens, and the Dockerfile is still read from `dockerfile`.",
+			},
+			"context_tarball": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				AtLeastOneOf:  []string{"context", "context_tarball", "context_files"},
+				ConflictsWith: []string{"context"},
+				Description:   "Path to a tarball, optionally gzip compressed, that should be used as the docker context instead of a directory, e.g. one produced by another tool. It is unpacked and sent to the builder like a directory, and the image is rebuilt whenever its contents change. The Dockerfile is still read from `dockerfile`.",
+			},
+			"context_files": {
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				AtLeastOneOf: []string{"context", "context_tarball", "context_files"},
+				Description:  "Files to build the image from in `path => content` form, e.g. an nginx config or a script rendered with `templatefile`, so that generated files don't have to be written to disk or committed. They are written to a temporary context of their own, on top of a copy of `context` or `context_tarball` when either is set, replacing files with the same path. Paths are relative to the root of the context.",
+			},
+			"context_tarball_digest": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Path to the directory that should be used as the docker context.",
+				Computed:    true,
+				Description: "The sha256 digest of the `context_tarball` the image was built from.",
 			},
 			"dockerfile": {
 				Type:        schema.TypeString,
@@ -185,7 +893,7 @@ func buildkitImageResource() *schema.Resource {
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
-				Description: "Target platforms / architectures that should be supported by the image being built by Buildkit.",
+				Description: "Target platforms / architectures that should be supported by the image being built by Buildkit. Windows images, e.g. `windows/amd64`, are built from windows base images whose layers are referenced rather than pushed to the publish targets, since they can't be distributed. A linux buildkit daemon can't run `RUN` instructions for windows images. WebAssembly modules, e.g. `wasi/wasm`, are published as OCI images for runtimes like the wasm shims of containerd, Spin or wasmCloud. They are built from `scratch` by copying the module in, since no worker runs them.",
 			},
 			"labels": {
 				Type:        schema.TypeMap,
@@ -217,6 +925,124 @@ func buildkitImageResource() *schema.Resource {
 				Sensitive:   true,
 				Description: "A map of secrets in key => base64_encoded_value form that will be made accessible to the image being built by Buildkit.",
 			},
+			"secret": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				Elem:        SecretResource,
+				Description: "A secret that will be made accessible to the image being built by Buildkit, along with the mode and owner it is mounted with. Use it instead of `secrets` when a build step requires the secret to be owned by a specific user or to have a specific mode, e.g. `RUN --mount=type=secret,id=npmrc` as a user other than root. The options are added to every `RUN --mount=type=secret` of the secret in the Dockerfile that doesn't set them itself.",
+			},
+			"mount_blobs": {
+				Type:        schema.TypeBool,
+				Default:     true,
+				Optional:    true,
+				Description: "Should publish targets in the same registry as another publish target be copied from it rather than pushed by buildkit? Copying within a registry mounts the layers from the other repository instead of uploading them again, so publishing to several repositories of the same registry uploads the layers once. Registries that don't support mounting blobs across repositories have them uploaded as usual.",
+			},
+			"resolve_platform_digests": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the `platform_digests` of the publish targets be resolved, whenever the image is published or refreshed? Multi-platform images are published as an index, whose digest is what `digest` is, while runtimes pull the image of their platform from it. Takes an extra request to each registry on every refresh.",
+			},
+			"detect_label_drift": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the labels of the image at each publish target be compared against `labels` whenever the image is refreshed? A tag whose image is missing any of the labels, or has other values for them, was likely overwritten with another image, so the plan shows the image being built and published again rather than nothing to do. Takes a request for the config of each platform of the image on every refresh.",
+			},
+			"verify_pull": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the image be pulled from every publish target once it is published, failing unless each registry serves it? The manifest and the manifest of each platform are fetched, along with the header of a layer of each, which catches registries and proxies that accept a push but can't serve it before anything deploys the image. Takes a few extra requests to each registry.",
+			},
+			"verify_consistency": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the tag of every publish target be read back once the image is published, failing unless they all point at the same digest? Catches registries that convert the manifests pushed to them, which leaves the targets with different images. Takes an extra request to each registry.",
+			},
+			"validate_on_plan": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the build be checked against the buildkit daemon during the plan whenever the image will be built? The Dockerfile frontend parses the Dockerfile, resolves its base images and checks its stages with the args and platforms of the image, without running any steps, so that mistakes fail the plan rather than an apply that already changed other infrastructure. Builds whose inputs are only known after apply, or whose Dockerfile doesn't exist yet, are only checked during the apply.",
+			},
+			"publish_lock": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Elem:        PublishLockResource,
+				Description: "Locks the tags of the publish targets while the image is built and published, so that simultaneous runs publishing to the same tag don't interleave their pushes and leave the tag pointing at an unexpected image. By default each tag is locked by a sentinel tag next to it, e.g. `1.0.0.tf-buildkit-lock` for `1.0.0`, which is deleted on release (or expired, where the registry doesn't allow deleting tags) and left out of listed tags. Registries can't replace a tag only if it is unchanged, so the sentinel is read back after writing it to detect runs that wrote it at the same time.",
+			},
+			"sbom": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Elem:        SbomResource,
+				Description: "Attaches an SBOM attestation to each platform of the image, generated while it is built, which `buildkit_image_sbom` reads back. Requires a buildkit daemon of v0.11 or later.",
+			},
+			"snapshot_context": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the context be copied to a temporary directory before building? The image is built from the copy and `context_digest` is the hash of exactly what was copied, so files changing during the build can't make the image differ from the recorded hash.",
+			},
+			"expected_context_digest": {
+				Type:        schema.TypeString,
+				Default:     "",
+				Optional:    true,
+				Description: "The hash the context is expected to have, e.g. the `hash` of a `buildkit_directory` of the context. When set together with `snapshot_context`, the build fails if the files changed since they were hashed during the plan.",
+			},
+			"context_digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hash of the context the image was built from, as computed by `buildkit_directory`, to correlate a published image with the exact files it was built from. When `context_files` or `context_tarball` are set, it is the hash of the context they make up. Without `snapshot_context` the context is hashed right before it is sent to the builder, so files that change during the build aren't accounted for. Empty for git contexts.",
+			},
+			"require_native": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				Optional:    true,
+				Description: "Should the build fail when a platform would be built through emulation, e.g. QEMU registered with binfmt_misc, because no node of the builder runs it natively? Otherwise a warning is reported for each emulated platform.",
+			},
+			"squash": {
+				Type:        schema.TypeBool,
+				Default:     false,
+				ForceNew:    true,
+				Optional:    true,
+				Description: "Should the layers of the image be collapsed into a single layer? Useful for consumers that require single-layer images or to hide the contents of intermediate layers.",
+			},
+			"base_image": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        BaseImageResource,
+				Description: "Another image this image is built from, e.g. a `buildkit_image` in the same configuration, passed to the Dockerfile as a build argument pinned by its digest rather than a tag another build could move in the meantime. Rebuilding the base image changes its digest, which rebuilds this image as well.",
+			},
+			"build_retries": {
+				Type:        schema.TypeInt,
+				Default:     0,
+				Optional:    true,
+				Description: "How many times the build is run again when it fails because of the buildkit daemon rather than the build itself, e.g. when the daemon is unavailable, the connection to it was reset or its worker restarted. Retries wait 5s, doubling each time up to a minute. The steps that completed before are cached by the daemon, so a retry mostly continues where the build stopped.",
+			},
+			"cache_from": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Caches the build may import layers from, e.g. `type=registry,ref=ghcr.io/org/app:buildcache`, or just the reference of a registry cache. Takes precedence over the `cache_from` of the provider.",
+			},
+			"cache_to": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Caches the build should be exported to, e.g. `type=registry,ref=ghcr.io/org/app:buildcache,mode=max`. Takes precedence over the `cache_to` of the provider.",
+			},
+			"squash_from": {
+				Type:        schema.TypeString,
+				Default:     "",
+				ForceNew:    true,
+				Optional:    true,
+				Description: "The name of a stage in the Dockerfile. When set, the layers of that stage are kept and only the layers added after it are collapsed into one. Implies `squash`.",
+			},
 			"forward_ssh_agent_socket": {
 				Type:        schema.TypeBool,
 				ForceNew:    false,
@@ -224,12 +1050,64 @@ func buildkitImageResource() *schema.Resource {
 				Default:     false,
 				Description: "Should the host running Terraform make their ssh agent socket available to the image being built by Buildkit?",
 			},
+			"build_only": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should the image be built without publishing it anywhere? Useful to check that an image builds or to warm the build cache. Only `image_digest` is known afterwards. Either this or at least one `publish_target` is required.",
+			},
+			"delete_strategy": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      deleteStrategyNone,
+				ValidateFunc: validation.StringInSlice([]string{deleteStrategyNone, deleteStrategyUntag, deleteStrategyDeleteManifest}, false),
+				Description:  "What happens to the published image when the resource is destroyed. Either `none` to leave it in place, `untag` to remove the tags of the publish targets, or `delete_manifest` to also delete the manifest, unless another tag still points at it. Tags that were moved to another image since they were published are left alone. When the resource is replaced, the image is removed before it's rebuilt, unless the resource sets `create_before_destroy`, in which case the tags its replacement published are left alone. Not every registry allows deleting tags or manifests.",
+			},
+			"shared_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The key the buildkit daemon caches the context of this image under, so that only files that changed are sent the next time. Overrides the `shared_key` of the provider, e.g. to give each service in a repository a key of its own.",
+			},
+			"metadata_file": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "A file to write a JSON report of the build to when the image is built, like the `--metadata-file` of buildx, e.g. for CI dashboards. It has the digest of the image and of each of its platforms, the publish targets, the steps of the build with how long they took and whether they were cached, cache statistics, how often the build was retried and the warnings of the build. Changing it doesn't rebuild the image.",
+			},
 			"image_digest": {
 				Type:        schema.TypeString,
-				ForceNew:    true,
 				Computed:    true,
 				Description: "The sha256 digest of the docker image. This is the canonical content addressable hash for a docker image.",
 			},
+			"exporter_metadata": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Everything the exporter of the buildkit daemon reported about the image, e.g. `containerimage.config.digest` or the base64 encoded JSON of `containerimage.descriptor`, for values that have no attribute of their own. When the platforms were built on several nodes, only `containerimage.digest` of the merged image is reported.",
+			},
+			"image_ref": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The `digest_url` of the first publish target, e.g. `ghcr.io/org/app@sha256:...`, to refer to the image without indexing `publish_target`.",
+			},
+			"refs": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The `digest_url` of every published tag keyed by its `tag_url`, e.g. `refs[\"ghcr.io/org/app:1.0.0\"]`, including the aliases of `also_tag_latest`.",
+			},
+			"platform_nodes": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "The name of the node that built each platform, when the provider has other `node`s. Platforms are built on the first node that builds them natively, so a platform built on a node that emulates it was one that no node builds natively.",
+			},
+			"trace_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The id of the OpenTelemetry trace the image was built under. It is passed on to the buildkit daemon along with the build, so the spans and build history the daemon records for the build can be found by it, e.g. for a post-mortem with `buildctl debug` or in the collector configured with `otlp_endpoint`.",
+			},
 		},
 	}
 }
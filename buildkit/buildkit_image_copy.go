@@ -0,0 +1,245 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func buildkitImageCopyResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageCopy,
+		ReadContext:   readImageCopy,
+		UpdateContext: updateImageCopy,
+		DeleteContext: deleteImageCopy,
+		CustomizeDiff: diffImageCopy,
+		Description:   "An image copied from one registry to another, including every platform of the image.",
+		Schema: map[string]*schema.Schema{
+			"source_registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url to copy the image from.",
+			},
+			"source_repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name to copy the image from.",
+			},
+			"source_tag": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"source_tag", "source_digest"},
+				Description:  "The tag of the image to copy. The image is copied again whenever the tag moves.",
+			},
+			"source_digest": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"source_tag", "source_digest"},
+				Description:  "The digest of the image to copy.",
+			},
+			"destination_registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url to copy the image to.",
+			},
+			"destination_repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name to copy the image to.",
+			},
+			"destination_tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The tag to publish the copy as.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest of the copied image. Digests are preserved so this is the same in both registries.",
+			},
+			"tag_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The tag-based url for the copied image.",
+			},
+			"digest_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hash-based url for the copied image.",
+			},
+		},
+	}
+}
+
+// getCopySource returns the reference of the image that should be copied.
+func getCopySource(data interface{ Get(string) interface{} }) string {
+	registry_url := data.Get("source_registry_url").(string)
+	repository_name := data.Get("source_repository_name").(string)
+	if digest := data.Get("source_digest").(string); digest != "" {
+		return fullImage(registry_url, repository_name+"@"+digest)
+	}
+	return fullImage(registry_url, repository_name+":"+data.Get("source_tag").(string))
+}
+
+// copyImage copies the manifest (or index and all of its manifests) along
+// with any missing blobs. Each side uses the credentials of its registry.
+func copyImage(ctx context.Context, source string, sourceAuth RegistryAuth, destination string, destinationAuth RegistryAuth) (string, error) {
+
+	sourceReference, err := name.ParseReference(source)
+	if err != nil {
+		return "", err
+	}
+
+	destinationReference, err := name.ParseReference(destination)
+	if err != nil {
+		return "", err
+	}
+
+	descriptor, err := remote.Get(sourceReference, makeOptions(craneOptions(ctx, sourceAuth)...).Remote...)
+	if err != nil {
+		return "", err
+	}
+
+	destinationOptions := makeOptions(craneOptions(ctx, destinationAuth)...).Remote
+
+	if isV2IndexManifest(descriptor.MediaType) {
+		index, err := descriptor.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		err = remote.WriteIndex(destinationReference, index, destinationOptions...)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		image, err := descriptor.Image()
+		if err != nil {
+			return "", err
+		}
+		err = remote.Write(destinationReference, image, destinationOptions...)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	destinationAuth.digests.remember(destination, descriptor.Digest.String())
+
+	return descriptor.Digest.String(), nil
+}
+
+func createImageCopy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	source_registry_url := data.Get("source_registry_url").(string)
+	destination_registry_url := data.Get("destination_registry_url").(string)
+	destination_repository_name := data.Get("destination_repository_name").(string)
+	destination_tag := data.Get("destination_tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	tag_url := fullImage(destination_registry_url, destination_repository_name+":"+destination_tag)
+
+	digest, err := copyImage(ctx,
+		getCopySource(data), provider.registryAuth(source_registry_url),
+		tag_url, provider.registryAuth(destination_registry_url))
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("digest", digest)
+	data.Set("tag_url", tag_url)
+	data.Set("digest_url", fullImage(destination_registry_url, destination_repository_name+"@"+digest))
+
+	return diag.Diagnostics{}
+}
+
+func readImageCopy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	destination_registry_url := data.Get("destination_registry_url").(string)
+	destination_repository_name := data.Get("destination_repository_name").(string)
+	destination_tag := data.Get("destination_tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return diag.Diagnostics{}
+	}
+
+	auth := provider.registryAuth(destination_registry_url)
+
+	hash, err := getRemoteImageHash(ctx, fullImage(destination_registry_url, destination_repository_name+":"+destination_tag), auth)
+
+	if err != nil {
+		// the copy was removed outside of terraform so it needs to be made again
+		if isNotFound(err) {
+			data.SetId("")
+			return diag.Diagnostics{}
+		}
+
+		return diag.Diagnostics{readFailure(provider, destination_registry_url, fullImage(destination_registry_url, destination_repository_name+":"+destination_tag), err)}
+	}
+
+	data.Set("digest", hash)
+	data.Set("digest_url", fullImage(destination_registry_url, destination_repository_name+"@"+hash))
+
+	return diag.Diagnostics{}
+}
+
+// diffImageCopy plans another copy when the source no longer matches what
+// was copied, either because the source tag moved or the destination was
+// overwritten outside of terraform.
+func diffImageCopy(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+
+	if diff.Id() == "" {
+		return nil
+	}
+
+	source_registry_url := diff.Get("source_registry_url").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return nil
+	}
+
+	auth := provider.registryAuth(source_registry_url)
+
+	hash, err := getRemoteImageHash(ctx, getCopySource(diff), auth)
+
+	// an unreachable source doesn't fail the plan, the copy is kept as it
+	// is until a plan can see that the source moved
+	if err != nil {
+		return nil
+	}
+
+	if hash != diff.Get("digest").(string) {
+		if err := diff.SetNewComputed("digest"); err != nil {
+			return err
+		}
+		return diff.SetNewComputed("digest_url")
+	}
+
+	return nil
+}
+
+func updateImageCopy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createImageCopy(ctx, data, meta)
+}
+
+func deleteImageCopy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// the copy is left in place, like the images published by buildkit_image
+	return diagnostics
+}
@@ -0,0 +1,103 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"testing"
+)
+
+func TestImageCopyPreservesIndexDigest(t *testing.T) {
+	source := testRegistry(t)
+	destination := testRegistry(t)
+
+	index, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reference, err := name.ParseReference(source + "/app:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.WriteIndex(reference, index); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := index.Digest()
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageCopyResource().Schema, map[string]interface{}{
+		"source_registry_url":         source,
+		"source_repository_name":      "app",
+		"source_tag":                  "1.0.0",
+		"destination_registry_url":    destination,
+		"destination_repository_name": "mirror/app",
+		"destination_tag":             "1.0.0",
+	})
+
+	if diags := createImageCopy(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("digest").(string) != expected.String() {
+		t.Fatalf("expected digest %s but got %s", expected, data.Get("digest"))
+	}
+
+	actual, err := crane.Digest(destination + "/mirror/app:1.0.0")
+	if err != nil || actual != expected.String() {
+		t.Fatalf("expected the copy to have digest %s but got %s (%v)", expected, actual, err)
+	}
+}
+
+func TestDiffImageCopy(t *testing.T) {
+	resource := buildkitImageCopyResource()
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	source := testRegistry(t)
+	digest := testPushImage(t, source+"/app:1.0.0")
+
+	config := func(registry string) map[string]interface{} {
+		return map[string]interface{}{
+			"source_registry_url":         registry,
+			"source_repository_name":      "app",
+			"source_tag":                  "1.0.0",
+			"destination_registry_url":    "ghcr.io",
+			"destination_repository_name": "mirror/app",
+			"destination_tag":             "1.0.0",
+		}
+	}
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, config(source))
+	data.SetId("previous")
+	data.Set("digest", digest)
+	state := data.State()
+
+	unchanged, err := resource.SimpleDiff(context.Background(), state, terraform.NewResourceConfigRaw(config(source)), meta)
+	if err != nil || (unchanged != nil && len(unchanged.Attributes) > 0) {
+		t.Fatalf("expected no changes while the source is unchanged: %v (%v)", unchanged, err)
+	}
+
+	testPushImage(t, source+"/app:1.0.0")
+
+	moved, err := resource.SimpleDiff(context.Background(), state, terraform.NewResourceConfigRaw(config(source)), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attribute, ok := moved.Attributes["digest"]; !ok || !attribute.NewComputed {
+		t.Fatalf("expected the digest to be unknown once the source moved: %v", moved.Attributes)
+	}
+
+	data.Set("source_registry_url", "127.0.0.1:1")
+	unreachable, err := resource.SimpleDiff(context.Background(), data.State(), terraform.NewResourceConfigRaw(config("127.0.0.1:1")), meta)
+	if err != nil {
+		t.Fatalf("expected an unreachable source not to fail the plan: %v", err)
+	}
+	if unreachable != nil && len(unreachable.Attributes) > 0 {
+		t.Fatalf("expected the copy to be kept while the source is unreachable: %v", unreachable.Attributes)
+	}
+}
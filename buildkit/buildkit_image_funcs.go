@@ -2,15 +2,8 @@ package buildkit
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"github.com/denisbrodbeck/machineid"
-	"github.com/docker/cli/cli/command/image/build"
-	"github.com/docker/docker/pkg/archive"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
@@ -19,40 +12,158 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/secrets/secretsprovider"
 	"github.com/moby/buildkit/session/sshforward/sshprovider"
-	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 func getCompiledOutputs(data *schema.ResourceData) []client.ExportEntry {
-	publish_targets := data.Get("publish_target").(*schema.Set).List()
+	publish_targets := data.Get("publish_target").([]interface{})
 	if len(publish_targets) > 0 {
+		copied := getCopiedTargets(data)
 		names := make([]string, 0)
-		for _, x := range publish_targets {
+		for i, x := range publish_targets {
+			if _, ok := copied[i]; ok {
+				continue
+			}
 			casted := x.(map[string]interface{})
 			registry := casted["registry_url"].(string)
 			completeRef := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
 			names = append(names, completeRef)
 		}
+		attrs := map[string]string{
+			"name": strings.Join(names, ","),
+			"push": "true",
+		}
+		for _, x := range getPlatforms(data) {
+			// windows base layers can't be redistributed so they are referenced rather than pushed
+			if isWindowsPlatform(x) {
+				attrs["prefer-nondist-layers"] = "true"
+			}
+		}
 		return append(make([]client.ExportEntry, 0), client.ExportEntry{
-			Type: "image",
-			Attrs: map[string]string{
-				"name": strings.Join(names, ","),
-				"push": "true",
-			},
+			Type:  "image",
+			Attrs: merge(attrs, getWasmAttrs(data)),
 		})
 	} else {
-		return make([]client.ExportEntry, 0)
+		// nothing is pushed but the exporter still reports the digest of the image
+		return append(make([]client.ExportEntry, 0), client.ExportEntry{
+			Type:  "image",
+			Attrs: getWasmAttrs(data),
+		})
+	}
+}
+
+// getWasmAttrs makes images with webassembly modules use oci media types,
+// which are the only ones their runtimes read.
+func getWasmAttrs(data *schema.ResourceData) map[string]string {
+	for _, x := range getPlatforms(data) {
+		if isWasmPlatform(x) {
+			return map[string]string{"oci-mediatypes": "true"}
+		}
+	}
+	return map[string]string{}
+}
+
+// validatePublishTargets makes sure an image is either published or built only.
+func validatePublishTargets(count int, build_only bool) error {
+	if count == 0 && !build_only {
+		return fmt.Errorf("at least one publish_target is required, or set build_only to build the image without publishing it")
+	}
+	if count > 0 && build_only {
+		return fmt.Errorf("an image that is built only can't have a publish_target")
+	}
+	return nil
+}
+
+func diffImage(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+
+	if !configuresPublishTargets(diff.GetRawConfig()) && len(diff.Get("publish_target").([]interface{})) > 0 {
+		if err := diff.SetNew("publish_target", []interface{}{}); err != nil {
+			return err
+		}
+	}
+
+	if diff.NewValueKnown("publish_target") && diff.NewValueKnown("build_only") {
+		if err := validatePublishTargets(len(diff.Get("publish_target").([]interface{})), diff.Get("build_only").(bool)); err != nil {
+			return err
+		}
+		if err := validateTargetPlatforms(diff.Get("publish_target").([]interface{})); err != nil {
+			return err
+		}
+	}
+
+	if diff.NewValueKnown("context") && diff.NewValueKnown("forward_ssh_agent_socket") && diff.NewValueKnown("snapshot_context") && diff.NewValueKnown("context_files") {
+		if err := validateContext(diff.Get("context").(string), diff.Get("forward_ssh_agent_socket").(bool), diff.Get("snapshot_context").(bool), len(diff.Get("context_files").(map[string]interface{})) > 0); err != nil {
+			return err
+		}
+	}
+
+	if diff.NewValueKnown("base_image") {
+		if _, err := getBaseImageArgs(diff); err != nil {
+			return err
+		}
+	}
+
+	if err := diffContextTarball(diff); err != nil {
+		return err
+	}
+
+	if err := diffDryRun(ctx, diff, meta); err != nil {
+		return err
+	}
+
+	// an image that is rebuilt gets a new digest, which anything using it has to wait for
+	if diff.Id() != "" && hasImageInputChanges(diff) {
+		if err := diff.SetNewComputed("image_digest"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("trace_id"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("exporter_metadata"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("image_ref"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("refs"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("platform_nodes"); err != nil {
+			return err
+		}
+		if err := diff.SetNewComputed("context_digest"); err != nil {
+			return err
+		}
+		if diff.NewValueKnown("publish_target") {
+			if err := diff.SetNew("publish_target", plannedTargets(diff)); err != nil {
+				return err
+			}
+		}
 	}
+
+	return nil
+}
+
+// hasImageInputChanges is true when the image will, or might, be rebuilt.
+func hasImageInputChanges(diff *schema.ResourceDiff) bool {
+	for _, x := range imageBuildAttributes() {
+		if !diff.NewValueKnown(x) || diff.HasChange(x) {
+			return true
+		}
+	}
+	return false
 }
 
 func getSecretsProvider(secrets map[string][]byte) session.Attachable {
 	return secretsprovider.FromMap(secrets)
 }
 
-func getPlatforms(data *schema.ResourceData) []string {
+func getPlatforms(data interface{ Get(string) interface{} }) []string {
 	platforms := data.Get("platforms").(*schema.Set).List()
 	result := make([]string, len(platforms))
 	for i, x := range platforms {
@@ -61,6 +172,23 @@ func getPlatforms(data *schema.ResourceData) []string {
 	return result
 }
 
+func getStringList(data *schema.ResourceData, key string) []string {
+	values := data.Get(key).([]interface{})
+	result := make([]string, len(values))
+	for i, x := range values {
+		result[i] = x.(string)
+	}
+	return result
+}
+
+func getStringMap(data *schema.ResourceData, key string) map[string]string {
+	result := map[string]string{}
+	for k, v := range data.Get(key).(map[string]interface{}) {
+		result[k] = v.(string)
+	}
+	return result
+}
+
 func getSecrets(data *schema.ResourceData) (map[string][]byte, diag.Diagnostics) {
 	diagnostics := diag.Diagnostics{}
 	result := map[string][]byte{}
@@ -80,10 +208,21 @@ func getSecrets(data *schema.ResourceData) (map[string][]byte, diag.Diagnostics)
 			})
 		}
 	}
+	blocks, _, diags := getSecretBlocks(data)
+	diagnostics = append(diagnostics, diags...)
+	for k, v := range blocks {
+		if _, ok := result[k]; ok {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("The secret '%s' is given more than once.", k),
+			})
+		}
+		result[k] = v
+	}
 	return result, diagnostics
 }
 
-func getSSHAgents(data *schema.ResourceData) map[string]string {
+func getSSHAgents(data interface{ Get(string) interface{} }) map[string]string {
 	result := map[string]string{}
 	if data.Get("forward_ssh_agent_socket").(bool) {
 		result["default"] = os.Getenv("SSH_AUTH_SOCK")
@@ -121,7 +260,7 @@ func merge[K comparable, V interface{}](maps ...map[K]V) map[K]V {
 	return result
 }
 
-func getLabels(data *schema.ResourceData) map[string]string {
+func getLabels(data interface{ Get(string) interface{} }) map[string]string {
 	result := map[string]string{}
 	secrets := data.Get("labels").(map[string]interface{})
 	for k, v := range secrets {
@@ -130,7 +269,7 @@ func getLabels(data *schema.ResourceData) map[string]string {
 	return result
 }
 
-func getBuildArgs(data *schema.ResourceData) map[string]string {
+func getBuildArgs(data interface{ Get(string) interface{} }) map[string]string {
 	result := map[string]string{}
 	secrets := data.Get("args").(map[string]interface{})
 	for k, v := range secrets {
@@ -139,149 +278,165 @@ func getBuildArgs(data *schema.ResourceData) map[string]string {
 	return result
 }
 
-func getDirectoryHash(directory string) (string, diag.Diagnostics) {
-	directory, _ = filepath.Abs(directory)
-	excludePatterns, err := build.ReadDockerignore(directory)
-	if err != nil {
-		return "", diag.Diagnostics{
-			diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  fmt.Sprintf("Could not open .dockerignore file in directory '%s'.", directory),
-				Detail:   err.Error(),
-			},
-		}
+// getSessionProviders are the credentials, secrets and ssh agents of a build.
+func getSessionProviders(data *schema.ResourceData, provider TerraformProviderBuildkit) ([]session.Attachable, diag.Diagnostics) {
+	secrets, diags := getSecrets(data)
+
+	if len(diags) > 0 {
+		return nil, diags
 	}
-	tarHandle, err := archive.TarWithOptions(directory, &archive.TarOptions{
-		ExcludePatterns: excludePatterns,
-	})
-	hash := sha256.New()
-	_, err = io.Copy(hash, tarHandle)
-	if err != nil {
-		return "", diag.Diagnostics{
-			diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  err.Error(),
-			},
-		}
+
+	sshProvider, diags := getSSHProvider(getSSHAgents(data))
+
+	if len(diags) > 0 {
+		return nil, diags
 	}
-	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), diag.Diagnostics{}
+
+	return []session.Attachable{
+		NewDockerAuthProvider(provider.registry_auth),
+		getSecretsProvider(secrets),
+		sshProvider,
+	}, diag.Diagnostics{}
 }
 
 func createImage(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
 
+	if !configuresPublishTargets(data.GetRawConfig()) {
+		_ = data.Set("publish_target", []interface{}{})
+	}
+
+	if err := validatePublishTargets(len(data.Get("publish_target").([]interface{})), data.Get("build_only").(bool)); err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if err := validateTargetPlatforms(data.Get("publish_target").([]interface{})); err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
 	buildContext := data.Get("context").(string)
+
+	context_files := getStringMap(data, "context_files")
+
+	if err := validateContext(buildContext, data.Get("forward_ssh_agent_socket").(bool), data.Get("snapshot_context").(bool), len(context_files) > 0); err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
 	dockerfile := data.Get("dockerfile").(string)
 	provider := meta.(TerraformProviderBuildkit)
 	platforms := getPlatforms(data)
-	labels := getLabels(data)
-	args := getBuildArgs(data)
-	secrets, diags := getSecrets(data)
+	_, mounts, diags := getSecretBlocks(data)
 
 	if len(diags) > 0 {
 		return diags
 	}
 
-	sshAgents := getSSHAgents(data)
-	outputs := getCompiledOutputs(data)
+	if len(mounts) > 0 {
+		rewritten, err := ioutil.TempDir("", "terraform-provider-buildkit-")
 
-	if len(diags) > 0 {
-		return diags
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+
+		defer os.RemoveAll(rewritten)
+
+		if dockerfile, err = writeSecretMounts(dockerfile, rewritten, mounts); err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "Could not add the options of the secrets to their mounts.",
+				Detail:   err.Error(),
+			}}
+		}
 	}
 
-	id, _ := uuid.GenerateUUID()
+	labels := getLabels(data)
+	base_images, err := getBaseImageArgs(data)
 
-	data.SetId(id)
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not pin the base images of the image.",
+			Detail:   err.Error(),
+		}}
+	}
 
-	sessionProviders := make([]session.Attachable, 0)
-	dockerAuthProvider := NewDockerAuthProvider(provider.registry_auth)
-	secretsProvider := getSecretsProvider(secrets)
-	sshProvider, diags := getSSHProvider(sshAgents)
+	args := merge(getBuildArgs(data), base_images)
+	outputs := getCompiledOutputs(data)
+	sessionProviders, diags := getSessionProviders(data, provider)
 
 	if len(diags) > 0 {
 		return diags
 	}
 
-	sessionProviders = append(sessionProviders, dockerAuthProvider, secretsProvider, sshProvider)
+	prepared, cleanup, diags := prepareContext(ctx, data, provider, buildContext, context_files)
 
-	cli, err := client.New(context.Background(), provider.buildkit_url, client.WithFailFast())
+	defer cleanup()
 
-	if err != nil {
-		panic(err)
+	if len(diags) > 0 {
+		return diags
 	}
 
-	defer cli.Close()
+	id, _ := uuid.GenerateUUID()
 
-	sharedKey, err := machineid.ProtectedID("terraform-provider-buildkit")
+	data.SetId(id)
 
-	if err != nil {
-		return diag.Diagnostics{
-			diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  err.Error(),
-			},
-		}
-	}
+	frontendAttrs := merge(labels, args, getSbomAttrs(data, provider), map[string]string{
+		"platform": strings.Join(platforms, ","),
+	})
 
-	resp, err := cli.Solve(ctx, nil, client.SolveOpt{
-		Exports:  outputs,
-		Frontend: "dockerfile.v0",
-		FrontendAttrs: merge(labels, args, map[string]string{
-			"platform": strings.Join(platforms, ","),
-		}),
-		LocalDirs: map[string]string{
-			"context":    buildContext,
-			"dockerfile": filepath.Dir(dockerfile),
-		},
-		Session:   sessionProviders,
-		SharedKey: sharedKey,
-	}, nil)
+	key, diags := getBuildKey(data, prepared.key, prepared.digest, frontendAttrs)
 
-	if err != nil {
-		return diag.Diagnostics{diag.Diagnostic{
-			Severity: diag.Error,
-			Summary:  err.Error(),
-		}}
-	} else {
-		_ = data.Set("image_digest", resp.ExporterResponse["containerimage.digest"])
-		publish_targets := data.Get("publish_target").(*schema.Set).List()
-		new_targets := []interface{}{}
+	if len(diags) > 0 {
+		return diags
+	}
 
-		diags := diag.Diagnostics{}
-		for _, x := range publish_targets {
-			casted := x.(map[string]interface{})
-			new_target := merge(map[string]interface{}{}, casted)
-			registry := casted["registry_url"].(string)
-			completeRef := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
-			hash, err := getRemoteImageHash(completeRef, provider.registry_auth[registry])
-			if err != nil {
-				diags = append(diags, diag.Diagnostic{
-					Severity: diag.Error,
-					Summary:  err.Error(),
-				})
-			}
-			new_target["tag_url"] = completeRef
-			new_target["digest_url"] = fullImage(registry, casted["name"].(string)+"@"+hash)
+	build, leader := provider.builds.join(key)
 
-			new_targets = append(new_targets, new_target)
+	if !leader {
+		if diags, ok := reuseBuild(ctx, data, provider, build); ok {
+			if diags.HasError() {
+				return diags
+			}
+			return writeBuildReport(ctx, data, provider, build.report)
 		}
+	}
 
-		if len(diags) > 0 {
-			return diags
-		}
+	report := BuildReport{}
+	diags = solveImage(ctx, data, provider, prepared.directory, dockerfile, frontendAttrs, outputs, sessionProviders, &report)
 
-		fun := schema.HashResource(PublishTargetResource)
-		asSet := schema.NewSet(fun, new_targets)
-		data.Set("publish_target", asSet)
+	if leader {
+		build.finish(data, diags, report)
 	}
 
-	return diag.Diagnostics{}
+	if diags.HasError() {
+		return diags
+	}
+
+	return append(diags, writeBuildReport(ctx, data, provider, report)...)
 }
 
 func readImage(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	diagnostics := make(diag.Diagnostics, 0)
 
 	provider := meta.(TerraformProviderBuildkit)
-	expected_targets := data.Get("publish_target").(*schema.Set).List()
+
+	if provider.skip_remote_refresh {
+		// the state is trusted as it is
+		return diag.Diagnostics{}
+	}
+
+	expected_targets := data.Get("publish_target").([]interface{})
 	actual_targets := make([]interface{}, 0)
 
 	diagnostics = make(diag.Diagnostics, 0)
@@ -289,97 +444,351 @@ func readImage(context context.Context, data *schema.ResourceData, meta interfac
 	for _, target := range expected_targets {
 		casted := target.(map[string]interface{})
 		hostname := casted["registry_url"].(string)
-		auth := provider.registry_auth[hostname]
+		auth := provider.registryAuth(hostname)
 
 		qualified := fullImage(hostname, casted["name"].(string)+":"+casted["tag"].(string))
-		hash, err := getRemoteImageHash(qualified, auth)
+		hash, err := getRemoteImageHash(context, qualified, auth)
 
 		if err != nil {
 			// an error is expected if it just doesn't exist on this registry yet at the expected tag
-			if te, ok := err.(*transport.Error); ok {
-				if te.StatusCode == 404 {
-					continue
+			if isNotFound(err) {
+				actual_targets = append(actual_targets, unpublishedTarget(casted))
+				continue
+			}
+
+			failure := readFailure(provider, hostname, qualified, err)
+			diagnostics = append(diagnostics, failure)
+
+			if failure.Severity == diag.Warning {
+				actual_targets = append(actual_targets, target)
+			}
+
+			continue
+		}
+
+		if data.Get("detect_label_drift").(bool) && len(data.Get("labels").(map[string]interface{})) > 0 {
+			digest_url := fullImage(hostname, casted["name"].(string)+"@"+hash)
+			drifted, err := getDriftedLabels(context, digest_url, auth, data.Get("labels").(map[string]interface{}))
+
+			if err != nil {
+				failure := readFailure(provider, hostname, digest_url, err)
+				diagnostics = append(diagnostics, failure)
+
+				if failure.Severity == diag.Warning {
+					actual_targets = append(actual_targets, target)
 				}
+
+				continue
 			}
 
-			diagnostics = append(diagnostics, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  err.Error(),
-			})
+			// a drifted target is published again like one whose tag is gone
+			if len(drifted) > 0 {
+				diagnostics = append(diagnostics, labelDrift(qualified, drifted))
+				actual_targets = append(actual_targets, unpublishedTarget(casted))
+				continue
+			}
+		}
+
+		published, err := withPlatformDigests(context, data, publishedTarget(casted, hash), auth)
+
+		if err != nil {
+			failure := readFailure(provider, hostname, published["digest_url"].(string), err)
+			diagnostics = append(diagnostics, failure)
+
+			if failure.Severity == diag.Warning {
+				actual_targets = append(actual_targets, target)
+			}
+
+			continue
+		}
+
+		// only whether the alias exists is checked, since newer builds move it
+		if alias := latestTag(casted); alias != "" {
+			qualified := fullImage(hostname, casted["name"].(string)+":"+alias)
+			_, err := getRemoteImageHash(context, qualified, auth)
+
+			if isNotFound(err) {
+				published = merge(published, map[string]interface{}{"latest_tag": "", "latest_tag_url": ""})
+			} else if err != nil {
+				failure := readFailure(provider, hostname, qualified, err)
+				diagnostics = append(diagnostics, failure)
+
+				if failure.Severity == diag.Warning {
+					actual_targets = append(actual_targets, target)
+				}
+
+				continue
+			}
 		}
 
-		casted["digest_url"] = hash
-		actual_targets = append(actual_targets, target)
+		// the platforms are published again when any of their tags is gone
+		if platformTags(casted) {
+			var err error
+			tag_urls, _ := casted["platform_tag_urls"].(map[string]interface{})
+			for _, x := range tag_urls {
+				if _, err = getRemoteImageHash(context, x.(string), auth); err != nil {
+					break
+				}
+			}
+
+			if err != nil && !isNotFound(err) {
+				failure := readFailure(provider, hostname, qualified, err)
+				diagnostics = append(diagnostics, failure)
+
+				if failure.Severity == diag.Warning {
+					actual_targets = append(actual_targets, target)
+				}
+
+				continue
+			}
+
+			if err != nil || len(tag_urls) == 0 {
+				published = merge(published, map[string]interface{}{"platform_tags": false, "platform_tag_urls": map[string]interface{}{}})
+			}
+		}
+
+		actual_targets = append(actual_targets, published)
 	}
 
-	if len(diagnostics) > 0 {
+	if diagnostics.HasError() {
 		return diagnostics
 	} else {
 		if !reflect.DeepEqual(expected_targets, actual_targets) {
-			fun := schema.HashResource(PublishTargetResource)
-			asSet := schema.NewSet(fun, actual_targets)
-			data.Set("publish_target", asSet)
+			data.Set("publish_target", actual_targets)
 		}
+		setImageRefs(data)
 	}
 
 	return diagnostics
 }
 
-func getRemoteImageHash(qualified string, auth RegistryAuth) (string, error) {
-	return crane.Digest(qualified, crane.WithAuth(&authn.Basic{
-		Username: auth.username,
-		Password: auth.password,
-	}))
+func getRemoteImageHash(ctx context.Context, qualified string, auth RegistryAuth) (string, error) {
+	return auth.digests.digest(qualified, craneOptions(ctx, auth)...)
 }
 
-func updateImage(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+func isNotFound(err error) bool {
+	if te, ok := err.(*transport.Error); ok {
+		return te.StatusCode == 404
+	}
+	return false
+}
+
+func isAuthFailure(err error) bool {
+	if te, ok := err.(*transport.Error); ok {
+		return te.StatusCode == 401 || te.StatusCode == 403
+	}
+	return false
+}
 
-	changeKeys := []string{
-		"secrets",
-		"labels",
-		"args",
-		"platforms",
-		"publish_target",
-		"triggers",
-		"secrets_base64",
+// readFailure describes an error refreshing target from a registry. It is a
+// warning, and the state should be kept, when rejected credentials only warn.
+func readFailure(provider TerraformProviderBuildkit, registry_url string, target string, err error) diag.Diagnostic {
+	if !isAuthFailure(err) {
+		return diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not read %s from registry %s.", target, registry_url),
+			Detail:   err.Error(),
+		}
 	}
 
-	for _, k := range changeKeys {
-		if data.HasChange(k) {
-			return createImage(context, data, meta)
+	if provider.registry_auth_failure == "warn" {
+		return diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Registry %s rejected the credentials for %s, keeping the previous state.", registry_url, target),
+			Detail:   err.Error(),
 		}
 	}
 
+	return diag.Diagnostic{
+		Severity: diag.Error,
+		Summary:  fmt.Sprintf("Registry %s rejected the credentials for %s.", registry_url, target),
+		Detail:   err.Error() + "\n\nCheck the registry_auth of the provider, or set registry_auth_failure to \"warn\" to keep the previous state when the credentials are rejected.",
+	}
+}
+
+// skippedRemoteRead leaves a data source empty when skip_remote_refresh is set.
+func skippedRemoteRead(data *schema.ResourceData) diag.Diagnostics {
+	id, _ := uuid.GenerateUUID()
+	data.SetId(id)
+
+	return diag.Diagnostics{diag.Diagnostic{
+		Severity: diag.Warning,
+		Summary:  "The registry wasn't queried because skip_remote_refresh is set.",
+		Detail:   "The attributes of the data source are empty, so whatever depends on them is planned with empty values.",
+	}}
+}
+
+func updateImage(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	if data.HasChanges(imageBuildAttributes()...) {
+		return createImage(context, data, meta)
+	}
+
 	return diag.Diagnostics{}
 }
 
-func deleteImage(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+// imageBuildAttributes are the attributes that rebuild the image when they
+// change, which is any attribute not listed in imageNonBuildAttributes.
+func imageBuildAttributes() []string {
+	result := make([]string, 0)
+	for k, x := range buildkitImageResource().Schema {
+		if (x.Computed && !x.Optional && !imageInputDigests[k]) || imageNonBuildAttributes[k] {
+			continue
+		}
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func deleteImage(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	diagnostics := make(diag.Diagnostics, 0)
 
-	return diagnostics
-}
+	provider := meta.(TerraformProviderBuildkit)
+	delete_strategy := data.Get("delete_strategy").(string)
+
+	if diags := validateDeleteStrategy(delete_strategy); len(diags) > 0 {
+		return diags
+	}
+
+	if delete_strategy == deleteStrategyNone {
+		return diagnostics
+	}
+
+	for _, x := range data.Get("publish_target").([]interface{}) {
+		casted := x.(map[string]interface{})
+		registry := casted["registry_url"].(string)
+		auth := provider.registryAuth(registry)
+		tag_url := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
+		digest := targetDigest(casted)
+
+		// the tag was already gone when the image was last read
+		if digest == "" {
+			continue
+		}
+
+		// the alias goes first so that it doesn't keep the manifest alive
+		if latest_tag_url, ok := casted["latest_tag_url"].(string); ok && latest_tag_url != "" {
+			if err := deletePublishedImage(ctx, auth, latest_tag_url, digest, deleteStrategyUntag); err != nil {
+				diagnostics = append(diagnostics, diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Could not delete %s from registry %s.", latest_tag_url, registry),
+					Detail:   err.Error(),
+				})
+			}
+		}
 
-func fullImage(registry string, repository string) string {
-	return strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://") + "/" + repository
+		// the images of the platforms stay with the index while another tag
+		// points at it
+		platform_strategy := delete_strategy
+		if delete_strategy == deleteStrategyDeleteManifest {
+			live, err := liveTag(ctx, auth, tag_url, digest)
+			if err != nil {
+				diagnostics = append(diagnostics, diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Could not list the tags of %s from registry %s.", tag_url, registry),
+					Detail:   err.Error(),
+				})
+				continue
+			}
+			if live != "" {
+				platform_strategy = deleteStrategyUntag
+			}
+		}
+
+		// the images of the platforms are looked up from the image of the tag
+		if err := deletePlatformTags(ctx, casted, digest, auth, platform_strategy); err != nil {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not delete the platform tags of %s from registry %s.", tag_url, registry),
+				Detail:   err.Error(),
+			})
+		}
+
+		if err := deletePublishedImage(ctx, auth, tag_url, digest, delete_strategy); err != nil {
+			diagnostics = append(diagnostics, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not delete %s from registry %s.", tag_url, registry),
+				Detail:   err.Error(),
+			})
+		}
+	}
+
+	return diagnostics
 }
 
 func readDirectoryHashDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	diagnostics := make(diag.Diagnostics, 0)
 
-	dir := data.Get("context").(string)
-	hash, err := getDirectoryHash(dir)
+	excludes := getStringList(data, "excludes")
+	includes := getStringList(data, "includes")
+	directory := data.Get("context").(string)
+	paths := getStringList(data, "paths")
+	cache_directory := meta.(TerraformProviderBuildkit).hash_cache_directory
+
+	var hash string
+	var files map[string]string
+	var err diag.Diagnostics
+
+	if len(paths) == 0 {
+		hash, files, err = getDirectoryHash(HashQuery{
+			Directory:      directory,
+			Excludes:       excludes,
+			Includes:       includes,
+			CacheDirectory: cache_directory,
+		})
+	} else {
+		queries := make([]HashQuery, 0)
+		if directory != "" {
+			queries = append(queries, HashQuery{Directory: directory, Excludes: excludes, Includes: includes, CacheDirectory: cache_directory})
+		}
+		for _, x := range paths {
+			queries = append(queries, HashQuery{Directory: x, Excludes: excludes, Includes: includes, CacheDirectory: cache_directory})
+		}
+		// relative to the working directory, which is the root module, when
+		// there is no context
+		base := directory
+		if base == "" {
+			base = "."
+		}
+		hash, files, err = getPathsHash(base, queries)
+	}
 
 	if hash == "" {
 		return err
 	}
 
+	if dockerfile := data.Get("dockerfile").(string); dockerfile != "" {
+		hash, err = addDockerfileHash(hash, files, directory, dockerfile)
+		if hash == "" {
+			return err
+		}
+	}
+
 	id, _ := uuid.GenerateUUID()
 	data.SetId(id)
 	data.Set("hash", hash)
+	data.Set("files", files)
 
 	return diagnostics
 }
 
+func getTimestamp(data *schema.ResourceData, key string) (time.Time, diag.Diagnostics) {
+	value := data.Get(key).(string)
+	if value == "" {
+		return time.Time{}, diag.Diagnostics{}
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not parse '%s' as an RFC3339 timestamp.", key),
+			Detail:   err.Error(),
+		}}
+	}
+	return parsed, diag.Diagnostics{}
+}
+
 func readImagesDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
 
 	labels_as_interface := data.Get("labels").(map[string]interface{})
@@ -396,20 +805,55 @@ func readImagesDataSource(context context.Context, data *schema.ResourceData, me
 	}
 
 	most_recent_only := data.Get("most_recent_only").(bool)
+	most_recent_n := data.Get("most_recent_n").(int)
+
+	limit := 0
+	if most_recent_n > 0 {
+		limit = most_recent_n
+	} else if most_recent_only {
+		limit = 1
+	}
+
+	sort_by := data.Get("sort_by").(string)
+	order := data.Get("order").(string)
 
 	registry_url := data.Get("registry_url").(string)
 	repository_name := data.Get("repository_name").(string)
 	tag_pattern := data.Get("tag_pattern").(string)
+	version_constraint := data.Get("version_constraint").(string)
+	created_after, diags := getTimestamp(data, "created_after")
+	if len(diags) > 0 {
+		return diags
+	}
+	created_before, diags := getTimestamp(data, "created_before")
+	if len(diags) > 0 {
+		return diags
+	}
 	provider := meta.(TerraformProviderBuildkit)
-	auth := provider.registry_auth[registry_url]
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
 
 	repo := fullImage(registry_url, repository_name)
 
 	results, err := query(context, auth, ImageQuery{
-		Name:       repo,
-		TagPattern: tag_pattern,
-		Labels:     labels,
-		Platforms:  supported_platforms,
+		Name:              repo,
+		TagPattern:        tag_pattern,
+		VersionConstraint: version_constraint,
+		Labels:            labels,
+		Platforms:         supported_platforms,
+		CreatedAfter:      created_after,
+		CreatedBefore:     created_before,
+		Digest:            data.Get("digest").(string),
+		MaxConcurrency:    data.Get("max_concurrency").(int),
+		PageSize:          data.Get("page_size").(int),
+		MaxTags:           data.Get("max_tags").(int),
+		Limit:             limit,
+		SortBy:            sort_by,
+		Order:             order,
 	})
 
 	if err != nil {
@@ -419,10 +863,8 @@ func readImagesDataSource(context context.Context, data *schema.ResourceData, me
 		}}
 	}
 
-	if most_recent_only {
-		if len(results) > 1 {
-			results = results[:1]
-		}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
 	}
 
 	id, _ := uuid.GenerateUUID()
@@ -431,6 +873,20 @@ func readImagesDataSource(context context.Context, data *schema.ResourceData, me
 	asMaps := descriptorsToMaps(results)
 	data.Set("images", asMaps)
 
+	images_by_tag := map[string]interface{}{}
+	digests_by_platform := map[string]interface{}{}
+	for _, x := range results {
+		if _, ok := images_by_tag[x.Tag]; !ok {
+			images_by_tag[x.Tag] = x.DigestUrl
+		}
+		platform := platformName(x.Platform, x.Variant)
+		if _, ok := digests_by_platform[platform]; !ok {
+			digests_by_platform[platform] = x.ManifestDigest
+		}
+	}
+	data.Set("images_by_tag", images_by_tag)
+	data.Set("digests_by_platform", digests_by_platform)
+
 	return diag.Diagnostics{}
 }
 
@@ -442,13 +898,27 @@ func descriptorsToMaps(data []ImageResult) []map[string]interface{} {
 			labels[k] = v
 		}
 
+		attestations := make([]interface{}, 0)
+		has_provenance, has_sbom := false, false
+		for _, predicateType := range x.Attestations {
+			attestations = append(attestations, predicateType)
+			has_provenance = has_provenance || isProvenancePredicate(predicateType)
+			has_sbom = has_sbom || isSbomPredicate(predicateType)
+		}
+
 		result := map[string]interface{}{
-			"name":       x.Name,
-			"tag":        x.Tag,
-			"tag_url":    x.TagUrl,
-			"digest_url": x.DigestUrl,
-			"labels":     labels,
-			"platform":   x.Platform,
+			"name":           x.Name,
+			"tag":            x.Tag,
+			"tag_url":        x.TagUrl,
+			"digest_url":     x.DigestUrl,
+			"labels":         labels,
+			"platform":       x.Platform,
+			"variant":        x.Variant,
+			"os_version":     x.OSVersion,
+			"created":        x.BuildTimestamp.Format(time.RFC3339),
+			"attestations":   attestations,
+			"has_provenance": has_provenance,
+			"has_sbom":       has_sbom,
 		}
 		results = append(results, result)
 	}
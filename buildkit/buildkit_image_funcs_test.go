@@ -0,0 +1,577 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, directory string, files map[string]string) {
+	for path, content := range files {
+		full := filepath.Join(directory, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestGetDirectoryHashIgnoresMetadata(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile":    "FROM alpine",
+		"src/main.go":   "package main",
+		".dockerignore": "ignored.txt",
+	}
+
+	first, second := t.TempDir(), t.TempDir()
+	writeFiles(t, first, files)
+	writeFiles(t, second, files)
+	writeFiles(t, second, map[string]string{"ignored.txt": "anything"})
+
+	past := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(second, "Dockerfile"), past, past); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	firstHash, _, diags := getDirectoryHash(HashQuery{Directory: first})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	secondHash, _, diags := getDirectoryHash(HashQuery{Directory: second})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if firstHash != secondHash {
+		t.Fatalf("expected identical content to hash the same but got %s and %s", firstHash, secondHash)
+	}
+
+	writeFiles(t, second, map[string]string{"src/main.go": "package changed"})
+	changedHash, _, _ := getDirectoryHash(HashQuery{Directory: second})
+	if changedHash == firstHash {
+		t.Fatalf("expected a content change to change the hash")
+	}
+}
+
+func TestGetDirectoryHashIncludesAndExcludes(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"Dockerfile":       "FROM alpine",
+		"src/main.go":      "package main",
+		"src/generated.go": "package main",
+		"docs/readme.md":   "hello",
+	})
+
+	subtree, _, _ := getDirectoryHash(HashQuery{Directory: directory, Includes: []string{"src"}, Excludes: []string{"src/generated.go"}})
+
+	writeFiles(t, directory, map[string]string{
+		"docs/readme.md":   "goodbye",
+		"src/generated.go": "package changed",
+	})
+
+	unchanged, _, _ := getDirectoryHash(HashQuery{Directory: directory, Includes: []string{"src"}, Excludes: []string{"src/generated.go"}})
+	if subtree != unchanged {
+		t.Fatalf("expected changes outside of the included files to be ignored")
+	}
+
+	writeFiles(t, directory, map[string]string{"src/main.go": "package changed"})
+
+	changed, _, _ := getDirectoryHash(HashQuery{Directory: directory, Includes: []string{"src"}, Excludes: []string{"src/generated.go"}})
+	if subtree == changed {
+		t.Fatalf("expected changes to included files to change the hash")
+	}
+}
+
+func TestGetPathsHashReportsFiles(t *testing.T) {
+	context, extra := t.TempDir(), t.TempDir()
+	writeFiles(t, context, map[string]string{"src/main.go": "package main"})
+	writeFiles(t, extra, map[string]string{"shared.txt": "shared"})
+
+	hash, files, diags := getPathsHash(context, []HashQuery{{Directory: context}, {Directory: filepath.Join(extra, "shared.txt")}})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if _, ok := files["src/main.go"]; !ok {
+		t.Fatalf("expected a hash for the file within the context: %v", files)
+	}
+	if _, ok := files[portablePath(context, filepath.Join(extra, "shared.txt"))]; !ok {
+		t.Fatalf("expected a hash for the standalone file: %v", files)
+	}
+
+	writeFiles(t, extra, map[string]string{"shared.txt": "changed"})
+	changed, _, _ := getPathsHash(context, []HashQuery{{Directory: context}, {Directory: filepath.Join(extra, "shared.txt")}})
+	if hash == changed {
+		t.Fatalf("expected a change to a standalone file to change the combined hash")
+	}
+}
+
+func TestGetPathsHashIsPortable(t *testing.T) {
+	hashes := []string{}
+	for _, checkout := range []string{t.TempDir(), t.TempDir()} {
+		writeFiles(t, checkout, map[string]string{"app/main.go": "package main", "shared/config.json": "{}"})
+		context := filepath.Join(checkout, "app")
+
+		hash, files, diags := getPathsHash(context, []HashQuery{{Directory: context}, {Directory: filepath.Join(checkout, "shared")}})
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+		if _, ok := files["../shared/config.json"]; !ok {
+			t.Fatalf("expected the files to be keyed relative to the context: %v", files)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Fatalf("expected the same files in another checkout to have the same hash")
+	}
+}
+
+func TestAddDockerfileHash(t *testing.T) {
+	context, elsewhere := t.TempDir(), t.TempDir()
+	writeFiles(t, context, map[string]string{"src/main.go": "package main"})
+	writeFiles(t, elsewhere, map[string]string{"Dockerfile": "FROM alpine", "Dockerfile.prod": "FROM alpine"})
+
+	hash, files, _ := getDirectoryHash(HashQuery{Directory: context})
+	withDockerfile, diags := addDockerfileHash(hash, files, context, filepath.Join(elsewhere, "Dockerfile"))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if withDockerfile == hash {
+		t.Fatalf("expected the dockerfile to change the hash")
+	}
+
+	_, files, _ = getDirectoryHash(HashQuery{Directory: context})
+	otherDockerfile, _ := addDockerfileHash(hash, files, context, filepath.Join(elsewhere, "Dockerfile.prod"))
+	if otherDockerfile == withDockerfile {
+		t.Fatalf("expected switching to a different dockerfile to change the hash")
+	}
+}
+
+func TestAddDockerfileHashRelativeContext(t *testing.T) {
+	context := t.TempDir()
+	writeFiles(t, context, map[string]string{"Dockerfile": "FROM alpine", "src/main.go": "package main"})
+
+	working, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(working, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, files, _ := getDirectoryHash(HashQuery{Directory: context})
+	absolute, _ := addDockerfileHash(hash, files, context, filepath.Join(context, "Dockerfile"))
+	mixed, _ := addDockerfileHash(hash, map[string]string{}, relative, filepath.Join(context, "Dockerfile"))
+
+	if absolute != mixed {
+		t.Fatalf("expected the location of the dockerfile not to depend on how the context is written")
+	}
+	if _, ok := files["Dockerfile"]; !ok {
+		t.Fatalf("expected the dockerfile to be keyed relative to the context: %v", files)
+	}
+}
+
+func TestDigestFilesIsIndependentOfConcurrency(t *testing.T) {
+	directory := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("dir%d/file%d.txt", i%7, i)] = strings.Repeat(fmt.Sprint(i), i)
+	}
+	writeFiles(t, directory, files)
+
+	digests := func(concurrency int) []hashEntry {
+		entries := make([]hashEntry, 0)
+		for path := range files {
+			full := filepath.Join(directory, path)
+			info, err := os.Lstat(full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, hashEntry{path: full, relative: path, info: info})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].relative < entries[j].relative })
+		if err := digestFiles(entries, concurrency, nil); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	serial, parallel := digests(1), digests(16)
+	for i := range serial {
+		if serial[i].digest == "" || serial[i].digest != parallel[i].digest {
+			t.Fatalf("expected %s to have the same digest but got %q and %q", serial[i].relative, serial[i].digest, parallel[i].digest)
+		}
+	}
+
+	info, _ := os.Lstat(filepath.Join(directory, "dir0/file0.txt"))
+	missing := []hashEntry{{path: filepath.Join(directory, "missing.txt"), relative: "missing.txt", info: info}}
+	if err := digestFiles(missing, 4, nil); err == nil {
+		t.Fatalf("expected an error for a file that can't be read")
+	}
+}
+
+func TestSnapshotDirectoryMatchesHash(t *testing.T) {
+	directory, snapshot := t.TempDir(), t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		".dockerignore":      "secrets\n!secrets/public.txt",
+		"src/main.go":        "package main",
+		"secrets/key.pem":    "private",
+		"secrets/public.txt": "public",
+		"bin/run.sh":         "#!/bin/sh",
+	})
+	if err := os.Chmod(filepath.Join(directory, "bin/run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/main.go", filepath.Join(directory, "main.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _, diags := getDirectoryHash(HashQuery{Directory: directory})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	actual, diags := snapshotDirectory(HashQuery{Directory: directory}, snapshot)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if actual != expected {
+		t.Fatalf("expected the snapshot to have hash %s but got %s", expected, actual)
+	}
+
+	if _, err := os.Stat(filepath.Join(snapshot, "secrets/key.pem")); !os.IsNotExist(err) {
+		t.Fatalf("expected ignored files to be left out of the snapshot")
+	}
+
+	copied, _, _ := getDirectoryHash(HashQuery{Directory: snapshot})
+	if copied != expected {
+		t.Fatalf("expected hashing the snapshot to give %s but got %s", expected, copied)
+	}
+}
+
+func TestValidatePublishTargets(t *testing.T) {
+	if err := validatePublishTargets(1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := validatePublishTargets(0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := validatePublishTargets(0, false); err == nil {
+		t.Fatal("expected an image without publish targets to need build_only")
+	}
+	if err := validatePublishTargets(2, true); err == nil {
+		t.Fatal("expected build_only to reject publish targets")
+	}
+}
+
+func TestGetCompiledOutputsBuildOnly(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"build_only": true,
+	})
+	outputs := getCompiledOutputs(data)
+	if len(outputs) != 1 || outputs[0].Type != "image" || outputs[0].Attrs["push"] != "" {
+		t.Fatalf("expected an image that isn't pushed: %v", outputs)
+	}
+}
+
+func TestGetCompiledOutputsWasm(t *testing.T) {
+	target := map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1"}
+
+	linux := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"platforms":      []interface{}{"linux/amd64"},
+		"publish_target": []interface{}{target},
+	})
+	if _, ok := getCompiledOutputs(linux)[0].Attrs["oci-mediatypes"]; ok {
+		t.Fatalf("expected linux images to keep the media types of the daemon")
+	}
+
+	for _, platform := range []string{"wasi/wasm", "wasip1/wasm"} {
+		wasm := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+			"platforms":      []interface{}{platform},
+			"publish_target": []interface{}{target},
+		})
+		if attrs := getCompiledOutputs(wasm)[0].Attrs; attrs["oci-mediatypes"] != "true" || attrs["push"] != "true" {
+			t.Fatalf("expected %s to be published with oci media types but got %v", platform, attrs)
+		}
+	}
+}
+
+func TestGetCompiledOutputsWindows(t *testing.T) {
+	target := map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1"}
+
+	linux := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"platforms":      []interface{}{"linux/amd64"},
+		"publish_target": []interface{}{target},
+	})
+	if _, ok := getCompiledOutputs(linux)[0].Attrs["prefer-nondist-layers"]; ok {
+		t.Fatalf("expected linux images to push every layer")
+	}
+
+	windows := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"platforms":      []interface{}{"linux/amd64", "windows/amd64"},
+		"publish_target": []interface{}{target},
+	})
+	if getCompiledOutputs(windows)[0].Attrs["prefer-nondist-layers"] != "true" {
+		t.Fatalf("expected the layers of windows base images to be referenced")
+	}
+}
+
+func TestImageBuildAttributes(t *testing.T) {
+	attributes := map[string]bool{}
+	for _, x := range imageBuildAttributes() {
+		attributes[x] = true
+	}
+
+	for _, x := range []string{"context", "dockerfile", "args", "publish_target", "forward_ssh_agent_socket", "expected_context_digest", "context_tarball", "context_tarball_digest"} {
+		if !attributes[x] {
+			t.Fatalf("expected a change of %s to rebuild the image", x)
+		}
+	}
+
+	for _, x := range []string{"delete_strategy", "id", "image_digest", "context_digest"} {
+		if attributes[x] {
+			t.Fatalf("expected a change of %s not to rebuild the image", x)
+		}
+	}
+
+	for x := range imageNonBuildAttributes {
+		if _, ok := buildkitImageResource().Schema[x]; !ok {
+			t.Fatalf("%s is not an attribute of buildkit_image", x)
+		}
+	}
+}
+
+func TestReadImageDigestUrl(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"context":    "/context",
+		"dockerfile": "/context/Dockerfile",
+		"publish_target": []interface{}{map[string]interface{}{
+			"registry_url": host,
+			"name":         "app",
+			"tag":          "1.0.0",
+		}},
+	})
+
+	for i := 0; i < 2; i++ {
+		if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+
+		targets := data.Get("publish_target").([]interface{})
+		if len(targets) != 1 {
+			t.Fatalf("expected the target to be kept but got %v", targets)
+		}
+
+		// the same as createImage sets
+		expected := publishedTarget(map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"}, digest)
+		for k, v := range expected {
+			if actual := targets[0].(map[string]interface{})[k]; actual != v {
+				t.Fatalf("expected %s to be %s but got %s", k, v, actual)
+			}
+		}
+	}
+}
+
+func TestReadImagePlatformDigests(t *testing.T) {
+	host := testRegistry(t)
+	index := testPushIndex(t, host+"/app:1.0.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	for _, resolve := range []bool{true, false} {
+		data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+			"resolve_platform_digests": resolve,
+			"publish_target": []interface{}{
+				map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"},
+			},
+		}))
+
+		if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+
+		platform_digests := data.Get("publish_target.0.platform_digests").(map[string]interface{})
+
+		if !resolve {
+			if len(platform_digests) > 0 {
+				t.Fatalf("expected the platforms to be left alone: %v", platform_digests)
+			}
+			continue
+		}
+
+		expected := map[string]interface{}{
+			"linux/amd64":    manifest.Manifests[0].Digest.String(),
+			"linux/arm64/v8": manifest.Manifests[1].Digest.String(),
+		}
+		if !reflect.DeepEqual(platform_digests, expected) {
+			t.Fatalf("expected the digest of each platform %v but got %v", expected, platform_digests)
+		}
+	}
+}
+
+func TestReadImagesDataSourceMaps(t *testing.T) {
+	host := testRegistry(t)
+	testPushIndex(t, host+"/app:1.0.0", v1.Platform{OS: "linux", Architecture: "amd64"})
+	index := testPushIndex(t, host+"/app:1.1.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+		"registry_url":        host,
+		"repository_name":     "app",
+		"supported_platforms": []interface{}{"linux/amd64", "linux/arm64"},
+		"most_recent_only":    false,
+	})
+
+	if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	images_by_tag := data.Get("images_by_tag").(map[string]interface{})
+	if len(images_by_tag) != 2 || !strings.HasSuffix(images_by_tag["1.1.0"].(string), "/app@"+digest.String()) {
+		t.Fatalf("expected the digest url of each tag but got %v", images_by_tag)
+	}
+
+	// the images of the older tag aren't the most recent of their platform
+	digests_by_platform := data.Get("digests_by_platform").(map[string]interface{})
+	expected := map[string]interface{}{
+		"linux/amd64": manifest.Manifests[0].Digest.String(),
+		"linux/arm64": manifest.Manifests[1].Digest.String(),
+	}
+	if !reflect.DeepEqual(digests_by_platform, expected) {
+		t.Fatalf("expected %v but got %v", expected, digests_by_platform)
+	}
+}
+
+func TestReadImageMissingTarget(t *testing.T) {
+	host := testRegistry(t)
+	testPushImage(t, host+"/app:1.0.0")
+	testPushImage(t, host+"/other:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"context":    "/context",
+		"dockerfile": "/context/Dockerfile",
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"},
+			map[string]interface{}{"registry_url": host, "name": "gone", "tag": "1.0.0"},
+			map[string]interface{}{"registry_url": host, "name": "other", "tag": "1.0.0"},
+		},
+	})
+
+	if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	// only the missing tag differs from the configuration
+	targets := data.Get("publish_target").([]interface{})
+	for i, name := range []string{"app", "gone", "other"} {
+		target := targets[i].(map[string]interface{})
+		if target["name"] != name {
+			t.Fatalf("expected the targets to keep their order but got %v", targets)
+		}
+		if published := target["tag"] == "1.0.0"; published == (name == "gone") {
+			t.Fatalf("unexpected tag for %s: %v", name, target)
+		}
+	}
+}
+
+func TestReadImageSkipRemoteRefresh(t *testing.T) {
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}, skip_remote_refresh: true}
+
+	// the registry doesn't exist, so reading it would fail
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": "127.0.0.1:1", "name": "app", "tag": "1.0.0"},
+		},
+	}))
+	expected := data.Get("publish_target")
+
+	if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if !reflect.DeepEqual(data.Get("publish_target"), expected) {
+		t.Fatalf("expected the state to be kept as it is but got %v", data.Get("publish_target"))
+	}
+}
+
+func TestReadImageMissingLatestTag(t *testing.T) {
+	host := testRegistry(t)
+	testPushImage(t, host+"/app:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0", "also_tag_latest": true},
+		},
+	}))
+
+	if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	// only the alias is published again
+	target := data.Get("publish_target").([]interface{})[0].(map[string]interface{})
+	if target["tag"] != "1.0.0" || target["latest_tag"] != "" {
+		t.Fatalf("expected only the alias to be missing but got %v", target)
+	}
+}
+
+func TestAddDockerfileHashWithoutContext(t *testing.T) {
+	working, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(working) })
+
+	hashes := []string{}
+	for _, checkout := range []string{t.TempDir(), t.TempDir()} {
+		writeFiles(t, checkout, map[string]string{"Dockerfile": "FROM alpine"})
+		if err := os.Chdir(checkout); err != nil {
+			t.Fatal(err)
+		}
+
+		files := map[string]string{}
+		hash, diags := addDockerfileHash("sha256:0", files, "", filepath.Join(checkout, "Dockerfile"))
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+		if _, ok := files["Dockerfile"]; !ok {
+			t.Fatalf("expected the dockerfile to be keyed relative to the working directory: %v", files)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Fatalf("expected the same dockerfile in another checkout to have the same hash")
+	}
+}
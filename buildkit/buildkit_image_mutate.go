@@ -0,0 +1,577 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func buildkitImageMutateResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageMutate,
+		ReadContext:   readImageMutate,
+		UpdateContext: updateImageMutate,
+		DeleteContext: deleteImageMutate,
+		CustomizeDiff: diffImageMutate,
+		Description:   "An existing image with changes to its configuration or an additional layer, published under a new tag without rebuilding it.",
+		Schema: map[string]*schema.Schema{
+			"source_registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url of the image to change.",
+			},
+			"source_repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name of the image to change.",
+			},
+			"source_tag": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"source_tag", "source_digest"},
+				Description:  "The tag of the image to change. The image is changed again whenever the tag moves.",
+			},
+			"source_digest": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ExactlyOneOf: []string{"source_tag", "source_digest"},
+				Description:  "The digest of the image to change.",
+			},
+			"destination_registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url to publish the changed image to.",
+			},
+			"destination_repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name to publish the changed image to.",
+			},
+			"destination_tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The tag to publish the changed image as.",
+			},
+			"labels": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Labels to add to the configuration of the image.",
+			},
+			"annotations": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Annotations to add to the manifest (and index) of the image.",
+			},
+			"env": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Environment variables to set, replacing variables of the image with the same name.",
+			},
+			"entrypoint": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Replaces the entrypoint of the image.",
+			},
+			"cmd": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Replaces the command of the image.",
+			},
+			"user": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "Replaces the user of the image.",
+			},
+			"workdir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "Replaces the working directory of the image.",
+			},
+			"layer_directory": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "Path to a local directory whose contents are added to the image as a new layer.",
+			},
+			"layer_path": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "/",
+				Description: "The directory within the image the contents of `layer_directory` are placed in.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the image to be changed again when any of the values change, e.g. the hash of `layer_directory`.",
+			},
+			"base_digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest of the source image the changes were applied to.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest of the changed image.",
+			},
+			"tag_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The tag-based url for the changed image.",
+			},
+			"digest_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hash-based url for the changed image.",
+			},
+		},
+	}
+}
+
+type imageMutation struct {
+	labels      map[string]string
+	annotations map[string]string
+	env         map[string]string
+	entrypoint  []string
+	cmd         []string
+	user        string
+	workdir     string
+	layer       []byte
+}
+
+func getImageMutation(data *schema.ResourceData) (imageMutation, error) {
+	result := imageMutation{
+		labels:      getStringMap(data, "labels"),
+		annotations: getStringMap(data, "annotations"),
+		env:         getStringMap(data, "env"),
+		entrypoint:  getStringList(data, "entrypoint"),
+		cmd:         getStringList(data, "cmd"),
+		user:        data.Get("user").(string),
+		workdir:     data.Get("workdir").(string),
+	}
+
+	if directory := data.Get("layer_directory").(string); directory != "" {
+		layer, err := makeDirectoryLayer(directory, data.Get("layer_path").(string))
+		if err != nil {
+			return result, err
+		}
+		result.layer = layer
+	}
+
+	return result, nil
+}
+
+// makeDirectoryLayer tars the contents of the directory under the given path.
+// Timestamps and ownership are reset so the same contents always produce the
+// same layer.
+func makeDirectoryLayer(directory string, destination string) ([]byte, error) {
+
+	buffer := &bytes.Buffer{}
+	writer := tar.NewWriter(buffer)
+
+	err := filepath.Walk(directory, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(directory, file)
+		if err != nil || relative == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = strings.TrimPrefix(path.Join(destination, filepath.ToSlash(relative)), "/")
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		header.Format = tar.FormatPAX
+
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		content, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		_, err = io.Copy(writer, content)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// mutateImage applies the mutation to a single platform image.
+func mutateImage(image v1.Image, mutation imageMutation) (v1.Image, error) {
+
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	config := *configFile.Config.DeepCopy()
+
+	if len(mutation.labels) > 0 {
+		config.Labels = merge(config.Labels, mutation.labels)
+	}
+
+	if len(mutation.env) > 0 {
+		keys := make([]string, 0, len(mutation.env))
+		for k := range mutation.env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		env := make([]string, 0, len(config.Env)+len(keys))
+		for _, x := range config.Env {
+			key, _, _ := strings.Cut(x, "=")
+			if _, ok := mutation.env[key]; !ok {
+				env = append(env, x)
+			}
+		}
+		for _, k := range keys {
+			env = append(env, k+"="+mutation.env[k])
+		}
+		config.Env = env
+	}
+
+	if len(mutation.entrypoint) > 0 {
+		config.Entrypoint = mutation.entrypoint
+	}
+
+	if len(mutation.cmd) > 0 {
+		config.Cmd = mutation.cmd
+	}
+
+	if mutation.user != "" {
+		config.User = mutation.user
+	}
+
+	if mutation.workdir != "" {
+		config.WorkingDir = mutation.workdir
+	}
+
+	result, err := mutate.Config(image, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if mutation.layer != nil {
+		mediaType, err := image.MediaType()
+		if err != nil {
+			return nil, err
+		}
+
+		layerMediaType := types.DockerLayer
+		if mediaType == types.OCIManifestSchema1 {
+			layerMediaType = types.OCILayer
+		}
+
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(mutation.layer)), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = mutate.Append(result, mutate.Addendum{
+			Layer:     layer,
+			MediaType: layerMediaType,
+			History: v1.History{
+				CreatedBy: "terraform-provider-buildkit: buildkit_image_mutate",
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(mutation.annotations) > 0 {
+		result = mutate.Annotations(result, mutation.annotations).(v1.Image)
+	}
+
+	return result, nil
+}
+
+// mutateIndex applies the mutation to every platform of the index. The
+// attestations buildx adds to an index are dropped since they describe the
+// images as they were before.
+func mutateIndex(index v1.ImageIndex, mutation imageMutation) (v1.ImageIndex, error) {
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	result := mutate.RemoveManifests(index, func(v1.Descriptor) bool { return true })
+
+	for _, x := range manifest.Manifests {
+		if isAttestationManifest(x) {
+			continue
+		}
+
+		image, err := index.Image(x.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		mutated, err := mutateImage(image, mutation)
+		if err != nil {
+			return nil, err
+		}
+
+		result = mutate.AppendManifests(result, mutate.IndexAddendum{
+			Add: mutated,
+			Descriptor: v1.Descriptor{
+				MediaType: x.MediaType,
+				Platform:  x.Platform,
+			},
+		})
+	}
+
+	if len(mutation.annotations) > 0 {
+		result = mutate.Annotations(result, mutation.annotations).(v1.ImageIndex)
+	}
+
+	return result, nil
+}
+
+// publishMutatedImage applies the mutation to the source image and pushes the
+// result to the destination, returning the digests of both.
+func publishMutatedImage(ctx context.Context, source string, sourceAuth RegistryAuth, destination string, destinationAuth RegistryAuth, mutation imageMutation) (string, string, error) {
+
+	sourceReference, err := name.ParseReference(source)
+	if err != nil {
+		return "", "", err
+	}
+
+	destinationReference, err := name.ParseReference(destination)
+	if err != nil {
+		return "", "", err
+	}
+
+	descriptor, err := remote.Get(sourceReference, makeOptions(craneOptions(ctx, sourceAuth)...).Remote...)
+	if err != nil {
+		return "", "", err
+	}
+
+	destinationOptions := makeOptions(craneOptions(ctx, destinationAuth)...).Remote
+
+	var digest v1.Hash
+
+	if isV2IndexManifest(descriptor.MediaType) {
+		index, err := descriptor.ImageIndex()
+		if err != nil {
+			return "", "", err
+		}
+		mutated, err := mutateIndex(index, mutation)
+		if err != nil {
+			return "", "", err
+		}
+		if err = remote.WriteIndex(destinationReference, mutated, destinationOptions...); err != nil {
+			return "", "", err
+		}
+		if digest, err = mutated.Digest(); err != nil {
+			return "", "", err
+		}
+	} else {
+		image, err := descriptor.Image()
+		if err != nil {
+			return "", "", err
+		}
+		mutated, err := mutateImage(image, mutation)
+		if err != nil {
+			return "", "", err
+		}
+		if err = remote.Write(destinationReference, mutated, destinationOptions...); err != nil {
+			return "", "", err
+		}
+		if digest, err = mutated.Digest(); err != nil {
+			return "", "", err
+		}
+	}
+
+	destinationAuth.digests.remember(destination, digest.String())
+
+	return descriptor.Digest.String(), digest.String(), nil
+}
+
+func createImageMutate(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	source_registry_url := data.Get("source_registry_url").(string)
+	destination_registry_url := data.Get("destination_registry_url").(string)
+	destination_repository_name := data.Get("destination_repository_name").(string)
+	destination_tag := data.Get("destination_tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	mutation, err := getImageMutation(data)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not make a layer of '%s'.", data.Get("layer_directory").(string)),
+			Detail:   err.Error(),
+		}}
+	}
+
+	tag_url := fullImage(destination_registry_url, destination_repository_name+":"+destination_tag)
+
+	base_digest, digest, err := publishMutatedImage(ctx,
+		getCopySource(data), provider.registryAuth(source_registry_url),
+		tag_url, provider.registryAuth(destination_registry_url), mutation)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("base_digest", base_digest)
+	data.Set("digest", digest)
+	data.Set("tag_url", tag_url)
+	data.Set("digest_url", fullImage(destination_registry_url, destination_repository_name+"@"+digest))
+
+	return diag.Diagnostics{}
+}
+
+func readImageMutate(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	destination_registry_url := data.Get("destination_registry_url").(string)
+	destination_repository_name := data.Get("destination_repository_name").(string)
+	destination_tag := data.Get("destination_tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return diag.Diagnostics{}
+	}
+
+	auth := provider.registryAuth(destination_registry_url)
+
+	hash, err := getRemoteImageHash(ctx, fullImage(destination_registry_url, destination_repository_name+":"+destination_tag), auth)
+
+	if err != nil && !isNotFound(err) {
+		return diag.Diagnostics{readFailure(provider, destination_registry_url, fullImage(destination_registry_url, destination_repository_name+":"+destination_tag), err)}
+	}
+
+	// the tag was removed or moved outside of terraform so the image needs to be published again
+	if err != nil || hash != data.Get("digest").(string) {
+		data.SetId("")
+	}
+
+	return diag.Diagnostics{}
+}
+
+// diffImageMutate plans another mutation when the source tag has moved since
+// the changes were last applied.
+func diffImageMutate(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+
+	if diff.Id() == "" {
+		return nil
+	}
+
+	source_registry_url := diff.Get("source_registry_url").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return nil
+	}
+
+	auth := provider.registryAuth(source_registry_url)
+
+	hash, err := getRemoteImageHash(ctx, getCopySource(diff), auth)
+
+	if err != nil {
+		return err
+	}
+
+	if hash != diff.Get("base_digest").(string) {
+		for _, x := range []string{"base_digest", "digest", "digest_url"} {
+			if err := diff.SetNewComputed(x); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func updateImageMutate(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createImageMutate(ctx, data, meta)
+}
+
+func deleteImageMutate(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// the image is left in place, like the images published by buildkit_image
+	return diagnostics
+}
@@ -0,0 +1,122 @@
+package buildkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io"
+	"testing"
+)
+
+func TestMakeDirectoryLayerIsReproducible(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	files := map[string]string{"config.yaml": "a: b", "nested/data.txt": "data"}
+	writeFiles(t, first, files)
+	writeFiles(t, second, files)
+
+	one, err := makeDirectoryLayer(first, "/etc/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	two, err := makeDirectoryLayer(second, "/etc/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(one, two) {
+		t.Fatal("expected identical directories to produce identical layers")
+	}
+
+	names := make([]string, 0)
+	reader := tar.NewReader(bytes.NewReader(one))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+
+	expected := []string{"etc/app/config.yaml", "etc/app/nested/", "etc/app/nested/data.txt"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v but got %v", expected, names)
+		}
+	}
+}
+
+func TestImageMutate(t *testing.T) {
+	host := testRegistry(t)
+	base := testPushImage(t, host+"/app:1.0.0")
+
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{"config.yaml": "a: b"})
+
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageMutateResource().Schema, map[string]interface{}{
+		"source_registry_url":         host,
+		"source_repository_name":      "app",
+		"source_tag":                  "1.0.0",
+		"destination_registry_url":    host,
+		"destination_repository_name": "app",
+		"destination_tag":             "1.0.0-patched",
+		"labels":                      map[string]interface{}{"org.opencontainers.image.vendor": "example"},
+		"env":                         map[string]interface{}{"APP_ENV": "production"},
+		"user":                        "nobody",
+		"layer_directory":             directory,
+		"layer_path":                  "/etc/app",
+	})
+
+	if diags := createImageMutate(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("base_digest").(string) != base {
+		t.Fatalf("expected base digest %s but got %s", base, data.Get("base_digest"))
+	}
+
+	image, err := crane.Pull(host + "/app:1.0.0-patched")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest := testDigestOf(t, image); digest != data.Get("digest").(string) {
+		t.Fatalf("expected digest %s but got %s", data.Get("digest"), digest)
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Config.Labels["org.opencontainers.image.vendor"] != "example" || config.Config.User != "nobody" {
+		t.Fatalf("expected the configuration to be changed but got %+v", config.Config)
+	}
+
+	found := false
+	for _, x := range config.Config.Env {
+		found = found || x == "APP_ENV=production"
+	}
+	if !found {
+		t.Fatalf("expected APP_ENV to be set but got %v", config.Config.Env)
+	}
+
+	layers, err := image.Layers()
+	if err != nil || len(layers) != 2 {
+		t.Fatalf("expected a layer to be appended but got %d layers (%v)", len(layers), err)
+	}
+
+	if diags := readImageMutate(context.Background(), data, meta); len(diags) > 0 || data.Id() == "" {
+		t.Fatalf("expected the published image to be found: %v", diags)
+	}
+}
@@ -0,0 +1,150 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/containerd/containerd/platforms"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/session"
+	"time"
+)
+
+func buildkitImagePullResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImagePull,
+		ReadContext:   readImagePull,
+		UpdateContext: updateImagePull,
+		DeleteContext: deleteImagePull,
+		Description:   "Pulls images into the content store of the buildkit daemon ahead of time, so that builds using them as base images don't have to.",
+		Schema: map[string]*schema.Schema{
+			"images": {
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "References of the images to pull (e.g. `alpine:3.15` or `golang@sha256:...`).",
+			},
+			"platforms": {
+				Type:     schema.TypeSet,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The platforms / architectures to pull the images for.",
+			},
+			"force_pull": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Whether to check the registry for a newer image behind each tag, rather than keeping one the daemon already has.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the images to be pulled again when any of the values change.",
+			},
+			"last_pulled": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The time (RFC 3339) the images were last pulled at.",
+			},
+		},
+	}
+}
+
+// pullImageState describes a build that only pulls the image. Buildkit pulls
+// layers lazily, so a file is written on top of the image to make sure they
+// are actually fetched and unpacked.
+func pullImageState(image string, platform string, forcePull bool) (llb.State, error) {
+	parsed, err := platforms.Parse(platform)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	options := []llb.ImageOption{llb.Platform(parsed)}
+	if forcePull {
+		options = append(options, llb.ResolveModeForcePull)
+	}
+
+	return llb.Image(image, options...).File(llb.Mkfile("/.terraform-provider-buildkit-pull", 0644, nil)), nil
+}
+
+func createImagePull(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	images := getStringList(data, "images")
+	force_pull := data.Get("force_pull").(bool)
+	provider := meta.(TerraformProviderBuildkit)
+	platforms := getPlatforms(data)
+
+	cli := provider.buildkit_client
+
+	diagnostics := make(diag.Diagnostics, 0)
+
+	for _, image := range images {
+		for _, platform := range platforms {
+			state, err := pullImageState(image, platform, force_pull)
+
+			if err != nil {
+				return diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  err.Error(),
+				}}
+			}
+
+			definition, err := state.Marshal(ctx)
+
+			if err != nil {
+				return diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  err.Error(),
+				}}
+			}
+
+			_, err = cli.Solve(ctx, definition, client.SolveOpt{
+				Session: []session.Attachable{NewDockerAuthProvider(provider.registry_auth)},
+			}, nil)
+
+			// keep pulling the other images so one bad reference doesn't leave the rest cold
+			if err != nil {
+				diagnostics = append(diagnostics, buildkitFailure(provider, "pull "+image+" for "+platform, err))
+			}
+		}
+	}
+
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("last_pulled", time.Now().UTC().Format(time.RFC3339))
+
+	return diag.Diagnostics{}
+}
+
+func readImagePull(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// pulls only happen on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateImagePull(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createImagePull(ctx, data, meta)
+}
+
+func deleteImagePull(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
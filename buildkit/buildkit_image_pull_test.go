@@ -0,0 +1,52 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/moby/buildkit/solver/pb"
+	"testing"
+)
+
+func TestPullImageState(t *testing.T) {
+	state, err := pullImageState("alpine:3.15", "linux/arm/v7", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	definition, err := state.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var source *pb.Op
+	for _, x := range definition.Def {
+		op := &pb.Op{}
+		if err := op.Unmarshal(x); err != nil {
+			t.Fatal(err)
+		}
+		if op.GetSource() != nil {
+			source = op
+		}
+	}
+
+	if source == nil {
+		t.Fatal("expected the definition to pull an image")
+	}
+
+	if identifier := source.GetSource().Identifier; identifier != "docker-image://docker.io/library/alpine:3.15" {
+		t.Fatalf("unexpected source %s", identifier)
+	}
+
+	if mode := source.GetSource().Attrs[pb.AttrImageResolveMode]; mode != pb.AttrImageResolveModeForcePull {
+		t.Fatalf("expected the image to be force pulled, got '%s'", mode)
+	}
+
+	if source.Platform == nil || source.Platform.Architecture != "arm" || source.Platform.Variant != "v7" {
+		t.Fatalf("unexpected platform %v", source.Platform)
+	}
+}
+
+func TestPullImageStateInvalidPlatform(t *testing.T) {
+	if _, err := pullImageState("alpine:3.15", "not a platform!", false); err == nil {
+		t.Fatal("expected an invalid platform to fail")
+	}
+}
@@ -0,0 +1,278 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/session"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// severities are ordered from least to most severe
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func buildkitImageScanResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageScan,
+		ReadContext:   readImageScan,
+		UpdateContext: updateImageScan,
+		DeleteContext: deleteImageScan,
+		Description:   "Scans an image for vulnerabilities with trivy (run on the buildkit daemon) and fails the apply when there are findings of a configured severity.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The repository name of the image.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The digest of the image to scan, e.g. the `image_digest` of a `buildkit_image`.",
+			},
+			"fail_on_severity": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "CRITICAL",
+				ValidateFunc: validation.StringInSlice(append([]string{""}, severities...), true),
+				Description:  "The apply fails when there are findings of this severity or above (one of `UNKNOWN`, `LOW`, `MEDIUM`, `HIGH` or `CRITICAL`). Set to an empty string to never fail.",
+			},
+			"ignore_unfixed": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to leave out vulnerabilities that have no fix yet.",
+			},
+			"scanner_image": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "aquasec/trivy:0.30.4",
+				Description: "The trivy image the scan is run with.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the image to be scanned again when any of the values change.",
+			},
+			"report": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The JSON report of the last scan.",
+			},
+			"critical_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of critical findings.",
+			},
+			"high_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of high severity findings.",
+			},
+			"medium_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of medium severity findings.",
+			},
+			"low_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of low severity findings.",
+			},
+			"unknown_count": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of findings with an unknown severity.",
+			},
+		},
+	}
+}
+
+func severityRank(severity string) int {
+	for i, x := range severities {
+		if strings.EqualFold(x, severity) {
+			return i
+		}
+	}
+	return -1
+}
+
+func countSeverities(report TrivyReport) map[string]int {
+	result := map[string]int{}
+	for _, x := range severities {
+		result[x] = 0
+	}
+	for _, target := range report.Results {
+		for _, x := range target.Vulnerabilities {
+			severity := strings.ToUpper(x.Severity)
+			if severityRank(severity) < 0 {
+				severity = "UNKNOWN"
+			}
+			result[severity]++
+		}
+	}
+	return result
+}
+
+// failingSeverities returns the severities at or above the threshold that
+// have findings, from most to least severe.
+func failingSeverities(counts map[string]int, threshold string) []string {
+	result := make([]string, 0)
+	if threshold == "" {
+		return result
+	}
+	for i := len(severities) - 1; i >= severityRank(threshold); i-- {
+		if counts[severities[i]] > 0 {
+			result = append(result, fmt.Sprintf("%d %s", counts[severities[i]], severities[i]))
+		}
+	}
+	return result
+}
+
+// scanImage runs trivy against the image on the buildkit daemon and returns
+// its JSON report. The vulnerability database is kept in a cache mount so it
+// is only downloaded when it's outdated.
+func scanImage(ctx context.Context, provider TerraformProviderBuildkit, reference string, auth RegistryAuth, scannerImage string, ignoreUnfixed bool) ([]byte, error) {
+
+	args := []string{"trivy", "--quiet", "image", "--format", "json", "--output", "/out/report.json"}
+	if ignoreUnfixed {
+		args = append(args, "--ignore-unfixed")
+	}
+	args = append(args, reference)
+
+	secrets := map[string][]byte{}
+	options := []llb.RunOption{
+		llb.Args(args),
+		llb.IgnoreCache,
+		llb.AddMount("/root/.cache/trivy", llb.Scratch(), llb.AsPersistentCacheDir("terraform-provider-buildkit-trivy", llb.CacheMountShared)),
+	}
+
+	if auth.username != "" {
+		secrets["TRIVY_USERNAME"] = []byte(auth.username)
+		secrets["TRIVY_PASSWORD"] = []byte(auth.password)
+		for id := range secrets {
+			options = append(options, llb.AddSecret(id, llb.SecretID(id), llb.SecretAsEnv(true)))
+		}
+	}
+
+	run := llb.Image(scannerImage).Run(options...)
+	definition, err := run.AddMount("/out", llb.Scratch()).Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	directory, err := ioutil.TempDir("", "buildkit-scan")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(directory)
+
+	cli := provider.buildkit_client
+
+	_, err = cli.Solve(ctx, definition, client.SolveOpt{
+		Exports: []client.ExportEntry{{
+			Type:      client.ExporterLocal,
+			OutputDir: directory,
+		}},
+		Session: []session.Attachable{
+			NewDockerAuthProvider(provider.registry_auth),
+			getSecretsProvider(secrets),
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(filepath.Join(directory, "report.json"))
+}
+
+func createImageScan(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	digest := data.Get("digest").(string)
+	fail_on_severity := data.Get("fail_on_severity").(string)
+	ignore_unfixed := data.Get("ignore_unfixed").(bool)
+	scanner_image := data.Get("scanner_image").(string)
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+
+	report, err := scanImage(ctx, provider, fullImage(registry_url, repository_name+"@"+digest), auth, scanner_image, ignore_unfixed)
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "scan "+fullImage(registry_url, repository_name+"@"+digest), err)}
+	}
+
+	parsed := TrivyReport{}
+	if err := json.Unmarshal(report, &parsed); err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not parse the scan report.",
+			Detail:   err.Error(),
+		}}
+	}
+
+	counts := countSeverities(parsed)
+
+	// no id is set so a failed scan leaves nothing behind and runs again on the next apply
+	if failing := failingSeverities(counts, fail_on_severity); len(failing) > 0 {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("%s has vulnerabilities of severity %s or above.", fullImage(registry_url, repository_name+"@"+digest), strings.ToUpper(fail_on_severity)),
+			Detail:   "Found " + strings.Join(failing, ", ") + " findings.",
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("report", string(report))
+	data.Set("critical_count", counts["CRITICAL"])
+	data.Set("high_count", counts["HIGH"])
+	data.Set("medium_count", counts["MEDIUM"])
+	data.Set("low_count", counts["LOW"])
+	data.Set("unknown_count", counts["UNKNOWN"])
+
+	return diag.Diagnostics{}
+}
+
+func readImageScan(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// scans only happen on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateImageScan(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := createImageScan(ctx, data, meta)
+
+	// the state is left as it was before a failed scan, otherwise terraform
+	// would record the new inputs and see nothing to do on the next apply
+	if diagnostics.HasError() {
+		data.Partial(true)
+	}
+
+	return diagnostics
+}
+
+func deleteImageScan(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
@@ -0,0 +1,117 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/moby/buildkit/client"
+	"reflect"
+	"testing"
+)
+
+const testTrivyReport = `{
+  "SchemaVersion": 2,
+  "ArtifactName": "alpine:3.14",
+  "Results": [
+    {
+      "Target": "alpine:3.14 (alpine 3.14.2)",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2021-42378", "PkgName": "busybox", "Severity": "HIGH"},
+        {"VulnerabilityID": "CVE-2021-42379", "PkgName": "busybox", "Severity": "HIGH"},
+        {"VulnerabilityID": "CVE-2021-3711", "PkgName": "libcrypto1.1", "Severity": "CRITICAL"}
+      ]
+    },
+    {
+      "Target": "app/package-lock.json",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2022-0001", "PkgName": "lodash", "Severity": "low"},
+        {"VulnerabilityID": "GHSA-0000", "PkgName": "left-pad", "Severity": "NEGLIGIBLE"}
+      ]
+    }
+  ]
+}`
+
+func TestCountSeverities(t *testing.T) {
+	report := TrivyReport{}
+	if err := json.Unmarshal([]byte(testTrivyReport), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"UNKNOWN": 1, "LOW": 1, "MEDIUM": 0, "HIGH": 2, "CRITICAL": 1}
+	if counts := countSeverities(report); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected %v, got %v", expected, counts)
+	}
+}
+
+func TestFailingSeverities(t *testing.T) {
+	counts := map[string]int{"UNKNOWN": 1, "LOW": 1, "MEDIUM": 0, "HIGH": 2, "CRITICAL": 0}
+
+	cases := map[string][]string{
+		"":         {},
+		"CRITICAL": {},
+		"high":     {"2 HIGH"},
+		"MEDIUM":   {"2 HIGH"},
+		"UNKNOWN":  {"2 HIGH", "1 LOW", "1 UNKNOWN"},
+	}
+
+	for threshold, expected := range cases {
+		if failing := failingSeverities(counts, threshold); !reflect.DeepEqual(failing, expected) {
+			t.Errorf("expected %v for '%s', got %v", expected, threshold, failing)
+		}
+	}
+}
+
+func testUnreachableProvider(t *testing.T) TerraformProviderBuildkit {
+	cli, err := client.New(context.Background(), "tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return TerraformProviderBuildkit{buildkit_client: cli, registry_auth: map[string]RegistryAuth{}}
+}
+
+// testFailedUpdate applies a change of the attributes to the resource and
+// returns the state terraform would record when the update fails.
+func testFailedUpdate(t *testing.T, resource *schema.Resource, before map[string]interface{}, after map[string]interface{}) *terraform.InstanceState {
+	provider := testUnreachableProvider(t)
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, before)
+	data.SetId("previous")
+	state := data.State()
+
+	diff, err := resource.SimpleDiff(context.Background(), state, terraform.NewResourceConfigRaw(after), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, diags := resource.Apply(context.Background(), state, diff, provider)
+	if !diags.HasError() {
+		t.Fatal("expected the update to fail")
+	}
+
+	return result
+}
+
+func TestUpdateImageScanFailure(t *testing.T) {
+	before := map[string]interface{}{"registry_url": "ghcr.io", "repository_name": "org/app", "digest": "sha256:1111"}
+	after := map[string]interface{}{"registry_url": "ghcr.io", "repository_name": "org/app", "digest": "sha256:2222"}
+
+	state := testFailedUpdate(t, buildkitImageScanResource(), before, after)
+
+	if state.ID != "previous" || state.Attributes["digest"] != "sha256:1111" {
+		t.Fatalf("expected the scanned digest to be kept so the scan runs again: %v", state.Attributes)
+	}
+}
+
+func TestFailOnSeverity(t *testing.T) {
+	validate := buildkitImageScanResource().Schema["fail_on_severity"].ValidateFunc
+	for _, x := range []string{"", "high", "CRITICAL"} {
+		if _, errs := validate(x, "fail_on_severity"); len(errs) > 0 {
+			t.Fatalf("expected '%s' to be valid: %v", x, errs)
+		}
+	}
+	if _, errs := validate("SEVERE", "fail_on_severity"); len(errs) == 0 {
+		t.Fatal("expected an unknown severity to be rejected when planning")
+	}
+}
@@ -1,11 +1,14 @@
 package buildkit
 
 import (
+	"context"
 	"fmt"
+	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -291,3 +294,218 @@ func addAPublishTarget(folder string) string {
 		folder,
 		folder)
 }
+
+func TestAccRepositoryTags_Basic(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: map[string]func() (*schema.Provider, error){
+			"buildkit": func() (*schema.Provider, error) {
+				return Provider(), nil
+			},
+		},
+		Steps: []resource.TestStep{
+			{
+				Config: dataSource_repositoryTags(),
+				Check:  resource.ComposeTestCheckFunc(printState),
+			},
+		},
+	})
+}
+
+func dataSource_repositoryTags() string {
+	return fmt.Sprintf(`
+		provider buildkit {
+			buildkit_url = "tcp://127.0.0.1:1234"
+			registry_auth {
+				registry_url = "https://docker.io"
+				username = "%s"
+				password = "%s"
+			}
+		}
+
+		data buildkit_repository_tags this {
+			registry_url = "https://docker.io"
+			repository_name = "rutledgepaulv/paul-test"
+		}
+	`,
+		os.Getenv("DOCKER_USERNAME"),
+		os.Getenv("DOCKER_TOKEN"))
+}
+
+func TestAccPrune_Basic(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: map[string]func() (*schema.Provider, error){
+			"buildkit": func() (*schema.Provider, error) {
+				return Provider(), nil
+			},
+		},
+		Steps: []resource.TestStep{
+			{
+				Config: resource_prune(),
+				Check:  resource.ComposeTestCheckFunc(printState),
+			},
+		},
+	})
+}
+
+func resource_prune() string {
+	return `
+		provider buildkit {
+			buildkit_url = "tcp://127.0.0.1:1234"
+		}
+
+		resource buildkit_prune this {
+			keep_duration = "48h"
+			filters = ["type==exec.cachemount"]
+		}
+	`
+}
+
+func TestAccCacheWarm_Basic(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: map[string]func() (*schema.Provider, error){
+			"buildkit": func() (*schema.Provider, error) {
+				return Provider(), nil
+			},
+		},
+		Steps: []resource.TestStep{
+			{
+				Config: resource_cacheWarm(),
+				Check:  resource.ComposeTestCheckFunc(printState),
+			},
+		},
+	})
+}
+
+func resource_cacheWarm() string {
+	return `
+		provider buildkit {
+			buildkit_url = "tcp://127.0.0.1:1234"
+		}
+
+		resource buildkit_cache_warm this {
+			context = "../examples/basic"
+			dockerfile = "../examples/basic/Dockerfile"
+			platforms = ["linux/amd64"]
+		}
+	`
+}
+
+// testUnknown is how terraform passes values that are only known after apply
+// to the legacy sdk.
+const testUnknown = "74D93920-ED26-11E3-AC10-0800200C9A66"
+
+func testImageConfig(overrides map[string]interface{}) map[string]interface{} {
+	config := map[string]interface{}{
+		"context":    "../examples/basic",
+		"dockerfile": "../examples/basic/Dockerfile",
+		"platforms":  []interface{}{"linux/amd64"},
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1"},
+		},
+	}
+	for k, v := range overrides {
+		config[k] = v
+	}
+	return config
+}
+
+func TestImageDiffUnknownInputs(t *testing.T) {
+	resource := buildkitImageResource()
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, testImageConfig(nil))
+	data.SetId("image")
+	_ = data.Set("image_digest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	_ = data.Set("publish_target", []interface{}{
+		publishedTarget(data.Get("publish_target").([]interface{})[0].(map[string]interface{}), "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+	})
+	state := data.State()
+
+	unchanged, err := resource.Diff(context.Background(), state, terraform.NewResourceConfigRaw(testImageConfig(nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil && unchanged.Attributes["image_digest"] != nil {
+		t.Fatalf("expected an unchanged image to keep its digest: %v", unchanged)
+	}
+
+	for _, x := range []map[string]interface{}{
+		{"expected_context_digest": testUnknown},
+		{"context": testUnknown},
+		{"context": "../examples/ignore"},
+	} {
+		diff, err := resource.Diff(context.Background(), state, terraform.NewResourceConfigRaw(testImageConfig(x)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff == nil || diff.Attributes["image_digest"] == nil || !diff.Attributes["image_digest"].NewComputed {
+			t.Fatalf("expected the digest to be known after apply for %v: %v", x, diff)
+		}
+		if diff.Attributes["context_digest"] == nil || !diff.Attributes["context_digest"].NewComputed {
+			t.Fatalf("expected the context digest to be known after apply for %v: %v", x, diff)
+		}
+		if diff.RequiresNew() {
+			t.Fatalf("expected the image to be rebuilt in place for %v", x)
+		}
+	}
+}
+
+func TestImageDiffPlansTargetDigests(t *testing.T) {
+	resource := buildkitImageResource()
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	resolved := map[string]interface{}{"resolve_platform_digests": true}
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, testImageConfig(resolved))
+	data.SetId("image")
+	_ = data.Set("image_digest", digest)
+	_ = data.Set("publish_target", []interface{}{
+		merge(publishedTarget(data.Get("publish_target").([]interface{})[0].(map[string]interface{}), digest), map[string]interface{}{
+			"platform_digests": map[string]interface{}{"linux/amd64": digest},
+		}),
+	})
+	state := data.State()
+	prior, err := state.AttrsAsObjectValue(resource.CoreConfigSchema().ImpliedType())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged, err := resource.Diff(context.Background(), state, terraform.NewResourceConfigRaw(testImageConfig(resolved)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range unchanged.Attributes {
+		if strings.HasPrefix(k, "publish_target.") {
+			t.Fatalf("expected an unchanged image to keep its publish targets: %v", unchanged)
+		}
+	}
+
+	diff, err := resource.Diff(context.Background(), state, terraform.NewResourceConfigRaw(testImageConfig(merge(resolved, map[string]interface{}{"context": "../examples/ignore"}))), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned, err := diff.ApplyToValue(prior, resource.CoreConfigSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := planned.GetAttr("publish_target").Index(cty.NumberIntVal(0))
+	for _, x := range []cty.Value{target.GetAttr("digest"), target.GetAttr("digest_url"), target.GetAttr("platform_digests").Index(cty.StringVal("linux/amd64"))} {
+		if x.IsKnown() {
+			t.Fatalf("expected the digests of the rebuilt image to be known after apply: %#v", target)
+		}
+	}
+	if !target.GetAttr("tag").IsKnown() || target.GetAttr("tag").AsString() != "1" {
+		t.Fatalf("expected the configured tag to stay known: %#v", target)
+	}
+
+	// the targets of the state aren't kept once the configuration has none
+	config := testImageConfig(map[string]interface{}{"build_only": true})
+	delete(config, "publish_target")
+	state.RawConfig = cty.ObjectVal(map[string]cty.Value{"publish_target": cty.ListValEmpty(cty.EmptyObject)})
+	removed, err := resource.Diff(context.Background(), state, terraform.NewResourceConfigRaw(config), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed.Attributes["publish_target.#"] == nil || removed.Attributes["publish_target.#"].New != "0" {
+		t.Fatalf("expected the publish targets to be removed: %v", removed)
+	}
+}
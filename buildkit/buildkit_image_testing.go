@@ -0,0 +1,217 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/platforms"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/session"
+	"sort"
+)
+
+// the output of a test is truncated to its end, where failures are reported
+const maxImageTestOutput = 64 * 1024
+
+func buildkitImageTestResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageTest,
+		ReadContext:   readImageTest,
+		UpdateContext: updateImageTest,
+		DeleteContext: deleteImageTest,
+		Description:   "Runs a command inside of an image on the buildkit daemon and fails the apply if it exits with a non-zero status.",
+		Schema: map[string]*schema.Schema{
+			"image": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The image to run the command in, e.g. the `digest_url` of a `publish_target` of a `buildkit_image`.",
+			},
+			"command": {
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The command to run. The entrypoint of the image is not used, so include it when the test relies on it.",
+			},
+			"env": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "Environment variables for the command, in addition to the ones set by the image.",
+			},
+			"workdir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The directory to run the command in. Defaults to the working directory of the image.",
+			},
+			"user": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The user to run the command as. Defaults to the user of the image.",
+			},
+			"platform": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "linux/amd64",
+				Description: "The platform of the image to run.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the command to be run again when any of the values change.",
+			},
+			"output": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The combined stdout and stderr of the last run.",
+			},
+		},
+	}
+}
+
+// makeImageTestState describes running the command on top of the image. The
+// resolver fills in the environment, working directory and user of the image.
+func makeImageTestState(image string, platform string, command []string, env map[string]string, workdir string, user string, resolver llb.ImageMetaResolver) (llb.State, error) {
+
+	parsed, err := platforms.Parse(platform)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	options := []llb.ImageOption{llb.Platform(parsed)}
+	if resolver != nil {
+		options = append(options, llb.WithMetaResolver(resolver))
+	}
+
+	state := llb.Image(image, options...)
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		state = state.AddEnv(k, env[k])
+	}
+
+	if workdir != "" {
+		state = state.Dir(workdir)
+	}
+
+	if user != "" {
+		state = state.User(user)
+	}
+
+	// tests always run again since their outcome can depend on more than the image
+	return state.Run(llb.Args(command), llb.IgnoreCache, llb.WithCustomName(fmt.Sprintf("test %v", command))).Root(), nil
+}
+
+// collectLogs gathers the output of every step until the status channel is
+// closed, keeping at most limit bytes of the end.
+func collectLogs(status chan *client.SolveStatus, limit int) *bytes.Buffer {
+	result := &bytes.Buffer{}
+	for x := range status {
+		for _, log := range x.Logs {
+			result.Write(log.Data)
+		}
+		if result.Len() > limit {
+			result = bytes.NewBuffer(result.Bytes()[result.Len()-limit:])
+		}
+	}
+	return result
+}
+
+func createImageTest(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	image := data.Get("image").(string)
+	command := getStringList(data, "command")
+	env := getStringMap(data, "env")
+	workdir := data.Get("workdir").(string)
+	user := data.Get("user").(string)
+	platform := data.Get("platform").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	cli := provider.buildkit_client
+
+	status := make(chan *client.SolveStatus)
+	output := make(chan *bytes.Buffer)
+
+	go func() {
+		output <- collectLogs(status, maxImageTestOutput)
+	}()
+
+	_, err := cli.Build(ctx, client.SolveOpt{
+		Session: []session.Attachable{NewDockerAuthProvider(provider.registry_auth)},
+	}, "terraform-provider-buildkit", func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		state, err := makeImageTestState(image, platform, command, env, workdir, user, c)
+		if err != nil {
+			return nil, err
+		}
+
+		definition, err := state.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.Solve(ctx, gateway.SolveRequest{
+			Definition: definition.ToPB(),
+			Evaluate:   true,
+		})
+	}, status)
+
+	logs := (<-output).String()
+
+	// no id is set so a failed test leaves nothing behind and runs again on the next apply
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("The test of %s failed: %s", image, err.Error()),
+			Detail:   logs,
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("output", logs)
+
+	return diag.Diagnostics{}
+}
+
+func readImageTest(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// tests only run on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateImageTest(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := createImageTest(ctx, data, meta)
+
+	// the state is left as it was before a failed test, otherwise terraform
+	// would record the new inputs and see nothing to do on the next apply
+	if diagnostics.HasError() {
+		data.Partial(true)
+	}
+
+	return diagnostics
+}
+
+func deleteImageTest(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
@@ -0,0 +1,77 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/solver/pb"
+	"reflect"
+	"testing"
+)
+
+func TestMakeImageTestState(t *testing.T) {
+	state, err := makeImageTestState("alpine:3.15", "linux/arm64", []string{"sh", "-c", "test -f /etc/os-release"},
+		map[string]string{"B": "2", "A": "1"}, "/app", "nobody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	definition, err := state.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exec *pb.ExecOp
+	for _, x := range definition.Def {
+		op := &pb.Op{}
+		if err := op.Unmarshal(x); err != nil {
+			t.Fatal(err)
+		}
+		if op.GetExec() != nil {
+			exec = op.GetExec()
+		}
+	}
+
+	if exec == nil {
+		t.Fatal("expected the definition to run the command")
+	}
+
+	if !reflect.DeepEqual(exec.Meta.Args, []string{"sh", "-c", "test -f /etc/os-release"}) {
+		t.Fatalf("unexpected command %v", exec.Meta.Args)
+	}
+
+	if exec.Meta.Cwd != "/app" || exec.Meta.User != "nobody" {
+		t.Fatalf("unexpected working directory '%s' or user '%s'", exec.Meta.Cwd, exec.Meta.User)
+	}
+
+	env := map[string]bool{}
+	for _, x := range exec.Meta.Env {
+		env[x] = true
+	}
+
+	if !env["A=1"] || !env["B=2"] {
+		t.Fatalf("unexpected environment %v", exec.Meta.Env)
+	}
+}
+
+func TestCollectLogs(t *testing.T) {
+	status := make(chan *client.SolveStatus, 3)
+	status <- &client.SolveStatus{Logs: []*client.VertexLog{{Data: []byte("hello ")}}}
+	status <- &client.SolveStatus{}
+	status <- &client.SolveStatus{Logs: []*client.VertexLog{{Data: []byte("world")}, {Data: []byte("!")}}}
+	close(status)
+
+	if logs := collectLogs(status, 8).String(); logs != "o world!" {
+		t.Fatalf("expected the end of the output to be kept, got '%s'", logs)
+	}
+}
+
+func TestUpdateImageTestFailure(t *testing.T) {
+	before := map[string]interface{}{"image": "ghcr.io/org/app@sha256:1111", "command": []interface{}{"true"}}
+	after := map[string]interface{}{"image": "ghcr.io/org/app@sha256:2222", "command": []interface{}{"true"}}
+
+	state := testFailedUpdate(t, buildkitImageTestResource(), before, after)
+
+	if state.ID != "previous" || state.Attributes["image"] != "ghcr.io/org/app@sha256:1111" {
+		t.Fatalf("expected the tested image to be kept so the test runs again: %v", state.Attributes)
+	}
+}
@@ -0,0 +1,89 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"sort"
+	"strings"
+)
+
+// getDriftedLabels are the labels that the image of some platform at the
+// reference is missing or has a different value for, sorted by name. Labels
+// that the image has on top of the expected ones are fine.
+func getDriftedLabels(ctx context.Context, reference string, auth RegistryAuth, expected map[string]interface{}) ([]string, error) {
+	parsed, err := name.ParseReference(reference)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+	descriptor, err := remote.Get(parsed, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	images := []v1.Image{}
+
+	if isV2IndexManifest(descriptor.MediaType) {
+		index, err := descriptor.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range manifest.Manifests {
+			if isAttestationManifest(x) {
+				continue
+			}
+			image, err := index.Image(x.Digest)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+	} else {
+		image, err := descriptor.Image()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+
+	drifted := map[string]bool{}
+
+	for _, image := range images {
+		config, err := image.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range expected {
+			if actual, ok := config.Config.Labels[k]; !ok || actual != v.(string) {
+				drifted[k] = true
+			}
+		}
+	}
+
+	result := make([]string, 0, len(drifted))
+	for k := range drifted {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+func labelDrift(target string, labels []string) diag.Diagnostic {
+	return diag.Diagnostic{
+		Severity: diag.Warning,
+		Summary:  fmt.Sprintf("The image at %s doesn't have the labels it was built with.", target),
+		Detail:   fmt.Sprintf("The labels %s are missing or have other values, so the tag was likely overwritten with another image. The image will be built and published again.", strings.Join(labels, ", ")),
+	}
+}
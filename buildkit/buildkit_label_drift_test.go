@@ -0,0 +1,83 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"strings"
+	"testing"
+)
+
+func testPushLabeledImage(t *testing.T, reference string, labels map[string]string) {
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err = mutate.Config(image, v1.Config{Labels: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(image, reference); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadImageLabelDrift(t *testing.T) {
+	host := testRegistry(t)
+	testPushLabeledImage(t, host+"/app:1.0.0", map[string]string{"team": "platform", "extra": "fine"})
+	testPushLabeledImage(t, host+"/other:1.0.0", map[string]string{"team": "someone-else"})
+	testPushLabeledImage(t, host+"/unlabeled:1.0.0", nil)
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"labels":             map[string]interface{}{"team": "platform"},
+		"detect_label_drift": true,
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"},
+			map[string]interface{}{"registry_url": host, "name": "other", "tag": "1.0.0"},
+			map[string]interface{}{"registry_url": host, "name": "unlabeled", "tag": "1.0.0"},
+		},
+	}))
+
+	diags := readImage(context.Background(), data, meta)
+
+	if len(diags) != 2 || diags.HasError() || diags[0].Severity != diag.Warning || !strings.Contains(diags[0].Detail, "team") {
+		t.Fatalf("expected a warning for each drifted target: %v", diags)
+	}
+
+	targets := data.Get("publish_target").([]interface{})
+	for i, expected := range []string{"1.0.0", "", ""} {
+		if tag := targets[i].(map[string]interface{})["tag"].(string); tag != expected {
+			t.Fatalf("expected target %d to have tag '%s' but got '%s'", i, expected, tag)
+		}
+	}
+
+	disabled := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"labels": map[string]interface{}{"team": "platform"},
+		"publish_target": []interface{}{
+			map[string]interface{}{"registry_url": host, "name": "unlabeled", "tag": "1.0.0"},
+		},
+	}))
+
+	if diags := readImage(context.Background(), disabled, meta); len(diags) > 0 {
+		t.Fatalf("expected the labels to not be checked: %v", diags)
+	}
+}
+
+func TestGetDriftedLabelsOfIndex(t *testing.T) {
+	host := testRegistry(t)
+	testPushIndex(t, host+"/app:1.0.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64"})
+
+	drifted, err := getDriftedLabels(context.Background(), host+"/app:1.0.0", RegistryAuth{}, map[string]interface{}{"b": "2", "a": "1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(drifted, ",") != "a,b" {
+		t.Fatalf("expected every platform to be checked: %v", drifted)
+	}
+}
@@ -0,0 +1,98 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"sort"
+	"strings"
+)
+
+// platformTagSuffix is the suffix of the tag the image of the platform is
+// published under, e.g. `amd64` for `linux/amd64`, `armv7` for `linux/arm/v7`
+// and `windows-amd64` for `windows/amd64`. The variant of `linux/arm64/v8` is
+// left out, since it is the only variant of arm64 in use.
+func platformTagSuffix(platform string) string {
+	parts := strings.SplitN(platform, "/", 3)
+	if len(parts) < 2 {
+		return platform
+	}
+	os, suffix := parts[0], parts[1]
+	if len(parts) == 3 && !(parts[1] == "arm64" && parts[2] == "v8") {
+		suffix += parts[2]
+	}
+	if os != "linux" {
+		suffix = os + "-" + suffix
+	}
+	return suffix
+}
+
+// platformTags is whether the image of each platform is also published under
+// a tag of its own for the publish target.
+func platformTags(target map[string]interface{}) bool {
+	enabled, ok := target["platform_tags"].(bool)
+	return ok && enabled
+}
+
+// publishPlatformTags puts the image of each platform of what was published to
+// the target under the tag of the target suffixed with the platform, e.g.
+// `1.2.3-amd64` and `1.2.3-arm64`, for tools that can't pull from an index.
+// Returns the url of each tag by platform.
+func publishPlatformTags(ctx context.Context, target map[string]interface{}, digest string, auth RegistryAuth) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	if !platformTags(target) {
+		return result, nil
+	}
+
+	registry := target["registry_url"].(string)
+	repository := target["name"].(string)
+
+	digests, err := getPlatformDigests(ctx, fullImage(registry, repository+"@"+digest), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := make([]string, 0, len(digests))
+	for k := range digests {
+		platforms = append(platforms, k)
+	}
+	sort.Strings(platforms)
+
+	for _, platform := range platforms {
+		tag := target["tag"].(string) + "-" + platformTagSuffix(platform)
+		if err := crane.Tag(fullImage(registry, repository+"@"+digests[platform]), tag, craneOptions(ctx, auth)...); err != nil {
+			return nil, err
+		}
+		tag_url := fullImage(registry, repository+":"+tag)
+		auth.digests.remember(tag_url, digests[platform])
+		auth.published.remember(tag_url, digests[platform])
+		result[platform] = tag_url
+	}
+
+	return result, nil
+}
+
+// deletePlatformTags removes the tags of the platforms of the target, or
+// their manifests, unless they were moved to another image since.
+func deletePlatformTags(ctx context.Context, target map[string]interface{}, digest string, auth RegistryAuth, delete_strategy string) error {
+	tag_urls, _ := target["platform_tag_urls"].(map[string]interface{})
+	if len(tag_urls) == 0 {
+		return nil
+	}
+
+	registry := target["registry_url"].(string)
+	digests, err := getPlatformDigests(ctx, fullImage(registry, target["name"].(string)+"@"+digest), auth)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for platform, tag_url := range tag_urls {
+		if err := deletePublishedImage(ctx, auth, tag_url.(string), digests[platform], delete_strategy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"testing"
+)
+
+func TestPlatformTagSuffix(t *testing.T) {
+	for platform, expected := range map[string]string{
+		"linux/amd64":    "amd64",
+		"linux/arm64":    "arm64",
+		"linux/arm64/v8": "arm64",
+		"linux/arm/v7":   "armv7",
+		"windows/amd64":  "windows-amd64",
+	} {
+		if suffix := platformTagSuffix(platform); suffix != expected {
+			t.Errorf("expected '%s' for %s but got '%s'", expected, platform, suffix)
+		}
+	}
+}
+
+func TestPublishPlatformTags(t *testing.T) {
+	host := testRegistry(t)
+	index := testPushIndex(t, host+"/app:1.2.3", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	auth := meta.registryAuth(host)
+	target := map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.2.3", "platform_tags": true}
+
+	tag_urls, err := publishPlatformTags(context.Background(), target, digest.String(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, platform := range []string{"linux/amd64", "linux/arm64"} {
+		tag_url := host + "/app:1.2.3-" + platformTagSuffix(platform)
+		if tag_urls[platform] != tag_url {
+			t.Fatalf("expected %s to be published as %s: %v", platform, tag_url, tag_urls)
+		}
+		published, err := crane.Digest(tag_url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if published != manifest.Manifests[i].Digest.String() {
+			t.Fatalf("expected %s to point at the image of %s", tag_url, platform)
+		}
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"delete_strategy": "untag",
+		"publish_target":  []interface{}{target},
+	}))
+	_ = data.Set("publish_target", []interface{}{merge(publishedTarget(target, digest.String()), map[string]interface{}{"platform_tag_urls": tag_urls})})
+
+	if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if !data.Get("publish_target.0.platform_tags").(bool) {
+		t.Fatal("expected the platform tags to be kept")
+	}
+
+	if diags := deleteImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	for _, x := range tag_urls {
+		auth.digests.forget(x.(string))
+		if _, err := getRemoteImageHash(context.Background(), x.(string), auth); !isNotFound(err) {
+			t.Fatalf("expected %s to be untagged: %v", x, err)
+		}
+	}
+
+	// the tag is published again by someone else, without the platform tags
+	testPushIndex(t, host+"/app:1.2.3", v1.Platform{OS: "linux", Architecture: "amd64"})
+	if diags := readImage(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if data.Get("publish_target.0.platform_tags").(bool) {
+		t.Fatal("expected the platform tags to be published again once they are gone")
+	}
+}
@@ -0,0 +1,62 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"io"
+)
+
+// newProgressLogger logs JSON to the output, which terraform parses into
+// structured entries of its own log when the output is stderr. The level is
+// left to TF_LOG, so everything is written.
+func newProgressLogger(output io.Writer) hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "buildkit",
+		Output:     output,
+		Level:      hclog.Trace,
+		JSONFormat: true,
+	})
+}
+
+// solveLogger logs an event for every step of a build once it completes, with
+// its name, whether it was cached, how long it took and why it failed, so that
+// log aggregators can compute metrics per step across builds.
+type solveLogger struct {
+	logger hclog.Logger
+	logged map[digest.Digest]struct{}
+}
+
+func newSolveLogger(logger hclog.Logger) *solveLogger {
+	return &solveLogger{logger: logger, logged: map[digest.Digest]struct{}{}}
+}
+
+func (l *solveLogger) observe(status *client.SolveStatus) {
+	for _, vertex := range status.Vertexes {
+		if vertex.Completed == nil {
+			continue
+		}
+		if _, ok := l.logged[vertex.Digest]; ok {
+			continue
+		}
+		l.logged[vertex.Digest] = struct{}{}
+
+		duration_ms := int64(0)
+		if vertex.Started != nil {
+			duration_ms = vertex.Completed.Sub(*vertex.Started).Milliseconds()
+		}
+
+		fields := []interface{}{
+			"step", vertex.Name,
+			"vertex", vertex.Digest.String(),
+			"cached", vertex.Cached,
+			"duration_ms", duration_ms,
+		}
+
+		if vertex.Error != "" {
+			l.logger.Warn("build step", append(fields, "error", vertex.Error)...)
+		} else {
+			l.logger.Info("build step", fields...)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package buildkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"testing"
+	"time"
+)
+
+func TestSolveLogger(t *testing.T) {
+	started := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	completed := started.Add(250 * time.Millisecond)
+	base := digest.FromString("base")
+	run := digest.FromString("run")
+
+	output := bytes.Buffer{}
+	logger := newSolveLogger(newProgressLogger(&output).With("image", "image-id"))
+
+	logger.observe(&client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: base, Name: "[1/2] FROM alpine", Started: &started, Completed: &started, Cached: true},
+		{Digest: run, Name: "[2/2] RUN make", Started: &started},
+	}})
+	logger.observe(&client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: base, Name: "[1/2] FROM alpine", Started: &started, Completed: &started, Cached: true},
+		{Digest: run, Name: "[2/2] RUN make", Started: &started, Completed: &completed, Error: "exit code: 2"},
+	}})
+
+	events := []map[string]interface{}{}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected a JSON event but got '%s'", scanner.Text())
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected an event for each step once it completed but got %d", len(events))
+	}
+
+	if events[0]["step"] != "[1/2] FROM alpine" || events[0]["cached"] != true || events[0]["image"] != "image-id" || events[0]["@level"] != "info" {
+		t.Fatalf("expected an event for the cached step but got %v", events[0])
+	}
+
+	if events[1]["duration_ms"] != float64(250) || events[1]["error"] != "exit code: 2" || events[1]["@level"] != "warn" {
+		t.Fatalf("expected an event for the failed step but got %v", events[1])
+	}
+}
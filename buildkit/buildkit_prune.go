@@ -0,0 +1,190 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"time"
+)
+
+func buildkitPruneResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createPrune,
+		ReadContext:   readPrune,
+		UpdateContext: updatePrune,
+		DeleteContext: deletePrune,
+		Description:   "Frees up space on the buildkit daemon by pruning its build cache when created and whenever its arguments change.",
+		Schema: map[string]*schema.Schema{
+			"keep_storage_bytes": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "Stop pruning once the cache is no larger than this many bytes. Zero prunes everything matching the other arguments.",
+			},
+			"keep_duration": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "Only prune cache records that have not been used for this long (e.g. `48h`).",
+			},
+			"filters": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Buildkit filters selecting the cache records to prune (e.g. `type==exec.cachemount`). A record is pruned if it matches any of them.",
+			},
+			"all": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Also prune internal and frontend cache records.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the cache to be pruned again when any of the values change.",
+			},
+			"reclaimed_bytes": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of bytes freed by the last prune.",
+			},
+			"pruned_records": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The number of cache records removed by the last prune.",
+			},
+		},
+	}
+}
+
+func getPruneOptions(data *schema.ResourceData) ([]client.PruneOption, diag.Diagnostics) {
+	options, err := makePruneOptions(
+		data.Get("keep_storage_bytes").(int),
+		data.Get("keep_duration").(string),
+		getStringList(data, "filters"),
+		data.Get("all").(bool))
+
+	if err != nil {
+		return nil, diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	return options, diag.Diagnostics{}
+}
+
+func makePruneOptions(keepStorageBytes int, keepDuration string, filters []string, all bool) ([]client.PruneOption, error) {
+	duration, err := parseKeepDuration(keepDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return pruneInfoOptions(client.PruneInfo{
+		Filter:       filters,
+		All:          all,
+		KeepDuration: duration,
+		KeepBytes:    int64(keepStorageBytes),
+	}), nil
+}
+
+func pruneInfoOptions(info client.PruneInfo) []client.PruneOption {
+	options := []client.PruneOption{client.WithKeepOpt(info.KeepDuration, info.KeepBytes)}
+
+	if len(info.Filter) > 0 {
+		options = append(options, client.WithFilter(info.Filter))
+	}
+
+	if info.All {
+		options = append(options, client.PruneAll)
+	}
+
+	return options
+}
+
+func parseKeepDuration(keepDuration string) (time.Duration, error) {
+	if keepDuration == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(keepDuration)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse keep_duration '%s': %w", keepDuration, err)
+	}
+	return duration, nil
+}
+
+// pruneCache runs a single prune and returns the number of bytes and cache
+// records it removed.
+func pruneCache(ctx context.Context, cli *client.Client, options []client.PruneOption) (int64, int, error) {
+	records := make(chan client.UsageInfo)
+	done := make(chan struct{})
+
+	reclaimed := int64(0)
+	pruned := 0
+
+	go func() {
+		defer close(done)
+		for x := range records {
+			reclaimed += x.Size
+			pruned++
+		}
+	}()
+
+	err := cli.Prune(ctx, records, options...)
+	close(records)
+	<-done
+
+	return reclaimed, pruned, err
+}
+
+func createPrune(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	provider := meta.(TerraformProviderBuildkit)
+	options, diags := getPruneOptions(data)
+
+	if len(diags) > 0 {
+		return diags
+	}
+
+	cli := provider.buildkit_client
+
+	reclaimed, pruned, err := pruneCache(ctx, cli, options)
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "prune the build cache", err)}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("reclaimed_bytes", int(reclaimed))
+	data.Set("pruned_records", pruned)
+
+	return diag.Diagnostics{}
+}
+
+func readPrune(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// pruning only happens on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updatePrune(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createPrune(ctx, data, meta)
+}
+
+func deletePrune(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
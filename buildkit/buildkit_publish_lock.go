@@ -0,0 +1,369 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	lockOwnerAnnotation   = "dev.terraform-provider-buildkit.lock.owner"
+	lockWhoAnnotation     = "dev.terraform-provider-buildkit.lock.who"
+	lockExpiresAnnotation = "dev.terraform-provider-buildkit.lock.expires"
+)
+
+// how often a lock that is held by someone else is checked again, how long
+// a lock written to a registry is left alone before it is read back to see
+// whether another run overwrote it in the meantime, and how long a request
+// to a lock service may take
+var (
+	publishLockInterval = 5 * time.Second
+	publishLockSettle   = 2 * time.Second
+	publishLockTimeout  = 30 * time.Second
+)
+
+// getPublishLock is the publish_lock of the image, or nil when it has none.
+func getPublishLock(data *schema.ResourceData) (*PublishLock, diag.Diagnostics) {
+	blocks, ok := data.Get("publish_lock").([]interface{})
+	if !ok || len(blocks) == 0 || blocks[0] == nil {
+		return nil, diag.Diagnostics{}
+	}
+
+	casted := blocks[0].(map[string]interface{})
+	lock := &PublishLock{url: casted["url"].(string)}
+
+	for key, target := range map[string]*time.Duration{"timeout": &lock.timeout, "ttl": &lock.ttl} {
+		duration, err := time.ParseDuration(casted[key].(string))
+		if err != nil {
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not parse the %s '%s' of the publish_lock.", key, casted[key].(string)),
+				Detail:   err.Error(),
+			}}
+		}
+		*target = duration
+	}
+
+	return lock, diag.Diagnostics{}
+}
+
+// lockTargets locks the tag of every publish target and returns a function
+// that unlocks them again. The tags are locked in order, so that runs which
+// publish to some of the same tags can't each wait for a lock the other has.
+func lockTargets(ctx context.Context, lock *PublishLock, provider TerraformProviderBuildkit, publish_targets []interface{}) (func(), diag.Diagnostics) {
+	unlock := func() {}
+	if lock == nil {
+		return unlock, diag.Diagnostics{}
+	}
+
+	auths := map[string]RegistryAuth{}
+	for _, x := range publish_targets {
+		casted := x.(map[string]interface{})
+		registry := casted["registry_url"].(string)
+		auths[fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))] = provider.registryAuth(registry)
+	}
+
+	tags := make([]string, 0, len(auths))
+	for k := range auths {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+
+	owner, _ := uuid.GenerateUUID()
+	who, _ := os.Hostname()
+	deadline := time.Now().Add(lock.timeout)
+	held := []func() error{}
+
+	unlock = func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			// a lock that can't be released expires after its ttl
+			_ = held[i]()
+		}
+	}
+
+	for _, tag := range tags {
+		var release func() error
+		var err error
+		if lock.url != "" {
+			release, err = lockURL(ctx, lock.url, tag, owner, who, deadline)
+		} else {
+			release, err = lockRegistry(ctx, tag, auths[tag], owner, who, lock.ttl, deadline)
+		}
+		if err != nil {
+			unlock()
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not lock the publish target '%s'.", tag),
+				Detail:   err.Error(),
+			}}
+		}
+		held = append(held, release)
+	}
+
+	return unlock, diag.Diagnostics{}
+}
+
+// waitForLock waits before the next attempt to take a lock that is held by
+// someone else, unless the deadline passes first.
+func waitForLock(ctx context.Context, deadline time.Time, holder string) error {
+	if time.Now().Add(publishLockInterval).After(deadline) {
+		return fmt.Errorf("timed out waiting for the lock held by %s", holder)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(publishLockInterval):
+		return nil
+	}
+}
+
+// lockTagSuffix is appended to a tag to name the sentinel that locks it.
+const lockTagSuffix = ".tf-buildkit-lock"
+
+// isLockTag is whether the tag is named like the sentinel of a lock.
+func isLockTag(tag string) bool {
+	return strings.HasSuffix(tag, lockTagSuffix)
+}
+
+// isLockSentinel is whether the tag is the sentinel of a lock, which isn't an
+// image and is left out of the tags listed in repositories.
+func isLockSentinel(tag name.Tag, options []remote.Option) (bool, error) {
+	if !isLockTag(tag.TagStr()) {
+		return false, nil
+	}
+	lock, err := readRegistryLock(tag, options)
+	return lock != nil, err
+}
+
+// lockTag is the sentinel tag that locks the tag, next to it in the same
+// repository.
+func lockTag(tag string) (name.Tag, error) {
+	parsed, err := name.NewTag(tag)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	return parsed.Context().Tag(parsed.TagStr() + lockTagSuffix), nil
+}
+
+// registryLock is the holder of the sentinel tag, if anyone holds it.
+type registryLock struct {
+	owner   string
+	who     string
+	expires time.Time
+}
+
+func readRegistryLock(sentinel name.Tag, options []remote.Option) (*registryLock, error) {
+	descriptor, err := remote.Get(sentinel, options...)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := time.Parse(time.RFC3339, manifest.Annotations[lockExpiresAnnotation])
+	if err != nil {
+		// whatever is at the tag isn't a lock this provider wrote
+		return nil, nil
+	}
+
+	return &registryLock{
+		owner:   manifest.Annotations[lockOwnerAnnotation],
+		who:     manifest.Annotations[lockWhoAnnotation],
+		expires: expires,
+	}, nil
+}
+
+func writeRegistryLock(sentinel name.Tag, options []remote.Option, owner string, who string, expires time.Time) error {
+	image := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	image = mutate.ConfigMediaType(image, types.OCIConfigJSON)
+	image = mutate.Annotations(image, map[string]string{
+		lockOwnerAnnotation:   owner,
+		lockWhoAnnotation:     who,
+		lockExpiresAnnotation: expires.UTC().Format(time.RFC3339Nano),
+	}).(v1.Image)
+	return remote.Write(sentinel, image, options...)
+}
+
+// lockRegistry locks the tag with a sentinel tag next to it. Registries can't
+// replace a tag only if it is unchanged, so the sentinel is read back after a
+// while to find out whether another run wrote it at the same time, in which
+// case the last one to write it holds the lock. Locks that expired, e.g.
+// because the run holding them was killed, are taken over.
+func lockRegistry(ctx context.Context, tag string, auth RegistryAuth, owner string, who string, ttl time.Duration, deadline time.Time) (func() error, error) {
+	sentinel, err := lockTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	for {
+		current, err := readRegistryLock(sentinel, options)
+		if err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.owner == owner || time.Now().After(current.expires) {
+			if err := writeRegistryLock(sentinel, options, owner, who, time.Now().Add(ttl)); err != nil {
+				return nil, err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(publishLockSettle):
+			}
+
+			current, err = readRegistryLock(sentinel, options)
+			if err != nil {
+				return nil, err
+			}
+			if current != nil && current.owner == owner {
+				break
+			}
+		}
+
+		holder := "another run"
+		if current != nil {
+			holder = fmt.Sprintf("%s until %s", current.who, current.expires.Format(time.RFC3339))
+		}
+		if err := waitForLock(ctx, deadline, holder); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		heartbeatRegistryLock(ctx, stop, sentinel, options, owner, who, ttl)
+	}()
+
+	return func() error {
+		close(stop)
+		<-stopped
+
+		// released even when the operation was cancelled
+		options := makeOptions(craneOptions(context.Background(), auth)...).Remote
+		current, err := readRegistryLock(sentinel, options)
+		if err != nil || current == nil || current.owner != owner {
+			return err
+		}
+		if err := remote.Delete(sentinel, options...); err == nil {
+			return nil
+		}
+		// not every registry allows deleting tags, so it is expired instead
+		return writeRegistryLock(sentinel, options, owner, who, time.Now())
+	}, nil
+}
+
+// heartbeatRegistryLock extends the lock until it is released, so that it
+// doesn't expire during builds that take longer than its ttl.
+func heartbeatRegistryLock(ctx context.Context, stop chan struct{}, sentinel name.Tag, options []remote.Option, owner string, who string, ttl time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-time.After(ttl / 3):
+		}
+
+		current, err := readRegistryLock(sentinel, options)
+		if err != nil {
+			continue
+		}
+		if current == nil || current.owner != owner {
+			return
+		}
+		_ = writeRegistryLock(sentinel, options, owner, who, time.Now().Add(ttl))
+	}
+}
+
+// lockURL locks the tag with the lock service at the url, in the way
+// Terraform's http backend locks its state: a LOCK request with a JSON
+// description of the lock that succeeds with 200 or reports that someone
+// else holds the lock with 409 or 423, and an UNLOCK request with the same
+// description. The tag is passed along as the `tag` query parameter.
+func lockURL(ctx context.Context, lockUrl string, tag string, owner string, who string, deadline time.Time) (func() error, error) {
+	parsed, err := url.Parse(lockUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	query := parsed.Query()
+	query.Set("tag", tag)
+	parsed.RawQuery = query.Encode()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"ID":        owner,
+		"Operation": "publish",
+		"Who":       who,
+		"Path":      tag,
+		"Created":   time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	send := func(ctx context.Context, method string) (int, error) {
+		request, err := http.NewRequestWithContext(ctx, method, parsed.String(), bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := (&http.Client{Timeout: publishLockTimeout}).Do(request)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	for {
+		status, err := send(ctx, "LOCK")
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusOK {
+			break
+		}
+		if status != http.StatusConflict && status != http.StatusLocked {
+			return nil, fmt.Errorf("the lock service responded to LOCK with status %d", status)
+		}
+		if err := waitForLock(ctx, deadline, "another run"); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() error {
+		// released even when the operation was cancelled
+		status, err := send(context.Background(), "UNLOCK")
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("the lock service responded to UNLOCK with status %d", status)
+		}
+		return err
+	}, nil
+}
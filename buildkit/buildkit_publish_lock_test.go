@@ -0,0 +1,170 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func shortPublishLocks(t *testing.T) {
+	interval, settle := publishLockInterval, publishLockSettle
+	publishLockInterval, publishLockSettle = 10*time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		publishLockInterval, publishLockSettle = interval, settle
+	})
+}
+
+func TestLockTargetsInRegistry(t *testing.T) {
+	shortPublishLocks(t)
+	registry := testRegistry(t)
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	targets := []interface{}{map[string]interface{}{"registry_url": registry, "name": "app", "tag": "1.0.0"}}
+	lock := &PublishLock{timeout: 50 * time.Millisecond, ttl: time.Hour}
+
+	unlock, diags := lockTargets(context.Background(), lock, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if _, diags := lockTargets(context.Background(), lock, provider, targets); !diags.HasError() {
+		t.Fatal("expected a locked publish target to time out")
+	}
+
+	unlock()
+
+	again, diags := lockTargets(context.Background(), lock, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("expected a released publish target to be locked again: %v", diags)
+	}
+	again()
+}
+
+func TestLockTargetsTakesOverExpiredLocks(t *testing.T) {
+	shortPublishLocks(t)
+	registry := testRegistry(t)
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	targets := []interface{}{map[string]interface{}{"registry_url": registry, "name": "app", "tag": "1.0.0"}}
+
+	// a run that was killed never releases its lock nor extends it
+	killed, kill := context.WithCancel(context.Background())
+	if _, diags := lockTargets(killed, &PublishLock{timeout: time.Second, ttl: time.Millisecond}, provider, targets); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	kill()
+
+	time.Sleep(5 * time.Millisecond)
+
+	unlock, diags := lockTargets(context.Background(), &PublishLock{timeout: 50 * time.Millisecond, ttl: time.Hour}, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("expected the expired lock to be taken over: %v", diags)
+	}
+	unlock()
+}
+
+func TestLockTargetsExtendsLocks(t *testing.T) {
+	shortPublishLocks(t)
+	registry := testRegistry(t)
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	targets := []interface{}{map[string]interface{}{"registry_url": registry, "name": "app", "tag": "1.0.0"}}
+	lock := &PublishLock{timeout: 50 * time.Millisecond, ttl: 150 * time.Millisecond}
+
+	unlock, diags := lockTargets(context.Background(), lock, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	time.Sleep(4 * lock.ttl)
+
+	if _, diags := lockTargets(context.Background(), lock, provider, targets); !diags.HasError() {
+		t.Fatal("expected a lock held for longer than its ttl to still be held")
+	}
+
+	unlock()
+
+	tags, err := crane.ListTags(registry + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range tags {
+		if isLockTag(x) {
+			t.Fatalf("expected the sentinel to be deleted on release: %v", tags)
+		}
+	}
+}
+
+func TestListTagsWithoutLocks(t *testing.T) {
+	shortPublishLocks(t)
+	registry := testRegistry(t)
+	testPushImage(t, registry+"/app:1.0.0")
+	// tags of images that merely look like sentinels are listed
+	testPushImage(t, registry+"/app:release.lock")
+	testPushImage(t, registry+"/app:image"+lockTagSuffix)
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	targets := []interface{}{map[string]interface{}{"registry_url": registry, "name": "app", "tag": "1.0.0"}}
+
+	unlock, diags := lockTargets(context.Background(), &PublishLock{timeout: time.Second, ttl: time.Hour}, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	defer unlock()
+
+	tags, err := listTags(context.Background(), RegistryAuth{}, registry+"/app", "/.*/", 0, 0)
+	sort.Strings(tags)
+	if err != nil || !reflect.DeepEqual(tags, []string{"1.0.0", "image" + lockTagSuffix, "release.lock"}) {
+		t.Fatalf("expected the sentinel of the lock to be left out: %v %v", tags, err)
+	}
+}
+
+func TestLockTargetsWithURL(t *testing.T) {
+	shortPublishLocks(t)
+	mutex := sync.Mutex{}
+	locked := map[string]bool{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		tag := request.URL.Query().Get("tag")
+		switch request.Method {
+		case "LOCK":
+			if locked[tag] {
+				writer.WriteHeader(http.StatusLocked)
+				return
+			}
+			locked[tag] = true
+		case "UNLOCK":
+			delete(locked, tag)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+	targets := []interface{}{
+		map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1.0.0"},
+		map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "latest"},
+	}
+	lock := &PublishLock{url: server.URL, timeout: 50 * time.Millisecond}
+
+	unlock, diags := lockTargets(context.Background(), lock, provider, targets)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if !locked["ghcr.io/org/app:1.0.0"] || !locked["ghcr.io/org/app:latest"] {
+		t.Fatalf("expected every tag to be locked: %v", locked)
+	}
+
+	if _, diags := lockTargets(context.Background(), lock, provider, targets[1:]); !diags.HasError() {
+		t.Fatal("expected a locked publish target to time out")
+	}
+
+	unlock()
+
+	if len(locked) > 0 {
+		t.Fatalf("expected every tag to be unlocked: %v", locked)
+	}
+}
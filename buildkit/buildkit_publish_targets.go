@@ -0,0 +1,376 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+)
+
+// publishedTarget is the publish target as it is kept in state once the tag
+// points at the digest.
+func publishedTarget(target map[string]interface{}, digest string) map[string]interface{} {
+	registry := target["registry_url"].(string)
+	latest_tag_url := ""
+	if alias := latestTag(target); alias != "" {
+		latest_tag_url = fullImage(registry, target["name"].(string)+":"+alias)
+	}
+	return merge(target, map[string]interface{}{
+		"tag_url":        fullImage(registry, target["name"].(string)+":"+target["tag"].(string)),
+		"digest_url":     fullImage(registry, target["name"].(string)+"@"+digest),
+		"digest":         digest,
+		"latest_tag_url": latest_tag_url,
+	})
+}
+
+// unknownValue is what the sdk reads as a value that is known after apply
+// when it is nested in the value of a computed attribute.
+const unknownValue = "74D93920-ED26-11E3-AC10-0800200C9A66"
+
+// configuresPublishTargets is false when the configuration has no
+// publish_target. The attribute is computed so that rebuilds can plan the
+// digests of the targets, which otherwise keeps the targets of the state when
+// the last one is removed from the configuration.
+func configuresPublishTargets(config cty.Value) bool {
+	if config.IsNull() || !config.IsKnown() {
+		return true
+	}
+	targets := config.GetAttr("publish_target")
+	return !targets.IsKnown() || (!targets.IsNull() && targets.LengthInt() > 0)
+}
+
+// plannedTargets are the publish targets of an image that is rebuilt, whose
+// digests are known after apply. The digests of the platforms are planned
+// for the platforms of the target, or else of the image, or else the ones the
+// target had before.
+func plannedTargets(diff *schema.ResourceDiff) []interface{} {
+	image_platforms := []string{}
+	if diff.NewValueKnown("platforms") {
+		for _, x := range diff.Get("platforms").(*schema.Set).List() {
+			image_platforms = append(image_platforms, x.(string))
+		}
+	}
+
+	result := []interface{}{}
+	for _, x := range diff.Get("publish_target").([]interface{}) {
+		casted := x.(map[string]interface{})
+		platform_digests := map[string]interface{}{}
+		if diff.Get("resolve_platform_digests").(bool) {
+			platforms := getTargetPlatforms(casted)
+			if len(platforms) == 0 {
+				platforms = image_platforms
+			}
+			if len(platforms) == 0 {
+				for k := range casted["platform_digests"].(map[string]interface{}) {
+					platforms = append(platforms, k)
+				}
+			}
+			for _, platform := range platforms {
+				platform_digests[platform] = unknownValue
+			}
+		}
+		result = append(result, merge(casted, map[string]interface{}{
+			"digest":           unknownValue,
+			"digest_url":       unknownValue,
+			"platform_digests": platform_digests,
+		}))
+	}
+	return result
+}
+
+// imageRefs are the digest_url of the first publish target and the
+// digest_url of every tag that is published, keyed by the tag_url.
+func imageRefs(targets []interface{}) (string, map[string]interface{}) {
+	image_ref := ""
+	refs := map[string]interface{}{}
+	for i, x := range targets {
+		casted := x.(map[string]interface{})
+		digest_url := casted["digest_url"].(string)
+		if i == 0 {
+			image_ref = digest_url
+		}
+		if digest_url == "" {
+			continue
+		}
+		for _, key := range []string{"tag_url", "latest_tag_url"} {
+			if tag_url, ok := casted[key].(string); ok && tag_url != "" {
+				refs[tag_url] = digest_url
+			}
+		}
+	}
+	return image_ref, refs
+}
+
+func setImageRefs(data *schema.ResourceData) {
+	image_ref, refs := imageRefs(data.Get("publish_target").([]interface{}))
+	_ = data.Set("image_ref", image_ref)
+	_ = data.Set("refs", refs)
+}
+
+// latestTag is the alias that is moved along with the tag of the publish
+// target, if it has one.
+func latestTag(target map[string]interface{}) string {
+	if enabled, ok := target["also_tag_latest"].(bool); !ok || !enabled {
+		return ""
+	}
+	return target["latest_tag"].(string)
+}
+
+// publishLatestTag moves the alias of the publish target to the digest it
+// was just published with.
+func publishLatestTag(ctx context.Context, target map[string]interface{}, digest string, auth RegistryAuth) error {
+	alias := latestTag(target)
+	if alias == "" {
+		return nil
+	}
+
+	registry := target["registry_url"].(string)
+	if err := crane.Tag(fullImage(registry, target["name"].(string)+"@"+digest), alias, craneOptions(ctx, auth)...); err != nil {
+		return err
+	}
+
+	auth.digests.remember(fullImage(registry, target["name"].(string)+":"+alias), digest)
+	auth.published.remember(fullImage(registry, target["name"].(string)+":"+alias), digest)
+	return nil
+}
+
+// unpublishedTarget is the publish target as it is kept in state once its tag
+// is gone from the registry.
+func unpublishedTarget(target map[string]interface{}) map[string]interface{} {
+	return merge(target, map[string]interface{}{
+		"tag":               "",
+		"tag_url":           "",
+		"digest_url":        "",
+		"digest":            "",
+		"latest_tag_url":    "",
+		"platform_digests":  map[string]interface{}{},
+		"platform_tag_urls": map[string]interface{}{},
+	})
+}
+
+// verifyConsistency fails unless the tag of every published target points
+// at the digest the image was published with.
+func verifyConsistency(ctx context.Context, provider TerraformProviderBuildkit, targets []interface{}) diag.Diagnostics {
+	if len(targets) < 2 {
+		return diag.Diagnostics{}
+	}
+
+	// targets limited to some of the platforms have a digest of their own
+	expected := ""
+	if first := getFullTarget(targets); first >= 0 {
+		expected = targets[first].(map[string]interface{})["digest"].(string)
+	}
+	consistent := true
+	lines := []string{}
+
+	for _, x := range targets {
+		casted := x.(map[string]interface{})
+		filtered := len(getTargetPlatforms(casted)) > 0
+		tag_url := casted["tag_url"].(string)
+		auth := provider.registryAuth(casted["registry_url"].(string))
+		// the digest has to come from the registry rather than the push
+		auth.digests.forget(tag_url)
+		digest, err := getRemoteImageHash(ctx, tag_url, auth)
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not read back '%s' to verify the publish targets are consistent.", tag_url),
+				Detail:   err.Error(),
+			}}
+		}
+		consistent = consistent && (filtered || digest == expected) && digest == casted["digest"].(string)
+		lines = append(lines, fmt.Sprintf("%s: %s", tag_url, digest))
+	}
+
+	if consistent {
+		return diag.Diagnostics{}
+	}
+
+	return diag.Diagnostics{diag.Diagnostic{
+		Severity: diag.Error,
+		Summary:  "The publish targets of the image don't all have the same digest.",
+		Detail:   fmt.Sprintf("The image was published as %s, but the tags point at:\n\n%s\n\nA registry may have converted the manifest when it was pushed.", expected, strings.Join(lines, "\n")),
+	}}
+}
+
+// withPlatformDigests adds the digest of the image of each platform to a
+// published target, when the image resolves them.
+func withPlatformDigests(ctx context.Context, data *schema.ResourceData, target map[string]interface{}, auth RegistryAuth) (map[string]interface{}, error) {
+	platform_digests := map[string]interface{}{}
+
+	if data.Get("resolve_platform_digests").(bool) {
+		digests, err := getPlatformDigests(ctx, target["digest_url"].(string), auth)
+		if err != nil {
+			return target, err
+		}
+		for k, v := range digests {
+			platform_digests[k] = v
+		}
+	}
+
+	return merge(target, map[string]interface{}{"platform_digests": platform_digests}), nil
+}
+
+func validateDeleteStrategy(delete_strategy string) diag.Diagnostics {
+	switch delete_strategy {
+	case deleteStrategyNone, deleteStrategyUntag, deleteStrategyDeleteManifest:
+		return diag.Diagnostics{}
+	}
+	return diag.Diagnostics{diag.Diagnostic{
+		Severity: diag.Error,
+		Summary:  fmt.Sprintf("unknown delete_strategy '%s', expected one of %s", delete_strategy, strings.Join([]string{deleteStrategyNone, deleteStrategyUntag, deleteStrategyDeleteManifest}, ", ")),
+	}}
+}
+
+// deletePublishedImage removes the tag or the manifest of a publish target,
+// unless the tag was since moved to another image or published again by this
+// run of the provider, as a replacement created before the destroy does. The
+// manifest is only untagged while another tag still points at it.
+func deletePublishedImage(ctx context.Context, auth RegistryAuth, tag_url string, digest string, delete_strategy string) error {
+
+	tag, err := name.NewTag(tag_url)
+	if err != nil {
+		return err
+	}
+
+	auth.digests.forget(tag_url)
+
+	current, err := getRemoteImageHash(ctx, tag_url, auth)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if digest == "" || current != digest {
+		return nil
+	}
+
+	if _, ok := auth.published.cached(tag_url); ok {
+		return nil
+	}
+
+	var reference name.Reference = tag
+	if delete_strategy == deleteStrategyDeleteManifest {
+		live, err := liveTag(ctx, auth, tag_url, digest)
+		if err != nil {
+			return err
+		}
+		if live == "" {
+			reference = tag.Context().Digest(digest)
+		}
+	}
+
+	err = remote.Delete(reference, makeOptions(craneOptions(ctx, auth)...).Remote...)
+	auth.digests.forget(tag_url)
+
+	if isNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// liveTag is another tag of the repository of the tag that points at the
+// digest, if there is one.
+func liveTag(ctx context.Context, auth RegistryAuth, tag_url string, digest string) (string, error) {
+	tag, err := name.NewTag(tag_url)
+	if err != nil {
+		return "", err
+	}
+
+	tags, err := listTags(ctx, auth, tag.Context().Name(), "/.*/", 0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	for _, x := range tags {
+		if x == tag.TagStr() {
+			continue
+		}
+		tag_url := tag.Context().Tag(x).Name()
+		current, err := getRemoteImageHash(ctx, tag_url, auth)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if current == digest {
+			return tag_url, nil
+		}
+	}
+
+	return "", nil
+}
+
+// targetDigest is the digest a publish target was published with. The state
+// of older versions only has a digest_url, which sometimes was just the digest.
+func targetDigest(target map[string]interface{}) string {
+	if digest, ok := target["digest"].(string); ok && digest != "" {
+		return digest
+	}
+	digest_url := target["digest_url"].(string)
+	if _, digest, ok := strings.Cut(digest_url, "@"); ok {
+		return digest
+	}
+	return digest_url
+}
+
+// publishTargets resolves what each publish target was published with once
+// the build pushed it, and moves the tags that go along with it.
+func publishTargets(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, digest string) ([]interface{}, diag.Diagnostics) {
+	publish_targets := data.Get("publish_target").([]interface{})
+	copied := getCopiedTargets(data)
+	new_targets := []interface{}{}
+
+	diags := diag.Diagnostics{}
+	for i, x := range publish_targets {
+		casted := x.(map[string]interface{})
+		registry := casted["registry_url"].(string)
+		completeRef := fullImage(registry, casted["name"].(string)+":"+casted["tag"].(string))
+		auth := provider.registryAuth(registry)
+		// the tag was just pushed so whatever it pointed at before is stale
+		auth.digests.forget(completeRef)
+		targetCtx, span := startSpan(ctx, provider.tracer(), "publish target", attribute.String("buildkit.tag_url", completeRef))
+		var err error
+		if source, ok := copied[i]; ok {
+			err = copyTarget(targetCtx, provider, publish_targets[source].(map[string]interface{}), casted, digest)
+		}
+		hash := ""
+		if err == nil {
+			hash, err = getRemoteImageHash(targetCtx, completeRef, auth)
+		}
+		if err == nil {
+			auth.published.remember(completeRef, hash)
+		}
+		if err == nil {
+			err = publishLatestTag(targetCtx, casted, hash, auth)
+		}
+		platform_tag_urls := map[string]interface{}{}
+		if err == nil {
+			platform_tag_urls, err = publishPlatformTags(targetCtx, casted, hash, auth)
+		}
+		published := merge(publishedTarget(casted, hash), map[string]interface{}{"platform_tag_urls": platform_tag_urls})
+		if err == nil {
+			published, err = withPlatformDigests(targetCtx, data, published, auth)
+		}
+		span.SetAttributes(attribute.String("buildkit.digest", hash))
+		span.end(err)
+		if err != nil {
+			diags = append(diags, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			})
+		}
+
+		new_targets = append(new_targets, published)
+	}
+
+	return new_targets, diags
+}
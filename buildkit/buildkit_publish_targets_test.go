@@ -0,0 +1,168 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeletePublishedImage(t *testing.T) {
+	host := testRegistry(t)
+	ctx := context.Background()
+	auth := RegistryAuth{}
+
+	untagged := testPushImage(t, host+"/app:untag")
+	if err := deletePublishedImage(ctx, auth, host+"/app:untag", untagged, deleteStrategyUntag); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crane.Digest(host + "/app:untag"); !isNotFound(err) {
+		t.Fatalf("expected the tag to be removed but got %v", err)
+	}
+
+	// a tag that was pushed again belongs to whoever pushed it
+	published := testPushImage(t, host+"/app:moved")
+	moved := testPushImage(t, host+"/app:moved")
+	if err := deletePublishedImage(ctx, auth, host+"/app:moved", published, deleteStrategyUntag); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := crane.Digest(host + "/app:moved"); err != nil || actual != moved {
+		t.Fatalf("expected the moved tag to be left alone but got %s (%v)", actual, err)
+	}
+
+	manifest := testPushImage(t, host+"/app:manifest")
+	if err := deletePublishedImage(ctx, auth, host+"/app:manifest", manifest, deleteStrategyDeleteManifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crane.Digest(host + "/app@" + manifest); !isNotFound(err) {
+		t.Fatalf("expected the manifest to be deleted but got %v", err)
+	}
+
+	// a manifest that another tag points at is only untagged
+	shared := testPushImage(t, host+"/app:shared")
+	if err := crane.Tag(host+"/app@"+shared, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deletePublishedImage(ctx, auth, host+"/app:shared", shared, deleteStrategyDeleteManifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crane.Digest(host + "/app:shared"); !isNotFound(err) {
+		t.Fatalf("expected the tag to be removed but got %v", err)
+	}
+	if actual, err := crane.Digest(host + "/app:other"); err != nil || actual != shared {
+		t.Fatalf("expected the other tag to keep the manifest but got %s (%v)", actual, err)
+	}
+
+	// a replacement created before the destroy published the same image again
+	replaced := testPushImage(t, host+"/app:replaced")
+	replacement := TerraformProviderBuildkit{registry_published: newDigestCache()}.registryAuth(host)
+	replacement.published.remember(host+"/app:replaced", replaced)
+	if err := deletePublishedImage(ctx, replacement, host+"/app:replaced", replaced, deleteStrategyDeleteManifest); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := crane.Digest(host + "/app:replaced"); err != nil || actual != replaced {
+		t.Fatalf("expected the tag of the replacement to be left alone but got %s (%v)", actual, err)
+	}
+
+	// deleting what is already gone succeeds
+	if err := deletePublishedImage(ctx, auth, host+"/app:untag", untagged, deleteStrategyUntag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateDeleteStrategy(t *testing.T) {
+	for _, x := range []string{deleteStrategyNone, deleteStrategyUntag, deleteStrategyDeleteManifest} {
+		if diags := validateDeleteStrategy(x); len(diags) > 0 {
+			t.Fatalf("expected %s to be valid: %v", x, diags)
+		}
+	}
+	if diags := validateDeleteStrategy("purge"); len(diags) == 0 {
+		t.Fatal("expected an unknown strategy to be rejected")
+	}
+	if _, errs := buildkitImageResource().Schema["delete_strategy"].ValidateFunc("purge", "delete_strategy"); len(errs) == 0 {
+		t.Fatal("expected an unknown strategy to be rejected when planning")
+	}
+}
+
+func TestTargetDigest(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if actual := targetDigest(map[string]interface{}{"digest_url": "registry.example.com/app@" + digest}); actual != digest {
+		t.Fatalf("unexpected digest: %s", actual)
+	}
+	if actual := targetDigest(map[string]interface{}{"digest_url": digest}); actual != digest {
+		t.Fatalf("unexpected digest: %s", actual)
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	if err := crane.Copy(host+"/app:1.0.0", host+"/mirror:1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	targets := []interface{}{
+		publishedTarget(map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"}, digest),
+		publishedTarget(map[string]interface{}{"registry_url": host, "name": "mirror", "tag": "1.0.0"}, digest),
+	}
+
+	if diags := verifyConsistency(context.Background(), meta, targets); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	// the mirror converted the image on its way in
+	testPushImage(t, host+"/mirror:1.0.0")
+
+	diags := verifyConsistency(context.Background(), meta, targets)
+	if !diags.HasError() || !strings.Contains(diags[0].Detail, host+"/mirror:1.0.0") {
+		t.Fatalf("expected the targets to be inconsistent: %v", diags)
+	}
+}
+
+func TestPublishLatestTag(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	auth := TerraformProviderBuildkit{registry_digests: newDigestCache()}.registryAuth(host)
+	target := map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0", "also_tag_latest": true, "latest_tag": "stable"}
+
+	if err := publishLatestTag(context.Background(), target, digest, auth); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual, err := crane.Digest(host + "/app:stable"); err != nil || actual != digest {
+		t.Fatalf("expected the alias to point at %s but got %s: %v", digest, actual, err)
+	}
+
+	if published := publishedTarget(target, digest); published["latest_tag_url"] != host+"/app:stable" {
+		t.Fatalf("expected the url of the alias but got %v", published)
+	}
+
+	// without also_tag_latest there is no alias to move
+	target["also_tag_latest"] = false
+	if published := publishedTarget(target, digest); published["latest_tag_url"] != "" {
+		t.Fatalf("expected no alias but got %v", published)
+	}
+}
+
+func TestImageRefs(t *testing.T) {
+	image_ref, refs := imageRefs([]interface{}{
+		map[string]interface{}{"tag_url": "ghcr.io/org/app:1.0.0", "digest_url": "ghcr.io/org/app@sha256:1", "latest_tag_url": "ghcr.io/org/app:latest"},
+		map[string]interface{}{"tag_url": "", "digest_url": "", "latest_tag_url": ""},
+		map[string]interface{}{"tag_url": "docker.io/org/app:1.0.0", "digest_url": "docker.io/org/app@sha256:1", "latest_tag_url": ""},
+	})
+
+	if image_ref != "ghcr.io/org/app@sha256:1" {
+		t.Fatalf("expected the digest url of the first target but got %s", image_ref)
+	}
+
+	expected := map[string]interface{}{
+		"ghcr.io/org/app:1.0.0":   "ghcr.io/org/app@sha256:1",
+		"ghcr.io/org/app:latest":  "ghcr.io/org/app@sha256:1",
+		"docker.io/org/app:1.0.0": "docker.io/org/app@sha256:1",
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("expected the published tags %v but got %v", expected, refs)
+	}
+}
@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"golang.org/x/sync/errgroup"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strings"
@@ -18,288 +27,500 @@ import (
 	"time"
 )
 
-func mergeChannels[K interface{}](channels []chan K) chan K {
-	out := make(chan K)
-	var wg sync.WaitGroup
-	wg.Add(len(channels))
-	for _, c := range channels {
-		go func(c <-chan K) {
-			for v := range c {
-				out <- v
-			}
-			wg.Done()
-		}(c)
-	}
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-	return out
-}
-
-func sinkChannels[K interface{}](resultsIn chan K, errorsIn chan error) ([]K, error) {
-	results := make([]K, 0)
-	for {
-		select {
-		case result, ok := <-resultsIn:
-			if ok {
-				results = append(results, result)
-			} else {
-				return results, nil
-			}
-		case e, ok := <-errorsIn:
-			if ok {
-				close(resultsIn)
-				close(errorsIn)
-				return results, e
-			} else {
-				for {
-					select {
-					case result, ok := <-resultsIn:
-						if ok {
-							results = append(results, result)
-						} else {
-							return results, nil
-						}
-					}
-				}
-			}
-		}
-	}
+// manifestTask is a single platform manifest of an index that still needs
+// to be fetched in order to produce an ImageResult.
+type manifestTask struct {
+	reference   name.Reference
+	descriptor  v1.Descriptor
+	attestation *v1.Descriptor
 }
 
-func copyChannels[K interface{}](resultsOut chan K, resultsIn chan K, errorsOut chan error, errorsIn chan error) {
-	for {
-		select {
-		case result, ok := <-resultsIn:
-			if ok {
-				resultsOut <- result
-			} else {
-				close(errorsOut)
-				close(resultsOut)
-				return
+// forEach calls fn for every index in [0, count) using at most concurrency
+// workers. The first error cancels the context handed to the remaining calls.
+func forEach(ctx context.Context, concurrency int, count int, fn func(context.Context, int) error) error {
+	if concurrency <= 0 || concurrency > count {
+		concurrency = count
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	indices := make(chan int)
+
+	group.Go(func() error {
+		defer close(indices)
+		for i := 0; i < count; i++ {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-		case e, ok := <-errorsIn:
-			if ok {
-				errorsOut <- e
-				close(errorsIn)
-				close(errorsOut)
-				close(resultsIn)
-				close(resultsOut)
-				return
-			} else {
-				close(errorsOut)
-				for {
-					select {
-					case result, ok := <-resultsIn:
-						if ok {
-							resultsOut <- result
-						} else {
-							close(resultsOut)
-							return
-						}
-					}
+		}
+		return nil
+	})
+
+	for w := 0; w < concurrency; w++ {
+		group.Go(func() error {
+			for i := range indices {
+				if err := fn(ctx, i); err != nil {
+					return err
 				}
 			}
-		}
+			return nil
+		})
 	}
+
+	return group.Wait()
 }
 
 func query(ctx context.Context, auth RegistryAuth, query ImageQuery) ([]ImageResult, error) {
 
-	tags, err := crane.ListTags(query.Name, crane.WithAuth(&authn.Basic{
-		Username: auth.username,
-		Password: auth.password,
-	}))
+	// tags inspected in the order the registry lists them are only listed
+	// until there are enough of them
+	listLimit := 0
+	if query.sortBy() == "created" && query.VersionConstraint == "" {
+		listLimit = query.MaxTags
+	}
+
+	matchingTags, err := listTags(ctx, auth, query.Name, query.TagPattern, query.PageSize, listLimit)
 
 	if err != nil {
 		return []ImageResult{}, err
 	}
 
-	matchingTags := filterTags(tags, query.TagPattern)
+	if query.VersionConstraint != "" {
+		matchingTags, err = filterVersions(matchingTags, query.VersionConstraint)
+		if err != nil {
+			return []ImageResult{}, err
+		}
+		sortVersions(matchingTags)
+	}
+
+	sortBy := query.sortBy()
+
+	if sortBy != "created" {
+		sort.SliceStable(matchingTags, func(i, j int) bool {
+			return query.before(compareTags(matchingTags[i], matchingTags[j], sortBy))
+		})
+	}
+
+	if query.MaxTags > 0 && len(matchingTags) > query.MaxTags {
+		matchingTags = matchingTags[:query.MaxTags]
+	}
 
 	if len(matchingTags) == 0 {
 		return []ImageResult{}, nil
 	}
 
-	errorChannels := make([]chan error, 0)
-	resultChannels := make([]chan ImageResult, 0)
-
-	for _, tag := range matchingTags {
-		childResults, childErrors := queryOne(ctx, auth, query, tag)
-		errorChannels = append(errorChannels, childErrors)
-		resultChannels = append(resultChannels, childResults)
+	// when results are ordered by their tags the first results can only come
+	// from the first tags, so we can stop inspecting once the limit is reached
+	earlyExit := sortBy != "created" && query.Limit > 0
+	batchSize := len(matchingTags)
+	if earlyExit {
+		batchSize = query.Limit
+		if query.MaxConcurrency > batchSize {
+			batchSize = query.MaxConcurrency
+		}
 	}
 
-	resultsChannel := mergeChannels(resultChannels)
-	errorsChannel := mergeChannels(errorChannels)
+	results := make([]ImageResult, 0)
 
-	results, err := sinkChannels(resultsChannel, errorsChannel)
+	for start := 0; start < len(matchingTags); start += batchSize {
+		end := start + batchSize
+		if end > len(matchingTags) {
+			end = len(matchingTags)
+		}
 
-	if err == nil {
-		results = filterLabels(results, query.Labels)
+		batch, err := inspectTags(ctx, auth, query, matchingTags[start:end])
+
+		if err != nil {
+			return []ImageResult{}, err
+		}
+
+		results = append(results, batch...)
+
+		if earlyExit && len(results) >= query.Limit {
+			break
+		}
 	}
 
 	sort.SliceStable(results, func(i, j int) bool {
+		if sortBy == "created" {
+			if results[i].BuildTimestamp.Before(results[j].BuildTimestamp) {
+				return query.before(-1)
+			}
+			if results[i].BuildTimestamp.After(results[j].BuildTimestamp) {
+				return query.before(1)
+			}
+			// images pushed together share their timestamp, so the highest
+			// version among them is the most recent
+			if order := compareTags(results[i].Tag, results[j].Tag, "tag_semver"); order != 0 {
+				return query.before(order)
+			}
+		} else if order := compareTags(results[i].Tag, results[j].Tag, sortBy); order != 0 {
+			return query.before(order)
+		}
+		// the platforms of a tag are the most recent first
 		if results[i].BuildTimestamp.Before(results[j].BuildTimestamp) {
 			return false
 		}
 		if results[i].BuildTimestamp.After(results[j].BuildTimestamp) {
 			return true
 		}
+		if results[i].Platform != results[j].Platform {
+			return results[i].Platform < results[j].Platform
+		}
 		return results[i].ImageDigest > results[j].ImageDigest
 	})
 
-	return results, err
+	return results, nil
+}
+
+// sortBy is what the results of the query are ordered by. Results are ordered
+// by version when they are filtered by one and by when they were built
+// otherwise, unless the query says.
+func (query ImageQuery) sortBy() string {
+	if query.SortBy != "" {
+		return query.SortBy
+	}
+	if query.VersionConstraint != "" {
+		return "tag_semver"
+	}
+	return "created"
+}
+
+// before is whether a result that compares to another as given comes first
+// in the order of the query, which is descending unless it says otherwise.
+func (query ImageQuery) before(comparison int) bool {
+	if query.Order == "asc" {
+		return comparison < 0
+	}
+	return comparison > 0
 }
 
-func queryOne(ctx context.Context, auth RegistryAuth, query ImageQuery, tag string) (chan ImageResult, chan error) {
-	results := make(chan ImageResult)
-	errors := make(chan error)
+// compareTags compares two tags as versions or as strings. Tags that aren't
+// versions are lower than any version and compared as strings among each
+// other, as are tags of the same version such as `1.2` and `1.2.0`.
+func compareTags(left string, right string, sortBy string) int {
+	if sortBy == "tag_lexical" {
+		return strings.Compare(left, right)
+	}
+	leftVersion, leftErr := version.NewVersion(left)
+	rightVersion, rightErr := version.NewVersion(right)
+	switch {
+	case leftErr != nil && rightErr != nil:
+		return strings.Compare(left, right)
+	case leftErr != nil:
+		return -1
+	case rightErr != nil:
+		return 1
+	}
+	if order := leftVersion.Compare(rightVersion); order != 0 {
+		return order
+	}
+	return strings.Compare(left, right)
+}
 
-	go func() {
+// inspectTags fetches the manifests of the given tags and returns the results
+// which satisfy the filters of the query.
+func inspectTags(ctx context.Context, auth RegistryAuth, query ImageQuery, tags []string) ([]ImageResult, error) {
 
-		tagReference, err := name.ParseReference(query.Name + ":" + tag)
+	var mu sync.Mutex
+	results := make([]ImageResult, 0)
+	tasks := make([]manifestTask, 0)
 
+	err := forEach(ctx, query.MaxConcurrency, len(tags), func(ctx context.Context, i int) error {
+		tagResults, tagTasks, err := queryOne(ctx, auth, query, tags[i])
 		if err != nil {
-			errors <- err
-			close(results)
-			close(errors)
-			return
+			return err
 		}
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, tagResults...)
+		tasks = append(tasks, tagTasks...)
+		return nil
+	})
 
-		tagDescriptor, err := remote.Get(tagReference, makeOptions(crane.WithAuth(&authn.Basic{
-			Username: auth.username,
-			Password: auth.password,
-		})).Remote...)
+	if err != nil {
+		return []ImageResult{}, err
+	}
+
+	err = forEach(ctx, query.MaxConcurrency, len(tasks), func(ctx context.Context, i int) error {
+		imageManifestReference := tasks[i].reference.Context().Digest(tasks[i].descriptor.Digest.String())
 
+		imageManifestDescriptor, err := remote.Get(imageManifestReference, makeOptions(craneOptions(ctx, auth)...).Remote...)
 		if err != nil {
-			errors <- err
-			close(results)
-			close(errors)
-			return
+			return err
 		}
 
-		if isV2IndexManifest(tagDescriptor.MediaType) {
-
-			indexManifestReader := bytes.NewReader(tagDescriptor.Manifest)
-			parsedIndexManifest, err := v1.ParseIndexManifest(indexManifestReader)
+		result, err := processManifest(ctx, tasks[i].reference, imageManifestDescriptor.Manifest, auth)
+		if err != nil {
+			return err
+		}
 
+		if tasks[i].attestation != nil {
+			layers, err := getAttestationLayers(ctx, auth, tasks[i].reference, *tasks[i].attestation)
 			if err != nil {
-				errors <- err
-				close(results)
-				close(errors)
-				return
+				return err
 			}
+			result.Attestations = getPredicateTypes(layers)
+		}
 
-			childResults := make([]chan ImageResult, 0)
-			childErrors := make([]chan error, 0)
-
-			for _, indexManifest := range parsedIndexManifest.Manifests {
-				if isSupportedPlatform(query.Platforms, indexManifest.Platform) {
-					childResult := make(chan ImageResult)
-					childError := make(chan error)
-					childResults = append(childResults, childResult)
-					childErrors = append(childErrors, childError)
-					go func(indexManifest v1.Descriptor) {
-						imageManifestReference := tagReference.Context().Digest(indexManifest.Digest.String())
-
-						imageManifestDescriptor, err := remote.Get(imageManifestReference, makeOptions(crane.WithAuth(&authn.Basic{
-							Username: auth.username,
-							Password: auth.password,
-						})).Remote...)
-
-						if err != nil {
-							childError <- err
-							close(childResult)
-							close(childError)
-							return
-						}
-
-						result, err := processManifest(tagReference, imageManifestDescriptor.Manifest, auth)
-
-						if err != nil {
-							childError <- err
-							close(childResult)
-							close(childError)
-							return
-						}
-
-						childResult <- *result
-						close(childResult)
-						close(childError)
-
-					}(indexManifest)
-				}
-			}
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, *result)
+		return nil
+	})
 
-			childResult := mergeChannels(childResults)
-			childError := mergeChannels(childErrors)
+	if err != nil {
+		return []ImageResult{}, err
+	}
 
-			copyChannels(results, childResult, errors, childError)
+	results = filterLabels(results, query.Labels)
+	results = filterCreated(results, query.CreatedAfter, query.CreatedBefore)
+	results = filterDigest(results, query.Digest)
 
-		} else if isV2ImageManifest(tagDescriptor.MediaType) {
+	return results, nil
+}
 
-			result, err := processManifest(tagReference, tagDescriptor.Manifest, auth)
+// listTags lists the tags of the repository that match the pattern a page at
+// a time, and stops at the page that completes the limit when there is one.
+func listTags(ctx context.Context, auth RegistryAuth, repository string, tagPattern string, pageSize int, limit int) ([]string, error) {
 
-			if err != nil {
-				errors <- err
-				close(results)
-				close(errors)
-				return
-			}
+	repositoryReference, err := name.NewRepository(repository)
 
-			results <- *result
-			close(results)
-			close(errors)
+	if err != nil {
+		return []string{}, err
+	}
 
-		} else if isV1ImageManifest(tagDescriptor.MediaType) {
-			imageManifest := SchemaV1{}
-			err = json.Unmarshal(tagDescriptor.Manifest, &imageManifest)
-			lastLayer := imageManifest.History[0].V1Compatibility
-			layerManifest := SchemaV1History{}
-			err = json.Unmarshal([]byte(lastLayer), &layerManifest)
+	pattern, err := compileTagPattern(tagPattern)
 
-			if err != nil {
-				errors <- err
-				close(results)
-				close(errors)
-				return
-			}
+	if err != nil {
+		return []string{}, err
+	}
+
+	scopes := []string{repositoryReference.Scope(transport.PullScope)}
+	client, err := transport.NewWithContext(ctx, repositoryReference.Registry, registryAuthenticator(auth), registryTransport(auth), scopes)
 
-			digest, err := crane.Digest(tagReference.String(), crane.WithAuth(&authn.Basic{
-				Username: auth.username,
-				Password: auth.password,
-			}))
+	if err != nil {
+		return []string{}, err
+	}
+
+	next := &url.URL{
+		Scheme: repositoryReference.Registry.Scheme(),
+		Host:   repositoryReference.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/tags/list", repositoryReference.RepositoryStr()),
+	}
+	if pageSize > 0 {
+		next.RawQuery = fmt.Sprintf("n=%d", pageSize)
+	}
 
+	tags := make([]string, 0)
+
+	for next != nil && (limit <= 0 || len(tags) < limit) {
+		page, link, err := listTagPage(ctx, &http.Client{Transport: client}, next)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, x := range page {
+			if !pattern.MatchString(x) {
+				continue
+			}
+			sentinel, err := isLockSentinel(repositoryReference.Tag(x), makeOptions(craneOptions(ctx, auth)...).Remote)
 			if err != nil {
-				errors <- err
-				close(results)
-				close(errors)
-				return
+				return []string{}, err
 			}
+			if !sentinel {
+				tags = append(tags, x)
+			}
+		}
+		next = link
+	}
+
+	if limit > 0 && len(tags) > limit {
+		tags = tags[:limit]
+	}
+
+	return tags, nil
+}
+
+// listTagPage returns the tags of one page and the url of the next page,
+// which is nil on the last one.
+func listTagPage(ctx context.Context, client *http.Client, page *url.URL) ([]string, *url.URL, error) {
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, page.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	if err := transport.CheckError(response, http.StatusOK); err != nil {
+		return nil, nil, err
+	}
+
+	listed := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&listed); err != nil {
+		return nil, nil, err
+	}
+
+	link := response.Header.Get("Link")
+	if link == "" {
+		return listed.Tags, nil, nil
+	}
+
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start != 0 || end < 0 {
+		return nil, nil, fmt.Errorf("could not parse the link to the next page of tags: %s", link)
+	}
+
+	next, err := page.Parse(link[1:end])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return listed.Tags, next, nil
+}
+
+// listRepositories lists the catalog of the host of the registry, falling back
+// to the APIs of ECR, GCR and Artifact Registry which don't support it. When
+// the registry url has a path, only the repositories under it are returned and
+// they are named relative to it, the same way they are named everywhere else.
+func listRepositories(ctx context.Context, auth RegistryAuth, registry string, prefix string) ([]string, error) {
+
+	host, namespace := splitRegistry(registry)
+	if namespace != "" {
+		namespace += "/"
+	}
+
+	repositories, err := crane.Catalog(host, craneOptions(ctx, auth)...)
+
+	if err != nil && ctx.Err() == nil {
+		repositories, err = catalogFallback(ctx, auth, host, namespace, err)
+	}
+
+	if err != nil {
+		return []string{}, err
+	}
+
+	result := []string{}
+	for _, x := range repositories {
+		if strings.HasPrefix(x, namespace+prefix) {
+			result = append(result, strings.TrimPrefix(x, namespace))
+		}
+	}
+
+	return result, nil
+}
+
+// queryOne resolves a single tag. Image manifests are turned into results
+// immediately while the platform manifests of an index are returned as tasks
+// so that they share the same worker pool as the tags.
+func queryOne(ctx context.Context, auth RegistryAuth, query ImageQuery, tag string) ([]ImageResult, []manifestTask, error) {
+
+	tagReference, err := name.ParseReference(query.Name + ":" + tag)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tagDescriptor, err := remote.Get(tagReference, makeOptions(craneOptions(ctx, auth)...).Remote...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auth.digests.remember(tagReference.String(), tagDescriptor.Digest.String())
+
+	if isV2IndexManifest(tagDescriptor.MediaType) {
 
-			results <- ImageResult{
-				Name:           tagReference.Context().RepositoryStr(),
-				Registry:       tagReference.Context().RegistryStr(),
-				Tag:            tagReference.Identifier(),
-				Labels:         normalize(layerManifest.Config.Labels),
-				TagUrl:         tagReference.Name(),
-				DigestUrl:      tagReference.Context().Digest(digest).String(),
-				ImageDigest:    layerManifest.Config.Image,
-				Platform:       layerManifest.Os + "/" + layerManifest.Architecture,
-				BuildTimestamp: layerManifest.Created.UTC().Round(time.Second),
+		indexManifestReader := bytes.NewReader(tagDescriptor.Manifest)
+		parsedIndexManifest, err := v1.ParseIndexManifest(indexManifestReader)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		attestations := findAttestations(parsedIndexManifest)
+		tasks := make([]manifestTask, 0)
+		for _, indexManifest := range parsedIndexManifest.Manifests {
+			if isAttestationManifest(indexManifest) {
+				continue
 			}
+			if isSupportedPlatform(query.Platforms, indexManifest.Platform) {
+				task := manifestTask{
+					reference:  tagReference,
+					descriptor: indexManifest,
+				}
+				if attestation, ok := attestations[indexManifest.Digest.String()]; ok {
+					task.attestation = &attestation
+				}
+				tasks = append(tasks, task)
+			}
+		}
+
+		return nil, tasks, nil
+
+	} else if isV2ImageManifest(tagDescriptor.MediaType) {
+
+		result, err := processManifest(ctx, tagReference, tagDescriptor.Manifest, auth)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return []ImageResult{*result}, nil, nil
+
+	} else if isV1ImageManifest(tagDescriptor.MediaType) {
+
+		imageManifest := SchemaV1{}
+		err = json.Unmarshal(tagDescriptor.Manifest, &imageManifest)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(imageManifest.History) == 0 {
+			return nil, nil, fmt.Errorf("schema v1 manifest for '%s' has no history", tagReference.Name())
+		}
+
+		lastLayer := imageManifest.History[0].V1Compatibility
+		layerManifest := SchemaV1History{}
+		err = json.Unmarshal([]byte(lastLayer), &layerManifest)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		digest, err := getRemoteImageHash(ctx, tagReference.String(), auth)
 
-			close(results)
-			close(errors)
+		if err != nil {
+			return nil, nil, err
 		}
-	}()
 
-	return results, errors
+		return []ImageResult{{
+			Name:           tagReference.Context().RepositoryStr(),
+			Registry:       tagReference.Context().RegistryStr(),
+			Tag:            tagReference.Identifier(),
+			Labels:         normalize(layerManifest.Config.Labels),
+			TagUrl:         tagReference.Name(),
+			DigestUrl:      tagReference.Context().Digest(digest).String(),
+			Digest:         digest,
+			ImageDigest:    layerManifest.Config.Image,
+			ManifestDigest: digest,
+			Platform:       layerManifest.Os + "/" + layerManifest.Architecture,
+			BuildTimestamp: layerManifest.Created.UTC().Round(time.Second),
+		}}, nil, nil
+	}
+
+	return nil, nil, nil
 }
 
-func processManifest(reference name.Reference, manifest []byte, auth RegistryAuth) (*ImageResult, error) {
+func processManifest(ctx context.Context, reference name.Reference, manifest []byte, auth RegistryAuth) (*ImageResult, error) {
 
 	imageManifestReader := bytes.NewReader(manifest)
 	parsedImageManifest, err := v1.ParseManifest(imageManifestReader)
@@ -308,10 +529,7 @@ func processManifest(reference name.Reference, manifest []byte, auth RegistryAut
 	}
 
 	imageConfigManifestReference := reference.Context().Digest(parsedImageManifest.Config.Digest.String())
-	imageConfigLayer, err := remote.Layer(imageConfigManifestReference, makeOptions(crane.WithAuth(&authn.Basic{
-		Username: auth.username,
-		Password: auth.password,
-	})).Remote...)
+	imageConfigLayer, err := remote.Layer(imageConfigManifestReference, makeOptions(craneOptions(ctx, auth)...).Remote...)
 	if err != nil {
 		return nil, err
 	}
@@ -332,10 +550,13 @@ func processManifest(reference name.Reference, manifest []byte, auth RegistryAut
 		return nil, err
 	}
 
-	digest, err := crane.Digest(reference.String(), crane.WithAuth(&authn.Basic{
-		Username: auth.username,
-		Password: auth.password,
-	}))
+	digest, err := getRemoteImageHash(ctx, reference.String(), auth)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(manifest))
 
 	if err != nil {
 		return nil, err
@@ -348,8 +569,12 @@ func processManifest(reference name.Reference, manifest []byte, auth RegistryAut
 		Labels:         normalize(imageConfig.Config.Labels),
 		TagUrl:         reference.Name(),
 		DigestUrl:      reference.Context().Digest(digest).String(),
+		Digest:         digest,
 		ImageDigest:    parsedImageManifest.Config.Digest.String(),
+		ManifestDigest: manifestDigest.String(),
 		Platform:       imageConfig.Os + "/" + imageConfig.Architecture,
+		Variant:        imageConfig.Variant,
+		OSVersion:      imageConfig.OSVersion,
 		BuildTimestamp: imageConfig.Created.UTC().Round(time.Second),
 	}, nil
 
@@ -366,6 +591,9 @@ func normalize[K comparable, V interface{}](x map[K]V) map[K]V {
 func parseGroups(re *regexp.Regexp, s string) map[string]string {
 	match := re.FindStringSubmatch(s)
 	result := map[string]string{}
+	if match == nil {
+		return result
+	}
 	for i, n := range re.SubexpNames() {
 		if i != 0 && n != "" {
 			result[n] = match[i]
@@ -374,29 +602,70 @@ func parseGroups(re *regexp.Regexp, s string) map[string]string {
 	return result
 }
 
+// parsePlatform parses platforms like `linux/arm64/v8`. Windows images only
+// run on hosts of a matching version, which is given in parentheses the same
+// way containerd does, e.g. `windows(10.0.17763)/amd64`.
 func parsePlatform(platform string) Platform {
-	re := regexp.MustCompile(`(?P<os>[^/]+)/(?P<architecture>[^/]+)`)
+	re := regexp.MustCompile(`^(?P<os>[^/(]+)(\((?P<os_version>[^)]*)\))?/(?P<architecture>[^/]+)(/(?P<variant>[^/]+))?$`)
 	groups := parseGroups(re, platform)
 	return Platform{
 		OperatingSystem: groups["os"],
+		OSVersion:       groups["os_version"],
 		Architecture:    groups["architecture"],
+		Variant:         groups["variant"],
 	}
 }
 
+// isWindowsPlatform is true for platforms whose images are built on windows
+// base images.
+func isWindowsPlatform(platform string) bool {
+	return strings.EqualFold(parsePlatform(platform).OperatingSystem, "windows")
+}
+
+// isWasmPlatform is true for platforms of webassembly modules, e.g. `wasi/wasm`
+// or `wasip1/wasm`, which are built from scratch since no worker runs them.
+func isWasmPlatform(platform string) bool {
+	return strings.EqualFold(parsePlatform(platform).Architecture, "wasm")
+}
+
 func isSupportedPlatform(requiredPlatforms []string, platform *v1.Platform) bool {
 	if len(requiredPlatforms) == 0 {
 		return true
 	}
+	if platform == nil {
+		return false
+	}
 	for _, x := range requiredPlatforms {
 		parsed := parsePlatform(x)
 		if strings.EqualFold(parsed.OperatingSystem, platform.OS) &&
-			strings.EqualFold(parsed.Architecture, platform.Architecture) {
+			strings.EqualFold(parsed.Architecture, platform.Architecture) &&
+			(parsed.Variant == "" || strings.EqualFold(parsed.Variant, platform.Variant)) &&
+			isSupportedOSVersion(parsed.OSVersion, platform.OSVersion) {
 			return true
 		}
 	}
 	return false
 }
 
+// isSupportedOSVersion matches the version of the os an image requires by its
+// prefix, so `10.0.17763` matches every revision of windows server 2019.
+func isSupportedOSVersion(required string, actual string) bool {
+	return required == "" || actual == required || strings.HasPrefix(actual, required+".")
+}
+
+// isAttestationManifest detects the in-toto attestation manifests that buildx
+// adds to an index. They aren't runnable images and carry an unknown platform.
+func isAttestationManifest(descriptor v1.Descriptor) bool {
+	if descriptor.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return true
+	}
+	return isUnknownPlatform(descriptor.Platform)
+}
+
+func isUnknownPlatform(platform *v1.Platform) bool {
+	return platform == nil || platform.OS == "" || platform.OS == "unknown" || platform.Architecture == "unknown"
+}
+
 func isV2IndexManifest(kind types.MediaType) bool {
 	return kind.IsIndex()
 }
@@ -426,15 +695,56 @@ func filterLabels(images []ImageResult, labels Labels) []ImageResult {
 	return results
 }
 
-func filterTags(tags []string, tagPattern string) []string {
+func filterCreated(images []ImageResult, after time.Time, before time.Time) []ImageResult {
+	results := make([]ImageResult, 0)
+	for _, image := range images {
+		if !after.IsZero() && !image.BuildTimestamp.After(after) {
+			continue
+		}
+		if !before.IsZero() && !image.BuildTimestamp.Before(before) {
+			continue
+		}
+		results = append(results, image)
+	}
+	return results
+}
+
+func filterDigest(images []ImageResult, digest string) []ImageResult {
+	if digest == "" {
+		return images
+	}
+	results := make([]ImageResult, 0)
+	for _, image := range images {
+		if image.Digest == digest || image.ImageDigest == digest || image.ManifestDigest == digest {
+			results = append(results, image)
+		}
+	}
+	return results
+}
+
+// compileTagPattern compiles a pattern of tags, which is either a literal tag
+// or a regex surrounded by slashes.
+func compileTagPattern(tagPattern string) (*regexp.Regexp, error) {
+	if len(tagPattern) > 1 && strings.HasPrefix(tagPattern, "/") && strings.HasSuffix(tagPattern, "/") {
+		return regexp.Compile(strings.Trim(tagPattern, "/"))
+	}
+	return regexp.Compile("^" + regexp.QuoteMeta(tagPattern) + "$")
+}
+
+func validateTagPattern(value interface{}, key string) ([]string, []error) {
+	if _, err := compileTagPattern(value.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%s is not a valid pattern: %w", key, err)}
+	}
+	return nil, nil
+}
+
+func filterTags(tags []string, tagPattern string) ([]string, error) {
 
-	var regex *regexp.Regexp
 	result := []string{}
 
-	if strings.HasPrefix(tagPattern, "/") && strings.HasSuffix(tagPattern, "/") {
-		regex = regexp.MustCompile(strings.Trim(tagPattern, "/"))
-	} else {
-		regex = regexp.MustCompile("^" + regexp.QuoteMeta(tagPattern) + "$")
+	regex, err := compileTagPattern(tagPattern)
+	if err != nil {
+		return result, err
 	}
 
 	for _, x := range tags {
@@ -443,14 +753,80 @@ func filterTags(tags []string, tagPattern string) []string {
 		}
 	}
 
-	return result
+	return result, nil
+}
+
+func validateVersionConstraint(value interface{}, key string) ([]string, []error) {
+	if value.(string) == "" {
+		return nil, nil
+	}
+	if _, err := version.NewConstraint(value.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%s is not a valid version constraint: %w", key, err)}
+	}
+	return nil, nil
+}
+
+func filterVersions(tags []string, versionConstraint string) ([]string, error) {
+
+	constraints, err := version.NewConstraint(versionConstraint)
+	result := []string{}
+
+	if err != nil {
+		return result, err
+	}
+
+	for _, x := range tags {
+		parsed, err := version.NewVersion(x)
+		if err == nil && constraints.Check(parsed) {
+			result = append(result, x)
+		}
+	}
+
+	return result, nil
+}
+
+func sortVersions(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return version.Must(version.NewVersion(tags[i])).GreaterThan(version.Must(version.NewVersion(tags[j])))
+	})
+}
+
+func craneOptions(ctx context.Context, auth RegistryAuth) []crane.Option {
+	return []crane.Option{
+		crane.WithAuth(&authn.Basic{
+			Username: auth.username,
+			Password: auth.password,
+		}),
+		crane.WithContext(ctx),
+		crane.WithTransport(registryTransport(auth)),
+	}
+}
+
+// registryTransport is used for requests made outside of crane so that they
+// are subject to the same timeouts.
+func registryTransport(auth RegistryAuth) http.RoundTripper {
+	if auth.transport == nil {
+		return http.DefaultTransport
+	}
+	return auth.transport
+}
+
+// registryAuthenticator is used for requests made outside of crane, which
+// should be anonymous when there are no credentials.
+func registryAuthenticator(auth RegistryAuth) authn.Authenticator {
+	if auth.username == "" {
+		return authn.Anonymous
+	}
+	return &authn.Basic{
+		Username: auth.username,
+		Password: auth.password,
+	}
 }
 
 func makeOptions(opts ...crane.Option) crane.Options {
 	opt := crane.Options{
 		Remote: []remote.Option{
 			remote.WithAuthFromKeychain(authn.DefaultKeychain),
-			//remote.WithContext(ctx),
 		},
 	}
 	for _, o := range opts {
@@ -458,3 +834,71 @@ func makeOptions(opts ...crane.Option) crane.Options {
 	}
 	return opt
 }
+
+func readRepositoryTagsDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag_pattern := data.Get("tag_pattern").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	tags, err := listTags(context, auth, fullImage(registry_url, repository_name), tag_pattern, data.Get("page_size").(int), 0)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("tags", tags)
+
+	return diag.Diagnostics{}
+}
+
+func readTagExistsDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	hash, err := getRemoteImageHash(context, fullImage(registry_url, repository_name+":"+tag), auth)
+
+	if err != nil && !isNotFound(err) {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("exists", err == nil)
+
+	if err == nil {
+		data.Set("digest", hash)
+		data.Set("digest_url", fullImage(registry_url, repository_name+"@"+hash))
+	} else {
+		data.Set("digest", "")
+		data.Set("digest_url", "")
+	}
+
+	return diag.Diagnostics{}
+}
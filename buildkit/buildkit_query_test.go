@@ -0,0 +1,813 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFilterTags(t *testing.T) {
+	tags := []string{"1.0.0", "1.0.0-rc1", "latest", "v1.4.2"}
+
+	regex, err := filterTags(tags, "/^v?[0-9.]+$/")
+	if err != nil || !reflect.DeepEqual(regex, []string{"1.0.0", "v1.4.2"}) {
+		t.Fatalf("unexpected tags: %v %v", regex, err)
+	}
+
+	exact, err := filterTags(tags, "latest")
+	if err != nil || !reflect.DeepEqual(exact, []string{"latest"}) {
+		t.Fatalf("unexpected tags: %v %v", exact, err)
+	}
+
+	if _, err := filterTags(tags, "/^v(/"); err == nil {
+		t.Fatal("expected an invalid regex to be an error")
+	}
+
+	if _, errs := validateTagPattern("/^v(/", "tag_pattern"); len(errs) == 0 {
+		t.Fatal("expected an invalid regex to be rejected")
+	}
+	if _, errs := validateTagPattern("1.0.0+build(1)", "tag_pattern"); len(errs) > 0 {
+		t.Fatalf("expected a literal tag to be accepted: %v", errs)
+	}
+}
+
+func TestFilterVersions(t *testing.T) {
+	tags := []string{"1.3.9", "1.4.0", "v1.4.2", "1.5.0", "2.0.0", "latest"}
+
+	result, err := filterVersions(tags, "~> 1.4")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, []string{"1.4.0", "v1.4.2", "1.5.0"}) {
+		t.Fatalf("unexpected tags: %v", result)
+	}
+
+	if _, err := filterVersions(tags, "not a constraint"); err == nil {
+		t.Fatalf("expected an invalid constraint to produce an error")
+	}
+}
+
+func TestValidateVersionConstraint(t *testing.T) {
+	resource := buildkitImagesDataSource()
+
+	invalid := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"registry_url":        "ghcr.io",
+		"repository_name":     "org/app",
+		"supported_platforms": []interface{}{"linux/amd64"},
+		"version_constraint":  "~> one",
+	})
+	if diags := resource.Validate(invalid); !diags.HasError() {
+		t.Fatal("expected an invalid version constraint to fail the plan")
+	}
+
+	valid := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"registry_url":        "ghcr.io",
+		"repository_name":     "org/app",
+		"supported_platforms": []interface{}{"linux/amd64"},
+		"version_constraint":  ">= 1.2, < 2",
+	})
+	if diags := resource.Validate(valid); diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+}
+
+// testPushImageCreatedAt pushes a random image that was built at the time.
+func testPushImageCreatedAt(t *testing.T, reference string, created time.Time) {
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err = mutate.CreatedAt(image, v1.Time{Time: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(image, reference); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuerySortBy(t *testing.T) {
+	host := testRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+
+	// 1.2.0 was backfilled after 1.10.0 was released
+	testPushImageCreatedAt(t, host+"/app:1.10.0", now.Add(-2*time.Hour))
+	testPushImageCreatedAt(t, host+"/app:1.2.0", now.Add(-time.Hour))
+	testPushImageCreatedAt(t, host+"/app:latest", now.Add(-3*time.Hour))
+
+	for _, x := range []struct {
+		sortBy   string
+		order    string
+		expected []string
+	}{
+		{"", "desc", []string{"1.2.0", "1.10.0", "latest"}},
+		{"created", "asc", []string{"latest", "1.10.0", "1.2.0"}},
+		{"tag_semver", "desc", []string{"1.10.0", "1.2.0", "latest"}},
+		{"tag_semver", "asc", []string{"latest", "1.2.0", "1.10.0"}},
+		{"tag_lexical", "desc", []string{"latest", "1.2.0", "1.10.0"}},
+	} {
+		results, err := query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", SortBy: x.sortBy, Order: x.order, MaxConcurrency: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := []string{}
+		for _, result := range results {
+			tags = append(tags, result.Tag)
+		}
+		if !reflect.DeepEqual(tags, x.expected) {
+			t.Fatalf("expected %v sorted by %q %s but got %v", x.expected, x.sortBy, x.order, tags)
+		}
+	}
+
+	// the highest version is found without inspecting every tag
+	results, err := query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", SortBy: "tag_semver", Order: "desc", Limit: 1, MaxConcurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Tag != "1.10.0" {
+		t.Fatalf("expected only the highest version but got %v", results)
+	}
+}
+
+func TestQueryBreaksTiesByVersion(t *testing.T) {
+	host := testRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+
+	// every tag of a release is pushed at once
+	for _, tag := range []string{"latest", "1.2.0", "1.10.0", "1.10"} {
+		testPushImageCreatedAt(t, host+"/app:"+tag, now)
+	}
+
+	for i := 0; i < 3; i++ {
+		results, err := query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", MaxConcurrency: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := []string{}
+		for _, result := range results {
+			tags = append(tags, result.Tag)
+		}
+		if !reflect.DeepEqual(tags, []string{"1.10.0", "1.10", "1.2.0", "latest"}) {
+			t.Fatalf("expected images built at the same time to be ordered by version but got %v", tags)
+		}
+	}
+}
+
+func TestForEachBoundsConcurrency(t *testing.T) {
+	var active, peak int32
+	err := forEach(context.Background(), 3, 20, func(ctx context.Context, i int) error {
+		current := atomic.AddInt32(&active, 1)
+		for {
+			previous := atomic.LoadInt32(&peak)
+			if current <= previous || atomic.CompareAndSwapInt32(&peak, previous, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if peak > 3 {
+		t.Fatalf("expected at most 3 concurrent calls but saw %d", peak)
+	}
+}
+
+func TestForEachStopsOnError(t *testing.T) {
+	var calls int32
+	expected := errors.New("boom")
+	err := forEach(context.Background(), 1, 100, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 2 {
+			return expected
+		}
+		return nil
+	})
+	if err != expected {
+		t.Fatalf("expected %v but got %v", expected, err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected processing to stop after the failure but saw %d calls", calls)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	cases := map[string]Platform{
+		"linux/amd64":               {OperatingSystem: "linux", Architecture: "amd64"},
+		"linux/arm/v7":              {OperatingSystem: "linux", Architecture: "arm", Variant: "v7"},
+		"windows(10.0.17763)/amd64": {OperatingSystem: "windows", OSVersion: "10.0.17763", Architecture: "amd64"},
+		"linux":                     {},
+	}
+	for x, expected := range cases {
+		if actual := parsePlatform(x); actual != expected {
+			t.Fatalf("expected %s to parse as %+v but got %+v", x, expected, actual)
+		}
+	}
+}
+
+func TestIsSupportedPlatform(t *testing.T) {
+	arm := &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	windows := &v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.2114"}
+
+	if !isSupportedPlatform([]string{"linux/arm"}, arm) || !isSupportedPlatform([]string{"linux/arm/v7"}, arm) {
+		t.Fatalf("expected linux/arm/v7 to be supported")
+	}
+	if isSupportedPlatform([]string{"linux/arm/v6"}, arm) {
+		t.Fatalf("expected a different variant not to be supported")
+	}
+	if !isSupportedPlatform([]string{"windows/amd64"}, windows) || !isSupportedPlatform([]string{"windows(10.0.17763)/amd64"}, windows) {
+		t.Fatalf("expected windows server 2019 to be supported")
+	}
+	if isSupportedPlatform([]string{"windows(10.0.20348)/amd64"}, windows) || isSupportedPlatform([]string{"windows(10.0.1776)/amd64"}, windows) {
+		t.Fatalf("expected a different os version not to be supported")
+	}
+}
+
+func TestIsAttestationManifest(t *testing.T) {
+	image := v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}
+	if isAttestationManifest(image) {
+		t.Fatalf("expected an image manifest to not be treated as an attestation")
+	}
+
+	annotated := v1.Descriptor{
+		Platform:    &v1.Platform{OS: "unknown", Architecture: "unknown"},
+		Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+	}
+	if !isAttestationManifest(annotated) {
+		t.Fatalf("expected an annotated attestation manifest to be skipped")
+	}
+
+	if !isAttestationManifest(v1.Descriptor{}) {
+		t.Fatalf("expected a manifest without a platform to be skipped")
+	}
+}
+
+func TestRegistryRequestsAreCancelled(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	provider := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	started := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := getRemoteImageHash(ctx, host+"/app:latest", provider.registryAuth(host)); err == nil {
+		t.Fatalf("expected a cancelled request to fail")
+	}
+
+	if _, err := listRepositories(ctx, provider.registryAuth(host), host, ""); err == nil {
+		t.Fatalf("expected a cancelled request to fail")
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected requests to stop when cancelled but they took %s", elapsed)
+	}
+}
+
+func TestProviderRegistryTimeout(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url":     "tcp://127.0.0.1:1234",
+		"registry_timeout": "30s",
+		"registry_auth": []interface{}{
+			map[string]interface{}{"registry_url": "https://ghcr.io", "username": "user", "password": "secret", "timeout": "5s"},
+		},
+	})
+
+	meta, diags := providerConfigure(context.Background(), data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	shared, ok := meta.(TerraformProviderBuildkit).registryAuth("docker.io").transport.(*registryRoundTripper)
+	if !ok {
+		t.Fatalf("expected every registry to share a transport")
+	}
+
+	if shared.timeout != 30*time.Second {
+		t.Fatalf("expected registry requests to time out after 30s")
+	}
+
+	if shared.timeouts["ghcr.io"] != 5*time.Second {
+		t.Fatalf("expected requests to ghcr.io to time out after 5s but got %v", shared.timeouts)
+	}
+
+	data = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url":     "tcp://127.0.0.1:1234",
+		"registry_timeout": "soon",
+	})
+
+	if _, diags := providerConfigure(context.Background(), data); len(diags) == 0 {
+		t.Fatalf("expected an invalid timeout to be rejected")
+	}
+}
+
+func TestProviderBuildkitClient(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url": "tcp://127.0.0.1:1234",
+	})
+
+	// nothing listens on the address, the daemon isn't connected to until it is used
+	meta, diags := providerConfigure(context.Background(), data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if meta.(TerraformProviderBuildkit).buildkit_client == nil {
+		t.Fatalf("expected a client to be shared by every operation")
+	}
+
+	data = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url": "://127.0.0.1:1234",
+	})
+
+	if _, diags := providerConfigure(context.Background(), data); len(diags) == 0 || !strings.Contains(diags[0].Summary, "://127.0.0.1:1234") {
+		t.Fatalf("expected an invalid buildkit_url to be reported but got %v", diags)
+	}
+}
+
+func TestProviderRegistryAuthAliases(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url": "tcp://127.0.0.1:1234",
+		"registry_auth": []interface{}{
+			map[string]interface{}{"registry_url": "https://docker.io", "username": "hub", "password": "secret"},
+			map[string]interface{}{"registry_url": "GHCR.io/", "username": "github", "password": "secret"},
+		},
+	})
+
+	meta, diags := providerConfigure(context.Background(), data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	provider := meta.(TerraformProviderBuildkit)
+
+	for _, x := range []string{"docker.io", "index.docker.io", "registry-1.docker.io", "https://index.docker.io/v1/"} {
+		if auth := provider.registryAuth(x); auth.username != "hub" {
+			t.Fatalf("expected %s to find the docker hub credentials", x)
+		}
+	}
+
+	for _, x := range []string{"ghcr.io", "https://ghcr.io", "ghcr.io/org"} {
+		if auth := provider.registryAuth(x); auth.username != "github" {
+			t.Fatalf("expected %s to find the ghcr credentials", x)
+		}
+	}
+
+	if auth := provider.registryAuth("quay.io"); auth.username != "" {
+		t.Fatalf("expected no credentials for quay.io")
+	}
+
+	// buildkit asks for the credentials of the host it pulls from
+	creds, err := NewDockerAuthProvider(provider.registry_auth).(*authProvider).credentials("registry-1.docker.io")
+	if err != nil || creds.Username != "hub" {
+		t.Fatalf("expected the daemon to get the docker hub credentials: %v", err)
+	}
+}
+
+func TestImagesOrdering(t *testing.T) {
+	resource := buildkitImagesDataSource()
+	for key, values := range map[string][]string{"sort_by": {"", "created", "tag_semver", "tag_lexical"}, "order": {"asc", "desc"}} {
+		for _, x := range values {
+			if _, errs := resource.Schema[key].ValidateFunc(x, key); len(errs) > 0 {
+				t.Fatalf("expected %s '%s' to be valid: %v", key, x, errs)
+			}
+		}
+		if _, errs := resource.Schema[key].ValidateFunc("semver", key); len(errs) == 0 {
+			t.Fatalf("expected an unknown %s to be rejected when planning", key)
+		}
+	}
+}
+
+func TestImagesMostRecentN(t *testing.T) {
+	resource := buildkitImagesDataSource()
+
+	conflicting := terraform.NewResourceConfigRaw(map[string]interface{}{
+		"registry_url":        "ghcr.io",
+		"repository_name":     "org/app",
+		"supported_platforms": []interface{}{"linux/amd64"},
+		"most_recent_only":    true,
+		"most_recent_n":       2,
+	})
+	if diags := resource.Validate(conflicting); !diags.HasError() {
+		t.Fatal("expected most_recent_n to conflict with most_recent_only")
+	}
+
+	host := testRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+	testPushImageCreatedAt(t, host+"/app:1.0.0", now.Add(-3*time.Hour))
+	testPushImageCreatedAt(t, host+"/app:1.1.0", now.Add(-2*time.Hour))
+	testPushImageCreatedAt(t, host+"/app:1.2.0", now.Add(-time.Hour))
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"most_recent_n":   2,
+	})
+
+	if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	images_by_tag := data.Get("images_by_tag").(map[string]interface{})
+	if _, ok := images_by_tag["1.0.0"]; ok || len(images_by_tag) != 2 {
+		t.Fatalf("expected the 2 most recent images but got %v", images_by_tag)
+	}
+}
+
+// testPagingRegistry is an in-memory registry that lists tags a page at a
+// time like the distribution spec describes, and counts the pages listed and
+// the manifests fetched.
+func testPagingRegistry(t *testing.T) (string, *int32, *int32) {
+	inner := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	var pages, manifests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodGet {
+			atomic.AddInt32(&manifests, 1)
+		}
+
+		if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt32(&pages, 1)
+
+		listed := struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}{}
+		json.Unmarshal(testServe(inner, http.MethodGet, r.URL.Path).Body.Bytes(), &listed)
+
+		last := r.URL.Query().Get("last")
+		size, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		remaining := []string{}
+		for _, x := range listed.Tags {
+			if x > last {
+				remaining = append(remaining, x)
+			}
+		}
+
+		if size > 0 && len(remaining) > size {
+			remaining = remaining[:size]
+			w.Header().Set("Link", fmt.Sprintf(`<%s?n=%d&last=%s>; rel="next"`, r.URL.Path, size, remaining[size-1]))
+		}
+
+		listed.Tags = remaining
+		json.NewEncoder(w).Encode(listed)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://"), &pages, &manifests
+}
+
+func TestListTagsPages(t *testing.T) {
+	host, pages, _ := testPagingRegistry(t)
+	for _, tag := range []string{"1", "2", "3", "4", "5"} {
+		testPushImage(t, host+"/app:"+tag)
+	}
+
+	for _, x := range []struct {
+		pageSize int
+		limit    int
+		expected []string
+		pages    int32
+	}{
+		// a page boundary that falls on the last tag
+		{5, 0, []string{"1", "2", "3", "4", "5"}, 1},
+		{2, 0, []string{"1", "2", "3", "4", "5"}, 3},
+		// listing stops at the page that completes the limit
+		{2, 3, []string{"1", "2", "3"}, 2},
+		{2, 4, []string{"1", "2", "3", "4"}, 2},
+		{0, 2, []string{"1", "2"}, 1},
+	} {
+		atomic.StoreInt32(pages, 0)
+
+		tags, err := listTags(context.Background(), RegistryAuth{}, host+"/app", "/.*/", x.pageSize, x.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, x.expected) || atomic.LoadInt32(pages) != x.pages {
+			t.Fatalf("expected %v from %d pages of %d but got %v from %d", x.expected, x.pages, x.pageSize, tags, atomic.LoadInt32(pages))
+		}
+	}
+
+	// tags that don't match don't count towards the limit
+	tags, err := listTags(context.Background(), RegistryAuth{}, host+"/app", "/[135]/", 2, 2)
+	if err != nil || !reflect.DeepEqual(tags, []string{"1", "3"}) {
+		t.Fatalf("expected the first matching tags but got %v (%v)", tags, err)
+	}
+}
+
+func TestQueryStopsEarly(t *testing.T) {
+	host, pages, manifests := testPagingRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+	for i, tag := range []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0", "1.4.0", "1.5.0"} {
+		testPushImageCreatedAt(t, host+"/app:"+tag, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	// in the order the registry lists them only the first max_tags are listed
+	atomic.StoreInt32(pages, 0)
+	results, err := query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", PageSize: 2, MaxTags: 3, MaxConcurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Tag != "1.2.0" || atomic.LoadInt32(pages) != 2 {
+		t.Fatalf("expected the first 3 tags from 2 pages but got %v from %d", results, atomic.LoadInt32(pages))
+	}
+
+	// sorted by version every page is listed, but only the highest is inspected
+	atomic.StoreInt32(pages, 0)
+	atomic.StoreInt32(manifests, 0)
+	results, err = query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", PageSize: 2, SortBy: "tag_semver", Limit: 1, MaxConcurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Tag != "1.5.0" || atomic.LoadInt32(pages) != 3 {
+		t.Fatalf("expected the highest version from 3 pages but got %v from %d", results, atomic.LoadInt32(pages))
+	}
+	inspected := atomic.LoadInt32(manifests)
+
+	atomic.StoreInt32(manifests, 0)
+	if _, err := query(context.Background(), RegistryAuth{}, ImageQuery{Name: host + "/app", TagPattern: "/.*/", SortBy: "tag_semver", MaxConcurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if all := atomic.LoadInt32(manifests); inspected >= all {
+		t.Fatalf("expected fewer tags to be inspected when stopping early but fetched %d of %d manifests", inspected, all)
+	}
+}
+
+func TestReadImagesDataSourceCreated(t *testing.T) {
+	host := testRegistry(t)
+	created := time.Date(2022, 3, 14, 15, 9, 26, 0, time.UTC)
+	testPushImageCreatedAt(t, host+"/app:1.0.0", created)
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+		"registry_url":        host,
+		"repository_name":     "app",
+		"supported_platforms": []interface{}{"linux/amd64"},
+	})
+
+	if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if actual := data.Get("images.0.created").(string); actual != "2022-03-14T15:09:26Z" {
+		t.Fatalf("expected the build timestamp of the image but got %q", actual)
+	}
+}
+
+func TestImagesCreatedBetween(t *testing.T) {
+	host := testRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+	testPushImageCreatedAt(t, host+"/app:1.0.0", now.Add(-3*time.Hour))
+	testPushImageCreatedAt(t, host+"/app:1.1.0", now.Add(-2*time.Hour))
+	testPushImageCreatedAt(t, host+"/app:1.2.0", now.Add(-time.Hour))
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	for _, x := range []struct {
+		after    time.Time
+		before   time.Time
+		expected []string
+	}{
+		{now.Add(-150 * time.Minute), time.Time{}, []string{"1.1.0", "1.2.0"}},
+		{time.Time{}, now.Add(-90 * time.Minute), []string{"1.0.0", "1.1.0"}},
+		{now.Add(-150 * time.Minute), now.Add(-90 * time.Minute), []string{"1.1.0"}},
+		// both bounds are exclusive
+		{now.Add(-2 * time.Hour), now.Add(-time.Hour), []string{}},
+	} {
+		raw := map[string]interface{}{
+			"registry_url":     host,
+			"repository_name":  "app",
+			"most_recent_only": false,
+		}
+		if !x.after.IsZero() {
+			raw["created_after"] = x.after.Format(time.RFC3339)
+		}
+		if !x.before.IsZero() {
+			raw["created_before"] = x.before.Format(time.RFC3339)
+		}
+		data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, raw)
+
+		if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+
+		tags := make([]string, 0)
+		for tag := range data.Get("images_by_tag").(map[string]interface{}) {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, x.expected) {
+			t.Fatalf("expected %v between %v and %v but got %v", x.expected, x.after, x.before, tags)
+		}
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"created_after":   "yesterday",
+	})
+	if diags := readImagesDataSource(context.Background(), data, meta); !diags.HasError() {
+		t.Fatal("expected a timestamp that isn't RFC3339 to be an error")
+	}
+}
+
+func TestImagesByDigest(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	if err := crane.Tag(host+"/app:1.0.0", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	testPushImage(t, host+"/app:2.0.0")
+	config, err := crane.Config(host + "/app:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, _, _ := v1.SHA256(bytes.NewReader(config))
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	// every tag of the image is found by its manifest or its config digest
+	for _, x := range []string{digest, configDigest.String()} {
+		data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+			"registry_url":     host,
+			"repository_name":  "app",
+			"most_recent_only": false,
+			"digest":           x,
+		})
+
+		if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+
+		tags := make([]string, 0)
+		for tag := range data.Get("images_by_tag").(map[string]interface{}) {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, []string{"1.0.0", "latest"}) {
+			t.Fatalf("expected the tags of %s but got %v", x, tags)
+		}
+	}
+
+	// the digest of a platform manifest, like platform_digests has, finds the platform
+	index := testPushIndex(t, host+"/app:3.0.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+		"registry_url":     host,
+		"repository_name":  "app",
+		"most_recent_only": false,
+		"digest":           manifest.Manifests[0].Digest.String(),
+	})
+
+	if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	images := data.Get("images").([]interface{})
+	if len(images) != 1 || images[0].(map[string]interface{})["tag"] != "3.0.0" || images[0].(map[string]interface{})["platform"] != "linux/amd64" {
+		t.Fatalf("expected the linux/amd64 image of 3.0.0 but got %v", images)
+	}
+}
+
+func TestImagesAttestations(t *testing.T) {
+	host := testRegistry(t)
+	testPushAttestedIndex(t, host+"/app:1.0.0",
+		InTotoStatement{PredicateType: "https://slsa.dev/provenance/v0.2", Predicate: json.RawMessage("{}")},
+		InTotoStatement{PredicateType: "https://spdx.dev/Document", Predicate: json.RawMessage("{}")})
+	testPushAttestedIndex(t, host+"/app:1.1.0",
+		InTotoStatement{PredicateType: "https://slsa.dev/provenance/v0.2", Predicate: json.RawMessage("{}")})
+	testPushImage(t, host+"/app:1.2.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImagesDataSource().Schema, map[string]interface{}{
+		"registry_url":     host,
+		"repository_name":  "app",
+		"most_recent_only": false,
+	})
+
+	if diags := readImagesDataSource(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	expected := map[string][]interface{}{
+		"1.0.0": {[]interface{}{"https://slsa.dev/provenance/v0.2", "https://spdx.dev/Document"}, true, true},
+		"1.1.0": {[]interface{}{"https://slsa.dev/provenance/v0.2"}, true, false},
+		"1.2.0": {[]interface{}{}, false, false},
+	}
+
+	images := data.Get("images").([]interface{})
+	if len(images) != len(expected) {
+		t.Fatalf("expected %d images but got %v", len(expected), images)
+	}
+	for _, x := range images {
+		image := x.(map[string]interface{})
+		actual := []interface{}{image["attestations"], image["has_provenance"], image["has_sbom"]}
+		if !reflect.DeepEqual(actual, expected[image["tag"].(string)]) {
+			t.Fatalf("expected %v for %s but got %v", expected[image["tag"].(string)], image["tag"], actual)
+		}
+	}
+}
+
+func TestReadTagExistsSkipRemoteRefresh(t *testing.T) {
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}, skip_remote_refresh: true}
+
+	data := schema.TestResourceDataRaw(t, buildkitTagExistsDataSource().Schema, map[string]interface{}{
+		"registry_url":    "127.0.0.1:1",
+		"repository_name": "app",
+		"tag":             "1.0.0",
+	})
+
+	diags := readTagExistsDataSource(context.Background(), data, meta)
+	if len(diags) != 1 || diags[0].Severity != diag.Warning {
+		t.Fatalf("expected a warning that the registry wasn't queried but got %v", diags)
+	}
+
+	if data.Id() == "" || data.Get("exists").(bool) {
+		t.Fatalf("expected an empty result but got %v", data.State())
+	}
+}
+
+func TestReadTagExists(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	for _, x := range []struct {
+		repository string
+		tag        string
+		exists     bool
+		digest     string
+	}{
+		{"app", "1.0.0", true, digest},
+		{"app", "2.0.0", false, ""},
+		{"missing", "1.0.0", false, ""},
+	} {
+		data := schema.TestResourceDataRaw(t, buildkitTagExistsDataSource().Schema, map[string]interface{}{
+			"registry_url":    host,
+			"repository_name": x.repository,
+			"tag":             x.tag,
+		})
+
+		if diags := readTagExistsDataSource(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("expected %s:%s to be read without diagnostics: %v", x.repository, x.tag, diags)
+		}
+
+		if data.Get("exists").(bool) != x.exists || data.Get("digest").(string) != x.digest {
+			t.Fatalf("expected %s:%s to exist %v with digest %q but got %v", x.repository, x.tag, x.exists, x.digest, data.State().Attributes)
+		}
+	}
+}
+
+func TestMaxConcurrencyIsPositive(t *testing.T) {
+	for name, x := range map[string]*schema.Resource{
+		"buildkit_images":           buildkitImagesDataSource(),
+		"buildkit_registry_cleanup": buildkitRegistryCleanupResource(),
+		"buildkit_retention_policy": buildkitRetentionPolicyResource(),
+		"buildkit_bake":             buildkitBakeResource(),
+	} {
+		for _, value := range []int{0, -1} {
+			if _, errs := x.Schema["max_concurrency"].ValidateFunc(value, "max_concurrency"); len(errs) == 0 {
+				t.Fatalf("expected max_concurrency = %d to be rejected by %s", value, name)
+			}
+		}
+	}
+}
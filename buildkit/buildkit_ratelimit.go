@@ -0,0 +1,146 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// docker hub reports the pull limits on manifest requests for this
+// repository without counting them as a pull
+const rateLimitReference = "ratelimitpreview/test:latest"
+
+func getDockerHubAuth(provider TerraformProviderBuildkit) RegistryAuth {
+	return provider.registryAuth(name.DefaultRegistry)
+}
+
+// getDockerHubRateLimit asks docker hub for the pull limits that apply to the
+// given credentials (or to the calling ip address when there are none).
+func getDockerHubRateLimit(ctx context.Context, auth RegistryAuth) (*RateLimit, error) {
+
+	reference, err := name.ParseReference(rateLimitReference)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := reference.Context().Registry
+	scopes := []string{reference.Scope(transport.PullScope)}
+
+	roundTripper, err := transport.NewWithContext(ctx, registry, registryAuthenticator(auth), registryTransport(auth), scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", registry.Scheme(), registry.RegistryStr(), reference.Context().RepositoryStr(), reference.Identifier())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := (&http.Client{Transport: roundTripper}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if err := transport.CheckError(response, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	return parseRateLimit(response.Header)
+}
+
+// parseRateLimit reads the ratelimit headers. Accounts without a pull limit
+// receive no headers at all.
+func parseRateLimit(header http.Header) (*RateLimit, error) {
+	result := &RateLimit{Source: header.Get("docker-ratelimit-source")}
+
+	if header.Get("ratelimit-limit") == "" {
+		return result, nil
+	}
+
+	limit, window, err := parseRateLimitHeader(header.Get("ratelimit-limit"))
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, _, err := parseRateLimitHeader(header.Get("ratelimit-remaining"))
+	if err != nil {
+		return nil, err
+	}
+
+	result.Limited = true
+	result.Limit = limit
+	result.Remaining = remaining
+	result.Window = window
+
+	return result, nil
+}
+
+// parseRateLimitHeader parses values of the form "100;w=21600".
+func parseRateLimitHeader(value string) (int, int, error) {
+	count, policy, _ := strings.Cut(value, ";")
+
+	parsed, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not parse rate limit '%s': %w", value, err)
+	}
+
+	window := 0
+	if policy = strings.TrimSpace(policy); strings.HasPrefix(policy, "w=") {
+		window, err = strconv.Atoi(strings.TrimPrefix(policy, "w="))
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not parse rate limit window '%s': %w", value, err)
+		}
+	}
+
+	return parsed, window, nil
+}
+
+func readDockerHubRateLimitDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	min_remaining := data.Get("min_remaining").(int)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := getDockerHubAuth(provider)
+
+	limit, err := getDockerHubRateLimit(context, auth)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if limit.Limited && limit.Remaining < min_remaining {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Only %d of %d Docker Hub pulls remain but at least %d are required.", limit.Remaining, limit.Limit, min_remaining),
+			Detail:   fmt.Sprintf("The limit applies to '%s' and resets within %d seconds.", limit.Source, limit.Window),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("limited", limit.Limited)
+	data.Set("limit", limit.Limit)
+	data.Set("remaining", limit.Remaining)
+	data.Set("window_seconds", limit.Window)
+	data.Set("source", limit.Source)
+
+	return diag.Diagnostics{}
+}
@@ -0,0 +1,33 @@
+package buildkit
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	header := http.Header{}
+	header.Set("ratelimit-limit", "100;w=21600")
+	header.Set("ratelimit-remaining", "76;w=21600")
+	header.Set("docker-ratelimit-source", "203.0.113.7")
+
+	limit, err := parseRateLimit(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !limit.Limited || limit.Limit != 100 || limit.Remaining != 76 || limit.Window != 21600 || limit.Source != "203.0.113.7" {
+		t.Fatalf("unexpected rate limit: %+v", limit)
+	}
+}
+
+func TestParseRateLimitUnlimited(t *testing.T) {
+	limit, err := parseRateLimit(http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limit.Limited {
+		t.Fatalf("expected no limit: %+v", limit)
+	}
+}
@@ -0,0 +1,241 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+const (
+	redactedValue   = "[redacted]"
+	minRedactedLine = 4
+)
+
+// redactor replaces the values of secrets in whatever the provider reports,
+// which is the diagnostics, the progress of builds and the spans and logs
+// made from it. Terraform only hides sensitive values in the plan, so a
+// secret echoed by a failing build step or a registry would otherwise be
+// shown as is.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(values []string) *redactor {
+	unique := map[string]bool{}
+	for _, x := range values {
+		unique[x] = true
+		// build steps log line by line, so each line of a secret spanning
+		// several, like a private key, is redacted on its own as well unless
+		// it is too short to tell apart from ordinary output, like a brace
+		for _, line := range strings.Split(x, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minRedactedLine {
+				unique[line] = true
+			}
+		}
+	}
+	delete(unique, "")
+
+	// the longest values are replaced first, so a secret containing another
+	// isn't left partially visible
+	sorted := []string{}
+	for x := range unique {
+		sorted = append(sorted, x)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	pairs := []string{}
+	for _, x := range sorted {
+		pairs = append(pairs, x, redactedValue)
+	}
+
+	return &redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+func (r *redactor) redact(value string) string {
+	return r.replacer.Replace(value)
+}
+
+func (r *redactor) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if message := r.redact(err.Error()); message != err.Error() {
+		return errors.New(message)
+	}
+	return err
+}
+
+func (r *redactor) redactDiagnostics(diags diag.Diagnostics) diag.Diagnostics {
+	result := make(diag.Diagnostics, 0, len(diags))
+	for _, x := range diags {
+		x.Summary = r.redact(x.Summary)
+		x.Detail = r.redact(x.Detail)
+		result = append(result, x)
+	}
+	return result
+}
+
+// redactStatus is a copy of the status of a build with the secrets redacted
+// from the names and errors of its steps, their logs and their warnings.
+func (r *redactor) redactStatus(status *client.SolveStatus) *client.SolveStatus {
+	result := &client.SolveStatus{}
+	for _, x := range status.Vertexes {
+		vertex := *x
+		vertex.Name = r.redact(vertex.Name)
+		vertex.Error = r.redact(vertex.Error)
+		result.Vertexes = append(result.Vertexes, &vertex)
+	}
+	for _, x := range status.Statuses {
+		vertexStatus := *x
+		vertexStatus.ID = r.redact(vertexStatus.ID)
+		vertexStatus.Name = r.redact(vertexStatus.Name)
+		result.Statuses = append(result.Statuses, &vertexStatus)
+	}
+	for _, x := range status.Logs {
+		vertexLog := *x
+		vertexLog.Data = []byte(r.redact(string(vertexLog.Data)))
+		result.Logs = append(result.Logs, &vertexLog)
+	}
+	for _, x := range status.Warnings {
+		warning := *x
+		warning.Short = []byte(r.redact(string(warning.Short)))
+		warning.Detail = nil
+		for _, detail := range x.Detail {
+			warning.Detail = append(warning.Detail, []byte(r.redact(string(detail))))
+		}
+		result.Warnings = append(result.Warnings, &warning)
+	}
+	return result
+}
+
+// redactPanic panics again with the secrets redacted from the panic and the
+// stack it was raised at, which terraform shows as the crash output.
+func (r *redactor) redactPanic() {
+	if recovered := recover(); recovered != nil {
+		panic(r.redact(fmt.Sprintf("%v\n\n%s", recovered, debug.Stack())))
+	}
+}
+
+// sensitiveValues are the values of every sensitive attribute of the schema,
+// including those nested in sensitive blocks. Attributes suffixed `_base64`
+// are decoded too, since it is the decoded value builds see.
+func sensitiveValues(schemas map[string]*schema.Schema, get func(string) interface{}, sensitive bool) []string {
+	result := []string{}
+	for key, definition := range schemas {
+		result = append(result, sensitiveValuesOf(key, definition, get(key), sensitive || definition.Sensitive)...)
+	}
+	return result
+}
+
+func sensitiveValuesOf(key string, definition *schema.Schema, value interface{}, sensitive bool) []string {
+	if set, ok := value.(*schema.Set); ok {
+		value = set.List()
+	}
+
+	result := []string{}
+
+	switch casted := value.(type) {
+	case string:
+		if !sensitive || casted == "" {
+			return result
+		}
+		result = append(result, casted)
+		if strings.HasSuffix(key, "_base64") {
+			if decoded, err := base64.StdEncoding.DecodeString(casted); err == nil {
+				result = append(result, string(decoded))
+			}
+		}
+	case []interface{}:
+		for _, x := range casted {
+			if nested, ok := definition.Elem.(*schema.Resource); ok {
+				if item, ok := x.(map[string]interface{}); ok {
+					result = append(result, sensitiveValues(nested.Schema, func(k string) interface{} { return item[k] }, sensitive)...)
+				}
+				continue
+			}
+			result = append(result, sensitiveValuesOf(key, definition, x, sensitive)...)
+		}
+	case map[string]interface{}:
+		for _, x := range casted {
+			result = append(result, sensitiveValuesOf(key, definition, x, sensitive)...)
+		}
+	}
+
+	return result
+}
+
+// resourceRedactor redacts the sensitive values of the provider and of the
+// resource whose attributes are given.
+func resourceRedactor(schemas map[string]*schema.Schema, get func(string) interface{}, meta interface{}) *redactor {
+	values := sensitiveValues(schemas, get, false)
+	if provider, ok := meta.(TerraformProviderBuildkit); ok {
+		values = append(values, provider.sensitive_values...)
+	}
+	return newRedactor(values)
+}
+
+// redactResources redacts the sensitive values of the provider and of each
+// resource from the diagnostics and the crash output of its operations.
+func redactResources(resources map[string]*schema.Resource) {
+	for _, definition := range resources {
+		definition.CreateContext = redactedOperation(definition.Schema, definition.CreateContext)
+		definition.ReadContext = redactedOperation(definition.Schema, definition.ReadContext)
+		definition.UpdateContext = redactedOperation(definition.Schema, definition.UpdateContext)
+		definition.DeleteContext = redactedOperation(definition.Schema, definition.DeleteContext)
+		definition.CustomizeDiff = redactedDiff(definition.Schema, definition.CustomizeDiff)
+	}
+}
+
+func redactedOperation(schemas map[string]*schema.Schema, operation func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics) func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics {
+	if operation == nil {
+		return nil
+	}
+	return func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		redactor := resourceRedactor(schemas, data.Get, meta)
+		defer redactor.redactPanic()
+		return redactor.redactDiagnostics(operation(ctx, data, meta))
+	}
+}
+
+func redactedDiff(schemas map[string]*schema.Schema, customize schema.CustomizeDiffFunc) schema.CustomizeDiffFunc {
+	if customize == nil {
+		return nil
+	}
+	return func(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+		redactor := resourceRedactor(schemas, diff.Get, meta)
+		defer redactor.redactPanic()
+		return redactor.redactError(customize(ctx, diff, meta))
+	}
+}
+
+// redactedConfigure keeps the sensitive values of the provider along with it,
+// for the operations of the resources to redact, and redacts them from the
+// diagnostics of configuring it.
+func redactedConfigure(schemas map[string]*schema.Schema, configure schema.ConfigureContextFunc) schema.ConfigureContextFunc {
+	return func(ctx context.Context, data *schema.ResourceData) (interface{}, diag.Diagnostics) {
+		values := sensitiveValues(schemas, data.Get, false)
+		redactor := newRedactor(values)
+		defer redactor.redactPanic()
+
+		meta, diags := configure(ctx, data)
+
+		if provider, ok := meta.(TerraformProviderBuildkit); ok {
+			provider.sensitive_values = values
+			meta = provider
+		}
+
+		return meta, redactor.redactDiagnostics(diags)
+	}
+}
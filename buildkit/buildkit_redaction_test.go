@@ -0,0 +1,136 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSensitiveValues(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"args":           map[string]interface{}{"VERSION": "1.0.0"},
+		"secrets":        map[string]interface{}{"token": "hunter2"},
+		"secrets_base64": map[string]interface{}{"key": base64.StdEncoding.EncodeToString([]byte("binary"))},
+		"secret": []interface{}{
+			map[string]interface{}{"id": "npmrc", "value": "//registry.npmjs.org/:_authToken=abc"},
+		},
+	}))
+
+	values := sensitiveValues(buildkitImageResource().Schema, data.Get, false)
+	sort.Strings(values)
+
+	expected := []string{"//registry.npmjs.org/:_authToken=abc", base64.StdEncoding.EncodeToString([]byte("binary")), "binary", "hunter2"}
+	sort.Strings(expected)
+
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, values)
+	}
+}
+
+func TestRedactStatus(t *testing.T) {
+	redactor := newRedactor([]string{"hunter2", "-----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----"})
+
+	status := &client.SolveStatus{
+		Vertexes: []*client.Vertex{{Name: "[2/2] RUN echo hunter2", Error: "exit code 1: hunter2"}},
+		Logs:     []*client.VertexLog{{Data: []byte("c2VjcmV0\n")}},
+		Warnings: []*client.VertexWarning{{Short: []byte("hunter2"), Detail: [][]byte{[]byte("uses hunter2")}}},
+	}
+
+	result := redactor.redactStatus(status)
+
+	if result.Vertexes[0].Name != "[2/2] RUN echo [redacted]" || result.Vertexes[0].Error != "exit code 1: [redacted]" {
+		t.Fatalf("expected the step to be redacted: %+v", result.Vertexes[0])
+	}
+	if string(result.Logs[0].Data) != "[redacted]\n" {
+		t.Fatalf("expected every line of a secret to be redacted: %q", result.Logs[0].Data)
+	}
+	if string(result.Warnings[0].Short) != "[redacted]" || string(result.Warnings[0].Detail[0]) != "uses [redacted]" {
+		t.Fatalf("expected the warning to be redacted: %+v", result.Warnings[0])
+	}
+	if status.Vertexes[0].Name != "[2/2] RUN echo hunter2" {
+		t.Fatal("expected the status to be left alone")
+	}
+}
+
+func TestRedactedOperation(t *testing.T) {
+	schemas := map[string]*schema.Schema{
+		"secrets": {Type: schema.TypeMap, Optional: true, Sensitive: true},
+	}
+	meta := TerraformProviderBuildkit{sensitive_values: []string{"registry-password"}}
+	data := schema.TestResourceDataRaw(t, schemas, map[string]interface{}{"secrets": map[string]interface{}{"token": "hunter2"}})
+
+	operation := redactedOperation(schemas, func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "failed to log in with registry-password",
+			Detail:   "echo hunter2",
+		}}
+	})
+
+	diags := operation(context.Background(), data, meta)
+	if diags[0].Summary != "failed to log in with [redacted]" || diags[0].Detail != "echo [redacted]" {
+		t.Fatalf("expected the diagnostics to be redacted: %v", diags)
+	}
+
+	panics := redactedOperation(schemas, func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		panic("unexpected hunter2")
+	})
+
+	defer func() {
+		recovered := fmt.Sprint(recover())
+		if !strings.HasPrefix(recovered, "unexpected [redacted]") || strings.Contains(recovered, "hunter2") {
+			t.Fatalf("expected the panic to be redacted: %s", recovered)
+		}
+	}()
+
+	panics(context.Background(), data, meta)
+}
+
+func TestRedactedConfigure(t *testing.T) {
+	schemas := map[string]*schema.Schema{
+		"registry_auth": {
+			Type:     schema.TypeSet,
+			Optional: true,
+			Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+				"username": {Type: schema.TypeString, Required: true},
+				"password": {Type: schema.TypeString, Required: true, Sensitive: true},
+			}},
+		},
+	}
+	data := schema.TestResourceDataRaw(t, schemas, map[string]interface{}{
+		"registry_auth": []interface{}{map[string]interface{}{"username": "user", "password": "registry-password"}},
+	})
+
+	configure := redactedConfigure(schemas, func(ctx context.Context, data *schema.ResourceData) (interface{}, diag.Diagnostics) {
+		return TerraformProviderBuildkit{}, diag.Diagnostics{diag.Diagnostic{Severity: diag.Warning, Summary: "user:registry-password was rejected"}}
+	})
+
+	meta, diags := configure(context.Background(), data)
+
+	if diags[0].Summary != "user:[redacted] was rejected" {
+		t.Fatalf("expected the diagnostics to be redacted: %v", diags)
+	}
+	if values := meta.(TerraformProviderBuildkit).sensitive_values; len(values) != 1 || values[0] != "registry-password" {
+		t.Fatalf("expected the password to be kept for the resources to redact: %v", values)
+	}
+}
+
+func TestRedactMultilineJson(t *testing.T) {
+	redactor := newRedactor([]string{"{\n  \"type\": \"service_account\",\n  \"private_key_id\": \"abc\"\n}"})
+
+	if result := redactor.redact("RUN echo {} > /tmp/a"); result != "RUN echo {} > /tmp/a" {
+		t.Fatalf("expected short lines of a secret to be left alone: %s", result)
+	}
+	if result := redactor.redact("  \"private_key_id\": \"abc\"\n"); result != "  [redacted]\n" {
+		t.Fatalf("expected the lines of a secret to be redacted: %q", result)
+	}
+	if result := redactor.redact("{\n  \"type\": \"service_account\",\n  \"private_key_id\": \"abc\"\n}"); result != "[redacted]" {
+		t.Fatalf("expected the whole secret to be redacted: %q", result)
+	}
+}
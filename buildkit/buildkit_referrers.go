@@ -0,0 +1,384 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"net/http"
+)
+
+const (
+	attestationModeReferrers = "referrers"
+	attestationModeTag       = "tag"
+	ociEmptyMediaType        = "application/vnd.oci.empty.v1+json"
+)
+
+func buildkitImageAttestationResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageAttestation,
+		ReadContext:   readImageAttestation,
+		DeleteContext: deleteImageAttestation,
+		Description:   "An artifact (like a vulnerability report or test results) attached to an image within its registry.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name of the image.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The digest of the image to attach to, e.g. the `image_digest` of a `buildkit_image`.",
+			},
+			"content": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The content of the artifact.",
+			},
+			"media_type": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The media type of the artifact (e.g. `application/sarif+json`). It's used as the artifact type of the referrer.",
+			},
+			"annotations": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     map[string]string{},
+				Description: "Annotations that are added to the artifact manifest (or layer, in `tag` mode).",
+			},
+			"mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      attestationModeReferrers,
+				ValidateFunc: validation.StringInSlice([]string{attestationModeReferrers, attestationModeTag}, false),
+				Description:  "Either `referrers` to push an OCI 1.1 artifact with the image as its subject, or `tag` to attach it like `cosign attach` does.",
+			},
+			"tag_suffix": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     "att",
+				Description: "The suffix of the `sha256-<digest>.<suffix>` tag artifacts are attached under in `tag` mode.",
+			},
+			"attestation_digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest of the artifact manifest (or layer, in `tag` mode).",
+			},
+			"attestation_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The url the artifact can be pulled from.",
+			},
+		},
+	}
+}
+
+// supportsReferrers checks whether the registry implements the referrers api,
+// otherwise referrers have to be recorded under the referrers tag schema.
+func supportsReferrers(ctx context.Context, auth RegistryAuth, repository name.Repository, digest string) (bool, error) {
+
+	registry := repository.Registry
+	scopes := []string{repository.Scope(transport.PullScope)}
+
+	roundTripper, err := transport.NewWithContext(ctx, registry, registryAuthenticator(auth), registryTransport(auth), scopes)
+	if err != nil {
+		return false, err
+	}
+
+	url := fmt.Sprintf("%s://%s/v2/%s/referrers/%s", registry.Scheme(), registry.RegistryStr(), repository.RepositoryStr(), digest)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := (&http.Client{Transport: roundTripper}).Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode == http.StatusOK, nil
+}
+
+// pushReferrer pushes an artifact manifest with the image as its subject and
+// returns its digest.
+func pushReferrer(ctx context.Context, auth RegistryAuth, repository name.Repository, digest string, content []byte, mediaType string, annotations map[string]string) (string, error) {
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	subject, err := remote.Head(repository.Digest(digest), options...)
+	if err != nil {
+		return "", err
+	}
+
+	layer := static.NewLayer(content, types.MediaType(mediaType))
+	config := static.NewLayer([]byte("{}"), ociEmptyMediaType)
+
+	descriptors := make([]OciDescriptor, 0, 2)
+	for _, x := range []v1.Layer{config, layer} {
+		if err := remote.WriteLayer(repository, x, options...); err != nil {
+			return "", err
+		}
+		layerDigest, err := x.Digest()
+		if err != nil {
+			return "", err
+		}
+		size, err := x.Size()
+		if err != nil {
+			return "", err
+		}
+		layerMediaType, err := x.MediaType()
+		if err != nil {
+			return "", err
+		}
+		descriptors = append(descriptors, OciDescriptor{
+			MediaType: string(layerMediaType),
+			Digest:    layerDigest.String(),
+			Size:      size,
+		})
+	}
+
+	manifest := OciArtifactManifest{
+		SchemaVersion: 2,
+		MediaType:     string(types.OCIManifestSchema1),
+		ArtifactType:  mediaType,
+		Config:        descriptors[0],
+		Layers:        descriptors[1:],
+		Subject: &OciDescriptor{
+			MediaType: string(subject.MediaType),
+			Digest:    subject.Digest.String(),
+			Size:      subject.Size,
+		},
+	}
+
+	if len(annotations) > 0 {
+		manifest.Annotations = annotations
+	}
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	hash, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+
+	err = remote.Put(repository.Digest(hash.String()), &remote.Descriptor{
+		Descriptor: v1.Descriptor{
+			MediaType: types.OCIManifestSchema1,
+			Digest:    hash,
+			Size:      size,
+		},
+		Manifest: raw,
+	}, options...)
+	if err != nil {
+		return "", err
+	}
+
+	supported, err := supportsReferrers(ctx, auth, repository, digest)
+	if err != nil {
+		return "", err
+	}
+
+	if !supported {
+		err = addReferrerToTag(ctx, auth, repository, digest, OciDescriptor{
+			MediaType:    manifest.MediaType,
+			ArtifactType: manifest.ArtifactType,
+			Digest:       hash.String(),
+			Size:         size,
+			Annotations:  manifest.Annotations,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hash.String(), nil
+}
+
+// addReferrerToTag records the referrer in the index under the
+// sha256-<digest> tag, which is how clients discover referrers on registries
+// without the referrers api.
+func addReferrerToTag(ctx context.Context, auth RegistryAuth, repository name.Repository, digest string, referrer OciDescriptor) error {
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+	tag := digestTag(repository, digest, "")
+
+	index := OciReferrersIndex{
+		SchemaVersion: 2,
+		MediaType:     string(types.OCIImageIndex),
+		Manifests:     []OciDescriptor{},
+	}
+
+	descriptor, err := remote.Get(tag, options...)
+	if err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+	} else if err := json.Unmarshal(descriptor.Manifest, &index); err != nil {
+		return err
+	}
+
+	for _, x := range index.Manifests {
+		if x.Digest == referrer.Digest {
+			return nil
+		}
+	}
+
+	index.Manifests = append(index.Manifests, referrer)
+
+	raw, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	hash, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	return remote.Put(tag, &remote.Descriptor{
+		Descriptor: v1.Descriptor{
+			MediaType: types.OCIImageIndex,
+			Digest:    hash,
+			Size:      size,
+		},
+		Manifest: raw,
+	}, options...)
+}
+
+func createImageAttestation(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	digest := data.Get("digest").(string)
+	content := data.Get("content").(string)
+	media_type := data.Get("media_type").(string)
+	annotations := getStringMap(data, "annotations")
+	mode := data.Get("mode").(string)
+	tag_suffix := data.Get("tag_suffix").(string)
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+
+	repository, err := imageRepository(registry_url, repository_name)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	attestation_digest := ""
+	attestation_url := ""
+
+	switch mode {
+	case attestationModeReferrers:
+		attestation_digest, err = pushReferrer(ctx, auth, repository, digest, []byte(content), media_type, annotations)
+		attestation_url = repository.Digest(attestation_digest).Name()
+	case attestationModeTag:
+		tag := digestTag(repository, digest, tag_suffix)
+		layer := static.NewLayer([]byte(content), types.MediaType(media_type))
+		if err = appendLayer(ctx, auth, tag, layer, annotations); err == nil {
+			layerDigest, _ := layer.Digest()
+			attestation_digest = layerDigest.String()
+		}
+		attestation_url = tag.Name()
+	default:
+		err = fmt.Errorf("unknown mode '%s', expected '%s' or '%s'", mode, attestationModeReferrers, attestationModeTag)
+	}
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("attestation_digest", attestation_digest)
+	data.Set("attestation_url", attestation_url)
+
+	return diag.Diagnostics{}
+}
+
+func readImageAttestation(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	digest := data.Get("digest").(string)
+	mode := data.Get("mode").(string)
+	tag_suffix := data.Get("tag_suffix").(string)
+	attestation_digest := data.Get("attestation_digest").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return diag.Diagnostics{}
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	repository, err := imageRepository(registry_url, repository_name)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	exists := true
+
+	if mode == attestationModeTag {
+		exists, err = hasLayer(ctx, auth, digestTag(repository, digest, tag_suffix), attestation_digest)
+	} else if _, err = remote.Head(repository.Digest(attestation_digest), makeOptions(craneOptions(ctx, auth)...).Remote...); isNotFound(err) {
+		exists, err = false, nil
+	}
+
+	if err != nil {
+		return diag.Diagnostics{readFailure(provider, registry_url, repository.Digest(attestation_digest).String(), err)}
+	}
+
+	// the artifact was removed outside of terraform so it needs to be attached again
+	if !exists {
+		data.SetId("")
+	}
+
+	return diag.Diagnostics{}
+}
+
+func deleteImageAttestation(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// artifacts are left in place, like the images they are attached to
+	return diagnostics
+}
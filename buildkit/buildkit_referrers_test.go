@@ -0,0 +1,104 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"strings"
+	"testing"
+)
+
+func TestImageAttestationReferrers(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageAttestationResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"digest":          digest,
+		"content":         `{"runs":[]}`,
+		"media_type":      "application/sarif+json",
+		"annotations":     map[string]interface{}{"scanner": "trivy"},
+	})
+
+	if diags := createImageAttestation(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	raw, err := crane.Manifest(data.Get("attestation_url").(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := OciArtifactManifest{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.Subject == nil || manifest.Subject.Digest != digest || manifest.ArtifactType != "application/sarif+json" {
+		t.Fatalf("unexpected manifest %s", raw)
+	}
+
+	// the test registry has no referrers api so the fallback tag is used
+	raw, err = crane.Manifest(host + "/app:" + strings.Replace(digest, ":", "-", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := OciReferrersIndex{}
+	if err := json.Unmarshal(raw, &index); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != data.Get("attestation_digest").(string) {
+		t.Fatalf("unexpected referrers index %s", raw)
+	}
+
+	if diags := readImageAttestation(context.Background(), data, meta); len(diags) > 0 || data.Id() == "" {
+		t.Fatalf("expected the attestation to still exist: %v", diags)
+	}
+}
+
+func TestImageAttestationTag(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageAttestationResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"digest":          digest,
+		"content":         "ok",
+		"media_type":      "text/plain",
+		"mode":            "tag",
+		"tag_suffix":      "tests",
+	})
+
+	if diags := createImageAttestation(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if diags := readImageAttestation(context.Background(), data, meta); len(diags) > 0 || data.Id() == "" {
+		t.Fatalf("expected the attestation to still exist: %v", diags)
+	}
+
+	data.Set("attestation_digest", "sha256:missing")
+
+	if diags := readImageAttestation(context.Background(), data, meta); len(diags) > 0 || data.Id() != "" {
+		t.Fatalf("expected a missing attestation to be detected: %v", diags)
+	}
+}
+
+func TestImageAttestationMode(t *testing.T) {
+	validate := buildkitImageAttestationResource().Schema["mode"].ValidateFunc
+	for _, x := range []string{attestationModeReferrers, attestationModeTag} {
+		if _, errs := validate(x, "mode"); len(errs) > 0 {
+			t.Fatalf("expected %s to be valid: %v", x, errs)
+		}
+	}
+	if _, errs := validate("referrer", "mode"); len(errs) == 0 {
+		t.Fatal("expected an unknown mode to be rejected when planning")
+	}
+}
@@ -0,0 +1,122 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var ecrHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// isGoogleRegistry is true for GCR and Artifact Registry, which list the
+// repositories under a path along with its tags.
+func isGoogleRegistry(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// listEcrRepositories lists the repositories of an ECR registry with the ECR
+// API, which needs AWS credentials from the environment (like the AWS cli)
+// rather than the credentials of the registry.
+func listEcrRepositories(ctx context.Context, account string, config aws.Config) ([]string, error) {
+
+	sess, err := session.NewSessionWithOptions(session.Options{Config: config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return []string{}, err
+	}
+
+	repositories := []string{}
+	err = ecr.New(sess).DescribeRepositoriesPagesWithContext(ctx, &ecr.DescribeRepositoriesInput{RegistryId: aws.String(account)},
+		func(page *ecr.DescribeRepositoriesOutput, last bool) bool {
+			for _, x := range page.Repositories {
+				repositories = append(repositories, aws.StringValue(x.RepositoryName))
+			}
+			return true
+		})
+
+	return repositories, err
+}
+
+// listGoogleRepositories walks the repositories under the path of a GCR or
+// Artifact Registry registry.
+func listGoogleRepositories(ctx context.Context, auth RegistryAuth, host string, namespace string) ([]string, error) {
+
+	if namespace == "" {
+		return []string{}, fmt.Errorf("the registry url of %s needs a path to list the repositories under, e.g. %s/project", host, host)
+	}
+
+	root, err := name.NewRepository(host + "/" + strings.TrimSuffix(namespace, "/"))
+	if err != nil {
+		return []string{}, err
+	}
+
+	repositories := []string{}
+	err = google.Walk(root, func(repository name.Repository, tags *google.Tags, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(tags.Tags) > 0 || len(tags.Manifests) > 0 {
+			repositories = append(repositories, repository.RepositoryStr())
+		}
+		return nil
+	}, google.WithAuth(registryAuthenticator(auth)), google.WithTransport(registryTransport(auth)), google.WithContext(ctx))
+
+	return repositories, err
+}
+
+// catalogFallback lists the repositories of registries that don't support the
+// catalog API with their own APIs, or explains that they can't be listed.
+func catalogFallback(ctx context.Context, auth RegistryAuth, host string, namespace string, catalogErr error) ([]string, error) {
+
+	if match := ecrHost.FindStringSubmatch(host); match != nil {
+		return listEcrRepositories(ctx, match[1], aws.Config{
+			Region:     aws.String(match[2]),
+			HTTPClient: &http.Client{Transport: registryTransport(auth)},
+		})
+	}
+
+	if isGoogleRegistry(host) {
+		return listGoogleRepositories(ctx, auth, host, namespace)
+	}
+
+	return []string{}, fmt.Errorf("registry %s doesn't support the catalog API (%w), only ECR, GCR and Artifact Registry are listed otherwise", host, catalogErr)
+}
+
+func readRegistryCatalogDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	prefix := data.Get("prefix").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	repositories, err := listRepositories(context, auth, registry_url, prefix)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+			Detail:   fmt.Sprintf("Could not list the repositories of '%s'.", registry_url),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("repositories", repositories)
+
+	return diag.Diagnostics{}
+}
@@ -0,0 +1,102 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListEcrRepositories(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.DescribeRepositories" || body["registryId"] != "123456789012" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body["nextToken"] == "" {
+			w.Write([]byte(`{"repositories":[{"repositoryName":"team/app"}],"nextToken":"2"}`))
+			return
+		}
+		w.Write([]byte(`{"repositories":[{"repositoryName":"team/worker"}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	repositories, err := listEcrRepositories(context.Background(), "123456789012", aws.Config{
+		Region:     aws.String("us-east-1"),
+		Endpoint:   aws.String(server.URL),
+		HTTPClient: server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"team/app", "team/worker"}; !reflect.DeepEqual(repositories, expected) {
+		t.Fatalf("expected %v but got %v", expected, repositories)
+	}
+}
+
+func TestListGoogleRepositories(t *testing.T) {
+	children := map[string]string{
+		"project":          `{"child":["team"],"tags":[]}`,
+		"project/team":     `{"child":["app","worker"],"tags":[]}`,
+		"project/team/app": `{"child":[],"tags":["1.0.0"]}`,
+		// the platform images of an index, which have no tags
+		"project/team/worker": `{"child":[],"tags":[],"manifest":{"sha256:abc":{"imageSizeBytes":"1","mediaType":"application/vnd.oci.image.manifest.v1+json","tag":[]}}}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if listing, ok := children[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")]; ok {
+			w.Write([]byte(listing))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	repositories, err := listGoogleRepositories(context.Background(), RegistryAuth{}, host, "project/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"project/team/app", "project/team/worker"}; !reflect.DeepEqual(repositories, expected) {
+		t.Fatalf("expected %v but got %v", expected, repositories)
+	}
+
+	if _, err := listGoogleRepositories(context.Background(), RegistryAuth{}, host, ""); err == nil {
+		t.Fatal("expected a registry url without a path to be an error")
+	}
+}
+
+func TestCatalogFallback(t *testing.T) {
+	catalogErr := errors.New("UNSUPPORTED")
+
+	_, err := catalogFallback(context.Background(), RegistryAuth{}, "registry.example.com", "", catalogErr)
+	if err == nil || !errors.Is(err, catalogErr) || !strings.Contains(err.Error(), "registry.example.com") {
+		t.Fatalf("expected a clear error for a registry without a catalog: %v", err)
+	}
+
+	for host, google := range map[string]bool{"gcr.io": true, "eu.gcr.io": true, "europe-docker.pkg.dev": true, "docker.io": false} {
+		if isGoogleRegistry(host) != google {
+			t.Fatalf("expected %s to be a google registry: %v", host, google)
+		}
+	}
+
+	if match := ecrHost.FindStringSubmatch("123456789012.dkr.ecr.eu-west-1.amazonaws.com"); match == nil || match[1] != "123456789012" || match[2] != "eu-west-1" {
+		t.Fatalf("expected the account and region of the ECR registry: %v", match)
+	}
+}
@@ -0,0 +1,400 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"sort"
+)
+
+func buildkitRegistryCleanupResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createRegistryCleanup,
+		ReadContext:   readRegistryCleanup,
+		UpdateContext: updateRegistryCleanup,
+		DeleteContext: deleteRegistryCleanup,
+		Description:   "Deletes tags, and the images left without a tag, from a repository when created and whenever its arguments change.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url of the repository.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name to delete tags from.",
+			},
+			"tags": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				AtLeastOneOf: []string{"tags", "tag_pattern", "untagged"},
+				Description:  "Tags that should be deleted.",
+			},
+			"tag_pattern": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				AtLeastOneOf: []string{"tags", "tag_pattern", "untagged"},
+				ValidateFunc: validateTagPattern,
+				Description:  "A pattern of tags that should be deleted. Either a literal tag or a regex surrounded by slashes (e.g. `/^ci-/`).",
+			},
+			"keep_tags": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Tags that should never be deleted, even when they match `tag_pattern`.",
+			},
+			"untagged": {
+				Type:         schema.TypeBool,
+				Optional:     true,
+				Default:      false,
+				AtLeastOneOf: []string{"tags", "tag_pattern", "untagged"},
+				Description:  "Whether images of the repository that have no tag should be deleted too, except for the platform images of a tagged index and whatever is attached to an image that is kept. Only registries that list untagged images along with the tags (like GCR and Artifact Registry) support this.",
+			},
+			"max_concurrency": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      8,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "The maximum number of tags to resolve in parallel.",
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Default:     map[string]string{},
+				Description: "A map of strings that will cause the cleanup to run again when any of the values change.",
+			},
+			"deleted_tags": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The tags that were deleted by the last run.",
+			},
+			"deleted_digests": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The digests of images that were deleted by the last run because none of their tags remained, or because they had none to begin with.",
+			},
+		},
+	}
+}
+
+// selectTags returns the tags that are listed explicitly or match the pattern,
+// except for the ones that should be kept.
+func selectTags(tags []string, explicit []string, tagPattern string, keep []string) ([]string, error) {
+	selected := map[string]bool{}
+	for _, x := range explicit {
+		selected[x] = true
+	}
+	if tagPattern != "" {
+		matching, err := filterTags(tags, tagPattern)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, x := range matching {
+			selected[x] = true
+		}
+	}
+	for _, x := range keep {
+		delete(selected, x)
+	}
+
+	result := make([]string, 0)
+	for _, x := range tags {
+		if selected[x] {
+			result = append(result, x)
+		}
+	}
+	return result, nil
+}
+
+// deleteTags removes tags (a subset of all) from a repository. Most registries
+// can only delete manifests (which removes every tag of the image), so a
+// manifest is deleted once all of its tags are being deleted. Tags that share their
+// manifest with a remaining tag are deleted on their own, which only some
+// registries support.
+func deleteTags(ctx context.Context, auth RegistryAuth, repository string, all []string, tags []string, concurrency int) (CleanupResult, error) {
+
+	result := CleanupResult{Tags: []string{}, Digests: []string{}}
+
+	repositoryReference, err := name.NewRepository(repository)
+	if err != nil {
+		return result, err
+	}
+
+	digests := make([]string, len(all))
+	err = forEach(ctx, concurrency, len(all), func(ctx context.Context, i int) error {
+		digest, err := getRemoteImageHash(ctx, repositoryReference.Tag(all[i]).String(), auth)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		digests[i] = digest
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	targets := map[string]bool{}
+	for _, x := range tags {
+		targets[x] = true
+	}
+
+	byDigest := map[string][]string{}
+	for i, x := range all {
+		if digests[i] != "" {
+			byDigest[digests[i]] = append(byDigest[digests[i]], x)
+		}
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	for digest, tagged := range byDigest {
+		deleting := make([]string, 0)
+		for _, x := range tagged {
+			if targets[x] {
+				deleting = append(deleting, x)
+			}
+		}
+
+		if len(deleting) == 0 {
+			continue
+		}
+
+		if len(deleting) == len(tagged) {
+			if err := remote.Delete(repositoryReference.Digest(digest), options...); err != nil {
+				return result, err
+			}
+			for _, x := range deleting {
+				auth.digests.forget(repositoryReference.Tag(x).String())
+			}
+			result.Digests = append(result.Digests, digest)
+			result.Tags = append(result.Tags, deleting...)
+			continue
+		}
+
+		for _, x := range deleting {
+			if err := remote.Delete(repositoryReference.Tag(x), options...); err != nil {
+				return result, err
+			}
+			auth.digests.forget(repositoryReference.Tag(x).String())
+			result.Tags = append(result.Tags, x)
+		}
+	}
+
+	sort.Strings(result.Tags)
+	sort.Strings(result.Digests)
+
+	return result, nil
+}
+
+// listUntagged returns the digests of the manifests of the repository that
+// no tag refers to, directly or through an index or a subject, with indexes
+// first so they are deleted before the manifests they contain.
+func listUntagged(ctx context.Context, auth RegistryAuth, repository string) ([]string, error) {
+
+	repositoryReference, err := name.NewRepository(repository)
+	if err != nil {
+		return []string{}, err
+	}
+
+	listed, err := google.List(repositoryReference,
+		google.WithAuth(registryAuthenticator(auth)),
+		google.WithTransport(registryTransport(auth)),
+		google.WithContext(ctx))
+	if err != nil {
+		return []string{}, err
+	}
+
+	if len(listed.Tags) > 0 && len(listed.Manifests) == 0 {
+		return []string{}, fmt.Errorf("registry %s doesn't list the untagged images of %s", repositoryReference.RegistryStr(), repositoryReference.RepositoryStr())
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	links := map[string]OciManifestLinks{}
+	for digest, info := range listed.Manifests {
+		if len(info.Tags) > 0 && info.MediaType != "" && !isV2IndexManifest(types.MediaType(info.MediaType)) {
+			continue
+		}
+		descriptor, err := remote.Get(repositoryReference.Digest(digest), options...)
+		if err != nil {
+			return []string{}, err
+		}
+		parsed := OciManifestLinks{}
+		if err := json.Unmarshal(descriptor.Manifest, &parsed); err != nil {
+			return []string{}, err
+		}
+		links[digest] = parsed
+	}
+
+	kept := map[string]bool{}
+	var keep func(digest string)
+	keep = func(digest string) {
+		if kept[digest] {
+			return
+		}
+		kept[digest] = true
+		for _, x := range links[digest].Manifests {
+			keep(x.Digest)
+		}
+	}
+
+	for digest, info := range listed.Manifests {
+		if len(info.Tags) > 0 {
+			keep(digest)
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for digest, x := range links {
+			if !kept[digest] && x.Subject != nil && kept[x.Subject.Digest] {
+				keep(digest)
+				changed = true
+			}
+		}
+	}
+
+	untagged := make([]string, 0)
+	for digest := range listed.Manifests {
+		if !kept[digest] {
+			untagged = append(untagged, digest)
+		}
+	}
+
+	sort.Slice(untagged, func(i, j int) bool {
+		a, b := len(links[untagged[i]].Manifests) > 0, len(links[untagged[j]].Manifests) > 0
+		if a != b {
+			return a
+		}
+		return untagged[i] < untagged[j]
+	})
+
+	return untagged, nil
+}
+
+func deleteUntagged(ctx context.Context, auth RegistryAuth, repository string) ([]string, error) {
+
+	untagged, err := listUntagged(ctx, auth, repository)
+	if err != nil {
+		return []string{}, err
+	}
+
+	repositoryReference, err := name.NewRepository(repository)
+	if err != nil {
+		return []string{}, err
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	for _, x := range untagged {
+		if err := remote.Delete(repositoryReference.Digest(x), options...); err != nil && !isNotFound(err) {
+			return []string{}, err
+		}
+	}
+
+	return untagged, nil
+}
+
+func createRegistryCleanup(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tags := getStringList(data, "tags")
+	tag_pattern := data.Get("tag_pattern").(string)
+	keep_tags := getStringList(data, "keep_tags")
+	untagged := data.Get("untagged").(bool)
+	max_concurrency := data.Get("max_concurrency").(int)
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+	repository := fullImage(registry_url, repository_name)
+
+	existing, err := listTags(ctx, auth, repository, "/.*/", 0, 0)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	selected, err := selectTags(existing, tags, tag_pattern, keep_tags)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	result, err := deleteTags(ctx, auth, repository, existing, selected, max_concurrency)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if untagged {
+		digests, err := deleteUntagged(ctx, auth, repository)
+
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			}}
+		}
+
+		result.Digests = append(result.Digests, digests...)
+		sort.Strings(result.Digests)
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("deleted_tags", result.Tags)
+	data.Set("deleted_digests", result.Digests)
+
+	return diag.Diagnostics{}
+}
+
+func readRegistryCleanup(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// the cleanup only happens on apply so there's nothing to refresh
+	return diagnostics
+}
+
+func updateRegistryCleanup(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createRegistryCleanup(ctx, data, meta)
+}
+
+func deleteRegistryCleanup(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
@@ -0,0 +1,206 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSelectTags(t *testing.T) {
+	tags := []string{"ci-1", "ci-2", "ci-3", "latest", "1.0.0"}
+
+	selected, err := selectTags(tags, []string{"1.0.0"}, "/^ci-/", []string{"ci-3"})
+
+	expected := []string{"ci-1", "ci-2", "1.0.0"}
+	if err != nil || !reflect.DeepEqual(selected, expected) {
+		t.Fatalf("expected %v but got %v %v", expected, selected, err)
+	}
+
+	if _, err := selectTags(tags, nil, "/ci-[/", nil); err == nil {
+		t.Fatal("expected an invalid pattern to be an error")
+	}
+}
+
+func TestRegistryCleanup(t *testing.T) {
+	host := testRegistry(t)
+	first := testPushImage(t, host+"/app:ci-1")
+	if err := crane.Tag(host+"/app@"+first, "ci-2"); err != nil {
+		t.Fatal(err)
+	}
+	second := testPushImage(t, host+"/app:ci-3")
+	if err := crane.Tag(host+"/app@"+second, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitRegistryCleanupResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"tag_pattern":     "/^ci-/",
+	})
+
+	if diags := createRegistryCleanup(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	// ci-1 and ci-2 were the only tags of the first image so it was deleted
+	// entirely while ci-3 had to be deleted by itself to keep latest
+	if tags := getStringList(data, "deleted_tags"); !reflect.DeepEqual(tags, []string{"ci-1", "ci-2", "ci-3"}) {
+		t.Fatalf("unexpected deleted tags: %v", tags)
+	}
+	if digests := getStringList(data, "deleted_digests"); !reflect.DeepEqual(digests, []string{first}) {
+		t.Fatalf("unexpected deleted digests: %v", digests)
+	}
+
+	if _, err := crane.Digest(host + "/app:ci-3"); err == nil {
+		t.Fatal("expected ci-3 to be deleted")
+	}
+	if actual, err := crane.Digest(host + "/app:latest"); err != nil || actual != second {
+		t.Fatalf("expected latest to be kept but got %s (%v)", actual, err)
+	}
+}
+
+func testServe(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+// testListingRegistry is an in-memory registry that lists the manifests of a
+// repository along with its tags, the way GCR does.
+func testListingRegistry(t *testing.T) string {
+	inner := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+
+	var lock sync.Mutex
+	pushed := map[string][]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+		if repository, _, ok := strings.Cut(path, "/manifests/"); ok && r.Method == http.MethodPut {
+			recorder := httptest.NewRecorder()
+			inner.ServeHTTP(recorder, r)
+			lock.Lock()
+			pushed[repository] = append(pushed[repository], recorder.Header().Get("Docker-Content-Digest"))
+			lock.Unlock()
+			for k, v := range recorder.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+			return
+		}
+
+		if repository := strings.TrimSuffix(path, "/tags/list"); repository != path && r.Method == http.MethodGet {
+			listed := google.Tags{}
+			json.Unmarshal(testServe(inner, http.MethodGet, r.URL.Path).Body.Bytes(), &listed)
+			listed.Manifests = map[string]google.ManifestInfo{}
+
+			lock.Lock()
+			for _, digest := range pushed[repository] {
+				if head := testServe(inner, http.MethodHead, "/v2/"+repository+"/manifests/"+digest); head.Code == http.StatusOK {
+					listed.Manifests[digest] = google.ManifestInfo{MediaType: head.Header().Get("Content-Type"), Tags: []string{}}
+				}
+			}
+			lock.Unlock()
+
+			for _, tag := range listed.Tags {
+				digest := testServe(inner, http.MethodHead, "/v2/"+repository+"/manifests/"+tag).Header().Get("Docker-Content-Digest")
+				info := listed.Manifests[digest]
+				info.Tags = append(info.Tags, tag)
+				listed.Manifests[digest] = info
+			}
+
+			json.NewEncoder(w).Encode(listed)
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestRegistryCleanupUntagged(t *testing.T) {
+	host := testListingRegistry(t)
+	repository, _ := name.NewRepository(host + "/app")
+
+	// replaced by the image that is pushed to the tag after it
+	replaced := testPushImage(t, host+"/app:latest")
+	current := testPushImage(t, host+"/app:latest")
+
+	// the platform images of a tagged index have no tag of their own
+	index, _ := random.Index(64, 1, 2)
+	if err := remote.WriteIndex(repository.Tag("multi"), index); err != nil {
+		t.Fatal(err)
+	}
+	platforms, _ := index.IndexManifest()
+
+	// attached to an image that is kept and to one that is deleted
+	attached, err := pushReferrer(context.Background(), RegistryAuth{}, repository, current, []byte("{}"), "application/vnd.example+json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphaned, err := pushReferrer(context.Background(), RegistryAuth{}, repository, replaced, []byte("[]"), "application/vnd.example+json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := repository.Tag(strings.Replace(replaced, ":", "-", 1))
+	referrers, err := crane.Digest(fallback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Delete(fallback); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitRegistryCleanupResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"untagged":        true,
+	})
+
+	if diags := createRegistryCleanup(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	expected := []string{replaced, orphaned, referrers}
+	sort.Strings(expected)
+	if digests := getStringList(data, "deleted_digests"); !reflect.DeepEqual(digests, expected) {
+		t.Fatalf("expected %v to be deleted but got %v", expected, digests)
+	}
+
+	for _, x := range []string{current, attached, platforms.Manifests[0].Digest.String(), platforms.Manifests[1].Digest.String()} {
+		if _, err := remote.Head(repository.Digest(x)); err != nil {
+			t.Fatalf("expected %s to be kept (%v)", x, err)
+		}
+	}
+}
+
+func TestRegistryCleanupUntaggedUnsupported(t *testing.T) {
+	host := testRegistry(t)
+	testPushImage(t, host+"/app:latest")
+
+	if _, err := listUntagged(context.Background(), RegistryAuth{}, host+"/app"); err == nil {
+		t.Fatal("expected a registry that doesn't list untagged images to be an error")
+	}
+}
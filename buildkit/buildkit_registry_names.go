@@ -0,0 +1,81 @@
+package buildkit
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"path"
+	"strings"
+)
+
+// fullImage puts the repository, along with a tag or digest, in the registry.
+// The registry url may have a path of its own that repositories are nested
+// under, e.g. `europe-docker.pkg.dev/project/images` on Artifact Registry.
+func fullImage(registry string, repository string) string {
+	return canonicalImage(path.Join(registryHost(registry), strings.TrimPrefix(repository, "/")))
+}
+
+// dockerHubHosts are the names Docker Hub goes by.
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// canonicalImage writes an image on Docker Hub one way, e.g. `nginx` and
+// `registry-1.docker.io/nginx` are both `index.docker.io/library/nginx`.
+func canonicalImage(image string) string {
+	host, repository, found := strings.Cut(image, "/")
+
+	if !found || !(strings.ContainsAny(host, ".:") || host == "localhost") {
+		// without a registry the image is on Docker Hub
+		host, repository = name.DefaultRegistry, image
+	} else if dockerHubHosts[strings.ToLower(host)] {
+		host, repository = name.DefaultRegistry, strings.TrimPrefix(repository, "v1/")
+	} else {
+		return image
+	}
+
+	if repository == "" {
+		return image
+	}
+
+	// official images are in the library namespace
+	if named, _, _ := strings.Cut(repository, "@"); !strings.Contains(named, "/") {
+		repository = "library/" + repository
+	}
+
+	return host + "/" + repository
+}
+
+// imageRepository parses the repository in the registry, so that deeply
+// nested repositories like `team/app/component` on ECR are kept intact.
+func imageRepository(registry string, repository string) (name.Repository, error) {
+	return name.NewRepository(fullImage(registry, repository))
+}
+
+// imageTag parses the tag of the repository in the registry.
+func imageTag(registry string, repository string, tag string) (name.Tag, error) {
+	return name.NewTag(fullImage(registry, repository) + ":" + tag)
+}
+
+func registryHost(registry string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://"), "/")
+}
+
+// splitRegistry separates the host of a registry url from the path that
+// repositories are nested under, if any.
+func splitRegistry(registry string) (string, string) {
+	host, namespace, _ := strings.Cut(registryHost(registry), "/")
+	return host, namespace
+}
+
+// normalizeRegistry is the host credentials are stored and looked up under,
+// whichever way the url of the registry is written.
+func normalizeRegistry(registry string) string {
+	host, _ := splitRegistry(registry)
+	host = strings.ToLower(host)
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return name.DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,76 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"testing"
+)
+
+func TestFullImage(t *testing.T) {
+	cases := []struct {
+		registry   string
+		repository string
+		expected   string
+	}{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com", "team/app/component:1", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app/component:1"},
+		{"https://europe-docker.pkg.dev/", "project/images/app:1", "europe-docker.pkg.dev/project/images/app:1"},
+		{"europe-docker.pkg.dev/project/images", "/app:1", "europe-docker.pkg.dev/project/images/app:1"},
+		{"", "alpine:3", "index.docker.io/library/alpine:3"},
+		{"https://docker.io", "nginx:1", "index.docker.io/library/nginx:1"},
+		{"https://index.docker.io/v1/", "library/nginx@sha256:1", "index.docker.io/library/nginx@sha256:1"},
+		{"registry-1.docker.io", "org/app:1", "index.docker.io/org/app:1"},
+		{"localhost:5000", "app:1", "localhost:5000/app:1"},
+	}
+	for _, x := range cases {
+		if actual := fullImage(x.registry, x.repository); actual != x.expected {
+			t.Fatalf("expected %s but got %s", x.expected, actual)
+		}
+	}
+
+	repository, err := imageRepository("https://europe-docker.pkg.dev/project", "images/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repository.RegistryStr() != "europe-docker.pkg.dev" || repository.RepositoryStr() != "project/images/app" {
+		t.Fatalf("unexpected repository: %s", repository.Name())
+	}
+
+	if _, err := imageTag("ghcr.io", "org/app", "not a tag"); err == nil {
+		t.Fatal("expected an invalid tag to be rejected")
+	}
+}
+
+func TestDeepRepositoryPaths(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/team/app/component:1")
+	testPushImage(t, host+"/other/app:1")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	for registry, repository := range map[string]string{
+		host:                   "team/app/component",
+		"http://" + host + "/": "team/app/component",
+		host + "/team":         "app/component",
+	} {
+		data := schema.TestResourceDataRaw(t, buildkitTagExistsDataSource().Schema, map[string]interface{}{
+			"registry_url":    registry,
+			"repository_name": repository,
+			"tag":             "1",
+		})
+
+		if diags := readTagExistsDataSource(context.Background(), data, meta); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %v", diags)
+		}
+
+		if data.Get("digest_url").(string) != host+"/team/app/component@"+digest {
+			t.Fatalf("unexpected digest_url for %s and %s: %s", registry, repository, data.Get("digest_url"))
+		}
+	}
+
+	repositories, err := listRepositories(context.Background(), meta.registryAuth(host), host+"/team", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repositories) != 1 || repositories[0] != "app/component" {
+		t.Fatalf("expected the repositories to be relative to the registry path: %v", repositories)
+	}
+}
@@ -0,0 +1,137 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func buildkitRegistryTagResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createRegistryTag,
+		ReadContext:   readRegistryTag,
+		UpdateContext: updateRegistryTag,
+		DeleteContext: deleteRegistryTag,
+		Description:   "An additional tag pointing at an image that already exists within a registry.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name of the image.",
+			},
+			"tag": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The tag that should point at `digest`.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The digest of an image (or image index) within the repository, e.g. the `image_digest` of a `buildkit_image`.",
+			},
+			"tag_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The tag-based url for the image.",
+			},
+			"digest_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The hash-based url for the image.",
+			},
+		},
+	}
+}
+
+func createRegistryTag(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	digest := data.Get("digest").(string)
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+
+	digest_url := fullImage(registry_url, repository_name+"@"+digest)
+
+	// the manifest is put again under the new tag, no layers are copied
+	err := crane.Tag(digest_url, tag, craneOptions(ctx, auth)...)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	auth.digests.remember(fullImage(registry_url, repository_name+":"+tag), digest)
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("tag_url", fullImage(registry_url, repository_name+":"+tag))
+	data.Set("digest_url", digest_url)
+
+	return diag.Diagnostics{}
+}
+
+func readRegistryTag(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return diag.Diagnostics{}
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	hash, err := getRemoteImageHash(ctx, fullImage(registry_url, repository_name+":"+tag), auth)
+
+	if err != nil {
+		// the tag was removed outside of terraform so it needs to be created again
+		if isNotFound(err) {
+			data.SetId("")
+			return diag.Diagnostics{}
+		}
+
+		return diag.Diagnostics{readFailure(provider, registry_url, fullImage(registry_url, repository_name+":"+tag), err)}
+	}
+
+	// when the tag was moved outside of terraform this shows up as a change of digest
+	data.Set("digest", hash)
+	data.Set("digest_url", fullImage(registry_url, repository_name+"@"+hash))
+
+	return diag.Diagnostics{}
+}
+
+func updateRegistryTag(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	if data.HasChange("digest") {
+		return createRegistryTag(ctx, data, meta)
+	}
+
+	return diag.Diagnostics{}
+}
+
+func deleteRegistryTag(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// registries can generally only delete manifests rather than tags, and
+	// deleting the manifest would remove the image from every other tag too
+	return diagnostics
+}
@@ -0,0 +1,108 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testRegistry starts an in-memory registry and returns its host.
+func testRegistry(t *testing.T) string {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// testPushImage pushes a random image to the reference and returns its digest.
+func testPushImage(t *testing.T, reference string) string {
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crane.Push(image, reference); err != nil {
+		t.Fatal(err)
+	}
+	return testDigestOf(t, image)
+}
+
+func testDigestOf(t *testing.T, image v1.Image) string {
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
+
+func TestRegistryTag(t *testing.T) {
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:build")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitRegistryTagResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"tag":             "prod",
+		"digest":          digest,
+	})
+
+	if diags := createRegistryTag(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if actual, err := crane.Digest(host + "/app:prod"); err != nil || actual != digest {
+		t.Fatalf("expected prod to point at %s but got %s (%v)", digest, actual, err)
+	}
+
+	moved := testPushImage(t, host+"/app:prod")
+
+	if diags := readRegistryTag(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if data.Get("digest").(string) != moved {
+		t.Fatalf("expected the moved tag to be detected but got %s", data.Get("digest"))
+	}
+}
+
+func TestReadRegistryTagAuthFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, behavior := range []string{"error", "warn"} {
+		meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}, registry_auth_failure: behavior}
+
+		data := schema.TestResourceDataRaw(t, buildkitRegistryTagResource().Schema, map[string]interface{}{
+			"registry_url":    host,
+			"repository_name": "app",
+			"tag":             "prod",
+			"digest":          "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		})
+		data.SetId("prod")
+
+		diags := readRegistryTag(context.Background(), data, meta)
+
+		if len(diags) != 1 || !strings.Contains(diags[0].Summary, host) {
+			t.Fatalf("%s: expected a diagnostic naming the registry but got %v", behavior, diags)
+		}
+
+		if diags.HasError() != (behavior == "error") {
+			t.Fatalf("%s: unexpected severity %v", behavior, diags[0].Severity)
+		}
+
+		if data.Id() != "prod" {
+			t.Fatalf("%s: expected the state to be kept", behavior)
+		}
+	}
+}
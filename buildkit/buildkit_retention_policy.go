@@ -0,0 +1,241 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"sort"
+	"time"
+)
+
+func buildkitRetentionPolicyResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createRetentionPolicy,
+		ReadContext:   readRetentionPolicy,
+		UpdateContext: updateRetentionPolicy,
+		DeleteContext: deleteRetentionPolicy,
+		CustomizeDiff: diffRetentionPolicy,
+		Description:   "Deletes the images of a repository that fall outside of a retention policy on every apply.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url of the repository.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name the policy applies to.",
+			},
+			"tag_pattern": {
+				Type:         schema.TypeString,
+				Default:      "/.*/",
+				Optional:     true,
+				ValidateFunc: validateTagPattern,
+				Description:  "A regex pattern of the tags the policy applies to. Other tags are never deleted.",
+			},
+			"keep_last": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				AtLeastOneOf: []string{"keep_last", "older_than_days"},
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "The number of most recently created images that are always kept, along with every one of their tags.",
+			},
+			"older_than_days": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				AtLeastOneOf: []string{"keep_last", "older_than_days"},
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Only delete images created more than this many days ago. Images without a creation time are never considered old.",
+			},
+			"keep_tags": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Tags that should never be deleted.",
+			},
+			"max_concurrency": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      8,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "The maximum number of manifests to fetch in parallel.",
+			},
+			"deleted_tags": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The tags that were deleted by the last apply.",
+			},
+			"deleted_digests": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "The digests of images that were deleted by the last apply because none of their tags remained.",
+			},
+		},
+	}
+}
+
+// selectExpiredTags orders the images by the time they were created and
+// returns the tags of the ones past the first keepLast that were created
+// before cutoff. A zero cutoff only applies keepLast.
+func selectExpiredTags(results []ImageResult, keepLast int, cutoff time.Time) []string {
+
+	// an image shows up once per platform and once per tag
+	created := map[string]time.Time{}
+	tags := map[string]map[string]bool{}
+	for _, x := range results {
+		key := x.Digest
+		if key == "" {
+			key = x.Tag
+		}
+		if current, ok := created[key]; !ok || x.BuildTimestamp.After(current) {
+			created[key] = x.BuildTimestamp
+		}
+		if tags[key] == nil {
+			tags[key] = map[string]bool{}
+		}
+		tags[key][x.Tag] = true
+	}
+
+	images := make([]string, 0, len(created))
+	for key := range created {
+		images = append(images, key)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if !created[images[i]].Equal(created[images[j]]) {
+			return created[images[i]].After(created[images[j]])
+		}
+		return images[i] < images[j]
+	})
+
+	result := make([]string, 0)
+	for i, key := range images {
+		if i < keepLast {
+			continue
+		}
+		if !cutoff.IsZero() && (created[key].IsZero() || !created[key].Before(cutoff)) {
+			continue
+		}
+		for tag := range tags[key] {
+			result = append(result, tag)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func createRetentionPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag_pattern := data.Get("tag_pattern").(string)
+	keep_last := data.Get("keep_last").(int)
+	older_than_days := data.Get("older_than_days").(int)
+	keep_tags := getStringList(data, "keep_tags")
+	max_concurrency := data.Get("max_concurrency").(int)
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+	repository := fullImage(registry_url, repository_name)
+
+	results, err := query(ctx, auth, ImageQuery{
+		Name:           repository,
+		TagPattern:     tag_pattern,
+		MaxConcurrency: max_concurrency,
+	})
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	cutoff := time.Time{}
+	if older_than_days > 0 {
+		cutoff = time.Now().AddDate(0, 0, -older_than_days)
+	}
+
+	expired := selectExpiredTags(results, keep_last, cutoff)
+
+	all, err := listTags(ctx, auth, repository, "/.*/", 0, 0)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	selected, err := selectTags(all, expired, "", keep_tags)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	deleted, err := deleteTags(ctx, auth, repository, all, selected, max_concurrency)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	if data.Id() == "" {
+		id, _ := uuid.GenerateUUID()
+		data.SetId(id)
+	}
+
+	data.Set("deleted_tags", deleted.Tags)
+	data.Set("deleted_digests", deleted.Digests)
+
+	return diag.Diagnostics{}
+}
+
+func readRetentionPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// the policy is enforced on apply so there's nothing to refresh
+	return diagnostics
+}
+
+// diffRetentionPolicy always plans an update so that the policy is enforced
+// on every apply rather than only when its arguments change.
+func diffRetentionPolicy(ctx context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if diff.Id() == "" {
+		return nil
+	}
+	if err := diff.SetNewComputed("deleted_tags"); err != nil {
+		return err
+	}
+	return diff.SetNewComputed("deleted_digests")
+}
+
+func updateRetentionPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return createRetentionPolicy(ctx, data, meta)
+}
+
+func deleteRetentionPolicy(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	return diagnostics
+}
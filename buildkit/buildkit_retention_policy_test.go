@@ -0,0 +1,95 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectExpiredTags(t *testing.T) {
+	now := time.Now()
+	results := []ImageResult{
+		{Tag: "4", BuildTimestamp: now.AddDate(0, 0, -1)},
+		{Tag: "3", BuildTimestamp: now.AddDate(0, 0, -10), Platform: "linux/amd64"},
+		{Tag: "3", BuildTimestamp: now.AddDate(0, 0, -10), Platform: "linux/arm64"},
+		{Tag: "2", BuildTimestamp: now.AddDate(0, 0, -20)},
+		{Tag: "1", BuildTimestamp: now.AddDate(0, 0, -30)},
+		{Tag: "unknown"},
+	}
+
+	if expired := selectExpiredTags(results, 2, time.Time{}); !reflect.DeepEqual(expired, []string{"1", "2", "unknown"}) {
+		t.Fatalf("unexpected tags when keeping the last two: %v", expired)
+	}
+
+	if expired := selectExpiredTags(results, 0, now.AddDate(0, 0, -15)); !reflect.DeepEqual(expired, []string{"1", "2"}) {
+		t.Fatalf("unexpected tags older than 15 days: %v", expired)
+	}
+
+	if expired := selectExpiredTags(results, 3, now.AddDate(0, 0, -15)); !reflect.DeepEqual(expired, []string{"1"}) {
+		t.Fatalf("unexpected tags when combining both: %v", expired)
+	}
+}
+
+func TestSelectExpiredTagsByImage(t *testing.T) {
+	now := time.Now()
+	results := []ImageResult{
+		{Tag: "latest", Digest: "sha256:3", BuildTimestamp: now.AddDate(0, 0, -1)},
+		{Tag: "3", Digest: "sha256:3", BuildTimestamp: now.AddDate(0, 0, -1)},
+		{Tag: "2", Digest: "sha256:2", BuildTimestamp: now.AddDate(0, 0, -10)},
+		{Tag: "stable", Digest: "sha256:2", BuildTimestamp: now.AddDate(0, 0, -10)},
+		{Tag: "1", Digest: "sha256:1", BuildTimestamp: now.AddDate(0, 0, -20)},
+	}
+
+	// both tags of the kept image are kept, and both tags of the expired image go
+	if expired := selectExpiredTags(results, 1, time.Time{}); !reflect.DeepEqual(expired, []string{"1", "2", "stable"}) {
+		t.Fatalf("unexpected tags when keeping the last image: %v", expired)
+	}
+}
+
+func TestRetentionPolicyKeepsEveryTagOfAnImage(t *testing.T) {
+	host := testRegistry(t)
+	now := time.Now().UTC().Round(time.Second)
+	testPushImageCreatedAt(t, host+"/app:1", now.AddDate(0, 0, -2))
+	testPushImageCreatedAt(t, host+"/app:2", now.AddDate(0, 0, -1))
+	if err := crane.Tag(host+"/app:2", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitRetentionPolicyResource().Schema, map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"keep_last":       1,
+	})
+
+	if diags := createRetentionPolicy(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	if tags := getStringList(data, "deleted_tags"); !reflect.DeepEqual(tags, []string{"1"}) {
+		t.Fatalf("expected only the older image to be deleted but got %v", tags)
+	}
+	for _, x := range []string{"2", "latest"} {
+		if _, err := crane.Digest(host + "/app:" + x); err != nil {
+			t.Fatalf("expected %s to be kept (%v)", x, err)
+		}
+	}
+}
+
+func TestRetentionPolicyRequiresABound(t *testing.T) {
+	resource := buildkitRetentionPolicyResource()
+
+	for _, x := range []map[string]interface{}{{"keep_last": 0}, {"older_than_days": 0}, {"keep_last": -1}} {
+		config := map[string]interface{}{"registry_url": "ghcr.io", "repository_name": "org/app"}
+		for k, v := range x {
+			config[k] = v
+		}
+		if diags := resource.Validate(terraform.NewResourceConfigRaw(config)); !diags.HasError() {
+			t.Fatalf("expected %v to be rejected", x)
+		}
+	}
+}
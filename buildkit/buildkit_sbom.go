@@ -0,0 +1,42 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// getSbomAttrs are the frontend attributes that make the Dockerfile frontend
+// attach an SBOM attestation to each platform of the image, generated by the
+// generator of the sbom block or else the one of the provider. The scan
+// options are build arguments the frontend reads, like buildx passes them.
+func getSbomAttrs(data *schema.ResourceData, provider TerraformProviderBuildkit) map[string]string {
+	blocks, ok := data.Get("sbom").([]interface{})
+	if !ok || len(blocks) == 0 {
+		return map[string]string{}
+	}
+
+	casted := map[string]interface{}{}
+	if blocks[0] != nil {
+		casted = blocks[0].(map[string]interface{})
+	}
+
+	generator, _ := casted["generator"].(string)
+	if generator == "" {
+		generator = provider.sbom_generator
+	}
+
+	result := map[string]string{"attest:sbom": ""}
+
+	if generator != "" {
+		result["attest:sbom"] = "generator=" + generator
+	}
+
+	if scan, _ := casted["scan_context"].(bool); scan {
+		result["build-arg:BUILDKIT_SBOM_SCAN_CONTEXT"] = "true"
+	}
+
+	if scan, _ := casted["scan_stages"].(bool); scan {
+		result["build-arg:BUILDKIT_SBOM_SCAN_STAGE"] = "true"
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"reflect"
+	"testing"
+)
+
+func TestGetSbomAttrs(t *testing.T) {
+	provider := TerraformProviderBuildkit{sbom_generator: "docker/buildkit-syft-scanner:1.0.0"}
+
+	none := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(nil))
+
+	if attrs := getSbomAttrs(none, provider); len(attrs) != 0 {
+		t.Fatalf("expected no sbom without the block: %v", attrs)
+	}
+
+	defaulted := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"sbom": []interface{}{map[string]interface{}{"scan_context": true}},
+	}))
+
+	expected := map[string]string{
+		"attest:sbom":                          "generator=docker/buildkit-syft-scanner:1.0.0",
+		"build-arg:BUILDKIT_SBOM_SCAN_CONTEXT": "true",
+	}
+	if attrs := getSbomAttrs(defaulted, provider); !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("expected the generator of the provider: %v", attrs)
+	}
+
+	overridden := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{
+		"sbom": []interface{}{map[string]interface{}{"generator": "registry.example.com/syft:1.2.3", "scan_stages": true}},
+	}))
+
+	expected = map[string]string{
+		"attest:sbom":                        "generator=registry.example.com/syft:1.2.3",
+		"build-arg:BUILDKIT_SBOM_SCAN_STAGE": "true",
+	}
+	if attrs := getSbomAttrs(overridden, provider); !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("expected the generator of the image: %v", attrs)
+	}
+
+	if attrs := getSbomAttrs(overridden, TerraformProviderBuildkit{}); attrs["attest:sbom"] != "generator=registry.example.com/syft:1.2.3" {
+		t.Fatalf("expected the generator of the image: %v", attrs)
+	}
+
+	if attrs := getSbomAttrs(defaulted, TerraformProviderBuildkit{}); attrs["attest:sbom"] != "" {
+		t.Fatalf("expected the scanner of the daemon: %v", attrs)
+	}
+}
@@ -0,0 +1,159 @@
+package buildkit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// getSecretBlocks are the values of the secret blocks of an image, along with
+// the options every mount of each secret should have. Only buildkit_image has
+// secret blocks.
+func getSecretBlocks(data *schema.ResourceData) (map[string][]byte, map[string]SecretMount, diag.Diagnostics) {
+	values := map[string][]byte{}
+	mounts := map[string]SecretMount{}
+
+	blocks, ok := data.Get("secret").([]interface{})
+	if !ok {
+		return values, mounts, diag.Diagnostics{}
+	}
+
+	for _, x := range blocks {
+		casted := x.(map[string]interface{})
+		id := casted["id"].(string)
+		value := []byte(casted["value"].(string))
+
+		if encoded := casted["value_base64"].(string); encoded != "" {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, nil, diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Failed to base64 decode the secret '%s'.", id),
+				}}
+			}
+			value = decoded
+		}
+
+		mount := SecretMount{Mode: casted["mode"].(string), Uid: casted["uid"].(int), Gid: casted["gid"].(int)}
+
+		if mount.Mode != "" {
+			if _, err := strconv.ParseUint(mount.Mode, 8, 32); err != nil {
+				return nil, nil, diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("The mode '%s' of the secret '%s' is not an octal file mode.", mount.Mode, id),
+				}}
+			}
+		}
+
+		values[id] = value
+		if mount != (SecretMount{}) {
+			mounts[id] = mount
+		}
+	}
+
+	return values, mounts, diag.Diagnostics{}
+}
+
+// writeSecretMounts writes a copy of the dockerfile into the directory in
+// which the secret mounts of RUN instructions have the options of their
+// secret, unless they set them themselves, and returns the path of the copy.
+// Buildkit only sends the value of a secret to the daemon, how it is mounted
+// is up to the Dockerfile.
+func writeSecretMounts(dockerfile string, directory string, mounts map[string]SecretMount) (string, error) {
+	content, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	rewritten, err := rewriteSecretMounts(content, mounts)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(directory, filepath.Base(dockerfile))
+	return target, ioutil.WriteFile(target, rewritten, 0644)
+}
+
+func rewriteSecretMounts(content []byte, mounts map[string]SecretMount) ([]byte, error) {
+	parsed, err := parser.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+
+	for _, node := range parsed.AST.Children {
+		if !strings.EqualFold(node.Value, "run") {
+			continue
+		}
+		for _, flag := range node.Flags {
+			if !strings.HasPrefix(flag, "--mount=") {
+				continue
+			}
+			mount := strings.TrimPrefix(flag, "--mount=")
+			rewritten := rewriteSecretMount(mount, mounts)
+			if rewritten == mount {
+				continue
+			}
+			// the flag is replaced where it is written, which is on one of the lines of the instruction
+			for i := node.StartLine - 1; i < node.EndLine && i < len(lines); i++ {
+				if strings.Contains(lines[i], flag) {
+					lines[i] = strings.Replace(lines[i], flag, "--mount="+rewritten, 1)
+					break
+				}
+			}
+		}
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// rewriteSecretMount adds the options of the secret to a mount, if it is a
+// mount of a secret with options.
+func rewriteSecretMount(mount string, mounts map[string]SecretMount) string {
+	fields := strings.Split(mount, ",")
+	options := map[string]string{}
+	for _, x := range fields {
+		key, value, _ := strings.Cut(x, "=")
+		options[strings.ToLower(key)] = value
+	}
+
+	if options["type"] != "secret" {
+		return mount
+	}
+
+	// the id of a secret defaults to the name of the file it is mounted as
+	id := options["id"]
+	if id == "" {
+		for _, key := range []string{"target", "dst", "destination"} {
+			if options[key] != "" {
+				id = path.Base(options[key])
+			}
+		}
+	}
+
+	secret, ok := mounts[id]
+	if !ok {
+		return mount
+	}
+
+	if _, ok := options["mode"]; !ok && secret.Mode != "" {
+		fields = append(fields, "mode="+secret.Mode)
+	}
+	if _, ok := options["uid"]; !ok && secret.Uid != 0 {
+		fields = append(fields, "uid="+strconv.Itoa(secret.Uid))
+	}
+	if _, ok := options["gid"]; !ok && secret.Gid != 0 {
+		fields = append(fields, "gid="+strconv.Itoa(secret.Gid))
+	}
+
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,76 @@
+package buildkit
+
+import (
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"testing"
+)
+
+func TestRewriteSecretMounts(t *testing.T) {
+	dockerfile := `FROM alpine
+# --mount=type=secret,id=npmrc is only rewritten in RUN instructions
+RUN --mount=type=secret,id=npmrc \
+    --mount=type=secret,id=token,mode=0444 \
+    --mount=type=cache,target=/root/.npm npm ci
+RUN --mount=type=secret,target=/run/secrets/npmrc cat /run/secrets/npmrc
+RUN --mount=type=secret,id=other cat /run/secrets/other
+`
+
+	rewritten, err := rewriteSecretMounts([]byte(dockerfile), map[string]SecretMount{
+		"npmrc": {Mode: "0440", Uid: 1000},
+		"token": {Mode: "0400", Gid: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `FROM alpine
+# --mount=type=secret,id=npmrc is only rewritten in RUN instructions
+RUN --mount=type=secret,id=npmrc,mode=0440,uid=1000 \
+    --mount=type=secret,id=token,mode=0444,gid=1000 \
+    --mount=type=cache,target=/root/.npm npm ci
+RUN --mount=type=secret,target=/run/secrets/npmrc,mode=0440,uid=1000 cat /run/secrets/npmrc
+RUN --mount=type=secret,id=other cat /run/secrets/other
+`
+
+	if string(rewritten) != expected {
+		t.Fatalf("unexpected dockerfile:\n%s", rewritten)
+	}
+}
+
+func TestGetSecrets(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"secrets": map[string]interface{}{"token": "plain"},
+		"secret": []interface{}{
+			map[string]interface{}{"id": "npmrc", "value": "registry=", "mode": "0440", "uid": 1000},
+			map[string]interface{}{"id": "key", "value_base64": "a2V5"},
+		},
+	})
+
+	secrets, diags := getSecrets(data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if string(secrets["token"]) != "plain" || string(secrets["npmrc"]) != "registry=" || string(secrets["key"]) != "key" {
+		t.Fatalf("unexpected secrets: %v", secrets)
+	}
+
+	_, mounts, _ := getSecretBlocks(data)
+	if len(mounts) != 1 || mounts["npmrc"] != (SecretMount{Mode: "0440", Uid: 1000}) {
+		t.Fatalf("expected only the secret with options to be mounted with them: %v", mounts)
+	}
+
+	duplicate := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"secrets": map[string]interface{}{"npmrc": "plain"},
+		"secret":  []interface{}{map[string]interface{}{"id": "npmrc", "value": "registry="}},
+	})
+	if _, diags := getSecrets(duplicate); !diags.HasError() {
+		t.Fatal("expected a secret given twice to be rejected")
+	}
+
+	invalid := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, map[string]interface{}{
+		"secret": []interface{}{map[string]interface{}{"id": "npmrc", "mode": "rw"}},
+	})
+	if _, _, diags := getSecretBlocks(invalid); !diags.HasError() {
+		t.Fatal("expected a mode that isn't octal to be rejected")
+	}
+}
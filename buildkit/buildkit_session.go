@@ -0,0 +1,146 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/denisbrodbeck/machineid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/connhelper"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/grpchijack"
+	"github.com/moby/buildkit/util/appdefaults"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// the largest message buildkit sends over a session, files are sent in much smaller chunks
+const maxSessionMessageSize = 16 << 20
+
+// connect creates a client of the buildkit daemon at the address. Sessions
+// are dialed on a compressed connection of their own when compress is set.
+func (provider TerraformProviderBuildkit) connect(ctx context.Context, address string, compress bool) (*client.Client, error) {
+	options := []client.ClientOpt{client.WithFailFast()}
+	if compress {
+		dialer, err := newCompressedSessionDialer(address)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, client.WithSessionDialer(dialer))
+	}
+	if provider.tracer_provider != nil {
+		options = append(options, client.WithTracerProvider(provider.tracer_provider))
+	}
+	return client.New(ctx, address, options...)
+}
+
+// builderNodes are the nodes builds are routed to, which is only the daemon
+// at the buildkit_url unless other nodes are configured.
+func (provider TerraformProviderBuildkit) builderNodes() []*builderNode {
+	if len(provider.builder_nodes) == 0 {
+		return []*builderNode{{name: defaultNodeName, url: provider.buildkit_url, client: provider.buildkit_client}}
+	}
+	return provider.builder_nodes
+}
+
+// sharedKey is the key the daemon caches uploaded contexts under. The key of
+// a resource takes precedence over the key of the provider.
+func (provider TerraformProviderBuildkit) sharedKey(key string) (string, error) {
+	if key != "" {
+		return key, nil
+	}
+	if provider.shared_key != "" {
+		return provider.shared_key, nil
+	}
+	return machineid.ProtectedID("terraform-provider-buildkit")
+}
+
+// buildkitFailure describes an error returned by the buildkit daemon. These
+// are often about reaching the daemon rather than about what it was asked to
+// do, so the address and the grpc status are included.
+func buildkitFailure(provider TerraformProviderBuildkit, action string, err error) diag.Diagnostic {
+	detail := err.Error()
+
+	switch code := grpcerrors.Code(err); code {
+	case codes.OK, codes.Unknown:
+	case codes.Unavailable:
+		detail += fmt.Sprintf("\n\nThe daemon is unavailable (grpc status %s), make sure buildkitd is running and reachable at the buildkit_url.", code)
+	default:
+		detail += fmt.Sprintf("\n\nThe daemon responded with grpc status %s.", code)
+	}
+
+	return diag.Diagnostic{
+		Severity: diag.Error,
+		Summary:  fmt.Sprintf("Could not %s with the buildkit daemon at '%s'.", action, provider.buildkit_url),
+		Detail:   detail,
+	}
+}
+
+// newCompressedSessionDialer connects sessions to the daemon over a connection
+// of their own on which every message is gzip compressed. The session is how
+// the daemon reads the context and the dockerfile from the machine running
+// terraform, so this trades some cpu for much less traffic over slow links.
+// The buildkit client has no way to compress the sessions it dials itself.
+func newCompressedSessionDialer(address string) (session.Dialer, error) {
+	if address == "" {
+		address = appdefaults.Address
+	}
+
+	dialer, err := sessionContextDialer(address)
+	if err != nil {
+		return nil, err
+	}
+
+	uri, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// dialing doesn't block, the connection is made along with the first session
+	conn, err := grpc.Dial(address,
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority(uri.Host),
+		grpc.WithDefaultCallOptions(
+			grpc.UseCompressor(gzip.Name),
+			grpc.MaxCallRecvMsgSize(maxSessionMessageSize),
+			grpc.MaxCallSendMsgSize(maxSessionMessageSize),
+		),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return grpchijack.Dialer(controlapi.NewControlClient(conn)), nil
+}
+
+// sessionContextDialer resolves the address the same way the buildkit client
+// does, e.g. `tcp://buildkitd:1234` or `unix:///run/buildkit/buildkitd.sock`.
+func sessionContextDialer(address string) (func(context.Context, string) (net.Conn, error), error) {
+	helper, err := connhelper.GetConnectionHelper(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if helper != nil {
+		return helper.ContextDialer, nil
+	}
+
+	scheme, path, ok := strings.Cut(address, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid buildkit_url '%s'", address)
+	}
+
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, scheme, path)
+	}, nil
+}
@@ -0,0 +1,169 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"google.golang.org/grpc"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingListener struct {
+	net.Listener
+	received *int64
+}
+
+type countingConn struct {
+	net.Conn
+	received *int64
+}
+
+func (listener countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	return countingConn{Conn: conn, received: listener.received}, err
+}
+
+func (conn countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(conn.received, int64(n))
+	return n, err
+}
+
+// testControl is a buildkit daemon that only accepts sessions, reporting how
+// much data it received through them.
+type testControl struct {
+	controlapi.UnimplementedControlServer
+	data chan int
+}
+
+func (control *testControl) Session(stream controlapi.Control_SessionServer) error {
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		control.data <- len(message.Data)
+	}
+}
+
+func TestCompressedSessionDialer(t *testing.T) {
+	var received int64
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control := &testControl{data: make(chan int, 1024)}
+	server := grpc.NewServer()
+	controlapi.RegisterControlServer(server, control)
+	go server.Serve(countingListener{Listener: listener, received: &received})
+	t.Cleanup(server.Stop)
+
+	dialer, err := newCompressedSessionDialer("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := dialer(ctx, "h2c", map[string][]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	size := 1 << 20
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	for total := 0; total < size; {
+		select {
+		case n := <-control.data:
+			total += n
+		case <-ctx.Done():
+			t.Fatalf("expected %d bytes to arrive but only %d did", size, total)
+		}
+	}
+
+	if actual := atomic.LoadInt64(&received); actual > int64(size/10) {
+		t.Fatalf("expected the session to be compressed but %d bytes were received for %d bytes of data", actual, size)
+	}
+}
+
+func TestSessionContextDialer(t *testing.T) {
+	if _, err := sessionContextDialer("tcp://buildkitd:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessionContextDialer("buildkitd:1234"); err == nil {
+		t.Fatal("expected an address without a scheme to be rejected")
+	}
+}
+
+func TestBuildkitFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	data := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url": address,
+	})
+
+	meta, diags := providerConfigure(context.Background(), data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	provider := meta.(TerraformProviderBuildkit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = provider.buildkit_client.ListWorkers(ctx)
+	if err == nil {
+		t.Fatal("expected a daemon that isn't running to be unavailable")
+	}
+
+	failure := buildkitFailure(provider, "list the workers", err)
+
+	if !strings.Contains(failure.Summary, address) {
+		t.Fatalf("expected the summary to name the daemon but got %s", failure.Summary)
+	}
+
+	if !strings.Contains(failure.Detail, "Unavailable") {
+		t.Fatalf("expected the detail to include the grpc status but got %s", failure.Detail)
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	data := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"buildkit_url": "tcp://127.0.0.1:1234",
+		"shared_key":   "monorepo",
+	})
+
+	meta, diags := providerConfigure(context.Background(), data)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	provider := meta.(TerraformProviderBuildkit)
+
+	if key, err := provider.sharedKey(""); err != nil || key != "monorepo" {
+		t.Fatalf("expected the key of the provider but got %s (%v)", key, err)
+	}
+	if key, err := provider.sharedKey("monorepo/api"); err != nil || key != "monorepo/api" {
+		t.Fatalf("expected the key of the resource to take precedence but got %s (%v)", key, err)
+	}
+
+	provider.shared_key = ""
+	if key, err := provider.sharedKey(""); err == nil && key == "" {
+		t.Fatalf("expected a key derived from the machine")
+	}
+}
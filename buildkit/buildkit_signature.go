@@ -0,0 +1,364 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+var (
+	// fulcio records the OIDC issuer in one of two extensions depending on its version
+	fulcioIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// digestTag returns the tag that artifacts of an image digest are stored
+// under by cosign and the referrers tag schema (e.g. sha256-abc.sig).
+func digestTag(repository name.Repository, digest string, suffix string) name.Tag {
+	tag := strings.Replace(digest, ":", "-", 1)
+	if suffix != "" {
+		tag += "." + suffix
+	}
+	return repository.Tag(tag)
+}
+
+// signatureTag returns the tag cosign stores the signatures of an image
+// digest under.
+func signatureTag(repository name.Repository, digest string) name.Tag {
+	return digestTag(repository, digest, "sig")
+}
+
+// verifyImageSignature resolves the reference to a digest and checks the
+// cosign signatures stored alongside it. The returned result is nil when no
+// signature could be verified.
+func verifyImageSignature(ctx context.Context, auth RegistryAuth, reference name.Reference, query SignatureQuery) (string, *SignatureResult, error) {
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	head, err := remote.Head(reference, options...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	digest := head.Digest.String()
+
+	descriptor, err := remote.Get(signatureTag(reference.Context(), digest), options...)
+	if err != nil {
+		if isNotFound(err) {
+			return digest, nil, nil
+		}
+		return digest, nil, err
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return digest, nil, err
+	}
+
+	for _, layer := range manifest.Layers {
+		if _, ok := layer.Annotations[cosignSignatureAnnotation]; !ok {
+			continue
+		}
+
+		blob, err := remote.Layer(reference.Context().Digest(layer.Digest.String()), options...)
+		if err != nil {
+			return digest, nil, err
+		}
+
+		reader, err := blob.Compressed()
+		if err != nil {
+			return digest, nil, err
+		}
+
+		payload, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return digest, nil, err
+		}
+
+		// a signature that doesn't verify is not an error, there may be another one that does
+		if result, err := verifySignature(query, digest, payload, layer.Annotations); err == nil {
+			return digest, result, nil
+		}
+	}
+
+	return digest, nil, nil
+}
+
+// verifySignature checks a single cosign signature layer against either the
+// public key or the certificate roots of the query.
+func verifySignature(query SignatureQuery, digest string, payload []byte, annotations map[string]string) (*SignatureResult, error) {
+
+	signature, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SignatureResult{}
+
+	if query.PublicKey != "" {
+		key, err := parsePublicKey(query.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyWithKey(key, payload, signature); err != nil {
+			return nil, err
+		}
+	} else {
+		certificate, err := verifyCertificate(query, payload, signature, annotations)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyWithKey(certificate.PublicKey, payload, signature); err != nil {
+			return nil, err
+		}
+		result.Identity, result.OidcIssuer = certificateIdentity(certificate)
+		if query.Identity != "" && query.Identity != result.Identity {
+			return nil, fmt.Errorf("certificate identity '%s' does not match '%s'", result.Identity, query.Identity)
+		}
+		if query.OidcIssuer != "" && query.OidcIssuer != result.OidcIssuer {
+			return nil, fmt.Errorf("certificate issuer '%s' does not match '%s'", result.OidcIssuer, query.OidcIssuer)
+		}
+	}
+
+	simpleSigning := CosignPayload{}
+	if err := json.Unmarshal(payload, &simpleSigning); err != nil {
+		return nil, err
+	}
+
+	if simpleSigning.Critical.Image.DockerManifestDigest != digest {
+		return nil, fmt.Errorf("signature is for '%s' rather than '%s'", simpleSigning.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	return result, nil
+}
+
+func parsePublicKey(key string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func verifyWithKey(key crypto.PublicKey, payload []byte, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, hash[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verifyCertificate checks that the signing certificate chains up to one of
+// the configured roots. Fulcio certificates are only valid for minutes, so the
+// chain is checked at the time the signature was entered into the
+// transparency log, which is only trusted once the log has vouched for it.
+func verifyCertificate(query SignatureQuery, payload []byte, signature []byte, annotations map[string]string) (*x509.Certificate, error) {
+
+	block, _ := pem.Decode([]byte(annotations[cosignCertificateAnnotation]))
+	if block == nil {
+		return nil, fmt.Errorf("signature has no certificate")
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(query.CertificateRoots)) {
+		return nil, fmt.Errorf("no certificates found in the certificate roots")
+	}
+
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(annotations[cosignChainAnnotation]))
+
+	signed, err := verifyBundle(query.RekorPublicKey, payload, signature, annotations[cosignBundleAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signed,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate, nil
+}
+
+// verifyBundle checks the signed entry timestamp rekor issued for the
+// signature and returns the time it was entered into the log.
+func verifyBundle(rekorPublicKey string, payload []byte, signature []byte, annotation string) (time.Time, error) {
+
+	if annotation == "" {
+		return time.Time{}, fmt.Errorf("signature has no transparency log bundle")
+	}
+
+	key, err := parsePublicKey(rekorPublicKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid rekor public key: %w", err)
+	}
+
+	bundle := CosignBundle{}
+	if err := json.Unmarshal([]byte(annotation), &bundle); err != nil {
+		return time.Time{}, err
+	}
+
+	// rekor signs the canonical json of the entry, which has its keys sorted
+	// and nothing escaped that doesn't need to be
+	canonical := bytes.Buffer{}
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(map[string]interface{}{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := verifyWithKey(key, bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("transparency log bundle is not signed by rekor: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	entry := RekorEntry{}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, err
+	}
+
+	hash := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) || entry.Spec.Signature.Content != base64.StdEncoding.EncodeToString(signature) {
+		return time.Time{}, fmt.Errorf("transparency log bundle is for another signature")
+	}
+
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+func certificateIdentity(certificate *x509.Certificate) (string, string) {
+	identity := ""
+	if len(certificate.EmailAddresses) > 0 {
+		identity = certificate.EmailAddresses[0]
+	} else if len(certificate.URIs) > 0 {
+		identity = certificate.URIs[0].String()
+	}
+
+	issuer := ""
+	for _, x := range certificate.Extensions {
+		if x.Id.Equal(fulcioIssuerV2) {
+			var value string
+			if _, err := asn1.Unmarshal(x.Value, &value); err == nil {
+				issuer = value
+			}
+		} else if x.Id.Equal(fulcioIssuerV1) && issuer == "" {
+			issuer = string(x.Value)
+		}
+	}
+
+	return identity, issuer
+}
+
+func readImageSignatureDataSource(context context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	tag := data.Get("tag").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return skippedRemoteRead(data)
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	reference, err := imageTag(registry_url, repository_name, tag)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	digest, result, err := verifyImageSignature(context, auth, reference, SignatureQuery{
+		PublicKey:        data.Get("public_key").(string),
+		CertificateRoots: data.Get("certificate_roots").(string),
+		RekorPublicKey:   data.Get("rekor_public_key").(string),
+		Identity:         data.Get("certificate_identity").(string),
+		OidcIssuer:       data.Get("certificate_oidc_issuer").(string),
+	})
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("digest", digest)
+	data.Set("verified", result != nil)
+
+	if result != nil {
+		data.Set("signer_identity", result.Identity)
+		data.Set("signer_oidc_issuer", result.OidcIssuer)
+	} else {
+		data.Set("signer_identity", "")
+		data.Set("signer_oidc_issuer", "")
+	}
+
+	return diag.Diagnostics{}
+}
@@ -0,0 +1,214 @@
+package buildkit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+func testPayload(digest string) []byte {
+	return []byte(`{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+}
+
+func testSign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func testPem(kind string, bites []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: bites}))
+}
+
+func testBundle(t *testing.T, key *ecdsa.PrivateKey, payload []byte, signature string, integrated time.Time) string {
+	hash := sha256.Sum256(payload)
+	body := `{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"` + hex.EncodeToString(hash[:]) + `"}},"signature":{"content":"` + signature + `"}}}`
+
+	bundle := CosignBundle{Payload: CosignBundlePayload{
+		Body:           base64.StdEncoding.EncodeToString([]byte(body)),
+		IntegratedTime: integrated.Unix(),
+		LogIndex:       42,
+		LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+	}}
+
+	entry, _ := json.Marshal(map[string]interface{}{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	timestamp, _ := base64.StdEncoding.DecodeString(testSign(t, key, entry))
+	bundle.SignedEntryTimestamp = timestamp
+
+	result, _ := json.Marshal(bundle)
+	return string(result)
+}
+
+func TestVerifySignatureWithKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	query := SignatureQuery{PublicKey: testPem("PUBLIC KEY", public)}
+
+	payload := testPayload(testDigest)
+	annotations := map[string]string{cosignSignatureAnnotation: testSign(t, key, payload)}
+
+	if _, err := verifySignature(query, testDigest, payload, annotations); err != nil {
+		t.Fatalf("expected signature to verify: %v", err)
+	}
+
+	if _, err := verifySignature(query, "sha256:1111", payload, annotations); err == nil {
+		t.Fatal("expected signature for another digest to be rejected")
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	annotations[cosignSignatureAnnotation] = testSign(t, other, payload)
+
+	if _, err := verifySignature(query, testDigest, payload, annotations); err == nil {
+		t.Fatal("expected signature by another key to be rejected")
+	}
+}
+
+func TestVerifySignatureWithCertificate(t *testing.T) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDer, _ := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(-50 * time.Minute),
+		EmailAddresses: []string{"someone@example.com"},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{
+			{Id: fulcioIssuerV1, Value: []byte("https://accounts.example.com")},
+		},
+	}
+	leafDer, _ := x509.CreateCertificate(rand.Reader, leaf, root, &leafKey.PublicKey, rootKey)
+
+	rekorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rekorPublic, _ := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+
+	payload := testPayload(testDigest)
+	signature := testSign(t, leafKey, payload)
+	annotations := map[string]string{
+		cosignSignatureAnnotation:   signature,
+		cosignCertificateAnnotation: testPem("CERTIFICATE", leafDer),
+		cosignBundleAnnotation:      testBundle(t, rekorKey, payload, signature, time.Now().Add(-55*time.Minute)),
+	}
+
+	query := SignatureQuery{
+		CertificateRoots: testPem("CERTIFICATE", rootDer),
+		RekorPublicKey:   testPem("PUBLIC KEY", rekorPublic),
+		Identity:         "someone@example.com",
+		OidcIssuer:       "https://accounts.example.com",
+	}
+
+	result, err := verifySignature(query, testDigest, payload, annotations)
+	if err != nil {
+		t.Fatalf("expected signature to verify: %v", err)
+	}
+	if result.Identity != query.Identity || result.OidcIssuer != query.OidcIssuer {
+		t.Fatalf("unexpected signer: %+v", result)
+	}
+
+	query.Identity = "someone-else@example.com"
+	if _, err := verifySignature(query, testDigest, payload, annotations); err == nil {
+		t.Fatal("expected a different identity to be rejected")
+	}
+}
+
+func TestVerifySignatureWithCertificateBundle(t *testing.T) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDer, _ := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(-50 * time.Minute),
+		EmailAddresses: []string{"someone@example.com"},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	leafDer, _ := x509.CreateCertificate(rand.Reader, leaf, root, &leafKey.PublicKey, rootKey)
+
+	rekorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rekorPublic, _ := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+
+	payload := testPayload(testDigest)
+	signature := testSign(t, leafKey, payload)
+	query := SignatureQuery{
+		CertificateRoots: testPem("CERTIFICATE", rootDer),
+		RekorPublicKey:   testPem("PUBLIC KEY", rekorPublic),
+	}
+
+	annotations := func(bundle string) map[string]string {
+		return map[string]string{
+			cosignSignatureAnnotation:   signature,
+			cosignCertificateAnnotation: testPem("CERTIFICATE", leafDer),
+			cosignBundleAnnotation:      bundle,
+		}
+	}
+
+	if _, err := verifySignature(query, testDigest, payload, annotations("")); err == nil {
+		t.Fatal("expected a signature that wasn't logged to be rejected")
+	}
+
+	expired := testBundle(t, rekorKey, payload, signature, time.Now())
+	if _, err := verifySignature(query, testDigest, payload, annotations(expired)); err == nil {
+		t.Fatal("expected a signature logged after the certificate expired to be rejected")
+	}
+
+	tampered := CosignBundle{}
+	json.Unmarshal([]byte(expired), &tampered)
+	tampered.Payload.IntegratedTime = time.Now().Add(-55 * time.Minute).Unix()
+	edited, _ := json.Marshal(tampered)
+	if _, err := verifySignature(query, testDigest, payload, annotations(string(edited))); err == nil {
+		t.Fatal("expected a bundle with an edited time to be rejected")
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forged := testBundle(t, other, payload, signature, time.Now().Add(-55*time.Minute))
+	if _, err := verifySignature(query, testDigest, payload, annotations(forged)); err == nil {
+		t.Fatal("expected a bundle not signed by rekor to be rejected")
+	}
+
+	replayed := testBundle(t, rekorKey, testPayload("sha256:1111"), testSign(t, leafKey, testPayload("sha256:1111")), time.Now().Add(-55*time.Minute))
+	if _, err := verifySignature(query, testDigest, payload, annotations(replayed)); err == nil {
+		t.Fatal("expected a bundle of another signature to be rejected")
+	}
+}
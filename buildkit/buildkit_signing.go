@@ -0,0 +1,504 @@
+package buildkit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"net/http"
+	"time"
+)
+
+const (
+	cosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignPayloadType      = "cosign container image signature"
+)
+
+var signingKeys = []string{"private_key", "kms_key", "keyless"}
+
+// signingClient talks to the kms, fulcio and rekor when signing
+var signingClient = &http.Client{Timeout: 30 * time.Second}
+
+var KeylessResource = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"fulcio_url": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     defaultFulcioUrl,
+			Description: "The url of the fulcio certificate authority that issues the signing certificate.",
+		},
+		"rekor_url": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     defaultRekorUrl,
+			Description: "The url of the rekor transparency log the signature is entered into.",
+		},
+		"identity_token": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Default:     "",
+			Description: "The OIDC identity token the certificate is issued for. Defaults to `SIGSTORE_ID_TOKEN` or, within GitHub Actions, a token requested from GitHub.",
+		},
+	},
+}
+
+func buildkitImageSignatureResource() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: createImageSignature,
+		ReadContext:   readImageSignature,
+		DeleteContext: deleteImageSignature,
+		Description:   "A cosign signature of an image, pushed to the registry alongside the image.",
+		Schema: map[string]*schema.Schema{
+			"registry_url": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The registry url of the image.",
+			},
+			"repository_name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The repository name of the image.",
+			},
+			"digest": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "The digest of the image to sign, e.g. the `image_digest` of a `buildkit_image`.",
+			},
+			"private_key": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Sensitive:    true,
+				ExactlyOneOf: signingKeys,
+				Description:  "The PEM encoded private key to sign with. Both keys created by `cosign generate-key-pair` and unencrypted PKCS8 keys are supported.",
+			},
+			"kms_key": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ExactlyOneOf: signingKeys,
+				Description:  "The uri of a kms key to sign with, like for `cosign sign --key`. `awskms://` and `hashivault://` keys are supported.",
+			},
+			"keyless": {
+				Type:         schema.TypeList,
+				Optional:     true,
+				ForceNew:     true,
+				MaxItems:     1,
+				ExactlyOneOf: signingKeys,
+				Elem:         KeylessResource,
+				Description:  "Sign with an ephemeral key certified by fulcio for an OIDC identity, and enter the signature into rekor.",
+			},
+			"private_key_password": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Sensitive:   true,
+				Default:     "",
+				Description: "The password of an encrypted cosign private key.",
+			},
+			"annotations": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     map[string]string{},
+				Description: "Annotations that are added to the signed payload (like `cosign sign -a`).",
+			},
+			"public_key": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The PEM encoded public key the signature can be verified with.",
+			},
+			"certificate": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The PEM encoded certificate fulcio issued for a keyless signature.",
+			},
+			"signature_digest": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The digest of the signed payload within the signature image.",
+			},
+			"signature_tag_url": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The url of the tag cosign stores the signatures of the image under.",
+			},
+		},
+	}
+}
+
+// parsePrivateKey reads an unencrypted PKCS8 key or a key encrypted by cosign.
+func parsePrivateKey(key string, password string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	der := block.Bytes
+	switch block.Type {
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		decrypted, err := decryptCosignKey(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		der = decrypted
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+
+	return signer, nil
+}
+
+// decryptCosignKey opens the scrypt + secretbox envelope cosign stores its
+// private keys in.
+func decryptCosignKey(envelope []byte, password string) ([]byte, error) {
+	encrypted := CosignEncryptedKey{}
+	if err := json.Unmarshal(envelope, &encrypted); err != nil {
+		return nil, err
+	}
+
+	if encrypted.Kdf.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported private key encryption %s with %s", encrypted.Kdf.Name, encrypted.Cipher.Name)
+	}
+
+	key, err := scrypt.Key([]byte(password), encrypted.Kdf.Salt, encrypted.Kdf.Params.N, encrypted.Kdf.Params.R, encrypted.Kdf.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], key)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+
+	decrypted, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &secret)
+	if !ok {
+		return nil, fmt.Errorf("could not decrypt the private key, is the password correct?")
+	}
+
+	return decrypted, nil
+}
+
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func makeSignaturePayload(repository name.Repository, digest string, annotations map[string]interface{}) ([]byte, error) {
+	payload := CosignPayload{}
+	payload.Critical.Identity.DockerReference = repository.Name()
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = cosignPayloadType
+	if len(annotations) > 0 {
+		payload.Optional = annotations
+	}
+	return json.Marshal(payload)
+}
+
+// how long a tag appendLayer wrote is left alone before it is read back to
+// see whether another run appended to it at the same time, and how often the
+// layer is appended again when one did
+var (
+	appendLayerSettle   = time.Second
+	appendLayerAttempts = 5
+)
+
+// appendLayer adds a layer to the image under the tag (which is created when
+// it doesn't exist yet), the way cosign stores signatures and attachments.
+// Registries can't replace a tag only if it is unchanged, so the tag is
+// checked right before writing it and read back afterwards, and the layer is
+// appended again to whatever another run replaced it with in the meantime.
+func appendLayer(ctx context.Context, auth RegistryAuth, tag name.Tag, layer v1.Layer, annotations map[string]string) error {
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < appendLayerAttempts; attempt++ {
+		base, previous, err := readAppendBase(tag, options)
+		if err != nil {
+			return err
+		}
+
+		appended, err := mutate.Append(base, mutate.Addendum{
+			Layer:       layer,
+			Annotations: annotations,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, current, err := readAppendBase(tag, options); err != nil {
+			return err
+		} else if current != previous {
+			continue
+		}
+
+		if err := remote.Write(tag, appended, options...); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(appendLayerSettle):
+		}
+
+		if exists, err := hasLayer(ctx, auth, tag, layerDigest.String()); err != nil || exists {
+			return err
+		}
+	}
+
+	return fmt.Errorf("could not append to %s, it kept being replaced by someone else", tag.Name())
+}
+
+// readAppendBase is the image under the tag along with its digest, or an
+// empty image without a digest when there is none yet.
+func readAppendBase(tag name.Tag, options []remote.Option) (v1.Image, string, error) {
+	image, err := remote.Image(tag, options...)
+	if isNotFound(err) {
+		return mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON), "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return nil, "", err
+	}
+	return image, digest.String(), nil
+}
+
+// hasLayer checks whether the image under the tag still holds the layer.
+func hasLayer(ctx context.Context, auth RegistryAuth, tag name.Tag, layerDigest string) (bool, error) {
+
+	image, err := remote.Image(tag, makeOptions(craneOptions(ctx, auth)...).Remote...)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return false, err
+	}
+
+	for _, x := range manifest.Layers {
+		if x.Digest.String() == layerDigest {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// pushSignature adds a signature to the signature image of the digest and
+// returns the digest of the new layer.
+func pushSignature(ctx context.Context, auth RegistryAuth, repository name.Repository, digest string, payload []byte, signature []byte, annotations map[string]string) (string, error) {
+
+	layer := static.NewLayer(payload, cosignPayloadMediaType)
+
+	merged := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+
+	err := appendLayer(ctx, auth, signatureTag(repository, digest), layer, merged)
+	if err != nil {
+		return "", err
+	}
+
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return layerDigest.String(), nil
+}
+
+func createImageSignature(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	digest := data.Get("digest").(string)
+	private_key := data.Get("private_key").(string)
+	private_key_password := data.Get("private_key_password").(string)
+	kms_key := data.Get("kms_key").(string)
+	keyless := data.Get("keyless").([]interface{})
+	annotations := data.Get("annotations").(map[string]interface{})
+	provider := meta.(TerraformProviderBuildkit)
+	auth := provider.registryAuth(registry_url)
+
+	repository, err := imageRepository(registry_url, repository_name)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	var signer crypto.Signer
+	switch {
+	case kms_key != "":
+		signer, err = kmsSigner(ctx, kms_key)
+	case len(keyless) > 0:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		signer, err = parsePrivateKey(private_key, private_key_password)
+	}
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "Could not read the private key.",
+			Detail:   err.Error(),
+		}}
+	}
+
+	public_key, err := x509.MarshalPKIXPublicKey(signer.Public())
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	payload, err := makeSignaturePayload(repository, digest, annotations)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	signature, err := signPayload(signer, payload)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	signature_annotations := map[string]string{}
+
+	if len(keyless) > 0 {
+		signature_annotations, err = keylessAnnotations(ctx, keyless[0].(map[string]interface{}), signer, payload, signature)
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "Could not sign without a key.",
+				Detail:   err.Error(),
+			}}
+		}
+	}
+
+	signature_digest, err := pushSignature(ctx, auth, repository, digest, payload, signature, signature_annotations)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	id, _ := uuid.GenerateUUID()
+
+	data.SetId(id)
+	data.Set("public_key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public_key})))
+	data.Set("certificate", signature_annotations[cosignCertificateAnnotation])
+	data.Set("signature_digest", signature_digest)
+	data.Set("signature_tag_url", signatureTag(repository, digest).Name())
+
+	return diag.Diagnostics{}
+}
+
+func readImageSignature(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+
+	registry_url := data.Get("registry_url").(string)
+	repository_name := data.Get("repository_name").(string)
+	digest := data.Get("digest").(string)
+	signature_digest := data.Get("signature_digest").(string)
+	provider := meta.(TerraformProviderBuildkit)
+
+	if provider.skip_remote_refresh {
+		return diag.Diagnostics{}
+	}
+
+	auth := provider.registryAuth(registry_url)
+
+	repository, err := imageRepository(registry_url, repository_name)
+
+	if err != nil {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}}
+	}
+
+	signature_tag := signatureTag(repository, digest)
+	exists, err := hasLayer(ctx, auth, signature_tag, signature_digest)
+
+	if err != nil {
+		return diag.Diagnostics{readFailure(provider, registry_url, signature_tag.String(), err)}
+	}
+
+	// the signature was removed outside of terraform so the image needs to be signed again
+	if !exists {
+		data.SetId("")
+	}
+
+	return diag.Diagnostics{}
+}
+
+func deleteImageSignature(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, 0)
+
+	// signatures are left in place, like the images published by buildkit_image
+	return diagnostics
+}
@@ -0,0 +1,227 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultFulcioUrl = "https://fulcio.sigstore.dev"
+	defaultRekorUrl  = "https://rekor.sigstore.dev"
+)
+
+// keylessAnnotations has fulcio issue a certificate for the ephemeral key the
+// payload was signed with to the identity of the OIDC token, and enters the
+// signature into the rekor transparency log. The certificate, its chain and
+// the proof of when the signature was logged are attached to the signature
+// the way `cosign sign` attaches them.
+func keylessAnnotations(ctx context.Context, keyless map[string]interface{}, signer crypto.Signer, payload []byte, signature []byte) (map[string]string, error) {
+
+	token, err := identityToken(ctx, keyless["identity_token"].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, chain, err := requestCertificate(ctx, keyless["fulcio_url"].(string), token, signer)
+	if err != nil {
+		return nil, fmt.Errorf("could not get a certificate from fulcio: %w", err)
+	}
+
+	bundle, err := uploadToRekor(ctx, keyless["rekor_url"].(string), payload, signature, certificate)
+	if err != nil {
+		return nil, fmt.Errorf("could not enter the signature into rekor: %w", err)
+	}
+
+	return map[string]string{
+		cosignCertificateAnnotation: certificate,
+		cosignChainAnnotation:       chain,
+		cosignBundleAnnotation:      bundle,
+	}, nil
+}
+
+// identityToken is the OIDC token keyless signatures are issued for. Unless
+// one is configured it is taken from `SIGSTORE_ID_TOKEN` or, within GitHub
+// Actions, requested for the sigstore audience like cosign does.
+func identityToken(ctx context.Context, configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if token := os.Getenv("SIGSTORE_ID_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	requestUrl, requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"), os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestUrl == "" || requestToken == "" {
+		return "", fmt.Errorf("there is no identity token to sign with, set the identity_token or SIGSTORE_ID_TOKEN")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl+"&audience=sigstore", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+requestToken)
+
+	response, err := signingClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("github responded to the identity token request with status %d", response.StatusCode)
+	}
+
+	result := struct {
+		Value string `json:"value"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.Value, nil
+}
+
+// tokenSubject is what fulcio has the key prove its possession by signing,
+// which is the email of the token when it has one and its subject otherwise.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("the identity token is not a JWT")
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+
+	parsed := struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}{}
+	if err := json.Unmarshal(claims, &parsed); err != nil {
+		return "", err
+	}
+
+	if parsed.Email != "" {
+		return parsed.Email, nil
+	}
+	return parsed.Subject, nil
+}
+
+// requestCertificate returns the PEM encoded certificate fulcio issued for the
+// key, and the chain of certificates it was issued by.
+func requestCertificate(ctx context.Context, fulcioUrl string, token string, signer crypto.Signer) (string, string, error) {
+
+	subject, err := tokenSubject(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	proof, err := signPayload(signer, []byte(subject))
+	if err != nil {
+		return "", "", err
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", "", err
+	}
+
+	body := FulcioCertificateRequest{}
+	body.Credentials.OidcIdentityToken = token
+	body.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	body.PublicKeyRequest.PublicKey.Content = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+	body.PublicKeyRequest.ProofOfPossession = proof
+
+	response := FulcioCertificateResponse{}
+	if err := postJson(ctx, strings.TrimSuffix(fulcioUrl, "/")+"/api/v2/signingCert", body, &response); err != nil {
+		return "", "", err
+	}
+
+	chain := response.SignedCertificateEmbeddedSct
+	if chain == nil {
+		chain = response.SignedCertificateDetachedSct
+	}
+	if chain == nil || len(chain.Chain.Certificates) == 0 {
+		return "", "", fmt.Errorf("fulcio returned no certificate")
+	}
+
+	certificates := chain.Chain.Certificates
+	return certificates[0], strings.Join(certificates[1:], ""), nil
+}
+
+// uploadToRekor enters the signature into the transparency log and returns
+// the bundle that proves when it was logged.
+func uploadToRekor(ctx context.Context, rekorUrl string, payload []byte, signature []byte, certificate string) (string, error) {
+
+	hash := sha256.Sum256(payload)
+	entry := map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data": map[string]interface{}{
+				"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(hash[:])},
+			},
+			"signature": map[string]interface{}{
+				"content":   base64.StdEncoding.EncodeToString(signature),
+				"publicKey": map[string]string{"content": base64.StdEncoding.EncodeToString([]byte(certificate))},
+			},
+		},
+	}
+
+	response := map[string]RekorLogEntry{}
+	if err := postJson(ctx, strings.TrimSuffix(rekorUrl, "/")+"/api/v1/log/entries", entry, &response); err != nil {
+		return "", err
+	}
+
+	for _, x := range response {
+		bundle, err := json.Marshal(CosignBundle{
+			SignedEntryTimestamp: x.Verification.SignedEntryTimestamp,
+			Payload: CosignBundlePayload{
+				Body:           x.Body,
+				IntegratedTime: x.IntegratedTime,
+				LogIndex:       x.LogIndex,
+				LogID:          x.LogID,
+			},
+		})
+		return string(bundle), err
+	}
+
+	return "", fmt.Errorf("rekor returned no log entry")
+}
+
+func postJson(ctx context.Context, url string, body interface{}, result interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := signingClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %d", url, response.StatusCode)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,169 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/google/go-containerregistry/pkg/name"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testSigstore serves a fulcio that issues certificates for the email of any
+// token and a rekor that logs any entry, and returns their url along with the
+// root certificate and rekor key to verify with.
+func testSigstore(t *testing.T) (string, string, string) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDer, _ := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+
+	rekorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rekorPublic, _ := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/signingCert", func(w http.ResponseWriter, r *http.Request) {
+		request := FulcioCertificateRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		email, err := tokenSubject(request.Credentials.OidcIdentityToken)
+		block, _ := pem.Decode([]byte(request.PublicKeyRequest.PublicKey.Content))
+		if err != nil || block == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		public, _ := x509.ParsePKIXPublicKey(block.Bytes)
+		hash := sha256.Sum256([]byte(email))
+		if !ecdsa.VerifyASN1(public.(*ecdsa.PublicKey), hash[:], request.PublicKeyRequest.ProofOfPossession) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		leaf := &x509.Certificate{
+			SerialNumber:   big.NewInt(2),
+			NotBefore:      time.Now().Add(-time.Minute),
+			NotAfter:       time.Now().Add(10 * time.Minute),
+			EmailAddresses: []string{email},
+			KeyUsage:       x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}
+		leafDer, _ := x509.CreateCertificate(rand.Reader, leaf, root, public, rootKey)
+
+		response := FulcioCertificateResponse{SignedCertificateEmbeddedSct: &FulcioCertificateChain{}}
+		response.SignedCertificateEmbeddedSct.Chain.Certificates = []string{testPem("CERTIFICATE", leafDer), testPem("CERTIFICATE", rootDer)}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc("/api/v1/log/entries", func(w http.ResponseWriter, r *http.Request) {
+		body := json.RawMessage{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		entry := RekorLogEntry{
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: time.Now().Unix(),
+			LogIndex:       1,
+			LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+		}
+		signed, _ := json.Marshal(map[string]interface{}{
+			"body":           entry.Body,
+			"integratedTime": entry.IntegratedTime,
+			"logIndex":       entry.LogIndex,
+			"logID":          entry.LogID,
+		})
+		entry.Verification.SignedEntryTimestamp, _ = base64.StdEncoding.DecodeString(testSign(t, rekorKey, signed))
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]RekorLogEntry{"24296fb24b8ad77a": entry})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server.URL, testPem("CERTIFICATE", rootDer), testPem("PUBLIC KEY", rekorPublic)
+}
+
+func testIdentityToken(claims string) string {
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestTokenSubject(t *testing.T) {
+	if subject, _ := tokenSubject(testIdentityToken(`{"sub":"123","email":"someone@example.com"}`)); subject != "someone@example.com" {
+		t.Fatalf("expected the email to be the subject, got %s", subject)
+	}
+	if subject, _ := tokenSubject(testIdentityToken(`{"sub":"repo:org/app:ref:refs/heads/main"}`)); subject != "repo:org/app:ref:refs/heads/main" {
+		t.Fatalf("expected the sub to be the subject, got %s", subject)
+	}
+	if _, err := tokenSubject("not a token"); err == nil {
+		t.Fatal("expected a token that isn't a JWT to be rejected")
+	}
+}
+
+func TestImageSignatureKeyless(t *testing.T) {
+	testQuickAppend(t)
+	sigstore, roots, rekorPublicKey := testSigstore(t)
+
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	data := testSignImage(t, host, digest, map[string]interface{}{
+		"keyless": []interface{}{map[string]interface{}{
+			"fulcio_url":     sigstore,
+			"rekor_url":      sigstore,
+			"identity_token": testIdentityToken(`{"email":"someone@example.com"}`),
+		}},
+	})
+
+	if data.Get("certificate").(string) == "" {
+		t.Fatal("expected the certificate to be set")
+	}
+
+	reference, _ := name.ParseReference(host + "/app:1.0.0")
+	query := SignatureQuery{CertificateRoots: roots, RekorPublicKey: rekorPublicKey, Identity: "someone@example.com"}
+	_, result, err := verifyImageSignature(context.Background(), RegistryAuth{}, reference, query)
+	if err != nil || result == nil || result.Identity != "someone@example.com" {
+		t.Fatalf("expected the keyless signature to verify (%v)", err)
+	}
+
+	query.Identity = "someone-else@example.com"
+	if _, result, _ := verifyImageSignature(context.Background(), RegistryAuth{}, reference, query); result != nil {
+		t.Fatal("expected a different identity to be rejected")
+	}
+}
+
+func TestIdentityTokenFromGithub(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer request-token" || r.URL.Query().Get("audience") != "sigstore" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"value":"github-token"}`))
+	}))
+	t.Cleanup(github.Close)
+
+	t.Setenv("SIGSTORE_ID_TOKEN", "")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", github.URL+"/token?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+
+	if token, err := identityToken(context.Background(), ""); err != nil || token != "github-token" {
+		t.Fatalf("expected the github token, got %s (%v)", token, err)
+	}
+	if token, _ := identityToken(context.Background(), "configured"); token != "configured" {
+		t.Fatalf("expected the configured token to be preferred, got %s", token)
+	}
+}
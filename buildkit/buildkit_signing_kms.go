@@ -0,0 +1,201 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// kmsSigner signs with a key that never leaves the key management service
+// the uri points at, using the same uris as `cosign sign --key`.
+func kmsSigner(ctx context.Context, uri string) (crypto.Signer, error) {
+	scheme, key, _ := strings.Cut(uri, "://")
+	switch scheme {
+	case "awskms":
+		return newAwsKmsSigner(ctx, key)
+	case "hashivault":
+		return newVaultSigner(ctx, key)
+	case "gcpkms", "azurekms":
+		return nil, fmt.Errorf("%s keys are not supported, only awskms:// and hashivault:// keys are", scheme)
+	}
+	return nil, fmt.Errorf("'%s' is not a kms key uri, expected awskms:// or hashivault://", uri)
+}
+
+type awsKmsSigner struct {
+	ctx       context.Context
+	client    *kms.KMS
+	keyId     string
+	algorithm string
+	public    crypto.PublicKey
+}
+
+// newAwsKmsSigner reads the public key of the AWS KMS key, which is either
+// `/<key id, arn or alias>` or `<endpoint>/<key id, arn or alias>`.
+// Credentials and the region come from the environment, like for the AWS cli.
+func newAwsKmsSigner(ctx context.Context, key string) (crypto.Signer, error) {
+	endpoint, keyId, _ := strings.Cut(key, "/")
+
+	// the session sets up AWS_CA_BUNDLE on the transport of the client it is given
+	client := *signingClient
+	config := aws.Config{HTTPClient: &client}
+	if endpoint != "" {
+		config.Endpoint = aws.String("https://" + endpoint)
+	}
+	if parsed, err := arn.Parse(keyId); err == nil {
+		config.Region = aws.String(parsed.Region)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{Config: config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+
+	service := kms.New(sess)
+
+	output, err := service.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(keyId)})
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := x509.ParsePKIXPublicKey(output.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &awsKmsSigner{ctx: ctx, client: service, keyId: keyId, public: public}
+	switch public.(type) {
+	case *ecdsa.PublicKey:
+		signer.algorithm = kms.SigningAlgorithmSpecEcdsaSha256
+	case *rsa.PublicKey:
+		signer.algorithm = kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+	default:
+		return nil, fmt.Errorf("unsupported kms key type %T", public)
+	}
+
+	return signer, nil
+}
+
+func (s *awsKmsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *awsKmsSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	output, err := s.client.SignWithContext(s.ctx, &kms.SignInput{
+		KeyId:            aws.String(s.keyId),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.algorithm),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Signature, nil
+}
+
+type vaultSigner struct {
+	ctx    context.Context
+	url    string
+	token  string
+	public crypto.PublicKey
+}
+
+// newVaultSigner reads the public key of a key of the transit secrets engine
+// of HashiCorp Vault. The address and token come from `VAULT_ADDR` and
+// `VAULT_TOKEN`, and the engine is mounted at `TRANSIT_SECRET_ENGINE_PATH`
+// (`transit` by default), like for cosign.
+func newVaultSigner(ctx context.Context, key string) (crypto.Signer, error) {
+	address := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if address == "" {
+		return nil, fmt.Errorf("VAULT_ADDR must be set to sign with a hashivault:// key")
+	}
+
+	mount := os.Getenv("TRANSIT_SECRET_ENGINE_PATH")
+	if mount == "" {
+		mount = "transit"
+	}
+
+	signer := &vaultSigner{ctx: ctx, url: fmt.Sprintf("%s/v1/%s", address, mount), token: os.Getenv("VAULT_TOKEN")}
+
+	response := VaultResponse{}
+	if err := signer.request(http.MethodGet, "/keys/"+key, nil, &response); err != nil {
+		return nil, err
+	}
+
+	latest, ok := response.Data.Keys[fmt.Sprint(response.Data.LatestVersion)]
+	if !ok {
+		return nil, fmt.Errorf("vault has no version %d of the key %s", response.Data.LatestVersion, key)
+	}
+
+	public, err := parsePublicKey(latest.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("only ecdsa and rsa vault keys are supported: %w", err)
+	}
+
+	signer.url += "/sign/" + key + "/sha2-256"
+	signer.public = public
+
+	return signer, nil
+}
+
+func (s *vaultSigner) request(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequestWithContext(s.ctx, method, s.url+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Vault-Token", s.token)
+
+	response, err := signingClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault responded to %s %s with status %d", method, path, response.StatusCode)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *vaultSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	body := map[string]interface{}{"input": base64.StdEncoding.EncodeToString(digest), "prehashed": true}
+	if _, ok := s.public.(*rsa.PublicKey); ok {
+		body["signature_algorithm"] = "pkcs1v15"
+	}
+
+	response := VaultResponse{}
+	if err := s.request(http.MethodPost, "", body, &response); err != nil {
+		return nil, err
+	}
+
+	// signatures are prefixed with the version of the key, e.g. vault:v1:
+	parts := strings.Split(response.Data.Signature, ":")
+	return base64.StdEncoding.DecodeString(parts[len(parts)-1])
+}
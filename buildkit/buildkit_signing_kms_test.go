@@ -0,0 +1,124 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/name"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testVerifyWithKey(t *testing.T, host string, publicKey string) {
+	reference, _ := name.ParseReference(host + "/app:1.0.0")
+	_, result, err := verifyImageSignature(context.Background(), RegistryAuth{}, reference, SignatureQuery{
+		PublicKey: publicKey,
+	})
+	if err != nil || result == nil {
+		t.Fatalf("expected the signature to verify (%v)", err)
+	}
+}
+
+func TestImageSignatureWithVault(t *testing.T) {
+	testQuickAppend(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/keys/cosign":
+			response := VaultResponse{}
+			response.Data.LatestVersion = 1
+			response.Data.Keys = map[string]struct {
+				PublicKey string `json:"public_key"`
+			}{"1": {PublicKey: testPem("PUBLIC KEY", public)}}
+			json.NewEncoder(w).Encode(response)
+		case "/v1/transit/sign/cosign/sha2-256":
+			body := struct {
+				Input     string `json:"input"`
+				Prehashed bool   `json:"prehashed"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			digest, _ := base64.StdEncoding.DecodeString(body.Input)
+			signature, _ := ecdsa.SignASN1(rand.Reader, key, digest)
+			w.Write([]byte(`{"data":{"signature":"vault:v1:` + base64.StdEncoding.EncodeToString(signature) + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(vault.Close)
+
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	data := testSignImage(t, host, digest, map[string]interface{}{"kms_key": "hashivault://cosign"})
+
+	testVerifyWithKey(t, host, data.Get("public_key").(string))
+}
+
+func TestImageSignatureWithAwsKms(t *testing.T) {
+	testQuickAppend(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	kms := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["KeyId"] != "alias/cosign" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": body["KeyId"], "PublicKey": public})
+		case "TrentService.Sign":
+			digest, _ := base64.StdEncoding.DecodeString(body["Message"])
+			if body["MessageType"] != "DIGEST" || len(digest) != 32 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			signature, _ := ecdsa.SignASN1(rand.Reader, key, digest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": body["KeyId"], "Signature": signature})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(kms.Close)
+
+	client := signingClient
+	signingClient = kms.Client()
+	t.Cleanup(func() { signingClient = client })
+
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	data := testSignImage(t, host, digest, map[string]interface{}{
+		"kms_key": "awskms://" + strings.TrimPrefix(kms.URL, "https://") + "/alias/cosign",
+	})
+
+	testVerifyWithKey(t, host, data.Get("public_key").(string))
+}
+
+func TestKmsSignerUnsupported(t *testing.T) {
+	for _, uri := range []string{"gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k", "azurekms://vault.vault.azure.net/key", "cosign.key"} {
+		if _, err := kmsSigner(context.Background(), uri); err == nil {
+			t.Fatalf("expected %s to be rejected", uri)
+		}
+	}
+}
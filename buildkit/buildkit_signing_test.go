@@ -0,0 +1,169 @@
+package buildkit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"testing"
+	"time"
+)
+
+// testEncryptedKey encrypts a private key the way `cosign generate-key-pair` does.
+func testEncryptedKey(t *testing.T, key *ecdsa.PrivateKey, password string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope := CosignEncryptedKey{}
+	envelope.Kdf.Name = "scrypt"
+	envelope.Kdf.Params.N = 1024
+	envelope.Kdf.Params.R = 8
+	envelope.Kdf.Params.P = 1
+	envelope.Kdf.Salt = make([]byte, 32)
+	envelope.Cipher.Name = "nacl/secretbox"
+	envelope.Cipher.Nonce = make([]byte, 24)
+	rand.Read(envelope.Kdf.Salt)
+	rand.Read(envelope.Cipher.Nonce)
+
+	derived, err := scrypt.Key([]byte(password), envelope.Kdf.Salt, 1024, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], derived)
+	copy(nonce[:], envelope.Cipher.Nonce)
+	envelope.Ciphertext = secretbox.Seal(nil, der, &nonce, &secret)
+
+	bites, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testPem("ENCRYPTED COSIGN PRIVATE KEY", bites)
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encrypted := testEncryptedKey(t, key, "hunter2")
+
+	signer, err := parsePrivateKey(encrypted, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Fatal("expected the decrypted key to match")
+	}
+
+	if _, err := parsePrivateKey(encrypted, "wrong"); err == nil {
+		t.Fatal("expected a wrong password to fail")
+	}
+}
+
+func TestImageSignature(t *testing.T) {
+	testQuickAppend(t)
+	host := testRegistry(t)
+	digest := testPushImage(t, host+"/app:1.0.0")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageSignatureResource().Schema, map[string]interface{}{
+		"registry_url":         host,
+		"repository_name":      "app",
+		"digest":               digest,
+		"private_key":          testEncryptedKey(t, key, "hunter2"),
+		"private_key_password": "hunter2",
+		"annotations":          map[string]interface{}{"commit": "abc"},
+	})
+
+	if diags := createImageSignature(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	reference, _ := name.ParseReference(host + "/app:1.0.0")
+	_, result, err := verifyImageSignature(context.Background(), RegistryAuth{}, reference, SignatureQuery{
+		PublicKey: data.Get("public_key").(string),
+	})
+	if err != nil || result == nil {
+		t.Fatalf("expected the signature to verify (%v)", err)
+	}
+
+	if diags := readImageSignature(context.Background(), data, meta); len(diags) > 0 || data.Id() == "" {
+		t.Fatalf("expected the signature to still exist: %v", diags)
+	}
+
+	data.Set("signature_digest", "sha256:missing")
+
+	if diags := readImageSignature(context.Background(), data, meta); len(diags) > 0 || data.Id() != "" {
+		t.Fatalf("expected a missing signature to be detected: %v", diags)
+	}
+}
+
+// testQuickAppend shortens how long appendLayer waits for concurrent writers.
+func testQuickAppend(t *testing.T) {
+	settle := appendLayerSettle
+	appendLayerSettle = 50 * time.Millisecond
+	t.Cleanup(func() { appendLayerSettle = settle })
+}
+
+// testSignImage creates a signature of the image with the key settings and
+// returns the resource data.
+func testSignImage(t *testing.T, host string, digest string, settings map[string]interface{}) *schema.ResourceData {
+	raw := map[string]interface{}{
+		"registry_url":    host,
+		"repository_name": "app",
+		"digest":          digest,
+	}
+	for k, v := range settings {
+		raw[k] = v
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageSignatureResource().Schema, raw)
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	if diags := createImageSignature(context.Background(), data, meta); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	return data
+}
+
+func TestAppendLayerConcurrently(t *testing.T) {
+	testQuickAppend(t)
+	host := testRegistry(t)
+	tag, _ := name.NewTag(host + "/app:sha256-abc.sig")
+
+	layers := make([]v1.Layer, 4)
+	errs := make(chan error, len(layers))
+	for i := range layers {
+		layers[i] = static.NewLayer([]byte(fmt.Sprintf("signature %d", i)), cosignPayloadMediaType)
+		go func(layer v1.Layer) {
+			errs <- appendLayer(context.Background(), RegistryAuth{}, tag, layer, map[string]string{})
+		}(layers[i])
+	}
+
+	for range layers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, layer := range layers {
+		layerDigest, _ := layer.Digest()
+		if exists, err := hasLayer(context.Background(), RegistryAuth{}, tag, layerDigest.String()); err != nil || !exists {
+			t.Fatalf("expected signature %d to be kept (%v)", i, err)
+		}
+	}
+}
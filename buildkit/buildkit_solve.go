@@ -0,0 +1,209 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+	"strings"
+	"time"
+)
+
+// solveImage builds the image and publishes it to the publish targets. The
+// steps of the build and how long it took are added to the report.
+func solveImage(ctx context.Context, data *schema.ResourceData, provider TerraformProviderBuildkit, buildContext string, dockerfile string, frontendAttrs map[string]string, outputs []client.ExportEntry, sessionProviders []session.Attachable, report *BuildReport) diag.Diagnostics {
+
+	sharedKey, err := provider.sharedKey(data.Get("shared_key").(string))
+
+	if err != nil {
+		return diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  err.Error(),
+			},
+		}
+	}
+
+	routes, err := routePlatforms(ctx, provider.builderNodes(), getPlatforms(data))
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "route the platforms of the image", err)}
+	}
+
+	emulated, err := emulatedPlatforms(ctx, routes)
+
+	if err != nil {
+		return diag.Diagnostics{buildkitFailure(provider, "list the platforms of the builder", err)}
+	}
+
+	warnings := emulationDiagnostics(emulated, data.Get("require_native").(bool))
+
+	if warnings.HasError() {
+		return warnings
+	}
+
+	if len(routes) > 1 && len(data.Get("publish_target").([]interface{})) == 0 {
+		return diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "An image that is built only can't be built on several nodes.",
+			Detail:   "The platforms of the image are built on different nodes, which are merged into one image by pushing them to the publish targets. Add a publish_target or build platforms that a single node supports.",
+		}}
+	}
+
+	lock, diags := getPublishLock(data)
+
+	if len(diags) > 0 {
+		return append(warnings, diags...)
+	}
+
+	// the tags are pushed while solving, so they are locked for the whole build
+	unlock, diags := lockTargets(ctx, lock, provider, data.Get("publish_target").([]interface{}))
+
+	if len(diags) > 0 {
+		return append(warnings, diags...)
+	}
+
+	defer unlock()
+
+	cacheImports, cacheExports := getImageCaches(data, provider)
+
+	solveOpt := client.SolveOpt{
+		CacheExports:   cacheExports,
+		CacheImports:   cacheImports,
+		Exports:        outputs,
+		Frontend:       "dockerfile.v0",
+		FrontendAttrs:  frontendAttrs,
+		FrontendInputs: getContextInputs(buildContext),
+		LocalDirs:      getLocalDirs(buildContext, dockerfile),
+		Session:        sessionProviders,
+		SharedKey:      sharedKey,
+	}
+
+	var resp *client.SolveResponse
+
+	tracer := provider.tracer()
+	solveCtx, span := startSpan(ctx, tracer, "solve")
+	statuses := make(chan *client.SolveStatus)
+	done := make(chan struct{})
+
+	solveTracer := newSolveTracer(solveCtx, tracer)
+	solveReporter := newSolveReporter()
+	logger := newProgressLogger(os.Stderr).With("image", data.Id(), "trace_id", traceID(span))
+	solveLogger := newSolveLogger(logger)
+
+	// the steps of a build can print the secrets it was given, which would end
+	// up in the spans, the logs and the build report
+	redactor := resourceRedactor(buildkitImageResource().Schema, data.Get, provider)
+
+	go func() {
+		for status := range statuses {
+			status = redactor.redactStatus(status)
+			solveTracer.observe(status)
+			solveReporter.observe(status)
+			solveLogger.observe(status)
+		}
+		solveTracer.finish()
+		close(done)
+	}()
+
+	report.Started = time.Now()
+
+	squash_from := data.Get("squash_from").(string)
+	squash := data.Get("squash").(bool) || squash_from != ""
+
+	// solveOn builds the platforms routed to a node, whose statuses are
+	// merged into those of the whole build
+	solveOn := func(ctx context.Context, route nodeRoute, outputs []client.ExportEntry) (*client.SolveResponse, error) {
+		opt := solveOpt
+		opt.Exports = outputs
+		attrs := frontendAttrs
+		if len(route.platforms) > 0 {
+			attrs = merge(frontendAttrs, map[string]string{
+				"platform": strings.Join(route.platforms, ","),
+			})
+		}
+
+		nodeStatuses := make(chan *client.SolveStatus)
+		forwarded := make(chan struct{})
+
+		go func() {
+			for status := range nodeStatuses {
+				statuses <- status
+			}
+			close(forwarded)
+		}()
+
+		var resp *client.SolveResponse
+		var err error
+
+		if squash {
+			// the dockerfile frontend can't squash so it is run from a build that collapses its result
+			opt.Frontend, opt.FrontendAttrs = "", nil
+			resp, err = route.node.client.Build(ctx, opt, "terraform-provider-buildkit", squashImage(attrs, solveOpt.FrontendInputs, squash_from), nodeStatuses)
+		} else {
+			opt.FrontendAttrs = attrs
+			resp, err = route.node.client.Solve(ctx, nil, opt, nodeStatuses)
+		}
+
+		// the client closes the statuses once the solve is done
+		<-forwarded
+
+		return resp, err
+	}
+
+	resp, report.Retries, err = retrySolve(solveCtx, data.Get("build_retries").(int), logger, redactor, func(ctx context.Context) (*client.SolveResponse, error) {
+		if len(routes) == 1 {
+			return solveOn(ctx, routes[0], outputs)
+		}
+		return solveOnNodes(ctx, data, provider, routes, outputs, solveOn)
+	})
+
+	close(statuses)
+	<-done
+
+	report.Completed = time.Now()
+	report.DurationMs = report.Completed.Sub(report.Started).Milliseconds()
+	solveReporter.fill(report)
+
+	if err == nil {
+		span.SetAttributes(attribute.String("buildkit.image_digest", resp.ExporterResponse["containerimage.digest"]))
+	}
+	span.end(redactor.redactError(err))
+
+	if err != nil {
+		return append(warnings, buildkitFailure(provider, "build the image", err))
+	} else {
+		_ = data.Set("image_digest", resp.ExporterResponse["containerimage.digest"])
+		_ = data.Set("trace_id", traceID(span))
+		_ = data.Set("exporter_metadata", resp.ExporterResponse)
+		_ = data.Set("platform_nodes", routedPlatforms(routes))
+		report.ExporterResponse = resp.ExporterResponse
+
+		new_targets, diags := publishTargets(ctx, data, provider, resp.ExporterResponse["containerimage.digest"])
+
+		if len(diags) > 0 {
+			return append(warnings, diags...)
+		}
+
+		if data.Get("verify_consistency").(bool) {
+			if diags := verifyConsistency(ctx, provider, new_targets); len(diags) > 0 {
+				return append(warnings, diags...)
+			}
+		}
+
+		if data.Get("verify_pull").(bool) {
+			if diags := verifyPull(ctx, provider, new_targets); len(diags) > 0 {
+				return append(warnings, diags...)
+			}
+		}
+
+		data.Set("publish_target", new_targets)
+	}
+
+	setImageRefs(data)
+
+	return warnings
+}
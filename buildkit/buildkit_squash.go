@@ -0,0 +1,215 @@
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// marshalFrontendInputs are the inputs of the dockerfile frontend as they are
+// passed to a frontend from within a build.
+func marshalFrontendInputs(ctx context.Context, frontendInputs map[string]llb.State) (map[string]*pb.Definition, error) {
+	inputs := map[string]*pb.Definition{}
+	for k, x := range frontendInputs {
+		definition, err := x.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		inputs[k] = definition.ToPB()
+	}
+	return inputs, nil
+}
+
+// squashImage returns a build that runs the dockerfile frontend and collapses
+// the layers of the resulting image into one. When a stage is given, the layers
+// of that stage are kept as they are and only the layers added on top of it
+// are collapsed.
+func squashImage(frontendAttrs map[string]string, frontendInputs map[string]llb.State, stage string) gateway.BuildFunc {
+	return func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+
+		inputs, err := marshalFrontendInputs(ctx, frontendInputs)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.Solve(ctx, gateway.SolveRequest{
+			Frontend:       "dockerfile.v0",
+			FrontendOpt:    frontendAttrs,
+			FrontendInputs: inputs,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		base := gateway.NewResult()
+
+		if stage != "" {
+			base, err = c.Solve(ctx, gateway.SolveRequest{
+				Frontend:       "dockerfile.v0",
+				FrontendOpt:    merge(frontendAttrs, map[string]string{"target": stage}),
+				FrontendInputs: inputs,
+			})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result := gateway.NewResult()
+		for k, v := range res.Metadata {
+			result.AddMeta(k, v)
+		}
+
+		if res.Refs == nil {
+			ref, config, err := squashRef(ctx, c, res.Ref, res.Metadata[exptypes.ExporterImageConfigKey], base.Ref, base.Metadata[exptypes.ExporterImageConfigKey])
+			if err != nil {
+				return nil, err
+			}
+			result.SetRef(ref)
+			result.AddMeta(exptypes.ExporterImageConfigKey, config)
+			return result, nil
+		}
+
+		for platform, x := range res.Refs {
+			key := exptypes.ExporterImageConfigKey + "/" + platform
+			ref, config, err := squashRef(ctx, c, x, res.Metadata[key], base.Refs[platform], base.Metadata[key])
+			if err != nil {
+				return nil, err
+			}
+			result.AddRef(platform, ref)
+			result.AddMeta(key, config)
+		}
+
+		return result, nil
+	}
+}
+
+// squashRef copies the filesystem of the reference onto scratch, which
+// buildkit exports as a single layer. With a base, only the difference to the
+// base becomes the new layer and is placed on top of the layers of the base.
+func squashRef(ctx context.Context, c gateway.Client, ref gateway.Reference, config []byte, base gateway.Reference, baseConfig []byte) (gateway.Reference, []byte, error) {
+
+	// an image built FROM scratch without any files has nothing to squash
+	if ref == nil {
+		return ref, config, nil
+	}
+
+	state, err := ref.ToState()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	squashed := llb.Scratch().File(llb.Copy(state, "/", "/", &llb.CopyInfo{
+		CopyDirContentsOnly: true,
+	}), llb.WithCustomName("squash layers"))
+
+	keep := 0
+
+	if base != nil {
+		baseState, err := base.ToState()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		squashed = llb.Merge([]llb.State{baseState, llb.Diff(baseState, squashed)})
+
+		if keep, err = countLayers(baseConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	definition, err := squashed.Marshal(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := c.Solve(ctx, gateway.SolveRequest{
+		Definition: definition.ToPB(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := res.SingleRef()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err = squashHistory(config, keep)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, config, nil
+}
+
+// countLayers returns the number of layers the history of the image config
+// accounts for.
+func countLayers(config []byte) (int, error) {
+	var parsed struct {
+		History []struct {
+			EmptyLayer bool `json:"empty_layer"`
+		} `json:"history"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, x := range parsed.History {
+		if !x.EmptyLayer {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// squashHistory rewrites the history of the image config so that it matches
+// the squashed layers: the first keep layers are left alone, the entries of
+// every layer after them are marked as empty and a single entry is added for
+// the squashed layer. Everything else in the config is preserved as-is.
+func squashHistory(config []byte, keep int) ([]byte, error) {
+
+	parsed := map[string]json.RawMessage{}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil, err
+	}
+
+	history := make([]map[string]interface{}, 0)
+	if raw, ok := parsed["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, err
+		}
+	}
+
+	layers := 0
+	for _, x := range history {
+		if empty, _ := x["empty_layer"].(bool); empty {
+			continue
+		}
+		if layers >= keep {
+			x["empty_layer"] = true
+		}
+		layers++
+	}
+
+	// the exporter fills in the creation time of the layer
+	history = append(history, map[string]interface{}{
+		"created_by": "terraform-provider-buildkit: squash",
+		"comment":    "buildkit.exporter.image.v0",
+	})
+
+	raw, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed["history"] = raw
+
+	return json.Marshal(parsed)
+}
@@ -0,0 +1,78 @@
+package buildkit
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testSquashConfig = `{
+	"architecture": "amd64",
+	"os": "linux",
+	"config": {"Env": ["PATH=/usr/bin"]},
+	"rootfs": {"type": "layers", "diff_ids": ["sha256:a", "sha256:b", "sha256:c"]},
+	"history": [
+		{"created_by": "ADD rootfs.tar /"},
+		{"created_by": "ENV PATH=/usr/bin", "empty_layer": true},
+		{"created_by": "RUN apk add curl"},
+		{"created_by": "COPY . /app"}
+	]
+}`
+
+func TestCountLayers(t *testing.T) {
+	count, err := countLayers([]byte(testSquashConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 layers but got %d", count)
+	}
+}
+
+func TestSquashHistory(t *testing.T) {
+	tests := []struct {
+		keep     int
+		expected []bool
+	}{
+		{keep: 0, expected: []bool{true, true, true, true, false}},
+		{keep: 1, expected: []bool{false, true, true, true, false}},
+		{keep: 2, expected: []bool{false, true, false, true, false}},
+	}
+
+	for _, test := range tests {
+		squashed, err := squashHistory([]byte(testSquashConfig), test.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var parsed struct {
+			OS      string `json:"os"`
+			History []struct {
+				CreatedBy  string `json:"created_by"`
+				EmptyLayer bool   `json:"empty_layer"`
+			} `json:"history"`
+		}
+
+		if err := json.Unmarshal(squashed, &parsed); err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.OS != "linux" {
+			t.Fatalf("expected the rest of the config to be preserved but got %s", squashed)
+		}
+
+		if len(parsed.History) != len(test.expected) {
+			t.Fatalf("expected %d history entries but got %d", len(test.expected), len(parsed.History))
+		}
+
+		for i, x := range parsed.History {
+			if x.EmptyLayer != test.expected[i] {
+				t.Fatalf("keep %d: expected entry %d (%s) to have empty_layer %v", test.keep, i, x.CreatedBy, test.expected[i])
+			}
+		}
+
+		count, err := countLayers(squashed)
+		if err != nil || count != test.keep+1 {
+			t.Fatalf("keep %d: expected %d layers but got %d (%v)", test.keep, test.keep+1, count, err)
+		}
+	}
+}
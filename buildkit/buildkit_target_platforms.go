@@ -0,0 +1,142 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sort"
+)
+
+// getTargetPlatforms are the platforms a publish target is limited to, or
+// none when it publishes every platform of the image.
+func getTargetPlatforms(target map[string]interface{}) []string {
+	platforms, _ := target["platforms"].([]interface{})
+	result := make([]string, 0, len(platforms))
+	for _, x := range platforms {
+		result = append(result, x.(string))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// getFullTarget is the index of the first publish target that publishes
+// every platform of the image, or -1 when there is none.
+func getFullTarget(publish_targets []interface{}) int {
+	for i, x := range publish_targets {
+		if len(getTargetPlatforms(x.(map[string]interface{}))) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateTargetPlatforms makes sure that the targets limited to some of the
+// platforms have a target with every platform to be copied from, since only
+// the image with every platform is pushed by buildkit.
+func validateTargetPlatforms(publish_targets []interface{}) error {
+	if len(publish_targets) > 0 && getFullTarget(publish_targets) < 0 {
+		return fmt.Errorf("at least one publish_target has to publish every platform, the publish targets limited to some of them are copied from it")
+	}
+	return nil
+}
+
+// copyPlatforms copies the image at the source to the destination, keeping
+// only the images of the given platforms of an index along with their
+// attestations. A single platform is copied as an image rather than an index,
+// for registries that don't accept indexes. Returns the digest of what was
+// copied.
+func copyPlatforms(ctx context.Context, source string, sourceAuth RegistryAuth, destination string, destinationAuth RegistryAuth, platforms []string) (string, error) {
+	if len(platforms) == 0 {
+		return copyImage(ctx, source, sourceAuth, destination, destinationAuth)
+	}
+
+	sourceReference, err := name.ParseReference(source)
+	if err != nil {
+		return "", err
+	}
+
+	destinationReference, err := name.ParseReference(destination)
+	if err != nil {
+		return "", err
+	}
+
+	descriptor, err := remote.Get(sourceReference, makeOptions(craneOptions(ctx, sourceAuth)...).Remote...)
+	if err != nil {
+		return "", err
+	}
+
+	// an image of a single platform is copied as it is
+	if !isV2IndexManifest(descriptor.MediaType) {
+		return copyImage(ctx, source, sourceAuth, destination, destinationAuth)
+	}
+
+	index, err := descriptor.ImageIndex()
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := v1.ParseIndexManifest(bytes.NewReader(descriptor.Manifest))
+	if err != nil {
+		return "", err
+	}
+
+	selected := []v1.Descriptor{}
+	for _, x := range manifest.Manifests {
+		if !isAttestationManifest(x) && isSupportedPlatform(platforms, x.Platform) {
+			selected = append(selected, x)
+		}
+	}
+
+	if len(selected) == 0 {
+		return "", fmt.Errorf("'%s' has none of the platforms %v", source, platforms)
+	}
+
+	destinationOptions := makeOptions(craneOptions(ctx, destinationAuth)...).Remote
+
+	if len(selected) == 1 {
+		image, err := index.Image(selected[0].Digest)
+		if err != nil {
+			return "", err
+		}
+		if err := remote.Write(destinationReference, image, destinationOptions...); err != nil {
+			return "", err
+		}
+		destinationAuth.digests.remember(destination, selected[0].Digest.String())
+		return selected[0].Digest.String(), nil
+	}
+
+	attestations := findAttestations(manifest)
+	filtered := mutate.IndexMediaType(empty.Index, descriptor.MediaType)
+
+	for _, x := range selected {
+		descriptors := []v1.Descriptor{x}
+		if attestation, ok := attestations[x.Digest.String()]; ok {
+			descriptors = append(descriptors, attestation)
+		}
+		for _, descriptor := range descriptors {
+			image, err := index.Image(descriptor.Digest)
+			if err != nil {
+				return "", err
+			}
+			filtered = mutate.AppendManifests(filtered, mutate.IndexAddendum{Add: image, Descriptor: descriptor})
+		}
+	}
+
+	if err := remote.WriteIndex(destinationReference, filtered, destinationOptions...); err != nil {
+		return "", err
+	}
+
+	digest, err := filtered.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	destinationAuth.digests.remember(destination, digest.String())
+
+	return digest.String(), nil
+}
@@ -0,0 +1,83 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"reflect"
+	"testing"
+)
+
+func TestGetCopiedTargetsWithPlatforms(t *testing.T) {
+	targets := []interface{}{
+		map[string]interface{}{"registry_url": "legacy.example.com", "name": "app", "tag": "1.0.0", "platforms": []interface{}{"linux/amd64"}},
+		map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app", "tag": "1.0.0"},
+		map[string]interface{}{"registry_url": "ghcr.io", "name": "org/app-amd64", "tag": "1.0.0", "platforms": []interface{}{"linux/amd64"}},
+	}
+
+	data := schema.TestResourceDataRaw(t, buildkitImageResource().Schema, testImageConfig(map[string]interface{}{"publish_target": targets}))
+
+	if copied := getCopiedTargets(data); !reflect.DeepEqual(copied, map[int]int{0: 1, 2: 1}) {
+		t.Fatalf("expected the targets limited to some platforms to be copied: %v", copied)
+	}
+
+	if names := getCompiledOutputs(data)[0].Attrs["name"]; names != "ghcr.io/org/app:1.0.0" {
+		t.Fatalf("expected only the target with every platform to be pushed by buildkit: %s", names)
+	}
+
+	if err := validateTargetPlatforms(targets); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateTargetPlatforms(targets[:1]); err == nil {
+		t.Fatal("expected a target with every platform to be required")
+	}
+}
+
+func TestCopyPlatforms(t *testing.T) {
+	host := testRegistry(t)
+	index := testPushIndex(t, host+"/app:1.0.0", v1.Platform{OS: "linux", Architecture: "amd64"}, v1.Platform{OS: "linux", Architecture: "arm64"})
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}.registryAuth(host)
+
+	digest, err := copyPlatforms(context.Background(), host+"/app:1.0.0", auth, host+"/legacy:1.0.0", auth, []string{"linux/amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != manifest.Manifests[0].Digest.String() {
+		t.Fatalf("expected the image of the platform to be copied as it is: %s", digest)
+	}
+
+	reference, err := name.ParseReference(host + "/legacy:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := remote.Get(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isV2IndexManifest(descriptor.MediaType) || descriptor.Digest.String() != digest {
+		t.Fatalf("expected an image rather than an index: %s %s", descriptor.MediaType, descriptor.Digest)
+	}
+
+	digest, err = copyPlatforms(context.Background(), host+"/app:1.0.0", auth, host+"/both:1.0.0", auth, []string{"linux/arm64", "linux/amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := getPlatformDigests(context.Background(), host+"/both:1.0.0", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 || digests["linux/amd64"] != manifest.Manifests[0].Digest.String() || digests["linux/arm64"] != manifest.Manifests[1].Digest.String() {
+		t.Fatalf("expected an index of both platforms: %v", digests)
+	}
+
+	if _, err := copyPlatforms(context.Background(), host+"/app:1.0.0", auth, host+"/none:1.0.0", auth, []string{"linux/s390x"}); err == nil {
+		t.Fatal("expected copying a platform the image doesn't have to fail")
+	}
+}
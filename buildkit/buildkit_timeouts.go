@@ -0,0 +1,86 @@
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"time"
+)
+
+// how long a data source may take to read unless its timeouts block says
+// otherwise, which is the default the sdk gives every operation
+const dataSourceReadTimeout = 20 * time.Minute
+
+// timeoutDataSources gives every data source a timeouts block with a read
+// timeout. The sdk doesn't hand the timeouts of a data source to its read, so
+// the timeout is taken from the configuration and enforced through the
+// context instead.
+func timeoutDataSources(dataSources map[string]*schema.Resource) {
+	for dataSourceName, definition := range dataSources {
+		definition.Timeouts = &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(dataSourceReadTimeout),
+		}
+		definition.ReadWithoutTimeout = withReadTimeout(dataSourceName, definition.ReadContext)
+		definition.ReadContext = nil
+	}
+}
+
+func withReadTimeout(name string, read schema.ReadContextFunc) schema.ReadContextFunc {
+	return func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		timeout, err := readTimeout(data.GetRawConfig())
+
+		if err != nil {
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "The read timeout must be a duration such as \"2m\".",
+				Detail:   err.Error(),
+			}}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		diags := read(ctx, data, meta)
+
+		if diags.HasError() && ctx.Err() == context.DeadlineExceeded {
+			detail := "Increase the read timeout in the timeouts block of the data source if the registry or daemon is expected to take this long."
+			for _, x := range diags {
+				if x.Severity == diag.Error {
+					detail = x.Summary + "\n\n" + detail
+					break
+				}
+			}
+			return diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Timed out reading %s after %s.", name, timeout),
+				Detail:   detail,
+			}}
+		}
+
+		return diags
+	}
+}
+
+// readTimeout is the read timeout of the timeouts block of the configuration,
+// if it has one.
+func readTimeout(config cty.Value) (time.Duration, error) {
+	if config.IsNull() || !config.IsKnown() || !config.Type().IsObjectType() || !config.Type().HasAttribute(schema.TimeoutsConfigKey) {
+		return dataSourceReadTimeout, nil
+	}
+
+	timeouts := config.GetAttr(schema.TimeoutsConfigKey)
+
+	if timeouts.IsNull() || !timeouts.IsKnown() || !timeouts.Type().HasAttribute(schema.TimeoutRead) {
+		return dataSourceReadTimeout, nil
+	}
+
+	read := timeouts.GetAttr(schema.TimeoutRead)
+
+	if read.IsNull() || !read.IsKnown() {
+		return dataSourceReadTimeout, nil
+	}
+
+	return time.ParseDuration(read.AsString())
+}
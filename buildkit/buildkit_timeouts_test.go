@@ -0,0 +1,71 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	for _, x := range []struct {
+		config   cty.Value
+		expected time.Duration
+	}{
+		{cty.NullVal(cty.EmptyObject), dataSourceReadTimeout},
+		{cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("app")}), dataSourceReadTimeout},
+		{cty.ObjectVal(map[string]cty.Value{"timeouts": cty.NullVal(cty.Object(map[string]cty.Type{"read": cty.String}))}), dataSourceReadTimeout},
+		{cty.ObjectVal(map[string]cty.Value{"timeouts": cty.ObjectVal(map[string]cty.Value{"read": cty.StringVal("2m")})}), 2 * time.Minute},
+	} {
+		timeout, err := readTimeout(x.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timeout != x.expected {
+			t.Fatalf("expected %s but got %s for %#v", x.expected, timeout, x.config)
+		}
+	}
+
+	if _, err := readTimeout(cty.ObjectVal(map[string]cty.Value{"timeouts": cty.ObjectVal(map[string]cty.Value{"read": cty.StringVal("soon")})})); err == nil {
+		t.Fatal("expected a read timeout that isn't a duration to fail")
+	}
+}
+
+func TestTimeoutDataSources(t *testing.T) {
+	dataSources := map[string]*schema.Resource{
+		"buildkit_hanging": {
+			Schema: map[string]*schema.Schema{
+				"name": {Type: schema.TypeString, Optional: true},
+			},
+			ReadContext: func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+				<-ctx.Done()
+				return diag.FromErr(ctx.Err())
+			},
+		},
+	}
+
+	timeoutDataSources(dataSources)
+	definition := dataSources["buildkit_hanging"]
+
+	if _, ok := definition.CoreConfigSchema().BlockTypes["timeouts"]; !ok {
+		t.Fatal("expected the data source to have a timeouts block")
+	}
+
+	diff, err := definition.Diff(context.Background(), nil, terraform.NewResourceConfigRaw(map[string]interface{}{"name": "app"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff.RawConfig = cty.ObjectVal(map[string]cty.Value{
+		"name":     cty.StringVal("app"),
+		"timeouts": cty.ObjectVal(map[string]cty.Value{"read": cty.StringVal("10ms")}),
+	})
+
+	_, diags := definition.ReadDataApply(context.Background(), diff, nil)
+	if len(diags) != 1 || !strings.Contains(diags[0].Summary, "Timed out reading buildkit_hanging after 10ms") {
+		t.Fatalf("expected the read to time out: %v", diags)
+	}
+}
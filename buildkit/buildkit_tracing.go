@@ -0,0 +1,204 @@
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// the name spans are reported under, both as the service and the tracer
+const tracerName = "terraform-provider-buildkit"
+
+// newTracerProvider exports spans to an OpenTelemetry collector over OTLP/gRPC,
+// or nowhere without an endpoint. Builds are traced either way so that each
+// of them has a trace id the buildkit daemon knows it by. Connecting doesn't
+// block, spans that can't be delivered are dropped.
+func newTracerProvider(ctx context.Context, endpoint string, insecure bool, headers map[string]string) (*sdktrace.TracerProvider, error) {
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(tracerName))),
+	}
+
+	if endpoint != "" {
+		exporterOptions := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithHeaders(headers)}
+		if insecure {
+			exporterOptions = append(exporterOptions, otlptracegrpc.WithInsecure())
+		}
+
+		exporter, err := otlptracegrpc.New(ctx, exporterOptions...)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(options...), nil
+}
+
+// tracer creates the spans of the provider. Nothing is recorded before the
+// provider is configured.
+func (provider TerraformProviderBuildkit) tracer() trace.Tracer {
+	if provider.tracer_provider == nil {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	return provider.tracer_provider.Tracer(tracerName)
+}
+
+// traceResources wraps every operation of the resources in a span. Terraform
+// stops the provider without shutting it down, so the spans are flushed once
+// each operation is done instead of in the background.
+func traceResources(resources map[string]*schema.Resource) {
+	for resourceName, definition := range resources {
+		definition.CreateContext = traced(resourceName+".create", definition.CreateContext)
+		definition.ReadContext = traced(resourceName+".read", definition.ReadContext)
+		definition.UpdateContext = traced(resourceName+".update", definition.UpdateContext)
+		definition.DeleteContext = traced(resourceName+".delete", definition.DeleteContext)
+	}
+}
+
+func traced(name string, operation func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics) func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics {
+	if operation == nil {
+		return nil
+	}
+	return func(ctx context.Context, data *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		provider, ok := meta.(TerraformProviderBuildkit)
+		if !ok || provider.tracer_provider == nil {
+			return operation(ctx, data, meta)
+		}
+
+		ctx, span := startSpan(ctx, provider.tracer(), name)
+		diags := operation(ctx, data, meta)
+		span.SetAttributes(attribute.String("terraform.id", data.Id()))
+		span.endDiagnostics(diags)
+
+		_ = provider.tracer_provider.ForceFlush(ctx)
+		return diags
+	}
+}
+
+// traceID identifies the trace of the span, if it has one.
+func traceID(span trace.Span) string {
+	if !span.SpanContext().HasTraceID() {
+		return ""
+	}
+	return span.SpanContext().TraceID().String()
+}
+
+// timedSpan also records its duration as an attribute, which backends can
+// filter and aggregate on unlike the duration of the span itself.
+type timedSpan struct {
+	trace.Span
+	started time.Time
+}
+
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, attributes ...attribute.KeyValue) (context.Context, timedSpan) {
+	started := time.Now()
+	ctx, span := tracer.Start(ctx, name, trace.WithTimestamp(started), trace.WithAttributes(attributes...))
+	return ctx, timedSpan{Span: span, started: started}
+}
+
+// end marks the span as failed when there is an error.
+func (span timedSpan) end(err error) {
+	completed := time.Now()
+	span.SetAttributes(attribute.Int64("duration_ms", completed.Sub(span.started).Milliseconds()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(completed))
+}
+
+// endDiagnostics marks the span as failed with the first error, if any.
+func (span timedSpan) endDiagnostics(diags diag.Diagnostics) {
+	for _, d := range diags {
+		if d.Severity == diag.Error {
+			span.end(errors.New(d.Summary))
+			return
+		}
+	}
+	span.end(nil)
+}
+
+// solveTracer turns the vertexes the daemon reports while solving into spans,
+// e.g. loading the build context or exporting the image, with the progress
+// reported for each of them, e.g. pushing each layer and manifest, as spans
+// of their own.
+type solveTracer struct {
+	ctx       context.Context
+	tracer    trace.Tracer
+	vertexes  map[digest.Digest]trace.Span
+	completed map[string]struct{}
+}
+
+func newSolveTracer(ctx context.Context, tracer trace.Tracer) *solveTracer {
+	return &solveTracer{
+		ctx:       ctx,
+		tracer:    tracer,
+		vertexes:  map[digest.Digest]trace.Span{},
+		completed: map[string]struct{}{},
+	}
+}
+
+func (t *solveTracer) observe(status *client.SolveStatus) {
+	for _, vertex := range status.Vertexes {
+		span, ok := t.vertexes[vertex.Digest]
+		if !ok {
+			if vertex.Started == nil {
+				continue
+			}
+			_, span = t.tracer.Start(t.ctx, vertex.Name, trace.WithTimestamp(*vertex.Started), trace.WithAttributes(
+				attribute.String("buildkit.vertex", vertex.Digest.String()),
+			))
+			t.vertexes[vertex.Digest] = span
+		}
+		if vertex.Completed == nil {
+			continue
+		}
+		span.SetAttributes(
+			attribute.Bool("buildkit.cached", vertex.Cached),
+			attribute.Int64("duration_ms", vertex.Completed.Sub(*vertex.Started).Milliseconds()),
+		)
+		if vertex.Error != "" {
+			span.SetStatus(codes.Error, vertex.Error)
+		}
+		span.End(trace.WithTimestamp(*vertex.Completed))
+	}
+
+	for _, progress := range status.Statuses {
+		parent, ok := t.vertexes[progress.Vertex]
+		if !ok || progress.Started == nil || progress.Completed == nil {
+			continue
+		}
+		// the daemon may report a completed status more than once
+		if _, ok := t.completed[progress.Vertex.String()+progress.ID]; ok {
+			continue
+		}
+		t.completed[progress.Vertex.String()+progress.ID] = struct{}{}
+		_, span := t.tracer.Start(trace.ContextWithSpan(t.ctx, parent), progress.ID, trace.WithTimestamp(*progress.Started), trace.WithAttributes(
+			attribute.Int64("buildkit.total", progress.Total),
+			attribute.Int64("duration_ms", progress.Completed.Sub(*progress.Started).Milliseconds()),
+		))
+		span.End(trace.WithTimestamp(*progress.Completed))
+	}
+}
+
+// finish ends the spans of vertexes that never completed, they were
+// interrupted along with the solve.
+func (t *solveTracer) finish() {
+	for _, span := range t.vertexes {
+		if span.IsRecording() {
+			span.End()
+		}
+	}
+}
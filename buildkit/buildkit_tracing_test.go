@@ -0,0 +1,144 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testSpanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, x := range span.Attributes() {
+		if x.Key == key {
+			return x.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestSolveTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	started := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	loaded := started.Add(2 * time.Second)
+	pushed := started.Add(5 * time.Second)
+	context_vertex := digest.FromString("context")
+	export_vertex := digest.FromString("export")
+
+	statuses := make(chan *client.SolveStatus, 4)
+	statuses <- &client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: context_vertex, Name: "[internal] load build context", Started: &started},
+	}}
+	statuses <- &client.SolveStatus{Vertexes: []*client.Vertex{
+		{Digest: context_vertex, Name: "[internal] load build context", Started: &started, Completed: &loaded},
+		{Digest: export_vertex, Name: "exporting to image", Started: &loaded},
+	}}
+	statuses <- &client.SolveStatus{Statuses: []*client.VertexStatus{
+		{ID: "pushing manifest for localhost:5000/app:1.0.0", Vertex: export_vertex, Started: &loaded, Completed: &pushed},
+	}}
+	statuses <- &client.SolveStatus{Statuses: []*client.VertexStatus{
+		{ID: "pushing manifest for localhost:5000/app:1.0.0", Vertex: export_vertex, Started: &loaded, Completed: &pushed},
+	}}
+	close(statuses)
+
+	ctx, span := startSpan(context.Background(), tracer, "solve")
+	solveTracer := newSolveTracer(ctx, tracer)
+	for status := range statuses {
+		solveTracer.observe(status)
+	}
+	solveTracer.finish()
+	span.end(nil)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, x := range recorder.Ended() {
+		if _, ok := spans[x.Name()]; ok {
+			t.Fatalf("expected a single span named '%s'", x.Name())
+		}
+		spans[x.Name()] = x
+	}
+
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans but got %d", len(spans))
+	}
+
+	load := spans["[internal] load build context"]
+	if !load.StartTime().Equal(started) || !load.EndTime().Equal(loaded) {
+		t.Fatalf("expected the context to load from %s to %s but it took from %s to %s", started, loaded, load.StartTime(), load.EndTime())
+	}
+
+	if duration, _ := testSpanAttribute(load, "duration_ms"); duration.AsInt64() != 2000 {
+		t.Fatalf("expected a duration of 2000ms but got %d", duration.AsInt64())
+	}
+
+	if load.Parent().SpanID() != spans["solve"].SpanContext().SpanID() {
+		t.Fatal("expected the vertex to be part of the solve")
+	}
+
+	push := spans["pushing manifest for localhost:5000/app:1.0.0"]
+	if push.Parent().SpanID() != spans["exporting to image"].SpanContext().SpanID() {
+		t.Fatal("expected the push to be part of the export")
+	}
+}
+
+func TestRegistryRoundTripperTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	host := testRegistry(t)
+	testPushImage(t, host+"/app:1.0.0")
+
+	transport := newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), 0)
+	transport.tracer = tracer
+	auth := RegistryAuth{transport: transport}
+
+	ctx, span := startSpan(context.Background(), tracer, "query")
+	if _, err := getRemoteImageHash(ctx, host+"/app:1.0.0", auth); err != nil {
+		t.Fatal(err)
+	}
+	span.end(nil)
+
+	// the registry is pinged over https first, which fails before there is a status
+	answered := 0
+	for _, x := range recorder.Ended() {
+		if x.Name() == "query" {
+			continue
+		}
+		if x.Parent().SpanID() != span.SpanContext().SpanID() {
+			t.Fatalf("expected the request '%s' to be part of the query", x.Name())
+		}
+		if status, ok := testSpanAttribute(x, "http.status_code"); ok && status.AsInt64() == http.StatusOK {
+			answered++
+		}
+	}
+
+	if answered == 0 {
+		t.Fatal("expected the requests to the registry to be traced along with their status")
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	provider, err := newTracerProvider(context.Background(), "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := startSpan(context.Background(), provider.Tracer(tracerName), "solve")
+	span.end(nil)
+
+	if id := traceID(span); len(id) != 32 {
+		t.Fatalf("expected builds to be traced without an otlp_endpoint but got the trace id '%s'", id)
+	}
+
+	_, span = startSpan(context.Background(), TerraformProviderBuildkit{}.tracer(), "solve")
+	span.end(nil)
+
+	if id := traceID(span); id != "" {
+		t.Fatalf("expected no trace id before the provider is configured but got '%s'", id)
+	}
+}
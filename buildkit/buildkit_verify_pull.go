@@ -0,0 +1,94 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+)
+
+// verifyPull pulls the manifest of every published target the way a runtime
+// would, along with the manifest and the header of a layer of each platform,
+// which catches registries and proxies that accept a push but can't serve it.
+func verifyPull(ctx context.Context, provider TerraformProviderBuildkit, targets []interface{}) diag.Diagnostics {
+	diags := diag.Diagnostics{}
+
+	for _, x := range targets {
+		casted := x.(map[string]interface{})
+		digest_url := casted["digest_url"].(string)
+		if err := pullManifests(ctx, digest_url, provider.registryAuth(casted["registry_url"].(string))); err != nil {
+			diags = append(diags, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not pull '%s' after publishing it.", digest_url),
+				Detail:   err.Error() + "\n\nThe registry accepted the image but doesn't serve it, so pulling it would fail as well.",
+			})
+		}
+	}
+
+	return diags
+}
+
+// pullManifests fetches the manifest at the reference and, for an index, the
+// manifest of each platform, and checks that the first layer of each image
+// exists, or its config when it has no layers.
+func pullManifests(ctx context.Context, reference string, auth RegistryAuth) error {
+	parsed, err := name.ParseReference(reference)
+
+	if err != nil {
+		return err
+	}
+
+	options := makeOptions(craneOptions(ctx, auth)...).Remote
+	descriptor, err := remote.Get(parsed, options...)
+
+	if err != nil {
+		return err
+	}
+
+	manifests := [][]byte{descriptor.Manifest}
+
+	if isV2IndexManifest(descriptor.MediaType) {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(descriptor.Manifest))
+		if err != nil {
+			return err
+		}
+		manifests = [][]byte{}
+		for _, x := range index.Manifests {
+			if isAttestationManifest(x) {
+				continue
+			}
+			platform, err := remote.Get(parsed.Context().Digest(x.Digest.String()), options...)
+			if err != nil {
+				return fmt.Errorf("could not pull the manifest %s: %w", x.Digest, err)
+			}
+			manifests = append(manifests, platform.Manifest)
+		}
+	}
+
+	for _, x := range manifests {
+		manifest, err := v1.ParseManifest(bytes.NewReader(x))
+		if err != nil {
+			return err
+		}
+
+		blob := manifest.Config.Digest
+		if len(manifest.Layers) > 0 {
+			blob = manifest.Layers[0].Digest
+		}
+
+		layer, err := remote.Layer(parsed.Context().Digest(blob.String()), options...)
+		if err != nil {
+			return err
+		}
+
+		// a HEAD request for the blob, so the layer isn't downloaded
+		if _, err := layer.Size(); err != nil {
+			return fmt.Errorf("could not pull the blob %s: %w", blob, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package buildkit
+
+import (
+	"context"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPull(t *testing.T) {
+	// a proxy in front of the broken repository accepts pushes but can't serve blobs
+	backend := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/broken/blobs/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	meta := TerraformProviderBuildkit{registry_auth: map[string]RegistryAuth{}}
+
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	index := testPushIndex(t, host+"/app:1.0.0", platforms...)
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPushIndex(t, host+"/broken:1.0.0", platforms...)
+	broken, err := getRemoteImageHash(context.Background(), host+"/broken:1.0.0", meta.registryAuth(host))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []interface{}{
+		publishedTarget(map[string]interface{}{"registry_url": host, "name": "app", "tag": "1.0.0"}, digest.String()),
+	}
+
+	if diags := verifyPull(context.Background(), meta, targets); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	targets = append(targets, publishedTarget(map[string]interface{}{"registry_url": host, "name": "broken", "tag": "1.0.0"}, broken))
+
+	diags := verifyPull(context.Background(), meta, targets)
+	if len(diags) != 1 || !strings.Contains(diags[0].Summary, host+"/broken@") {
+		t.Fatalf("expected the broken target to fail to pull: %v", diags)
+	}
+}
@@ -2,29 +2,190 @@ package buildkit
 
 import (
 	"context"
+	"fmt"
+	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/moby/buildkit/client"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net/http"
+	"os"
+	"time"
 )
 
+// Version is the version of the provider, as set when it is released.
+var Version = "dev"
+
 type RegistryAuth struct {
 	registry_url string
 	username     string
 	password     string
+	transport    http.RoundTripper
+	digests      *digestCache
+	published    *digestCache
 }
 
 type TerraformProviderBuildkit struct {
-	buildkit_url  string
-	registry_auth map[string]RegistryAuth
+	buildkit_url          string
+	buildkit_client       *client.Client
+	registry_auth         map[string]RegistryAuth
+	registry_transport    http.RoundTripper
+	registry_digests      *digestCache
+	registry_published    *digestCache
+	builds                *buildGroup
+	registry_auth_failure string
+	skip_remote_refresh   bool
+	hash_cache_directory  string
+	builder_nodes         []*builderNode
+	shared_key            string
+	tracer_provider       *sdktrace.TracerProvider
+	sensitive_values      []string
+	cache_from            []string
+	cache_to              []string
+	sbom_generator        string
+}
+
+// registryAuth returns the credentials for the registry (if any) along with
+// the transport requests to every registry are made with, the digests
+// looked up so far and the tags published so far.
+func (provider TerraformProviderBuildkit) registryAuth(registry_url string) RegistryAuth {
+	auth := provider.registry_auth[normalizeRegistry(registry_url)]
+	auth.transport = provider.registry_transport
+	auth.digests = provider.registry_digests
+	auth.published = provider.registry_published
+	return auth
 }
 
 func Provider() *schema.Provider {
-	return &schema.Provider{
+	provider := &schema.Provider{
 		Schema: map[string]*schema.Schema{
 			"buildkit_url": {
 				Type:        schema.TypeString,
 				Required:    true,
 				Description: "URL for a running buildkit daemon.",
 			},
+			"compress_context": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should the context and dockerfile be gzip compressed while they are uploaded to the buildkit daemon? Speeds up builds over slow links to a remote daemon at the cost of some cpu on both ends. Requires a daemon that accepts gzip compressed grpc messages.",
+			},
+			"registry_timeout": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "2m",
+				Description: "How long to wait for a registry to respond to a request before giving up, e.g. `30s` or `5m`. Requests are also cancelled when Terraform is interrupted or an operation runs into its timeout.",
+			},
+			"required_buildkit_version": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "A version constraint the buildkit daemon of every node has to satisfy, e.g. `>= 0.12`, checked when the provider is configured so that a daemon that is too old for the features in use, like attestations or zstd compression, fails with a clear message rather than somewhere in the middle of a build. Daemons older than v0.11 don't report their version and are taken to be v0.10.0. Not checked when empty.",
+			},
+			"registry_auth_failure": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "error",
+				Description: "What to do when a registry rejects the credentials while refreshing the state of a resource. Either `error` to fail the plan or `warn` to keep the previous state and report a warning, e.g. when credentials that are only valid during apply have expired.",
+			},
+			"registry_requests_per_second": {
+				Type:        schema.TypeFloat,
+				Optional:    true,
+				Default:     0,
+				Description: "The maximum number of requests per second the provider makes to each registry, so that large queries don't trip the abuse detection of registries like Docker Hub or GHCR. Unlimited when zero. Pulls made by the buildkit daemon aren't affected.",
+			},
+			"registry_user_agent": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The user agent requests to registries are made with, ahead of the user agent of go-containerregistry, e.g. to tell the requests of different pipelines apart in the logs of a registry. Defaults to `terraform-provider-buildkit/<version>` when empty.",
+			},
+			"log_registry_requests": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should every request the provider makes to a registry be logged at the debug level of the Terraform log, e.g. with `TF_LOG=debug`? Each entry has the method, url, status and duration of the request, the scheme of its credentials but not the credentials themselves, and the rate limit headers of the response, to diagnose throttling or failures of a registry.",
+			},
+			"hash_cache_directory": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "Directory to keep the hashes of files in between runs, so that files whose size and modification time haven't changed aren't read again when hashing a `buildkit_directory`. Disabled when empty.",
+			},
+			"cache_from": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Caches every `buildkit_image` imports from unless it sets its own `cache_from`, e.g. `type=registry,ref=$${registry}/$${name}:buildcache`. `${registry}` and `${name}` are replaced with the registry and name of the first publish target of the image, and have to be escaped as `$${registry}` and `$${name}` so that Terraform doesn't interpolate them itself. Caches that use them are left out for images that aren't published.",
+			},
+			"cache_to": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Caches every `buildkit_image` exports to unless it sets its own `cache_to`, e.g. `type=registry,ref=$${registry}/$${name}:buildcache,mode=max`. Filled in the same way as `cache_from`.",
+			},
+			"sbom_generator": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The image of the SBOM generator every `buildkit_image` with an `sbom` block uses unless it sets its own `generator`, e.g. a pinned `docker/buildkit-syft-scanner:1.0.0@sha256:...`, so that the SBOMs of all images are generated by the same tool. Changing it doesn't rebuild images. Uses the default scanner of the buildkit daemon when empty.",
+			},
+			"shared_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The key the buildkit daemon caches the contexts it was sent under, so that only files that changed are sent the next time. When empty, a key derived from the id of the machine running Terraform is used, which changes with every ephemeral CI runner. Set it to something stable, e.g. the name of the repository, so that every runner can reuse what was sent before.",
+			},
+			"skip_remote_refresh": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should reading resources and data sources skip contacting registries? Resources keep their state as it is, and data sources that query a registry are empty and report a warning. Enables plans without network access to the registries or without credentials, e.g. to validate pull requests, at the cost of not noticing changes made outside of Terraform.",
+			},
+			"otlp_endpoint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: "The host and port of an OpenTelemetry collector to send traces of builds and registry requests to over OTLP/gRPC, e.g. `localhost:4317`. The trace is passed on to the buildkit daemon so that its own spans are part of it. Disabled when empty.",
+			},
+			"otlp_insecure": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Should traces be sent to the `otlp_endpoint` without TLS?",
+			},
+			"otlp_headers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Sensitive:   true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Headers to send along with the traces, e.g. the api key of a hosted collector.",
+			},
+			"node": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Other buildkit daemons of a multi-node builder, like the nodes of a buildx builder. Each platform of a `buildkit_image` is built on the first node that builds it natively, or else on the first node that can emulate it, with the daemon at the `buildkit_url` being the first node, named `default`. When the platforms of an image are built on several nodes, their results are merged into one image in each publish target.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "The name of the node, as reported in the `platform_nodes` of an image.",
+						},
+						"buildkit_url": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "URL for the buildkit daemon of the node.",
+						},
+						"platforms": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							Elem:        &schema.Schema{Type: schema.TypeString},
+							Description: "The platforms the node builds, e.g. `linux/arm64`. When empty, the workers of the daemon are asked for the platforms they support.",
+						},
+					},
+				},
+			},
 			"registry_auth": {
 				Type:     schema.TypeSet,
 				Optional: true,
@@ -33,7 +194,7 @@ func Provider() *schema.Provider {
 						"registry_url": {
 							Type:        schema.TypeString,
 							Required:    true,
-							Description: "The base url of the registry you want to support communicating with.",
+							Description: "The base url of the registry you want to support communicating with, e.g. `ghcr.io` or `https://docker.io`. The scheme and any path are ignored, credentials apply to the whole host, and `docker.io`, `index.docker.io` and `registry-1.docker.io` all mean Docker Hub.",
 						},
 						"username": {
 							Type:        schema.TypeString,
@@ -46,38 +207,230 @@ func Provider() *schema.Provider {
 							Required:    true,
 							Description: "The password for authenticating to the registry as `username`.",
 						},
+						"timeout": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "",
+							Description: "How long to wait for this registry to respond to a request before giving up, e.g. `30s`, instead of the `registry_timeout` of the provider. Useful to fail fast on a registry that is known to be slow or flaky, so that it doesn't stall publishing to the other registries.",
+						},
 					},
 				},
 			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
-			"buildkit_image": buildkitImageResource(),
+			"buildkit_bake":              buildkitBakeResource(),
+			"buildkit_binfmt":            buildkitBinfmtResource(),
+			"buildkit_cache_warm":        buildkitCacheWarmResource(),
+			"buildkit_gc_policy":         buildkitGcPolicyResource(),
+			"buildkit_image":             buildkitImageResource(),
+			"buildkit_image_attestation": buildkitImageAttestationResource(),
+			"buildkit_image_copy":        buildkitImageCopyResource(),
+			"buildkit_image_mutate":      buildkitImageMutateResource(),
+			"buildkit_image_pull":        buildkitImagePullResource(),
+			"buildkit_image_scan":        buildkitImageScanResource(),
+			"buildkit_image_signature":   buildkitImageSignatureResource(),
+			"buildkit_image_test":        buildkitImageTestResource(),
+			"buildkit_prune":             buildkitPruneResource(),
+			"buildkit_registry_cleanup":  buildkitRegistryCleanupResource(),
+			"buildkit_registry_tag":      buildkitRegistryTagResource(),
+			"buildkit_retention_policy":  buildkitRetentionPolicyResource(),
 		},
 		DataSourcesMap: map[string]*schema.Resource{
-			"buildkit_directory": buildkitDirectoryHashDataSource(),
-			"buildkit_images":    buildkitImagesDataSource(),
+			"buildkit_bake_definition":      buildkitBakeDefinitionDataSource(),
+			"buildkit_directory":            buildkitDirectoryHashDataSource(),
+			"buildkit_dockerfile":           buildkitDockerfileDataSource(),
+			"buildkit_dockerfile_lint":      buildkitDockerfileLintDataSource(),
+			"buildkit_dockerhub_rate_limit": buildkitDockerHubRateLimitDataSource(),
+			"buildkit_image_provenance":     buildkitImageProvenanceDataSource(),
+			"buildkit_image_sbom":           buildkitImageSbomDataSource(),
+			"buildkit_image_signature":      buildkitImageSignatureDataSource(),
+			"buildkit_images":               buildkitImagesDataSource(),
+			"buildkit_registry_catalog":     buildkitRegistryCatalogDataSource(),
+			"buildkit_repository_tags":      buildkitRepositoryTagsDataSource(),
+			"buildkit_tag_exists":           buildkitTagExistsDataSource(),
 		},
 		ConfigureContextFunc: providerConfigure,
 	}
+
+	redactResources(provider.ResourcesMap)
+	redactResources(provider.DataSourcesMap)
+	traceResources(provider.ResourcesMap)
+	traceResources(provider.DataSourcesMap)
+	timeoutDataSources(provider.DataSourcesMap)
+
+	provider.ConfigureContextFunc = redactedConfigure(provider.Schema, providerConfigure)
+
+	return provider
 }
 
 func providerConfigure(context context.Context, data *schema.ResourceData) (interface{}, diag.Diagnostics) {
 	registry_auth := data.Get("registry_auth").(*schema.Set).List()
 
 	by_host := make(map[string]RegistryAuth)
+	timeouts := make(map[string]time.Duration)
 
 	for _, x := range registry_auth {
 		casted := x.(map[string]interface{})
-		by_host[casted["registry_url"].(string)] = RegistryAuth{
+		by_host[normalizeRegistry(casted["registry_url"].(string))] = RegistryAuth{
 			registry_url: casted["registry_url"].(string),
 			username:     casted["username"].(string),
 			password:     casted["password"].(string),
 		}
+
+		if casted["timeout"].(string) == "" {
+			continue
+		}
+
+		timeout, err := time.ParseDuration(casted["timeout"].(string))
+
+		if err != nil {
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not parse the timeout '%s' of the registry_auth for '%s'.", casted["timeout"].(string), casted["registry_url"].(string)),
+				Detail:   err.Error(),
+			}}
+		}
+
+		timeouts[normalizeRegistry(casted["registry_url"].(string))] = timeout
 	}
 
-	return TerraformProviderBuildkit{
-			registry_auth: by_host,
-			buildkit_url:  data.Get("buildkit_url").(string),
-		},
-		make(diag.Diagnostics, 0)
+	registry_timeout, err := time.ParseDuration(data.Get("registry_timeout").(string))
+
+	if err != nil {
+		return nil, diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not parse the registry_timeout '%s'.", data.Get("registry_timeout").(string)),
+			Detail:   err.Error(),
+		}}
+	}
+
+	registry_auth_failure := data.Get("registry_auth_failure").(string)
+
+	if registry_auth_failure != "error" && registry_auth_failure != "warn" {
+		return nil, diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("The registry_auth_failure must be either 'error' or 'warn' but was '%s'.", registry_auth_failure),
+		}}
+	}
+
+	// a registry that accepts the connection but never responds would otherwise block forever
+	registry_transport := newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), data.Get("registry_requests_per_second").(float64))
+	registry_transport.timeout = registry_timeout
+	registry_transport.timeouts = timeouts
+	registry_transport.user_agent = data.Get("registry_user_agent").(string)
+
+	if registry_transport.user_agent == "" {
+		registry_transport.user_agent = "terraform-provider-buildkit/" + Version
+	}
+
+	if data.Get("log_registry_requests").(bool) {
+		registry_transport.logger = newProgressLogger(os.Stderr).Named("registry")
+	}
+
+	headers := map[string]string{}
+	for k, v := range data.Get("otlp_headers").(map[string]interface{}) {
+		headers[k] = v.(string)
+	}
+
+	tracer_provider, err := newTracerProvider(context, data.Get("otlp_endpoint").(string), data.Get("otlp_insecure").(bool), headers)
+
+	if err != nil {
+		return nil, diag.Diagnostics{diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Could not export traces to '%s'.", data.Get("otlp_endpoint").(string)),
+			Detail:   err.Error(),
+		}}
+	}
+
+	registry_transport.tracer = tracer_provider.Tracer(tracerName)
+
+	provider := TerraformProviderBuildkit{
+		registry_auth:         by_host,
+		registry_transport:    registry_transport,
+		registry_digests:      newDigestCache(),
+		registry_published:    newDigestCache(),
+		builds:                newBuildGroup(),
+		registry_auth_failure: registry_auth_failure,
+		buildkit_url:          data.Get("buildkit_url").(string),
+		hash_cache_directory:  data.Get("hash_cache_directory").(string),
+		shared_key:            data.Get("shared_key").(string),
+		cache_from:            getStringList(data, "cache_from"),
+		cache_to:              getStringList(data, "cache_to"),
+		sbom_generator:        data.Get("sbom_generator").(string),
+		skip_remote_refresh:   data.Get("skip_remote_refresh").(bool),
+		tracer_provider:       tracer_provider,
+	}
+
+	nodes := []*builderNode{{name: defaultNodeName, url: provider.buildkit_url}}
+	names := map[string]bool{defaultNodeName: true}
+
+	for _, x := range data.Get("node").([]interface{}) {
+		casted := x.(map[string]interface{})
+		node := &builderNode{name: casted["name"].(string), url: casted["buildkit_url"].(string)}
+		for _, platform := range casted["platforms"].([]interface{}) {
+			node.platforms = append(node.platforms, platform.(string))
+		}
+		if names[node.name] {
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("The name of every node must be unique but '%s' is used more than once.", node.name),
+				Detail:   fmt.Sprintf("The node at the buildkit_url of the provider is named '%s'.", defaultNodeName),
+			}}
+		}
+		names[node.name] = true
+		nodes = append(nodes, node)
+	}
+
+	// the daemons are only connected to when they are first needed, after which
+	// the connection is shared by every operation until terraform stops the provider
+	for _, node := range nodes {
+		node.client, err = provider.connect(context, node.url, data.Get("compress_context").(bool))
+
+		if err != nil {
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not connect to the buildkit daemon at '%s'.", node.url),
+				Detail:   err.Error(),
+			}}
+		}
+	}
+
+	if required := data.Get("required_buildkit_version").(string); required != "" {
+		if _, err := version.NewConstraint(required); err != nil {
+			return nil, diag.Diagnostics{diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Could not parse the required_buildkit_version '%s'.", required),
+				Detail:   err.Error(),
+			}}
+		}
+
+		for _, node := range nodes {
+			daemon, err := daemonVersion(context, node.url)
+
+			if err == errVersionUnreported {
+				daemon, err = unreportedBuildkitVersion, nil
+			}
+
+			if err != nil {
+				return nil, diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Could not query the version of the buildkit daemon at '%s'.", node.url),
+					Detail:   err.Error(),
+				}}
+			}
+
+			if err := checkBuildkitVersion(required, daemon); err != nil {
+				return nil, diag.Diagnostics{diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("The version of the buildkit daemon at '%s' isn't supported.", node.url),
+					Detail:   err.Error() + ".\n\nUpgrade the daemon or change the required_buildkit_version. Daemons older than v0.11 don't report their version and are taken to be v" + unreportedBuildkitVersion + ".",
+				}}
+			}
+		}
+	}
+
+	provider.buildkit_client = nodes[0].client
+	provider.builder_nodes = nodes
+
+	return provider, make(diag.Diagnostics, 0)
 }
@@ -0,0 +1,331 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the authentication challenge of a registry is remembered
+const pingExpiration = 5 * time.Minute
+
+// tokens are dropped a little before they expire so that they don't expire in flight
+const tokenExpirationMargin = 10 * time.Second
+
+// registryRoundTripper is shared by every request the provider makes to a
+// registry, so that connections and tokens are reused across operations.
+type registryRoundTripper struct {
+	inner      http.RoundTripper
+	tracer     trace.Tracer
+	logger     hclog.Logger
+	user_agent string
+	timeout    time.Duration
+	timeouts   map[string]time.Duration
+	limit      rate.Limit
+	mutex      sync.Mutex
+	limiters   map[string]*rate.Limiter
+	realms     map[string]struct{}
+	pings      map[string]cachedResponse
+	tokens     map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// newRegistryRoundTripper creates the shared transport. Requests per second
+// are unlimited when zero.
+func newRegistryRoundTripper(inner http.RoundTripper, requestsPerSecond float64) *registryRoundTripper {
+	limit := rate.Inf
+	if requestsPerSecond > 0 {
+		limit = rate.Limit(requestsPerSecond)
+	}
+	return &registryRoundTripper{
+		inner:    inner,
+		limit:    limit,
+		limiters: map[string]*rate.Limiter{},
+		realms:   map[string]struct{}{},
+		pings:    map[string]cachedResponse{},
+		tokens:   map[string]cachedResponse{},
+	}
+}
+
+// send waits for the limiter of the host before sending the request, and
+// traces and logs it when there is a tracer or a logger.
+func (t *registryRoundTripper) send(request *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	limiter, ok := t.limiters[request.URL.Host]
+	if !ok {
+		// up to a second worth of requests may be sent at once, the burst doesn't matter without a limit
+		burst := 1
+		if t.limit != rate.Inf {
+			burst = int(math.Max(1, math.Ceil(float64(t.limit))))
+		}
+		limiter = rate.NewLimiter(t.limit, burst)
+		t.limiters[request.URL.Host] = limiter
+	}
+	t.mutex.Unlock()
+
+	if err := limiter.Wait(request.Context()); err != nil {
+		return nil, err
+	}
+
+	timeout := t.timeout
+	if x, ok := t.timeouts[normalizeRegistry(request.URL.Host)]; ok {
+		timeout = x
+	}
+
+	// go-containerregistry names itself in the user agent, which is kept after the provider
+	if t.user_agent != "" {
+		request = request.Clone(request.Context())
+		request.Header.Set("User-Agent", strings.TrimSpace(t.user_agent+" "+request.Header.Get("User-Agent")))
+	}
+
+	started := time.Now()
+	response, err := t.trace(request, timeout)
+
+	if t.logger != nil {
+		t.logger.Debug("registry request", registryRequestFields(request, response, err, time.Since(started))...)
+	}
+
+	return response, err
+}
+
+func (t *registryRoundTripper) trace(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	if t.tracer == nil {
+		return t.roundTrip(request, timeout)
+	}
+
+	// the span ends with the headers, reading the body of e.g. a blob isn't part of it
+	_, span := startSpan(request.Context(), t.tracer, "HTTP "+request.Method, semconv.HTTPClientAttributesFromHTTPRequest(request)...)
+	response, err := t.roundTrip(request, timeout)
+	if err == nil {
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(response.StatusCode)...)
+	}
+	span.end(err)
+
+	return response, err
+}
+
+// registryRequestFields describe a request that was sent to a registry, with
+// only the scheme of its credentials and the headers registries report their
+// rate limits in.
+func registryRequestFields(request *http.Request, response *http.Response, err error, duration time.Duration) []interface{} {
+	fields := []interface{}{
+		"method", request.Method,
+		"url", request.URL.Redacted(),
+		"duration_ms", duration.Milliseconds(),
+	}
+
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		scheme, _, _ := strings.Cut(authorization, " ")
+		fields = append(fields, "authorization", scheme+" [redacted]")
+	}
+
+	if err != nil {
+		return append(fields, "error", err.Error())
+	}
+
+	fields = append(fields, "status", response.StatusCode)
+	for _, x := range []string{"Retry-After", "RateLimit-Limit", "RateLimit-Remaining"} {
+		if value := response.Header.Get(x); value != "" {
+			fields = append(fields, strings.ToLower(x), value)
+		}
+	}
+
+	return fields
+}
+
+// roundTrip gives up on the request when the registry doesn't respond within
+// the timeout, so that one slow registry can't stall everything else. Reading
+// the body isn't limited, so large blobs can take as long as they need.
+func (t *registryRoundTripper) roundTrip(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return t.inner.RoundTrip(request)
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	response, err := t.inner.RoundTrip(request.WithContext(ctx))
+
+	if !timer.Stop() && request.Context().Err() == nil {
+		cancel()
+		if err == nil {
+			response.Body.Close()
+		}
+		return nil, fmt.Errorf("%s did not respond within %s", request.URL.Host, timeout)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// cancelOnClose releases the context of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+// RoundTrip answers authentication challenges and tokens from the cache,
+// which go-containerregistry would otherwise request for every operation.
+func (t *registryRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	if request.Method != http.MethodGet {
+		return t.forward(request)
+	}
+
+	if request.URL.Path == "/v2/" && request.Header.Get("Authorization") == "" {
+		return t.cached(request, t.pings, request.URL.String(), func(response *http.Response, body []byte) (time.Duration, bool) {
+			if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnauthorized {
+				return 0, false
+			}
+			if realm := bearerRealm(response.Header.Get("WWW-Authenticate")); realm != "" {
+				t.mutex.Lock()
+				t.realms[realm] = struct{}{}
+				t.mutex.Unlock()
+			}
+			return pingExpiration, true
+		})
+	}
+
+	if t.isRealm(request) {
+		// tokens depend on the credentials they were requested with
+		key := request.URL.String() + "\x00" + request.Header.Get("Authorization")
+		return t.cached(request, t.tokens, key, func(response *http.Response, body []byte) (time.Duration, bool) {
+			if response.StatusCode != http.StatusOK {
+				return 0, false
+			}
+			return tokenExpiration(body), true
+		})
+	}
+
+	return t.forward(request)
+}
+
+// forward sends the request to the registry. A token that is rejected may
+// have been revoked early, so every cached token is dropped for the bearer
+// transport of go-containerregistry to request a new one.
+func (t *registryRoundTripper) forward(request *http.Request) (*http.Response, error) {
+	response, err := t.send(request)
+	if err == nil && response.StatusCode == http.StatusUnauthorized && strings.HasPrefix(request.Header.Get("Authorization"), "Bearer ") {
+		t.mutex.Lock()
+		t.tokens = map[string]cachedResponse{}
+		t.mutex.Unlock()
+	}
+	return response, err
+}
+
+func (t *registryRoundTripper) isRealm(request *http.Request) bool {
+	realm := request.URL.Scheme + "://" + request.URL.Host + request.URL.Path
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.realms[realm]
+	return ok
+}
+
+// cached answers the request from the cache when possible. Otherwise the
+// request is sent and the response is cached for as long as the callback says.
+func (t *registryRoundTripper) cached(request *http.Request, cache map[string]cachedResponse, key string, expiration func(*http.Response, []byte) (time.Duration, bool)) (*http.Response, error) {
+
+	t.mutex.Lock()
+	entry, ok := cache[key]
+	t.mutex.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.response(request), nil
+	}
+
+	response, err := t.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if duration, ok := expiration(response, body); ok {
+		t.mutex.Lock()
+		cache[key] = cachedResponse{
+			status:  response.StatusCode,
+			header:  response.Header.Clone(),
+			body:    body,
+			expires: time.Now().Add(duration),
+		}
+		t.mutex.Unlock()
+	}
+
+	return response, nil
+}
+
+func (entry cachedResponse) response(request *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.status, http.StatusText(entry.status)),
+		StatusCode:    entry.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       request,
+	}
+}
+
+// bearerRealm returns the realm of a bearer challenge, or nothing for any
+// other kind of challenge.
+func bearerRealm(challenge string) string {
+	scheme, parameters, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	for _, x := range strings.Split(parameters, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(x), "=")
+		if strings.EqualFold(key, "realm") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// tokenExpiration returns how long a token may be reused. Token servers that
+// don't say are assumed to hand out tokens for 60 seconds, as the spec says.
+func tokenExpiration(body []byte) time.Duration {
+	var response struct {
+		ExpiresIn int `json:"expires_in"`
+	}
+	expiresIn := defaultExpiration
+	if err := json.Unmarshal(body, &response); err == nil && response.ExpiresIn > 0 {
+		expiresIn = response.ExpiresIn
+	}
+	return time.Duration(expiresIn)*time.Second - tokenExpirationMargin
+}
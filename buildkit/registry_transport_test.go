@@ -0,0 +1,200 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTokenRegistry starts an in-memory registry that requires a bearer token,
+// counting the challenges and tokens it hands out.
+func testTokenRegistry(t *testing.T, pings *int32, tokens *int32) string {
+	inner := registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			atomic.AddInt32(tokens, 1)
+			fmt.Fprint(w, `{"token": "secret", "expires_in": 300}`)
+		case r.Header.Get("Authorization") != "Bearer secret":
+			if r.URL.Path == "/v2/" {
+				atomic.AddInt32(pings, 1)
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			inner.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestRegistryRoundTripperReusesTokens(t *testing.T) {
+	var pings, tokens int32
+	host := testTokenRegistry(t, &pings, &tokens)
+
+	auth := RegistryAuth{transport: newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), 0)}
+	ctx := context.Background()
+
+	testPushImage(t, host+"/app:1.0.0")
+	pushPings, pushTokens := atomic.LoadInt32(&pings), atomic.LoadInt32(&tokens)
+
+	for i := 0; i < 10; i++ {
+		if _, err := getRemoteImageHash(ctx, host+"/app:1.0.0", auth); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if actual := atomic.LoadInt32(&pings) - pushPings; actual != 1 {
+		t.Fatalf("expected the registry to be pinged once but it was pinged %d times", actual)
+	}
+
+	if actual := atomic.LoadInt32(&tokens) - pushTokens; actual != 1 {
+		t.Fatalf("expected a single token to be requested but %d were", actual)
+	}
+
+	// a different scope needs a token of its own
+	if _, err := crane.ListTags(host+"/other", craneOptions(ctx, auth)...); err == nil {
+		t.Fatalf("expected listing an unknown repository to fail")
+	}
+
+	if actual := atomic.LoadInt32(&tokens) - pushTokens; actual != 2 {
+		t.Fatalf("expected a token per scope but %d were requested", actual)
+	}
+}
+
+func TestBearerRealm(t *testing.T) {
+	challenge := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull,push"`
+	if realm := bearerRealm(challenge); realm != "https://auth.docker.io/token" {
+		t.Fatalf("unexpected realm: %s", realm)
+	}
+	if realm := bearerRealm(`Basic realm="registry"`); realm != "" {
+		t.Fatalf("expected no realm for a basic challenge but got %s", realm)
+	}
+}
+
+func TestTokenExpiration(t *testing.T) {
+	if actual := tokenExpiration([]byte(`{"token": "x", "expires_in": 300}`)); actual != 290*time.Second {
+		t.Fatalf("unexpected expiration: %s", actual)
+	}
+	if actual := tokenExpiration([]byte(`{"token": "x"}`)); actual != 50*time.Second {
+		t.Fatalf("unexpected default expiration: %s", actual)
+	}
+}
+
+func TestRegistryRoundTripperLimitsRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	transport := newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), 10)
+	client := &http.Client{Transport: transport}
+
+	// the first ten requests are a burst, the five after them are spread over half a second
+	started := time.Now()
+	for i := 0; i < 15; i++ {
+		response, err := client.Post(server.URL+"/v2/app/blobs/uploads/", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the requests to be limited but they took %s", elapsed)
+	}
+}
+
+func TestRegistryRoundTripperTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "body")
+	}))
+	t.Cleanup(fast.Close)
+
+	transport := newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), 0)
+	transport.timeout = 50 * time.Millisecond
+	transport.timeouts = map[string]time.Duration{
+		normalizeRegistry(strings.TrimPrefix(fast.URL, "http://")): time.Second,
+	}
+	client := &http.Client{Transport: transport}
+
+	if _, err := client.Get(slow.URL + "/v2/app/tags/list"); err == nil || !strings.Contains(err.Error(), "did not respond within 50ms") {
+		t.Fatalf("expected the slow registry to time out but got %v", err)
+	}
+
+	// the registry with a timeout of its own gets longer than the default
+	response, err := client.Get(fast.URL + "/v2/app/tags/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if body, err := ioutil.ReadAll(response.Body); err != nil || string(body) != "body" {
+		t.Fatalf("expected the body to be read after the headers arrived but got %q: %v", body, err)
+	}
+}
+
+func TestRegistryRoundTripperLogsRequests(t *testing.T) {
+	agents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		w.Header().Set("RateLimit-Remaining", "99;w=21600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(server.Close)
+
+	output := bytes.Buffer{}
+	transport := newRegistryRoundTripper(http.DefaultTransport.(*http.Transport).Clone(), 0)
+	transport.user_agent = "terraform-provider-buildkit/1.0.0"
+	transport.logger = newProgressLogger(&output)
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/app/manifests/latest", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("User-Agent", "go-containerregistry/v0.8.0")
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if agent := <-agents; agent != "terraform-provider-buildkit/1.0.0 go-containerregistry/v0.8.0" {
+		t.Fatalf("expected the user agent of the provider first but got %q", agent)
+	}
+
+	logged := output.String()
+	for _, x := range []string{`"method":"GET"`, `"status":429`, `"ratelimit-remaining":"99;w=21600"`, `"authorization":"Bearer [redacted]"`, "/v2/app/manifests/latest"} {
+		if !strings.Contains(logged, x) {
+			t.Fatalf("expected %s to be logged: %s", x, logged)
+		}
+	}
+	if strings.Contains(logged, "secret") {
+		t.Fatalf("expected the credentials to be redacted: %s", logged)
+	}
+	if request.Header.Get("User-Agent") != "go-containerregistry/v0.8.0" {
+		t.Fatal("expected the request to be left as it is")
+	}
+}
@@ -1,6 +1,11 @@
 package buildkit
 
-import "time"
+import (
+	"encoding/json"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"time"
+)
 
 type Labels map[string]string
 
@@ -11,16 +16,157 @@ type ImageResult struct {
 	Labels         Labels
 	TagUrl         string
 	DigestUrl      string
+	Digest         string
 	ImageDigest    string
+	ManifestDigest string
 	Platform       string
+	Variant        string
+	OSVersion      string
 	BuildTimestamp time.Time
+	Attestations   []string
 }
 
 type ImageQuery struct {
+	Name              string
+	TagPattern        string
+	VersionConstraint string
+	Labels            Labels
+	Platforms         []string
+	CreatedAfter      time.Time
+	CreatedBefore     time.Time
+	Digest            string
+	MaxConcurrency    int
+	PageSize          int
+	MaxTags           int
+	Limit             int
+	SortBy            string
+	Order             string
+}
+
+type HashQuery struct {
+	Directory      string
+	Excludes       []string
+	Includes       []string
+	CacheDirectory string
+}
+
+type FileHashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Digest  string `json:"digest"`
+}
+
+type BuildReport struct {
+	ImageDigest      string               `json:"image_digest"`
+	TraceId          string               `json:"trace_id"`
+	Started          time.Time            `json:"started"`
+	Completed        time.Time            `json:"completed"`
+	DurationMs       int64                `json:"duration_ms"`
+	Retries          int                  `json:"retries"`
+	PublishTargets   []BuildReportTarget  `json:"publish_targets"`
+	Platforms        map[string]string    `json:"platforms"`
+	Cache            BuildReportCache     `json:"cache"`
+	Steps            []BuildReportStep    `json:"steps"`
+	Warnings         []BuildReportWarning `json:"warnings"`
+	ExporterResponse map[string]string    `json:"exporter_response"`
+}
+
+type BuildReportTarget struct {
+	TagUrl    string `json:"tag_url"`
+	DigestUrl string `json:"digest_url"`
+	Digest    string `json:"digest"`
+}
+
+type BuildReportCache struct {
+	Steps  int `json:"steps"`
+	Cached int `json:"cached"`
+}
+
+type BuildReportStep struct {
+	Name       string     `json:"name"`
+	Cached     bool       `json:"cached"`
+	Started    *time.Time `json:"started,omitempty"`
+	Completed  *time.Time `json:"completed,omitempty"`
+	DurationMs int64      `json:"duration_ms"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type BuildReportWarning struct {
+	Step   string `json:"step"`
+	Short  string `json:"short"`
+	Detail string `json:"detail,omitempty"`
+	Url    string `json:"url,omitempty"`
+}
+
+type Dockerfile struct {
+	Stages   []DockerfileStage
+	Args     []DockerfileArg
+	Warnings []parser.Warning
+}
+
+type DockerfileStage struct {
+	Name      string
+	BaseImage string
+	Platform  string
+	Line      int
+	Commands  []*parser.Node
+}
+
+type DockerfileArg struct {
 	Name       string
-	TagPattern string
-	Labels     Labels
-	Platforms  []string
+	Default    string
+	HasDefault bool
+	Stage      string
+	StageIndex int
+}
+
+// SecretMount are the options a secret is mounted with. Zero values are left
+// to the mount.
+type SecretMount struct {
+	Mode string
+	Uid  int
+	Gid  int
+}
+
+// PublishLock is how the publish targets of an image are locked while it is
+// published. Without a url the lock is a sentinel tag in the registry.
+type PublishLock struct {
+	url     string
+	timeout time.Duration
+	ttl     time.Duration
+}
+
+type LintFinding struct {
+	Rule     string
+	Message  string
+	Line     int
+	Severity string
+}
+
+type SignatureQuery struct {
+	PublicKey        string
+	CertificateRoots string
+	RekorPublicKey   string
+	Identity         string
+	OidcIssuer       string
+}
+
+type SignatureResult struct {
+	Identity   string
+	OidcIssuer string
+}
+
+type RateLimit struct {
+	Limited   bool
+	Limit     int
+	Remaining int
+	Window    int
+	Source    string
+}
+
+type CleanupResult struct {
+	Tags    []string
+	Digests []string
 }
 
 type RegistrationAuthentication struct {
@@ -31,7 +177,9 @@ type RegistrationAuthentication struct {
 
 type Platform struct {
 	OperatingSystem string
+	OSVersion       string
 	Architecture    string
+	Variant         string
 }
 
 type ImageConfigManifest struct {
@@ -51,6 +199,7 @@ type ImageConfigManifest struct {
 	} `json:"history"`
 	MobyBuildkitBuildinfoV1 string `json:"moby.buildkit.buildinfo.v1"`
 	Os                      string `json:"os"`
+	OSVersion               string `json:"os.version"`
 	Rootfs                  struct {
 		Type    string   `json:"type"`
 		DiffIds []string `json:"diff_ids"`
@@ -58,6 +207,233 @@ type ImageConfigManifest struct {
 	Variant string `json:"variant"`
 }
 
+type InTotoStatement struct {
+	Type          string `json:"_type"`
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate json.RawMessage `json:"predicate"`
+}
+
+type SpdxDocument struct {
+	SpdxVersion string `json:"spdxVersion"`
+	Name        string `json:"name"`
+	Packages    []struct {
+		Name        string `json:"name"`
+		VersionInfo string `json:"versionInfo"`
+	} `json:"packages"`
+}
+
+type SlsaProvenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		ConfigSource struct {
+			URI        string            `json:"uri"`
+			Digest     map[string]string `json:"digest"`
+			EntryPoint string            `json:"entryPoint"`
+		} `json:"configSource"`
+	} `json:"invocation"`
+	Materials []struct {
+		URI    string            `json:"uri"`
+		Digest map[string]string `json:"digest"`
+	} `json:"materials"`
+	Metadata struct {
+		Buildkit struct {
+			VCS map[string]string `json:"vcs"`
+		} `json:"https://mobyproject.org/buildkit@v1#metadata"`
+	} `json:"metadata"`
+}
+
+type CosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+type CosignEncryptedKey struct {
+	Kdf struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type CosignBundle struct {
+	SignedEntryTimestamp []byte              `json:"SignedEntryTimestamp"`
+	Payload              CosignBundlePayload `json:"Payload"`
+}
+
+type CosignBundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+}
+
+type RekorLogEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	Verification   struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+type FulcioCertificateRequest struct {
+	Credentials struct {
+		OidcIdentityToken string `json:"oidcIdentityToken"`
+	} `json:"credentials"`
+	PublicKeyRequest struct {
+		PublicKey struct {
+			Algorithm string `json:"algorithm"`
+			Content   string `json:"content"`
+		} `json:"publicKey"`
+		ProofOfPossession []byte `json:"proofOfPossession"`
+	} `json:"publicKeyRequest"`
+}
+
+type FulcioCertificateChain struct {
+	Chain struct {
+		Certificates []string `json:"certificates"`
+	} `json:"chain"`
+}
+
+type FulcioCertificateResponse struct {
+	SignedCertificateEmbeddedSct *FulcioCertificateChain `json:"signedCertificateEmbeddedSct"`
+	SignedCertificateDetachedSct *FulcioCertificateChain `json:"signedCertificateDetachedSct"`
+}
+
+type VaultResponse struct {
+	Data struct {
+		Signature     string `json:"signature"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+type RekorEntry struct {
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+type OciDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type OciArtifactManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        OciDescriptor     `json:"config"`
+	Layers        []OciDescriptor   `json:"layers"`
+	Subject       *OciDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// OciManifestLinks are the manifests an index or manifest refers to.
+type OciManifestLinks struct {
+	Manifests []OciDescriptor `json:"manifests"`
+	Subject   *OciDescriptor  `json:"subject,omitempty"`
+}
+
+type OciReferrersIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []OciDescriptor `json:"manifests"`
+}
+
+type TrivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			PkgName         string `json:"PkgName"`
+			Severity        string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+type BakeFile struct {
+	Groups  []BakeGroupBlock  `hcl:"group,block"`
+	Targets []BakeTargetBlock `hcl:"target,block"`
+	Remain  hcl.Body          `hcl:",remain"`
+}
+
+type BakeGroupBlock struct {
+	Name    string   `hcl:"name,label"`
+	Targets []string `hcl:"targets"`
+	Remain  hcl.Body `hcl:",remain"`
+}
+
+// BakeTargetBlock is a target as written in the bake file, where nil fields
+// are inherited from the targets listed in Inherits.
+type BakeTargetBlock struct {
+	Name       string            `hcl:"name,label"`
+	Inherits   []string          `hcl:"inherits,optional"`
+	Context    *string           `hcl:"context,optional"`
+	Dockerfile *string           `hcl:"dockerfile,optional"`
+	Target     *string           `hcl:"target,optional"`
+	Args       map[string]string `hcl:"args,optional"`
+	Contexts   map[string]string `hcl:"contexts,optional"`
+	Labels     map[string]string `hcl:"labels,optional"`
+	Tags       []string          `hcl:"tags,optional"`
+	Platforms  []string          `hcl:"platforms,optional"`
+	CacheFrom  []string          `hcl:"cache-from,optional"`
+	CacheTo    []string          `hcl:"cache-to,optional"`
+	Remain     hcl.Body          `hcl:",remain"`
+}
+
+type BakeTarget struct {
+	Name       string
+	Context    string
+	Dockerfile string
+	Target     string
+	Args       map[string]string
+	Contexts   map[string]string
+	Labels     map[string]string
+	Tags       []string
+	Platforms  []string
+	CacheFrom  []string
+	CacheTo    []string
+}
+
 type SchemaV1History struct {
 	ID              string    `json:"id"`
 	Parent          string    `json:"parent"`
@@ -6,7 +6,11 @@ import (
 	"github.com/rutledgepaulv/terraform-provider-buildkit/buildkit"
 )
 
+// set when the provider is released
+var version = "dev"
+
 func main() {
+	buildkit.Version = version
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: func() *schema.Provider {
 			return buildkit.Provider()